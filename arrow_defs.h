@@ -29,6 +29,23 @@ typedef enum
 	ArrowMessageHeader__SparseTensor	= 5,
 } ArrowMessageHeader;
 
+/*
+ * CompressionType : byte
+ */
+typedef enum
+{
+	ArrowCompressionType__LZ4_FRAME	= 0,
+	ArrowCompressionType__ZSTD		= 1,
+} ArrowCompressionType;
+
+/*
+ * BodyCompressionMethod : byte
+ */
+typedef enum
+{
+	ArrowBodyCompressionMethod__BUFFER	= 0,
+} ArrowBodyCompressionMethod;
+
 /*
  * Endianness : short
  */
@@ -89,6 +106,7 @@ typedef enum
 {
 	ArrowIntervalUnit__Year_Month	= 0,
 	ArrowIntervalUnit__Day_Time		= 1,
+	ArrowIntervalUnit__Month_Day_Nano = 2,
 } ArrowIntervalUnit;
 
 /*
@@ -139,6 +157,7 @@ typedef enum
 	ArrowNodeTag__Field,
 	ArrowNodeTag__FieldNode,
 	ArrowNodeTag__Buffer,
+	ArrowNodeTag__BodyCompression,
 	ArrowNodeTag__Schema,
 	ArrowNodeTag__RecordBatch,
 	ArrowNodeTag__DictionaryBatch,
@@ -359,6 +378,16 @@ typedef struct		ArrowSchema
 	int				_num_custom_metadata;
 } ArrowSchema;
 
+/*
+ * BodyCompression
+ */
+typedef struct		ArrowBodyCompression
+{
+	ArrowNodeTag	tag;
+	ArrowCompressionType codec;
+	ArrowBodyCompressionMethod method;
+} ArrowBodyCompression;
+
 /*
  * RecordBatch
  */
@@ -372,6 +401,8 @@ typedef struct		ArrowRecordBatch
 	/* vector of Buffer */
 	ArrowBuffer	    *buffers;
 	int				_num_buffers;
+	/* NULL, if the body is not compressed */
+	ArrowBodyCompression *compression;
 } ArrowRecordBatch;
 
 /*
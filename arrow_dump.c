@@ -69,7 +69,9 @@ dumpArrowTypeInterval(ArrowTypeInterval *node, FILE *out)
 {
 	fprintf(out, "{Interval: unit=%s}",
 			node->unit == ArrowIntervalUnit__Year_Month ? "Year_Month" :
-			node->unit == ArrowIntervalUnit__Day_Time ? "Day_Time" : "???");
+			node->unit == ArrowIntervalUnit__Day_Time ? "Day_Time" :
+			node->unit == ArrowIntervalUnit__Month_Day_Nano ? "Month_Day_Nano" :
+			"???");
 }
 
 static void
@@ -17,6 +17,17 @@
  *
  * ----------------------------------------------------------------
  */
+/*
+ * void has no value to save; every row is NULL in Arrow.
+ */
+static void
+put_null_value(SQLattribute *attr,
+			   const char *addr, int sz)
+{
+	attr->nitems++;
+	attr->nullcount++;
+}
+
 static void
 put_inline_bool_value(SQLattribute *attr,
 					  const char *addr, int sz)
@@ -31,8 +42,13 @@ put_inline_bool_value(SQLattribute *attr,
 	}
 	else
 	{
+		assert(sz == sizeof(char));
 		sql_buffer_setbit(&attr->nullmap, row_index);
-		sql_buffer_setbit(&attr->values,  row_index);
+		/* bit-packed in LSB order, like the nullmap */
+		if (*addr)
+			sql_buffer_setbit(&attr->values, row_index);
+		else
+			sql_buffer_clrbit(&attr->values, row_index);
 	}
 }
 
@@ -129,6 +145,8 @@ put_inline_64b_value(SQLattribute *attr,
 #define NUMERIC_POS         0x0000
 #define NUMERIC_NEG         0x4000
 #define NUMERIC_NAN         0xC000
+#define NUMERIC_PINF		0xD000
+#define NUMERIC_NINF		0xF000
 
 #define NBASE				10000
 #define HALF_NBASE			5000
@@ -137,6 +155,60 @@ put_inline_64b_value(SQLattribute *attr,
 #define DIV_GUARD_DIGITS	4
 typedef int16				NumericDigit;
 
+#define DECIMAL128_MAX_PRECISION	38
+
+static inline int128
+__int128_pow10(int n)
+{
+	int128		value = 1;
+
+	while (n-- > 0)
+		value *= 10;
+	return value;
+}
+
+/*
+ * __numeric_digit - returns the NBASE digit at the index; digits out of
+ * the stored range are zero.
+ */
+static inline int
+__numeric_digit(SQLattribute *attr, const NumericDigit *digits,
+				int ndigits, int index)
+{
+	int		dig;
+
+	if (index < 0 || index >= ndigits)
+		return 0;
+	dig = (int16)ntohs(digits[index]);
+	if (dig < 0 || dig >= NBASE)
+		Elog("Numeric digit is out of range: %d (column \"%s\")",
+			 dig, attr->attname);
+	return dig;
+}
+
+/*
+ * __numeric_shift - returns value * 10^n + dig, or raises an error if it
+ * exceeds the range of Decimal128.
+ */
+static inline int128
+__numeric_shift(SQLattribute *attr, int128 value, int n, int dig)
+{
+	if (value >= __int128_pow10(DECIMAL128_MAX_PRECISION - n))
+		Elog("Numeric value is out of range of Decimal128(%d,%d) (column \"%s\")",
+			 attr->arrow_type.Decimal.precision,
+			 attr->arrow_type.Decimal.scale,
+			 attr->attname);
+	return value * __int128_pow10(n) + dig;
+}
+
+/*
+ * put_decimal_value
+ *
+ * Numeric is a sequence of NBASE digits in the wire format, and the first
+ * digit has the weight of NBASE^weight. It is converted to an integer,
+ * scaled by 10^scale, and rounded half away from zero like numeric(p,s)
+ * of PostgreSQL.
+ */
 static void
 put_decimal_value(SQLattribute *attr,
 				  const char *addr, int sz)
@@ -158,45 +230,49 @@ put_decimal_value(SQLattribute *attr,
 			int16		dscale;		/* display scale */
 			NumericDigit digits[FLEXIBLE_ARRAY_MEMBER];
 		}	   *rawdata = (void *)addr;
-		int		ndigits	= ntohs(rawdata->ndigits);
-		int		weight	= ntohs(rawdata->weight);
+		int		ndigits	= (int16)ntohs(rawdata->ndigits);
+		int		weight	= (int16)ntohs(rawdata->weight);
 		int		sign	= ntohs(rawdata->sign);
 		int		precision = attr->arrow_type.Decimal.precision;
+		int		scale	= attr->arrow_type.Decimal.scale;
 		int128	value = 0;
-		int		d, dig;
+		int		d, dig, rem;
 
-		if ((sign & NUMERIC_SIGN_MASK) == NUMERIC_NAN)
-			Elog("Decimal128 cannot map NaN in PostgreSQL Numeric");
+		if (sign == NUMERIC_NAN)
+			Elog("Decimal128 cannot map NaN in PostgreSQL Numeric (column \"%s\")",
+				 attr->attname);
+		if (sign == NUMERIC_PINF || sign == NUMERIC_NINF)
+			Elog("Decimal128 cannot map Infinity in PostgreSQL Numeric (column \"%s\")",
+				 attr->attname);
 
 		/* makes integer portion first */
 		for (d=0; d <= weight; d++)
 		{
-			dig = (d < ndigits) ? ntohs(rawdata->digits[d]) : 0;
-			if (dig < 0 || dig >= NBASE)
-				Elog("Numeric digit is out of range: %d", (int)dig);
-			value = NBASE * value + (int128)dig;
+			dig = __numeric_digit(attr, rawdata->digits, ndigits, d);
+			value = __numeric_shift(attr, value, DEC_DIGITS, dig);
 		}
 
-		/* makes floating point portion if any */
-		while (precision > 0)
+		/* makes fraction portion by the scale */
+		for (d = weight + 1, rem = scale; rem > 0; d++, rem -= DEC_DIGITS)
 		{
-			dig = (d >= 0 && d < ndigits) ? ntohs(rawdata->digits[d]) : 0;
-			if (dig < 0 || dig >= NBASE)
-				Elog("Numeric digit is out of range: %d", (int)dig);
-
-			if (precision >= DEC_DIGITS)
-				value = NBASE * value + dig;
-			else if (precision == 3)
-				value = 1000L * value + dig / 10L;
-			else if (precision == 2)
-				value =  100L * value + dig / 100L;
-			else if (precision == 1)
-				value =   10L * value + dig / 1000L;
+			dig = __numeric_digit(attr, rawdata->digits, ndigits, d);
+			if (rem >= DEC_DIGITS)
+				value = __numeric_shift(attr, value, DEC_DIGITS, dig);
 			else
-				Elog("internal bug");
-			precision -= DEC_DIGITS;
-			d++;
+				value = __numeric_shift(attr, value, rem,
+										dig / __int128_pow10(DEC_DIGITS - rem));
 		}
+
+		/* round half away from zero, by the next decimal digit */
+		dig = __numeric_digit(attr, rawdata->digits, ndigits,
+							  weight + 1 + scale / DEC_DIGITS);
+		if ((dig / __int128_pow10(DEC_DIGITS - 1 - scale % DEC_DIGITS)) % 10 >= 5)
+			value++;
+
+		if (value >= __int128_pow10(precision))
+			Elog("Numeric value is out of range of Decimal128(%d,%d) (column \"%s\")",
+				 precision, scale, attr->attname);
+
 		/* is it a negative value? */
 		if ((sign & NUMERIC_NEG) != 0)
 			value = -value;
@@ -205,6 +281,41 @@ put_decimal_value(SQLattribute *attr,
 		sql_buffer_append(&attr->values, &value, sizeof(value));
 	}
 }
+
+/*
+ * put_money_value
+ *
+ * Money is an int64 of the smallest currency unit in the wire format,
+ * regardless of lc_monetary, so it is just widened to Decimal128.
+ */
+static void
+put_money_value(SQLattribute *attr,
+				const char *addr, int sz)
+{
+	size_t		row_index = attr->nitems++;
+
+	if (!addr)
+	{
+		attr->nullcount++;
+		sql_buffer_clrbit(&attr->nullmap, row_index);
+		sql_buffer_append_zero(&attr->values, sizeof(int128));
+	}
+	else
+	{
+		uint32		h, l;
+		int128		value;
+
+		if (sz != sizeof(int64))
+			Elog("binary money of column \"%s\" has wrong length %d",
+				 attr->attname, sz);
+		h = ntohl(*((const uint32 *)(addr)));
+		l = ntohl(*((const uint32 *)(addr + sizeof(uint32))));
+		value = (int64)(((uint64)h << 32) | (uint64)l);
+
+		sql_buffer_setbit(&attr->nullmap, row_index);
+		sql_buffer_append(&attr->values, &value, sizeof(value));
+	}
+}
 #endif
 
 static void
@@ -253,13 +364,77 @@ put_timestamp_value(SQLattribute *attr,
 		h = ((const uint32 *)addr)[0];
 		l = ((const uint32 *)addr)[1];
 		value = (Timestamp)ntohl(h) << 32 | (Timestamp)ntohl(l);
-		/* convert PostgreSQL epoch to UNIX epoch */
-		value += (POSTGRES_EPOCH_JDATE -
-				  UNIX_EPOCH_JDATE) * USECS_PER_DAY;
+		/*
+		 * convert PostgreSQL epoch to UNIX epoch, except for '-infinity'
+		 * and 'infinity' which are kept as INT64 min/max.
+		 */
+		if (value != DT_NOBEGIN && value != DT_NOEND)
+			value += (POSTGRES_EPOCH_JDATE -
+					  UNIX_EPOCH_JDATE) * USECS_PER_DAY;
 		sql_buffer_append(&attr->values, &value, sizeof(Timestamp));
 	}
 }
 
+/*
+ * put_interval_value
+ *
+ * Interval is an int64 of microseconds, an int32 of days and an int32 of
+ * months in the wire format, then it is reordered to MonthDayNano; an
+ * int32 of months, an int32 of days and an int64 of nanoseconds. Each
+ * part keeps its own sign, as PostgreSQL does. '-infinity' and 'infinity'
+ * of PostgreSQL 17 are kept as all the parts of INT min/max.
+ */
+typedef struct
+{
+	int32		months;
+	int32		days;
+	int64		nanoseconds;
+} MonthDayNano;
+
+static void
+put_interval_value(SQLattribute *attr,
+				   const char *addr, int sz)
+{
+	size_t		row_index = attr->nitems++;
+
+	if (!addr)
+	{
+		attr->nullcount++;
+		sql_buffer_clrbit(&attr->nullmap, row_index);
+		sql_buffer_append_zero(&attr->values, sizeof(MonthDayNano));
+	}
+	else
+	{
+		MonthDayNano value;
+		int64		usecs;
+		uint32		h, l;
+
+		if (sz != sizeof(int64) + 2 * sizeof(int32))
+			Elog("binary interval of column \"%s\" has wrong length %d",
+				 attr->attname, sz);
+		h = ntohl(*((const uint32 *)(addr)));
+		l = ntohl(*((const uint32 *)(addr + sizeof(uint32))));
+		usecs = (int64)(((uint64)h << 32) | (uint64)l);
+		value.days = (int32)ntohl(*((const uint32 *)(addr + 8)));
+		value.months = (int32)ntohl(*((const uint32 *)(addr + 12)));
+
+		if ((usecs == PG_INT64_MAX &&
+			 value.days == PG_INT32_MAX &&
+			 value.months == PG_INT32_MAX) ||
+			(usecs == PG_INT64_MIN &&
+			 value.days == PG_INT32_MIN &&
+			 value.months == PG_INT32_MIN))
+			value.nanoseconds = usecs;
+		else if (__builtin_mul_overflow(usecs, (int64)1000,
+										&value.nanoseconds))
+			Elog("interval of column \"%s\" is out of range of nanoseconds",
+				 attr->attname);
+
+		sql_buffer_setbit(&attr->nullmap, row_index);
+		sql_buffer_append(&attr->values, &value, sizeof(value));
+	}
+}
+
 static void
 put_variable_value(SQLattribute *attr,
 				   const char *addr, int sz)
@@ -282,28 +457,300 @@ put_variable_value(SQLattribute *attr,
 	}
 }
 
+/*
+ * __check_utf8
+ *
+ * It raises an error if the value is not valid UTF-8, rather than writing
+ * out an invalid Utf8 buffer. Like PostgreSQL, NUL, overlong forms, the
+ * surrogates and the code points beyond U+10FFFF are invalid.
+ */
+static void
+__check_utf8(SQLattribute *attr, const char *addr, int sz)
+{
+	const unsigned char *s = (const unsigned char *)addr;
+	int			i = 0;
+
+	while (i < sz)
+	{
+		unsigned char c = s[i];
+		int			len, k;
+
+		if (c >= 0x01 && c <= 0x7f)
+		{
+			i++;
+			continue;
+		}
+		if (c >= 0xc2 && c <= 0xdf)
+			len = 2;
+		else if (c >= 0xe0 && c <= 0xef)
+			len = 3;
+		else if (c >= 0xf0 && c <= 0xf4)
+			len = 4;
+		else
+			goto invalid;
+		if (i + len > sz)
+			goto invalid;
+		for (k=1; k < len; k++)
+		{
+			if ((s[i+k] & 0xc0) != 0x80)
+				goto invalid;
+		}
+		/* overlong forms, surrogates, and beyond U+10FFFF */
+		if ((c == 0xe0 && s[i+1] < 0xa0) ||
+			(c == 0xed && s[i+1] > 0x9f) ||
+			(c == 0xf0 && s[i+1] < 0x90) ||
+			(c == 0xf4 && s[i+1] > 0x8f))
+			goto invalid;
+		i += len;
+	}
+	return;
+
+invalid:
+	Elog("invalid UTF-8 byte sequence in column \"%s\" at byte %d of the value; "
+		 "the client_encoding must be UTF8", attr->attname, i);
+}
+
+static void
+put_text_value(SQLattribute *attr,
+			   const char *addr, int sz)
+{
+	if (addr)
+		__check_utf8(attr, addr, sz);
+	put_variable_value(attr, addr, sz);
+}
+
+/*
+ * put_bpchar_value
+ *
+ * The trailing blanks of char(n) are trimmed, like the cast to text does,
+ * because they are insignificant in PostgreSQL; so 'ab'::char(5) is 'ab'.
+ * Note that n counts the characters, not the bytes.
+ */
 static void
 put_bpchar_value(SQLattribute *attr,
 				 const char *addr, int sz)
+{
+	if (addr)
+	{
+		__check_utf8(attr, addr, sz);
+		while (sz > 0 && addr[sz-1] == ' ')
+			sz--;
+	}
+	put_variable_value(attr, addr, sz);
+}
+
+/*
+ * put_char_value
+ *
+ * The single-byte "char" type is written like its text output; a byte
+ * beyond ASCII is an octal escape like \377, and NUL is an empty string.
+ */
+static void
+put_char_value(SQLattribute *attr,
+			   const char *addr, int sz)
+{
+	char		temp[8];
+	unsigned char c;
+
+	if (!addr)
+	{
+		put_variable_value(attr, NULL, 0);
+		return;
+	}
+	if (sz != 1)
+		Elog("binary \"char\" of column \"%s\" has wrong length %d",
+			 attr->attname, sz);
+	c = (unsigned char)addr[0];
+	if (c == 0)
+		put_variable_value(attr, "", 0);
+	else if (c < 0x80)
+		put_variable_value(attr, addr, 1);
+	else
+	{
+		snprintf(temp, sizeof(temp), "\\%03o", c);
+		put_variable_value(attr, temp, 4);
+	}
+}
+
+/*
+ * PostGIS geometry and geography
+ *
+ * Their binary format is EWKB, which marks Z, M and SRID by the high bits
+ * of the geometry type, and puts SRID next to the type. ISO WKB of the
+ * GeoArrow convention adds 1000, 2000 or 3000 to the type for Z, M and ZM
+ * instead, and has no SRID; so the headers are rewritten, while the
+ * coordinates are copied as is, in the byte order of the EWKB.
+ */
+#define EWKB_ZFLAG		0x80000000U
+#define EWKB_MFLAG		0x40000000U
+#define EWKB_SRIDFLAG	0x20000000U
+#define WKB_MAX_DEPTH	32
+
+static inline uint32
+__wkb_uint32(const char *addr, bool little)
+{
+	const unsigned char *s = (const unsigned char *)addr;
+
+	if (little)
+		return ((uint32)s[0] | ((uint32)s[1] << 8) |
+				((uint32)s[2] << 16) | ((uint32)s[3] << 24));
+	return (((uint32)s[0] << 24) | ((uint32)s[1] << 16) |
+			((uint32)s[2] << 8) | (uint32)s[3]);
+}
+
+static inline void
+__wkb_put_uint32(SQLbuffer *buf, uint32 value, bool little)
+{
+	unsigned char d[4];
+
+	if (little)
+	{
+		d[0] = value;
+		d[1] = value >> 8;
+		d[2] = value >> 16;
+		d[3] = value >> 24;
+	}
+	else
+	{
+		d[0] = value >> 24;
+		d[1] = value >> 16;
+		d[2] = value >> 8;
+		d[3] = value;
+	}
+	sql_buffer_append(buf, d, sizeof(d));
+}
+
+/*
+ * __put_wkb_geometry
+ *
+ * It appends the geometry of EWKB at pos as ISO WKB, then returns the
+ * position next to the geometry. The collections nest the geometries with
+ * their own headers, which are rewritten as well.
+ */
+static const char *
+__put_wkb_geometry(SQLattribute *attr, const char *pos, const char *end,
+				   int depth)
+{
+	SQLbuffer  *buf = &attr->extra;
+	bool		little;
+	uint32		type;
+	uint32		base;
+	bool		hasz;
+	bool		hasm;
+	size_t		ptsz;
+	uint32		i, j, count, npoints;
+
+#define WKB_REQUIRED(len)												\
+	do {																\
+		if ((len) > (size_t)(end - pos))								\
+			Elog("EWKB of column \"%s\" is truncated", attr->attname);	\
+	} while(0)
+
+	if (depth > WKB_MAX_DEPTH)
+		Elog("EWKB of column \"%s\" nests too deep", attr->attname);
+	WKB_REQUIRED(1 + sizeof(uint32));
+	if (*pos != 0 && *pos != 1)
+		Elog("EWKB of column \"%s\" has unknown byte order: %d",
+			 attr->attname, *pos);
+	little = (*pos == 1);
+	type = __wkb_uint32(pos + 1, little);
+	pos += 1 + sizeof(uint32);
+	if (type & EWKB_SRIDFLAG)
+	{
+		WKB_REQUIRED(sizeof(uint32));
+		pos += sizeof(uint32);		/* SRID; dropped */
+	}
+	hasz = (type & EWKB_ZFLAG) != 0;
+	hasm = (type & EWKB_MFLAG) != 0;
+	base = (type & 0x0fffffff);
+	if (base >= 1000)
+	{
+		/* ISO WKB already */
+		hasz |= (base / 1000 == 1 || base / 1000 == 3);
+		hasm |= (base / 1000 == 2 || base / 1000 == 3);
+		base %= 1000;
+	}
+	sql_buffer_append(buf, little ? "\x01" : "\x00", 1);
+	__wkb_put_uint32(buf, base + (hasz ? 1000 : 0) + (hasm ? 2000 : 0), little);
+
+	ptsz = sizeof(double) * (2 + hasz + hasm);
+	switch (base)
+	{
+		case 1:		/* Point */
+			WKB_REQUIRED(ptsz);
+			sql_buffer_append(buf, pos, ptsz);
+			pos += ptsz;
+			break;
+		case 2:		/* LineString */
+		case 8:		/* CircularString */
+			WKB_REQUIRED(sizeof(uint32));
+			npoints = __wkb_uint32(pos, little);
+			WKB_REQUIRED(sizeof(uint32) + npoints * ptsz);
+			sql_buffer_append(buf, pos, sizeof(uint32) + npoints * ptsz);
+			pos += sizeof(uint32) + npoints * ptsz;
+			break;
+		case 3:		/* Polygon */
+		case 17:	/* Triangle */
+			WKB_REQUIRED(sizeof(uint32));
+			count = __wkb_uint32(pos, little);
+			sql_buffer_append(buf, pos, sizeof(uint32));
+			pos += sizeof(uint32);
+			for (i=0; i < count; i++)
+			{
+				WKB_REQUIRED(sizeof(uint32));
+				npoints = __wkb_uint32(pos, little);
+				WKB_REQUIRED(sizeof(uint32) + npoints * ptsz);
+				sql_buffer_append(buf, pos, sizeof(uint32) + npoints * ptsz);
+				pos += sizeof(uint32) + npoints * ptsz;
+			}
+			break;
+		case 4:		/* MultiPoint */
+		case 5:		/* MultiLineString */
+		case 6:		/* MultiPolygon */
+		case 7:		/* GeometryCollection */
+		case 9:		/* CompoundCurve */
+		case 10:	/* CurvePolygon */
+		case 11:	/* MultiCurve */
+		case 12:	/* MultiSurface */
+		case 15:	/* PolyhedralSurface */
+		case 16:	/* TIN */
+			WKB_REQUIRED(sizeof(uint32));
+			count = __wkb_uint32(pos, little);
+			sql_buffer_append(buf, pos, sizeof(uint32));
+			pos += sizeof(uint32);
+			for (j=0; j < count; j++)
+				pos = __put_wkb_geometry(attr, pos, end, depth + 1);
+			break;
+		default:
+			Elog("EWKB of column \"%s\" has unknown geometry type: %u",
+				 attr->attname, base);
+	}
+#undef WKB_REQUIRED
+	return pos;
+}
+
+static void
+put_wkb_value(SQLattribute *attr,
+			  const char *addr, int sz)
 {
 	size_t		row_index = attr->nitems++;
-	int			len = attr->atttypmod - VARHDRSZ;
-	char	   *temp = alloca(len);
 
-	assert(len > 0);
-	memset(temp, ' ', len);
+	if (row_index == 0)
+		sql_buffer_append_zero(&attr->values, sizeof(uint32));
 	if (!addr)
 	{
 		attr->nullcount++;
 		sql_buffer_clrbit(&attr->nullmap, row_index);
-		sql_buffer_append(&attr->values, temp, len);
 	}
 	else
 	{
-		memcpy(temp, addr, Min(sz, len));
+		const char *end = addr + sz;
+
 		sql_buffer_setbit(&attr->nullmap, row_index);
-		sql_buffer_append(&attr->values, temp, len);
+		if (__put_wkb_geometry(attr, addr, end, 0) != end)
+			Elog("EWKB of column \"%s\" has trailing garbage", attr->attname);
 	}
+	sql_buffer_append(&attr->values, &attr->extra.usage, sizeof(uint32));
 }
 
 static void
@@ -323,7 +770,6 @@ put_array_value(SQLattribute *attr,
 	}
 	else
 	{
-		static bool		notification_has_printed = false;
 		struct {
 			int32		ndim;
 			int32		hasnull;
@@ -336,21 +782,23 @@ put_array_value(SQLattribute *attr,
 		int32		ndim = ntohl(rawdata->ndim);
 		//int32		hasnull = ntohl(rawdata->hasnull);
 		Oid			element_type = ntohl(rawdata->element_type);
-		size_t		i, nitems = 1;
+		size_t		i, nitems;
 		int			item_sz;
 		char	   *pos;
 
-		if (element_type != element->atttypid)
+		if (element_type != element->atttypid &&
+			element_type != element->domaintypid)
 			Elog("PostgreSQL array type mismatch");
-		if (ndim < 1)
+		if (ndim < 0)
 			Elog("Invalid dimension size of PostgreSQL Array (ndim=%d)", ndim);
-		if (ndim > 1 && !notification_has_printed)
-		{
-			fprintf(stderr, "Notice: multi-dimensional PostgreSQL Array is extracted to List<%s> type in Apache Arrow, due to data type restrictions", attr->arrow_typename);
-			notification_has_printed = true;
-		}
-		for (i=0; i < ndim; i++)
-			nitems *= ntohl(rawdata->dim[i].sz);
+		if (ndim > 1)
+			Elog("unsupported array dimensionality: %d (column \"%s\"); only one-dimensional arrays are mapped to List",
+				 ndim, attr->attname);
+		/* empty array has no dimensions */
+		if (ndim == 0)
+			nitems = 0;
+		else
+			nitems = ntohl(rawdata->dim[0].sz);
 
 		pos = (char *)&rawdata->dim[ndim];
 		for (i=0; i < nitems; i++)
@@ -363,6 +811,8 @@ put_array_value(SQLattribute *attr,
 				element->put_value(element, NULL, 0);
 			else
 			{
+				if (pos + item_sz > addr + sz)
+					Elog("out of range - binary array has corruption");
 				element->put_value(element, pos, item_sz);
 				pos += item_sz;
 			}
@@ -372,6 +822,205 @@ put_array_value(SQLattribute *attr,
 	}
 }
 
+#define UUID_LEN		16
+
+static void
+put_uuid_value(SQLattribute *attr,
+			   const char *addr, int sz)
+{
+	size_t		row_index = attr->nitems++;
+
+	if (!addr)
+	{
+		attr->nullcount++;
+		sql_buffer_clrbit(&attr->nullmap, row_index);
+		sql_buffer_append_zero(&attr->values, UUID_LEN);
+	}
+	else
+	{
+		if (sz != UUID_LEN)
+			Elog("binary uuid of column \"%s\" has wrong length %d",
+				 attr->attname, sz);
+		sql_buffer_setbit(&attr->nullmap, row_index);
+		sql_buffer_append(&attr->values, addr, UUID_LEN);
+	}
+}
+
+/*
+ * uuid in the canonical text form, like uuid_out()
+ */
+static void
+put_uuid_text_value(SQLattribute *attr,
+					const char *addr, int sz)
+{
+	static const char hex[] = "0123456789abcdef";
+	char		temp[2 * UUID_LEN + 4];
+	int			i, k = 0;
+
+	if (!addr)
+	{
+		put_variable_value(attr, NULL, 0);
+		return;
+	}
+	if (sz != UUID_LEN)
+		Elog("binary uuid of column \"%s\" has wrong length %d",
+			 attr->attname, sz);
+	for (i=0; i < UUID_LEN; i++)
+	{
+		unsigned char c = addr[i];
+
+		if (i == 4 || i == 6 || i == 8 || i == 10)
+			temp[k++] = '-';
+		temp[k++] = hex[c >> 4];
+		temp[k++] = hex[c & 0x0f];
+	}
+	put_variable_value(attr, temp, k);
+}
+
+/*
+ * inet and cidr in the wire format; see inet_send()
+ */
+#define PGSQL_AF_INET		(AF_INET + 0)
+#define PGSQL_AF_INET6		(AF_INET + 1)
+#define INET_BINARY_LEN		17	/* prefix length + IPv6 address */
+
+typedef struct
+{
+	uint8		family;
+	uint8		bits;		/* prefix length */
+	uint8		is_cidr;
+	uint8		nb;			/* number of address bytes */
+	uint8		ipaddr[FLEXIBLE_ARRAY_MEMBER];
+} inet_wire;
+
+static const inet_wire *
+fetch_inet_wire(SQLattribute *attr, const char *addr, int sz)
+{
+	const inet_wire *ip = (const inet_wire *)addr;
+
+	if (sz < offsetof(inet_wire, ipaddr) ||
+		sz != offsetof(inet_wire, ipaddr[ip->nb]) ||
+		!((ip->family == PGSQL_AF_INET && ip->nb == 4 && ip->bits <= 32) ||
+		  (ip->family == PGSQL_AF_INET6 && ip->nb == 16 && ip->bits <= 128)))
+		Elog("binary inet of column \"%s\" is corrupted", attr->attname);
+	return ip;
+}
+
+/*
+ * inet and cidr in the canonical text form, like inet_out(); the prefix
+ * length is omitted for a host address of inet, but never for cidr.
+ */
+static void
+put_inet_text_value(SQLattribute *attr,
+					const char *addr, int sz)
+{
+	const inet_wire *ip;
+	char		temp[INET6_ADDRSTRLEN + 8];
+	int			len;
+
+	if (!addr)
+	{
+		put_variable_value(attr, NULL, 0);
+		return;
+	}
+	ip = fetch_inet_wire(attr, addr, sz);
+	if (!inet_ntop(ip->family == PGSQL_AF_INET ? AF_INET : AF_INET6,
+				   ip->ipaddr, temp, sizeof(temp)))
+		Elog("failed on inet_ntop: %m");
+	len = strlen(temp);
+	if (ip->is_cidr || ip->bits != 8 * ip->nb)
+		len += snprintf(temp + len, sizeof(temp) - len, "/%u", ip->bits);
+	put_variable_value(attr, temp, len);
+}
+
+/*
+ * inet and cidr as FixedSizeBinary(17); the prefix length, then the IPv6
+ * address, or the IPv4-mapped IPv6 address (::ffff:a.b.c.d) for IPv4. The
+ * prefix length is of the original address family.
+ */
+static void
+put_inet_binary_value(SQLattribute *attr,
+					  const char *addr, int sz)
+{
+	size_t		row_index = attr->nitems++;
+	uint8		temp[INET_BINARY_LEN];
+
+	memset(temp, 0, sizeof(temp));
+	if (!addr)
+	{
+		attr->nullcount++;
+		sql_buffer_clrbit(&attr->nullmap, row_index);
+	}
+	else
+	{
+		const inet_wire *ip = fetch_inet_wire(attr, addr, sz);
+
+		temp[0] = ip->bits;
+		if (ip->family == PGSQL_AF_INET)
+		{
+			temp[11] = temp[12] = 0xff;
+			memcpy(temp + 13, ip->ipaddr, 4);
+		}
+		else
+			memcpy(temp + 1, ip->ipaddr, 16);
+		sql_buffer_setbit(&attr->nullmap, row_index);
+	}
+	sql_buffer_append(&attr->values, temp, INET_BINARY_LEN);
+}
+
+/*
+ * macaddr and macaddr8 in the canonical text form, like macaddr_out()
+ */
+static void
+put_macaddr_text_value(SQLattribute *attr,
+					   const char *addr, int sz)
+{
+	static const char hex[] = "0123456789abcdef";
+	char		temp[3 * sizeof(uint64)];
+	int			i, k = 0;
+
+	if (!addr)
+	{
+		put_variable_value(attr, NULL, 0);
+		return;
+	}
+	if (sz != attr->attlen)
+		Elog("binary %s of column \"%s\" has wrong length %d",
+			 attr->typname, attr->attname, sz);
+	for (i=0; i < sz; i++)
+	{
+		unsigned char c = addr[i];
+
+		if (i > 0)
+			temp[k++] = ':';
+		temp[k++] = hex[c >> 4];
+		temp[k++] = hex[c & 0x0f];
+	}
+	put_variable_value(attr, temp, k);
+}
+
+static void
+put_macaddr_value(SQLattribute *attr,
+				  const char *addr, int sz)
+{
+	size_t		row_index = attr->nitems++;
+
+	if (!addr)
+	{
+		attr->nullcount++;
+		sql_buffer_clrbit(&attr->nullmap, row_index);
+		sql_buffer_append_zero(&attr->values, attr->attlen);
+	}
+	else
+	{
+		if (sz != attr->attlen)
+			Elog("binary %s of column \"%s\" has wrong length %d",
+				 attr->typname, attr->attname, sz);
+		sql_buffer_setbit(&attr->nullmap, row_index);
+		sql_buffer_append(&attr->values, addr, sz);
+	}
+}
+
 static void
 put_composite_value(SQLattribute *attr,
 					const char *addr, int sz)
@@ -421,7 +1070,8 @@ put_composite_value(SQLattribute *attr,
 				Elog("binary composite record corruption");
 			atttypid = ntohl(*((Oid *)pos));
 			pos += sizeof(Oid);
-			if (subattr->atttypid != atttypid)
+			if (subattr->atttypid != atttypid &&
+				subattr->domaintypid != atttypid)
 				Elog("composite subtype mismatch");
 			attlen = ntohl(*((int *)pos));
 			pos += sizeof(int);
@@ -469,7 +1119,19 @@ put_dictionary_value(SQLattribute *attr,
 				break;
 		}
 		if (!hitem)
-			Elog("Enum label was not found in pg_enum result");
+		{
+			/*
+			 * A label unknown to the enum dictionary was added after the
+			 * labels were cached; it is written out as a delta like the
+			 * dictionary built from the values, and the cache is refreshed
+			 * by the next query.
+			 */
+			if (enumdict->enum_typeid != InvalidOid)
+				pgsql_invalidate_enum_type(enumdict->enum_cache,
+										   enumdict->enum_typeid);
+			__check_utf8(attr, addr, sz);
+			hitem = pgsql_append_dictionary(enumdict, addr, sz, hash);
+		}
 
 		sql_buffer_setbit(&attr->nullmap, row_index);
         sql_buffer_append(&attr->values,  &hitem->index, sizeof(int32));
@@ -481,6 +1143,48 @@ put_dictionary_value(SQLattribute *attr,
  * buffer_usage handler for each data types
  *
  * ---------------------------------------------------------------- */
+/*
+ * jsonb in binary wire format is a version number byte, then followed by
+ * the text representation.
+ */
+#define JSONB_WIRE_VERSION		1
+
+static void
+__check_jsonb_version(SQLattribute *attr, const char *addr, int sz)
+{
+	if (sz < 1 || addr[0] != JSONB_WIRE_VERSION)
+		Elog("unsupported jsonb wire format version %d (column \"%s\")",
+			 sz < 1 ? -1 : (int)addr[0], attr->attname);
+}
+
+static void
+put_jsonb_value(SQLattribute *attr,
+				const char *addr, int sz)
+{
+	if (addr)
+	{
+		__check_jsonb_version(attr, addr, sz);
+		addr++;
+		sz--;
+	}
+	put_variable_value(attr, addr, sz);
+}
+
+static void
+put_jsonb_binary_value(SQLattribute *attr,
+					   const char *addr, int sz)
+{
+	if (addr)
+		__check_jsonb_version(attr, addr, sz);
+	put_variable_value(attr, addr, sz);
+}
+
+static size_t
+buffer_usage_null_type(SQLattribute *attr)
+{
+	return 0;
+}
+
 static size_t
 buffer_usage_inline_type(SQLattribute *attr)
 {
@@ -591,6 +1295,13 @@ setup_arrow_buffer(ArrowBuffer *node, size_t offset, size_t length)
 	return node->length;
 }
 
+static int
+setup_buffer_null_type(SQLattribute *attr,
+					   ArrowBuffer *node, size_t *p_offset)
+{
+	return 0;	/* no buffers */
+}
+
 static int
 setup_buffer_inline_type(SQLattribute *attr,
 						 ArrowBuffer *node, size_t *p_offset)
@@ -681,64 +1392,70 @@ setup_buffer_composite_type(SQLattribute *attr,
  * ----------------------------------------------------------------
  */
 static void
-write_buffer_inline_type(SQLattribute *attr, int fdesc)
+write_buffer_null_type(SQLattribute *attr, SQLbuffer *out)
+{
+	/* nothing to write */
+}
+
+static void
+write_buffer_inline_type(SQLattribute *attr, SQLbuffer *out)
 {
 	/* nullmap */
 	if (attr->nullcount > 0)
-		__write_buffer_common(fdesc,
+		__write_buffer_common(out,
 							  attr->nullmap.ptr,
 							  attr->nullmap.usage);
 	/* fixed length values */
-	__write_buffer_common(fdesc,
+	__write_buffer_common(out,
 						  attr->values.ptr,
 						  attr->values.usage);
 }
 
 static void
-write_buffer_varlena_type(SQLattribute *attr, int fdesc)
+write_buffer_varlena_type(SQLattribute *attr, SQLbuffer *out)
 {
 	/* nullmap */
 	if (attr->nullcount > 0)
-		__write_buffer_common(fdesc,
+		__write_buffer_common(out,
 							  attr->nullmap.ptr,
 							  attr->nullmap.usage);
 	/* index values */
-	__write_buffer_common(fdesc,
+	__write_buffer_common(out,
 						  attr->values.ptr,
 						  attr->values.usage);
 	/* extra buffer */
-	__write_buffer_common(fdesc,
+	__write_buffer_common(out,
 						  attr->extra.ptr,
 						  attr->extra.usage);
 }
 
 static void
-write_buffer_array_type(SQLattribute *attr, int fdesc)
+write_buffer_array_type(SQLattribute *attr, SQLbuffer *out)
 {
 	SQLattribute *element = attr->element;
 
 	/* nullmap */
 	if (attr->nullcount > 0)
-		__write_buffer_common(fdesc,
+		__write_buffer_common(out,
 							  attr->nullmap.ptr,
 							  attr->nullmap.usage);
 	/* offset values */
-	__write_buffer_common(fdesc,
+	__write_buffer_common(out,
 						  attr->values.ptr,
 						  attr->values.usage);
 	/* element values */
-	element->write_buffer(element, fdesc);
+	element->write_buffer(element, out);
 }
 
 static void
-write_buffer_composite_type(SQLattribute *attr, int fdesc)
+write_buffer_composite_type(SQLattribute *attr, SQLbuffer *out)
 {
 	SQLtable   *subtypes = attr->subtypes;
 	int			i;
 
 	/* nullmap */
 	if (attr->nullcount > 0)
-		__write_buffer_common(fdesc,
+		__write_buffer_common(out,
 							  attr->nullmap.ptr,
 							  attr->nullmap.usage);
 	/* sub-types */
@@ -746,7 +1463,7 @@ write_buffer_composite_type(SQLattribute *attr, int fdesc)
 	{
 		SQLattribute   *subattr = &subtypes->attrs[i];
 
-		subattr->write_buffer(subattr, fdesc);
+		subattr->write_buffer(subattr, out);
 	}
 }
 
@@ -832,6 +1549,17 @@ assignArrowTypeFloatingPoint(SQLattribute *attr, int *p_numBuffers)
 	*p_numBuffers += 2;		/* nullmap + values */
 }
 
+static void
+assignArrowTypeNull(SQLattribute *attr, int *p_numBuffers)
+{
+	attr->arrow_type.tag	= ArrowNodeTag__Null;
+	attr->arrow_typename	= "Null";
+	attr->put_value			= put_null_value;
+	attr->buffer_usage		= buffer_usage_null_type;
+	attr->setup_buffer		= setup_buffer_null_type;
+	attr->write_buffer		= write_buffer_null_type;
+}
+
 static void
 assignArrowTypeBinary(SQLattribute *attr, int *p_numBuffers)
 {
@@ -858,16 +1586,37 @@ assignArrowTypeUtf8(SQLattribute *attr, int *p_numBuffers)
 	*p_numBuffers += 3;		/* nullmap + index + extra */
 }
 
+/*
+ * assignArrowTypeText
+ *
+ * text, varchar, bpchar, name and "char", with UTF-8 validation.
+ */
 static void
-assignArrowTypeBpchar(SQLattribute *attr, int *p_numBuffers)
+assignArrowTypeText(SQLattribute *attr, int *p_numBuffers)
 {
-	if (attr->atttypmod <= VARHDRSZ)
-		Elog("unexpected Bpchar definition (typmod=%d)", attr->atttypmod);
+	assignArrowTypeUtf8(attr, p_numBuffers);
+	if (strcmp(attr->typname, "bpchar") == 0)
+		attr->put_value = put_bpchar_value;
+	else if (strcmp(attr->typname, "char") == 0)
+		attr->put_value = put_char_value;
+	else
+		attr->put_value = put_text_value;
+}
 
+static void
+assignArrowTypeUuid(SQLattribute *attr, const SQLoptions *options,
+					int *p_numBuffers)
+{
+	if (options->uuid_as_string)
+	{
+		assignArrowTypeUtf8(attr, p_numBuffers);
+		attr->put_value = put_uuid_text_value;
+		return;
+	}
 	attr->arrow_type.tag	= ArrowNodeTag__FixedSizeBinary;
-	attr->arrow_type.FixedSizeBinary.byteWidth = attr->atttypmod - VARHDRSZ;
+	attr->arrow_type.FixedSizeBinary.byteWidth = UUID_LEN;
 	attr->arrow_typename	= "FixedSizeBinary";
-	attr->put_value			= put_bpchar_value;
+	attr->put_value			= put_uuid_value;
 	attr->buffer_usage		= buffer_usage_inline_type;
 	attr->setup_buffer		= setup_buffer_inline_type;
 	attr->write_buffer		= write_buffer_inline_type;
@@ -875,6 +1624,48 @@ assignArrowTypeBpchar(SQLattribute *attr, int *p_numBuffers)
 	*p_numBuffers += 2;		/* nullmap + values */
 }
 
+static void
+assignArrowTypeFixedSizeBinaryOf(SQLattribute *attr, int width,
+								 int *p_numBuffers)
+{
+	attr->arrow_type.tag	= ArrowNodeTag__FixedSizeBinary;
+	attr->arrow_type.FixedSizeBinary.byteWidth = width;
+	attr->arrow_typename	= "FixedSizeBinary";
+	attr->buffer_usage		= buffer_usage_inline_type;
+	attr->setup_buffer		= setup_buffer_inline_type;
+	attr->write_buffer		= write_buffer_inline_type;
+
+	*p_numBuffers += 2;		/* nullmap + values */
+}
+
+static void
+assignArrowTypeInet(SQLattribute *attr, const SQLoptions *options,
+					int *p_numBuffers)
+{
+	if (!options->network_as_binary)
+	{
+		assignArrowTypeUtf8(attr, p_numBuffers);
+		attr->put_value = put_inet_text_value;
+		return;
+	}
+	assignArrowTypeFixedSizeBinaryOf(attr, INET_BINARY_LEN, p_numBuffers);
+	attr->put_value = put_inet_binary_value;
+}
+
+static void
+assignArrowTypeMacaddr(SQLattribute *attr, const SQLoptions *options,
+					   int *p_numBuffers)
+{
+	if (!options->network_as_binary)
+	{
+		assignArrowTypeUtf8(attr, p_numBuffers);
+		attr->put_value = put_macaddr_text_value;
+		return;
+	}
+	assignArrowTypeFixedSizeBinaryOf(attr, attr->attlen, p_numBuffers);
+	attr->put_value = put_macaddr_value;
+}
+
 static void
 assignArrowTypeBool(SQLattribute *attr, int *p_numBuffers)
 {
@@ -890,19 +1681,32 @@ assignArrowTypeBool(SQLattribute *attr, int *p_numBuffers)
 }
 
 static void
-assignArrowTypeDecimal(SQLattribute *attr, int *p_numBuffers)
+assignArrowTypeDecimal(SQLattribute *attr, const SQLoptions *options,
+					   int *p_numBuffers)
 {
 #ifdef PG_INT128_TYPE
 	int		typmod			= attr->atttypmod;
-	int		precision		= 11;	/* default, if typmod == -1 */
-	int		scale			= 30;	/* default, if typmod == -1 */
+	int		precision		= DECIMAL128_MAX_PRECISION;	/* if typmod == -1 */
+	int		scale			= 18;						/* if typmod == -1 */
 
+	/* numeric without typmod has neither precision nor scale of its own */
+	if (options->numeric_precision > 0)
+	{
+		precision = options->numeric_precision;
+		scale = options->numeric_scale;
+	}
 	if (typmod >= VARHDRSZ)
 	{
 		typmod -= VARHDRSZ;
 		precision = (typmod >> 16) & 0xffff;
-		scale = (typmod & 0xffff);
+		scale = (int16)(typmod & 0xffff);
 	}
+	if (precision > DECIMAL128_MAX_PRECISION)
+		Elog("numeric(%d,%d) exceeds the maximum precision of Decimal128 (column \"%s\")",
+			 precision, scale, attr->attname);
+	if (scale < 0 || scale > precision)
+		Elog("numeric(%d,%d) has the scale not supported by Decimal128 (column \"%s\")",
+			 precision, scale, attr->attname);
 	memset(&attr->arrow_type, 0, sizeof(ArrowType));
 	attr->arrow_type.tag	= ArrowNodeTag__Decimal;
 	attr->arrow_type.Decimal.precision = precision;
@@ -923,6 +1727,33 @@ assignArrowTypeDecimal(SQLattribute *attr, int *p_numBuffers)
 #endif
 }
 
+/*
+ * money has 2 fraction digits, like most of lc_monetary. The currency
+ * symbol and the other decorations of the locale are dropped.
+ */
+#define MONEY_PRECISION		19
+#define MONEY_SCALE			2
+
+static void
+assignArrowTypeMoney(SQLattribute *attr, int *p_numBuffers)
+{
+#ifdef PG_INT128_TYPE
+	memset(&attr->arrow_type, 0, sizeof(ArrowType));
+	attr->arrow_type.tag	= ArrowNodeTag__Decimal;
+	attr->arrow_type.Decimal.precision = MONEY_PRECISION;
+	attr->arrow_type.Decimal.scale = MONEY_SCALE;
+	attr->arrow_typename	= "Decimal";
+	attr->put_value			= put_money_value;
+	attr->buffer_usage		= buffer_usage_inline_type;
+	attr->setup_buffer		= setup_buffer_inline_type;
+	attr->write_buffer		= write_buffer_inline_type;
+
+	*p_numBuffers += 2;		/* nullmap + values */
+#else
+	Elog("Money type of PostgreSQL is not supported in this build");
+#endif
+}
+
 static void
 assignArrowTypeDate(SQLattribute *attr, int *p_numBuffers)
 {
@@ -959,6 +1790,12 @@ assignArrowTypeTimestamp(SQLattribute *attr, int *p_numBuffers)
 {
 	attr->arrow_type.tag	= ArrowNodeTag__Timestamp;
 	attr->arrow_type.Timestamp.unit = ArrowTimeUnit__MicroSecond;
+	/* timestamptz is always sent in UTC */
+	if (strcmp(attr->typname, "timestamptz") == 0)
+	{
+		attr->arrow_type.Timestamp.timezone = "UTC";
+		attr->arrow_type.Timestamp._timezone_len = 3;
+	}
 	attr->arrow_typename	= "Timestamp";
 	attr->put_value			= put_timestamp_value;
 	attr->stat_update		= stat_update_int64_value;
@@ -969,14 +1806,19 @@ assignArrowTypeTimestamp(SQLattribute *attr, int *p_numBuffers)
 	*p_numBuffers += 2;		/* nullmap + values */
 }
 
-#if 0
 static void
 assignArrowTypeInterval(SQLattribute *attr, int *p_numBuffers)
 {
-	usec + day + mon;
-	Elog("Interval is not supported yet");
+	attr->arrow_type.tag	= ArrowNodeTag__Interval;
+	attr->arrow_type.Interval.unit = ArrowIntervalUnit__Month_Day_Nano;
+	attr->arrow_typename	= "Interval(MonthDayNano)";
+	attr->put_value			= put_interval_value;
+	attr->buffer_usage		= buffer_usage_inline_type;
+	attr->setup_buffer		= setup_buffer_inline_type;
+	attr->write_buffer		= write_buffer_inline_type;
+
+	*p_numBuffers += 2;		/* nullmap + values */
 }
-#endif
 
 static void
 assignArrowTypeList(SQLattribute *attr, int *p_numBuffers)
@@ -1021,29 +1863,116 @@ assignArrowTypeDictionary(SQLattribute *attr, int *p_numBuffers)
 }
 
 /*
- * assignArrowType
+ * assignArrowTypeTextForm
+ *
+ * It writes the column of any data type as Utf8 of its text form, for the
+ * results which come in text.
  */
 void
-assignArrowType(SQLattribute *attr, int *p_numBuffers)
+assignArrowTypeTextForm(SQLattribute *attr, int *p_numBuffers)
+{
+	memset(&attr->arrow_type, 0, sizeof(ArrowType));
+	assignArrowTypeUtf8(attr, p_numBuffers);
+	attr->put_value = put_text_value;
+}
+
+/*
+ * assignArrowTypeTextDictionary
+ *
+ * It switches the Utf8 column to dictionary-encoded. Only the plain text
+ * columns are allowed, because the values are saved as is.
+ */
+void
+assignArrowTypeTextDictionary(SQLattribute *attr, int *p_numBuffers)
+{
+	if (attr->arrow_type.tag != ArrowNodeTag__Utf8 ||
+		(attr->put_value != put_variable_value &&
+		 attr->put_value != put_text_value))
+		Elog("column \"%s\" of type %s cannot be dictionary-encoded",
+			 attr->attname, attr->typname);
+	*p_numBuffers -= 3;		/* nullmap + index + extra of Utf8 */
+	assignArrowTypeDictionary(attr, p_numBuffers);
+	attr->arrow_typename	= "Dictionary";
+}
+
+static void
+assignArrowTypeJson(SQLattribute *attr, const SQLoptions *options,
+					int *p_numBuffers)
+{
+	bool	is_jsonb = (strcmp(attr->typname, "jsonb") == 0);
+
+	switch (options->json_mode)
+	{
+		case PG2ARROW_JSON_UTF8:
+			assignArrowTypeUtf8(attr, p_numBuffers);
+			if (is_jsonb)
+				attr->put_value = put_jsonb_value;
+			break;
+		case PG2ARROW_JSON_BINARY:
+			assignArrowTypeBinary(attr, p_numBuffers);
+			if (is_jsonb)
+				attr->put_value = put_jsonb_binary_value;
+			break;
+		default:
+			Elog("unknown JSON mode: %d", options->json_mode);
+	}
+}
+
+/*
+ * assignArrowTypeGeometry
+ *
+ * geometry and geography of PostGIS, as ISO WKB in Binary with the
+ * GeoArrow extension type; geography has the spherical edges.
+ */
+static void
+assignArrowTypeGeometry(SQLattribute *attr, const SQLoptions *options,
+						int *p_numBuffers)
+{
+	assignArrowTypeBinary(attr, p_numBuffers);
+	attr->put_value			= put_wkb_value;
+	attr->extension_name	= "geoarrow.wkb";
+	if (attr->atttypid == options->postgis_types->geography_typid)
+		attr->extension_metadata = "{\"edges\":\"spherical\"}";
+	else
+		attr->extension_metadata = "{}";
+}
+
+/*
+ * assignArrowType
+ *
+ * It returns false if the data type has no known binary format, so the
+ * caller can fetch the column in text instead.
+ */
+bool
+assignArrowType(SQLattribute *attr, const SQLoptions *options,
+				int *p_numBuffers)
 {
 	memset(&attr->arrow_type, 0, sizeof(ArrowType));
 	if (attr->subtypes)
 	{
 		/* composite type */
 		assignArrowTypeStruct(attr, p_numBuffers);
-		return;
+		return true;
 	}
 	else if (attr->element)
 	{
 		/* array type */
 		assignArrowTypeList(attr, p_numBuffers);
-		return;
+		return true;
 	}
 	else if (attr->typtype == 'e')
 	{
-		/* enum type */
-		assignArrowTypeDictionary(attr, p_numBuffers);
-		return;
+		/* enum type; its wire format is the label */
+		if (attr->enumdict)
+			assignArrowTypeDictionary(attr, p_numBuffers);
+		else
+			assignArrowTypeUtf8(attr, p_numBuffers);
+		return true;
+	}
+	else if (attr->typtype != 'b' && attr->typtype != 'p')
+	{
+		/* range, multirange and so on */
+		return false;
 	}
 	else if (strcmp(attr->typnamespace, "pg_catalog") == 0)
 	{
@@ -1051,55 +1980,113 @@ assignArrowType(SQLattribute *attr, int *p_numBuffers)
 		if (strcmp(attr->typname, "bool") == 0)
 		{
 			assignArrowTypeBool(attr, p_numBuffers);
-			return;
+			return true;
 		}
 		else if (strcmp(attr->typname, "int2") == 0 ||
 				 strcmp(attr->typname, "int4") == 0 ||
 				 strcmp(attr->typname, "int8") == 0)
 		{
 			assignArrowTypeInt(attr, p_numBuffers, true);
-			return;
+			return true;
 		}
 		else if (strcmp(attr->typname, "float2") == 0 ||	/* by PG-Strom */
 				 strcmp(attr->typname, "float4") == 0 ||
 				 strcmp(attr->typname, "float8") == 0)
 		{
 			assignArrowTypeFloatingPoint(attr, p_numBuffers);
-			return;
+			return true;
 		}
 		else if (strcmp(attr->typname, "date") == 0)
 		{
 			assignArrowTypeDate(attr, p_numBuffers);
-			return;
+			return true;
 		}
 		else if (strcmp(attr->typname, "time") == 0)
 		{
 			assignArrowTypeTime(attr, p_numBuffers);
-			return;
+			return true;
 		}
 		else if (strcmp(attr->typname, "timestamp") == 0 ||
 				 strcmp(attr->typname, "timestamptz") == 0)
 		{
 			assignArrowTypeTimestamp(attr, p_numBuffers);
-			return;
+			return true;
 		}
-		else if (strcmp(attr->typname, "text") == 0 ||
-				 strcmp(attr->typname, "varchar") == 0)
+		else if (strcmp(attr->typname, "interval") == 0)
 		{
-			assignArrowTypeUtf8(attr, p_numBuffers);
-			return;
+			assignArrowTypeInterval(attr, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "void") == 0)
+		{
+			assignArrowTypeNull(attr, p_numBuffers);
+			return true;
 		}
-		else if (strcmp(attr->typname, "bpchar") == 0)
+		else if (strcmp(attr->typname, "bytea") == 0)
 		{
-			assignArrowTypeBpchar(attr, p_numBuffers);
-			return;
+			/*
+			 * binary transfer sends the raw bytes regardless of bytea_output,
+			 * so neither hex nor escape format needs to be decoded.
+			 */
+			assignArrowTypeBinary(attr, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "text") == 0 ||
+				 strcmp(attr->typname, "varchar") == 0 ||
+				 strcmp(attr->typname, "bpchar") == 0 ||
+				 strcmp(attr->typname, "name") == 0 ||
+				 strcmp(attr->typname, "char") == 0 ||
+				 strcmp(attr->typname, "unknown") == 0)
+		{
+			assignArrowTypeText(attr, p_numBuffers);
+			return true;
 		}
 		else if (strcmp(attr->typname, "numeric") == 0)
 		{
-			assignArrowTypeDecimal(attr, p_numBuffers);
-			return;
+			assignArrowTypeDecimal(attr, options, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "inet") == 0 ||
+				 strcmp(attr->typname, "cidr") == 0)
+		{
+			assignArrowTypeInet(attr, options, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "macaddr") == 0 ||
+				 strcmp(attr->typname, "macaddr8") == 0)
+		{
+			assignArrowTypeMacaddr(attr, options, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "money") == 0)
+		{
+			assignArrowTypeMoney(attr, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "uuid") == 0)
+		{
+			assignArrowTypeUuid(attr, options, p_numBuffers);
+			return true;
+		}
+		else if (strcmp(attr->typname, "json") == 0 ||
+				 strcmp(attr->typname, "jsonb") == 0)
+		{
+			assignArrowTypeJson(attr, options, p_numBuffers);
+			return true;
 		}
 	}
+	/* pseudo types, like record, have no fixed binary format */
+	if (attr->typtype != 'b')
+		return false;
+	/* PostGIS, by the OIDs resolved for the connection */
+	if (options->postgis_types &&
+		(attr->atttypid == options->postgis_types->geometry_typid ||
+		 attr->atttypid == options->postgis_types->geography_typid) &&
+		attr->atttypid != InvalidOid)
+	{
+		assignArrowTypeGeometry(attr, options, p_numBuffers);
+		return true;
+	}
 	/* elsewhere, we save the column just a bunch of binary data */
 	if (attr->attlen > 0)
 	{
@@ -1109,7 +2096,7 @@ assignArrowType(SQLattribute *attr, int *p_numBuffers)
 			attr->attlen == sizeof(long))
 		{
 			assignArrowTypeInt(attr, p_numBuffers, false);
-			return;
+			return true;
 		}
 		/*
 		 * MEMO: Unfortunately, we have no portable way to pack user defined
@@ -1120,12 +2107,10 @@ assignArrowType(SQLattribute *attr, int *p_numBuffers)
 		 * its binary format without proper knowledge.
 		 */
 	}
-	else if (attr->attlen == -1)
-	{
-		assignArrowTypeBinary(attr, p_numBuffers);
-		return;
-	}
-	Elog("PostgreSQL type: '%s.%s' is not supported",
-		 attr->typnamespace,
-		 attr->typname);
+	/*
+	 * Likewise, the variable-length types like hstore, tsvector or xml have
+	 * their own binary formats, which are not a bunch of bytes better than
+	 * their text forms; so they are fetched in text.
+	 */
+	return false;
 }
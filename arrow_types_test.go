@@ -0,0 +1,507 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/bitutil"
+)
+
+// decimalStrings returns the values of the Decimal128 column by its scale,
+// or "null"; ValueStr goes through float, which loses the digits.
+func decimalStrings(t *testing.T, col arrow.Array) []string {
+	t.Helper()
+	a, ok := col.(*array.Decimal128)
+	if !ok {
+		t.Fatalf("got %s, want Decimal128", col.DataType())
+	}
+	scale := a.DataType().(*arrow.Decimal128Type).Scale
+	values := make([]string, a.Len())
+	for i := range values {
+		if a.IsNull(i) {
+			values[i] = "null"
+		} else {
+			values[i] = a.Value(i).ToString(scale)
+		}
+	}
+	return values
+}
+
+func TestNumeric(t *testing.T) {
+	c := testConn(t)
+
+	tests := []struct {
+		sql  string
+		typ  string
+		want []string
+	}{
+		{
+			"SELECT v::numeric(10,2) FROM (VALUES ('123.45'), ('-0.5'), ('-123.4'), ('1.10'), ('0'), (NULL)) t(v)",
+			"decimal(10, 2)",
+			[]string{"123.45", "-0.50", "-123.40", "1.10", "0.00", "null"},
+		},
+		{
+			// the trailing zero digits are not sent, but the weight tells
+			"SELECT v::numeric(38,4) FROM (VALUES ('10000.0000'), ('-100000000'), ('1e20'), ('0.0001'), ('-0.1000')) t(v)",
+			"decimal(38, 4)",
+			[]string{"10000.0000", "-100000000.0000", "100000000000000000000.0000", "0.0001", "-0.1000"},
+		},
+		{
+			// rounded half away from zero
+			"SELECT v::numeric(5,2) FROM (VALUES ('1.005'), ('-1.005'), ('999.994')) t(v)",
+			"decimal(5, 2)",
+			[]string{"1.01", "-1.01", "999.99"},
+		},
+		{
+			"SELECT v::numeric FROM (VALUES ('1.500000'), ('-2'), ('-0.000000000000000001')) t(v)",
+			"decimal(38, 18)",
+			[]string{"1.500000000000000000", "-2.000000000000000000", "-0.000000000000000001"},
+		},
+	}
+	for _, tt := range tests {
+		col := testColumn(t, c, tt.sql)
+		if got := col.DataType().String(); got != tt.typ {
+			t.Errorf("%s: got %s, want %s", tt.sql, got, tt.typ)
+			continue
+		}
+		got := decimalStrings(t, col)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestNumericNotFinite(t *testing.T) {
+	c := testConn(t)
+
+	for _, v := range []string{"NaN", "Infinity", "-Infinity"} {
+		_, err := c.Query("SELECT '" + v + "'::numeric")
+		if err == nil {
+			t.Errorf("%s: got no error", v)
+			continue
+		}
+		want := strings.TrimPrefix(v, "-")
+		if !strings.Contains(err.Error(), "cannot map "+want) {
+			t.Errorf("%s: got %v, want the error of %s", v, err, want)
+		}
+	}
+}
+
+func TestNumericPrecision(t *testing.T) {
+	c := testConn(t, WithNumericPrecision(20, 4))
+
+	col := testColumn(t, c, "SELECT v::numeric FROM (VALUES ('1.23456'), ('-1.23454'), ('1234567890123456')) t(v)")
+	if got := col.DataType().String(); got != "decimal(20, 4)" {
+		t.Fatalf("got %s, want decimal(20, 4)", got)
+	}
+	got := decimalStrings(t, col)
+	want := []string{"1.2346", "-1.2345", "1234567890123456.0000"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// the typmod of the column precedes
+	col = testColumn(t, c, "SELECT 1.5::numeric(3,1)")
+	if got := col.DataType().String(); got != "decimal(3, 1)" {
+		t.Errorf("got %s, want decimal(3, 1)", got)
+	}
+	// beyond the integer digits
+	if _, err := c.Query("SELECT 12345678901234567::numeric"); err == nil {
+		t.Errorf("got no error of the value beyond numeric(20,4)")
+	}
+
+	for _, p := range [][2]int{{0, 0}, {39, 0}, {10, 11}, {10, -1}} {
+		if _, err := Connect(testDSN(t), WithNumericPrecision(p[0], p[1])); err == nil {
+			t.Errorf("WithNumericPrecision(%d, %d): got no error", p[0], p[1])
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	c := testConn(t)
+	testExec(t, c, "SET TimeZone = 'Asia/Tokyo'")
+
+	tests := []struct {
+		sql  string
+		typ  string
+		want []int64
+	}{
+		{
+			// around the PostgreSQL epoch, which is 2000-01-01
+			"SELECT v::timestamp FROM (VALUES ('1999-12-31 23:59:59.999999'), ('2000-01-01 00:00:00'), ('2000-01-01 00:00:00.000001'), ('1970-01-01'), ('1969-12-31 23:59:59.5')) t(v)",
+			"timestamp[us]",
+			[]int64{946684799999999, 946684800000000, 946684800000001, 0, -500000},
+		},
+		{
+			"SELECT v::timestamp FROM (VALUES ('infinity'), ('-infinity')) t(v)",
+			"timestamp[us]",
+			[]int64{math.MaxInt64, math.MinInt64},
+		},
+		{
+			// in UTC, whatever the TimeZone of the session
+			"SELECT v::timestamptz FROM (VALUES ('2000-01-01 09:00:00+09'), ('1999-12-31 23:59:59.999999+00'), ('2000-01-01 00:00:00')) t(v)",
+			"timestamp[us, tz=UTC]",
+			[]int64{946684800000000, 946684799999999, 946684800000000 - 9*3600*1000000},
+		},
+	}
+	for _, tt := range tests {
+		col := testColumn(t, c, tt.sql)
+		if got := col.DataType().String(); got != tt.typ {
+			t.Errorf("%s: got %s, want %s", tt.sql, got, tt.typ)
+			continue
+		}
+		a := col.(*array.Timestamp)
+		for i, want := range tt.want {
+			if got := int64(a.Value(i)); got != want {
+				t.Errorf("%s: row %d: got %d, want %d", tt.sql, i, got, want)
+			}
+		}
+	}
+}
+
+func TestArray(t *testing.T) {
+	c := testConn(t)
+
+	col := testColumn(t, c, "SELECT v FROM (VALUES (1, '{1,2,3}'::int4[]), (2, '{}'), (3, NULL), (4, '{NULL,5}'), (5, '{}')) t(k, v) ORDER BY k")
+	a, ok := col.(*array.List)
+	if !ok {
+		t.Fatalf("got %s, want List", col.DataType())
+	}
+	if a.Len() != 5 || a.NullN() != 1 {
+		t.Fatalf("got %d values of %d nulls, want 5 of 1", a.Len(), a.NullN())
+	}
+	want := []string{"[1 2 3]", "[]", "null", "[(null) 5]", "[]"}
+	for i, w := range want {
+		if a.IsNull(i) {
+			if w != "null" {
+				t.Errorf("row %d: got null, want %s", i, w)
+			}
+			continue
+		}
+		lo, hi := a.ValueOffsets(i)
+		elems := a.ListValues().(*array.Int32)
+		var s []string
+		for j := lo; j < hi; j++ {
+			s = append(s, elems.ValueStr(int(j)))
+		}
+		if got := "[" + strings.Join(s, " ") + "]"; got != w {
+			t.Errorf("row %d: got %s, want %s", i, got, w)
+		}
+	}
+	// an empty array and NULL are apart by the validity bitmap only
+	if a.IsNull(1) || !a.IsNull(2) {
+		t.Errorf("got the nulls %v %v, want false true", a.IsNull(1), a.IsNull(2))
+	}
+
+	col = testColumn(t, c, "SELECT ARRAY['a', NULL, 'c']::text[] UNION ALL SELECT '{}'")
+	if got := col.String(); got != `[["a" (null) "c"] []]` {
+		t.Errorf("text[]: got %s", got)
+	}
+
+	if _, err := c.Query("SELECT '{{1,2},{3,4}}'::int4[]"); err == nil {
+		t.Errorf("got no error of the two-dimensional array")
+	}
+}
+
+func TestUUID(t *testing.T) {
+	c := testConn(t)
+	const u = "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"
+
+	col := testColumn(t, c, "SELECT v::uuid FROM (VALUES ('"+u+"'), (NULL), ('00000000-0000-0000-0000-000000000000')) t(v)")
+	a, ok := col.(*array.FixedSizeBinary)
+	if !ok || a.DataType().(*arrow.FixedSizeBinaryType).ByteWidth != 16 {
+		t.Fatalf("got %s, want FixedSizeBinary(16)", col.DataType())
+	}
+	if got := hex.EncodeToString(a.Value(0)); got != strings.ReplaceAll(u, "-", "") {
+		t.Errorf("got %s, want %s", got, u)
+	}
+	if !a.IsNull(1) || hex.EncodeToString(a.Value(2)) != strings.Repeat("0", 32) {
+		t.Errorf("got %s", a)
+	}
+
+	s := testColumn(t, testConn(t, WithUUIDAsString()), "SELECT '"+strings.ToUpper(u)+"'::uuid")
+	if got := s.(*array.String).Value(0); got != u {
+		t.Errorf("WithUUIDAsString: got %s, want %s", got, u)
+	}
+
+	// back to the table by CopyIn, from both forms
+	testTable(t, c, "pg2arrow_test_uuid", "k int, v uuid")
+	for k, src := range []*Conn{testConn(t), testConn(t, WithUUIDAsString())} {
+		r, err := src.QueryStream(fmt.Sprintf("SELECT %d AS k, v::uuid FROM (VALUES ('%s'), (NULL)) t(v)", k, u))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.CopyIn("pg2arrow_test_uuid", r)
+		r.Close()
+		if err != nil || n != 2 {
+			t.Fatalf("CopyIn: got %d rows, %v", n, err)
+		}
+	}
+	col = testColumn(t, testConn(t, WithUUIDAsString()), "SELECT v FROM pg2arrow_test_uuid ORDER BY k, v")
+	if got := col.String(); got != `["`+u+`" (null) "`+u+`" (null)]` {
+		t.Errorf("got %s after CopyIn", got)
+	}
+}
+
+func TestBytea(t *testing.T) {
+	c := testConn(t)
+	const sql = `SELECT v FROM (VALUES (1, '\x00'::bytea), (2, '\x0001ff0000'), (3, ''), (4, NULL), (5, 'a\000b'::bytea), (6, decode(repeat('00ff', 100000), 'hex'))) t(k, v) ORDER BY k`
+	want := [][]byte{{0}, {0, 1, 0xff, 0, 0}, {}, nil, {'a', 0, 'b'}, bytes.Repeat([]byte{0, 0xff}, 100000)}
+
+	// bytea_output is of the text form; the binary one is the same anyway
+	for _, output := range []string{"hex", "escape"} {
+		testExec(t, c, "SET bytea_output = "+output)
+		col := testColumn(t, c, sql)
+		a, ok := col.(*array.Binary)
+		if !ok {
+			t.Fatalf("got %s, want Binary", col.DataType())
+		}
+		for i, w := range want {
+			if w == nil {
+				if !a.IsNull(i) {
+					t.Errorf("%s: row %d: got %x, want null", output, i, a.Value(i))
+				}
+			} else if a.IsNull(i) || !bytes.Equal(a.Value(i), w) {
+				t.Errorf("%s: row %d: got %.16x, want %.16x", output, i, a.Value(i), w)
+			}
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	c := testConn(t)
+	const values = "(VALUES (1, '-92233720368547758.08'), (2, '92233720368547758.07'), (3, '0'), (4, '-0.01'), (5, NULL)) t(k, v)"
+	const sql = "SELECT v::numeric::money FROM " + values + " ORDER BY k"
+	want := []string{"-92233720368547758.08", "92233720368547758.07", "0.00", "-0.01", "null"}
+
+	col := testColumn(t, c, sql)
+	if got := col.DataType().String(); got != "decimal(19, 2)" {
+		t.Fatalf("got %s, want decimal(19, 2)", got)
+	}
+	if got := decimalStrings(t, col); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// back to the table by CopyIn
+	testTable(t, c, "pg2arrow_test_money", "k int, v money")
+	r, err := testConn(t).QueryStream("SELECT k, v::numeric::money FROM " + values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := c.CopyIn("pg2arrow_test_money", r); err != nil {
+		t.Fatalf("CopyIn: %v", err)
+	}
+	col = testColumn(t, c, "SELECT v FROM pg2arrow_test_money ORDER BY k")
+	if got := decimalStrings(t, col); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v after CopyIn, want %v", got, want)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	const sql = `SELECT '2001:db8::1/64'::inet AS a, '2001:db8::/32'::cidr AS b, '2001:db8::1'::inet AS c,
+       '192.168.0.1/24'::inet AS d, '10.0.0.0/8'::cidr AS e,
+       '08:00:2b:01:02:03'::macaddr AS f, '08:00:2b:01:02:03:04:05'::macaddr8 AS g`
+
+	_, recs := testQuery(t, testConn(t), sql)
+	want := []string{"2001:db8::1/64", "2001:db8::/32", "2001:db8::1", "192.168.0.1/24", "10.0.0.0/8",
+		"08:00:2b:01:02:03", "08:00:2b:01:02:03:04:05"}
+	for j, w := range want {
+		col, ok := recs[0].Column(j).(*array.String)
+		if !ok {
+			t.Errorf("column %d: got %s, want Utf8", j, recs[0].Column(j).DataType())
+		} else if got := col.Value(0); got != w {
+			t.Errorf("column %d: got %s, want %s", j, got, w)
+		}
+	}
+
+	// the prefix length, then the IPv6 address or the IPv4-mapped one
+	_, recs = testQuery(t, testConn(t, WithNetworkAsBinary()), sql)
+	want = []string{
+		"40" + "20010db8000000000000000000000001",
+		"20" + "20010db8000000000000000000000000",
+		"80" + "20010db8000000000000000000000001",
+		"18" + "00000000000000000000ffffc0a80001",
+		"08" + "00000000000000000000ffff0a000000",
+		"08002b010203",
+		"08002b0102030405",
+	}
+	for j, w := range want {
+		col, ok := recs[0].Column(j).(*array.FixedSizeBinary)
+		if !ok {
+			t.Errorf("column %d: got %s, want FixedSizeBinary", j, recs[0].Column(j).DataType())
+		} else if got := hex.EncodeToString(col.Value(0)); got != w {
+			t.Errorf("column %d: got %s, want %s", j, got, w)
+		}
+	}
+}
+
+func TestEnum(t *testing.T) {
+	c := testConn(t)
+	testExec(t, c, "CREATE TYPE pg_temp.fruit AS ENUM ('zebra', 'apple', 'mango')",
+		"ALTER TYPE pg_temp.fruit ADD VALUE 'banana' BEFORE 'apple'")
+	const sql = "SELECT v::pg_temp.fruit FROM (VALUES (1, 'mango'), (2, 'zebra'), (3, NULL), (4, 'mango')) t(k, v) ORDER BY k"
+
+	check := func(labels []string) {
+		t.Helper()
+		col := testColumn(t, c, sql)
+		d, ok := col.(*array.Dictionary)
+		if !ok {
+			t.Fatalf("got %s, want Dictionary", col.DataType())
+		}
+		// the labels of the declared order, not of the appearance
+		dict := d.Dictionary().(*array.String)
+		var got []string
+		for i := 0; i < dict.Len(); i++ {
+			got = append(got, dict.Value(i))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(labels) {
+			t.Errorf("got the labels %v, want %v", got, labels)
+		}
+		if got := fmt.Sprint(dictionaryStrings(t, col)); got != "[mango zebra null mango]" {
+			t.Errorf("got %s", got)
+		}
+	}
+	check([]string{"zebra", "banana", "apple", "mango"})
+
+	// the labels cached by the Conn are refreshed by the new one appearing
+	testExec(t, c, "ALTER TYPE pg_temp.fruit ADD VALUE 'kiwi' AFTER 'zebra'")
+	testQuery(t, c, "SELECT 'kiwi'::pg_temp.fruit")
+	check([]string{"zebra", "kiwi", "banana", "apple", "mango"})
+}
+
+func TestInterval(t *testing.T) {
+	c := testConn(t)
+
+	col := testColumn(t, c, "SELECT v::interval FROM (VALUES (1, '1 year 2 mons 3 days 04:05:06'), (2, '-1 mons +2 days -00:00:01.5'), (3, '0'), (4, NULL), (5, '0.000001 sec')) t(k, v) ORDER BY k")
+	a, ok := col.(*array.MonthDayNanoInterval)
+	if !ok {
+		t.Fatalf("got %s, want Interval(MonthDayNano)", col.DataType())
+	}
+	want := []arrow.MonthDayNanoInterval{
+		{Months: 14, Days: 3, Nanoseconds: (4*3600 + 5*60 + 6) * 1000000000},
+		{Months: -1, Days: 2, Nanoseconds: -1500000000},
+		{},
+		{}, // null
+		{Nanoseconds: 1000},
+	}
+	for i, w := range want {
+		if a.IsNull(i) != (i == 3) {
+			t.Errorf("row %d: got null %v", i, a.IsNull(i))
+		} else if got := a.Value(i); i != 3 && got != w {
+			t.Errorf("row %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	c := testConn(t)
+
+	_, recs := testQuery(t, c, `SELECT 'ab'::char(5) AS a, 'abcde'::char(5) AS b, 'é'::char(5) AS c, '日本'::char(3) AS d,
+       ' x '::char(5) AS e, ''::char(5) AS f, 'héé'::varchar(3) AS g, 'Grüße, 日本語 🎉'::text AS h,
+       'tbl'::name AS i, 'x'::"char" AS j, '\377'::"char" AS k`)
+	// the trailing blanks of char(n) are trimmed, but the leading ones
+	want := []string{"ab", "abcde", "é", "日本", " x", "", "héé", "Grüße, 日本語 🎉", "tbl", "x", `\377`}
+	for j, w := range want {
+		col, ok := recs[0].Column(j).(*array.String)
+		if !ok {
+			t.Errorf("column %d: got %s, want Utf8", j, recs[0].Column(j).DataType())
+		} else if got := col.Value(0); got != w {
+			t.Errorf("column %d: got %q, want %q", j, got, w)
+		}
+	}
+
+	// char(n) counts the characters, not the bytes
+	col := testColumn(t, c, "SELECT v::char(5) FROM (VALUES ('éé'), (NULL), ('öööööö')) t(v)")
+	if got := col.String(); got != `["éé" (null) "ööööö"]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestBool(t *testing.T) {
+	// 13 values, so neither the values nor the validity end on a byte
+	const sql = "SELECT CASE WHEN i % 5 = 0 THEN NULL ELSE i % 3 = 1 END FROM generate_series(1, 13) i"
+
+	for _, size := range []int{13, 5} {
+		_, recs := testQuery(t, testConn(t, WithBatchSize(size)), sql)
+		i := 1
+		for _, rec := range recs {
+			a, ok := rec.Column(0).(*array.Boolean)
+			if !ok {
+				t.Fatalf("got %s, want Bool", rec.Column(0).DataType())
+			}
+			values := a.Data().Buffers()[1].Bytes()
+			for row := 0; row < a.Len(); row, i = row+1, i+1 {
+				if a.IsNull(row) != (i%5 == 0) {
+					t.Errorf("size %d: i = %d: got null %v", size, i, a.IsNull(row))
+				} else if !a.IsNull(row) && a.Value(row) != (i%3 == 1) {
+					t.Errorf("size %d: i = %d: got %v", size, i, a.Value(row))
+				}
+				// one bit per value, and the NULL is false
+				bit := bitutil.BitIsSet(values, a.Data().Offset()+row)
+				if bit != (i%5 != 0 && i%3 == 1) {
+					t.Errorf("size %d: i = %d: got the bit %v", size, i, bit)
+				}
+			}
+		}
+		if i != 14 {
+			t.Errorf("size %d: got %d rows, want 13", size, i-1)
+		}
+	}
+}
+
+func TestGeometryLookalike(t *testing.T) {
+	c := testConn(t)
+	testExec(t, c, "CREATE TYPE pg_temp.geometry AS (x int4)")
+
+	// of the name, but not of PostGIS
+	schema, _ := testQuery(t, c, "SELECT ROW(1)::pg_temp.geometry AS g")
+	f := schema.Field(0)
+	if _, ok := f.Type.(*arrow.StructType); !ok {
+		t.Errorf("got %s, want Struct", f.Type)
+	}
+	if f.Metadata.FindKey("ARROW:extension:name") >= 0 {
+		t.Errorf("got the extension type of %v", f.Metadata)
+	}
+}
+
+func TestGeometry(t *testing.T) {
+	c := testConn(t)
+	_, recs := testQuery(t, c, "SELECT count(*) FROM pg_extension WHERE extname = 'postgis'")
+	if recs[0].Column(0).(*array.Int64).Value(0) == 0 {
+		t.Skip("PostGIS is not installed")
+	}
+
+	schema, recs := testQuery(t, c, `SELECT v::geometry AS g, v::geography AS h FROM (VALUES (1, 'SRID=4326;POINT(1 2)'), (2, NULL), (3, 'LINESTRING(0 0, 1 1)')) t(k, v) ORDER BY k`)
+	for j, edges := range []string{"{}", `{"edges":"spherical"}`} {
+		f := schema.Field(j)
+		if f.Type.ID() != arrow.BINARY {
+			t.Errorf("%s: got %s, want Binary", f.Name, f.Type)
+		}
+		if name, _ := f.Metadata.GetValue("ARROW:extension:name"); name != "geoarrow.wkb" {
+			t.Errorf("%s: got the extension type %q, want geoarrow.wkb", f.Name, name)
+		}
+		if meta, _ := f.Metadata.GetValue("ARROW:extension:metadata"); meta != edges {
+			t.Errorf("%s: got the extension metadata %q, want %q", f.Name, meta, edges)
+		}
+		// ISO WKB without the SRID
+		a := recs[0].Column(j).(*array.Binary)
+		want := []string{
+			"0101000000" + "000000000000f03f" + "0000000000000040",
+			"",
+			"010200000002000000" + "0000000000000000" + "0000000000000000" + "000000000000f03f" + "000000000000f03f",
+		}
+		for i, w := range want {
+			if a.IsNull(i) != (w == "") {
+				t.Errorf("%s: row %d: got null %v", f.Name, i, a.IsNull(i))
+			} else if got := hex.EncodeToString(a.Value(i)); got != w {
+				t.Errorf("%s: row %d: got %s, want %s", f.Name, i, got, w)
+			}
+		}
+	}
+}
@@ -8,6 +8,55 @@
  */
 #include "pg2arrow.h"
 
+/*
+ * The flat images are built on the temporary chunks, then released at once
+ * when the message is written out. Chunks left by an error are released
+ * by the next message on the same thread.
+ */
+typedef struct FBChunk
+{
+	struct FBChunk *next;
+	size_t		sz;
+	double		data[FLEXIBLE_ARRAY_MEMBER];	/* MAXALIGN'ed */
+} FBChunk;
+
+static __thread FBChunk *fb_chunks = NULL;
+
+static void *
+fb_palloc0(size_t sz)
+{
+	FBChunk	   *chunk = calloc(1, offsetof(FBChunk, data) + sz);
+
+	if (!chunk)
+		Elog("out of memory");
+	chunk->next = fb_chunks;
+	chunk->sz = sz;
+	fb_chunks = chunk;
+	return chunk->data;
+}
+
+static void *
+fb_repalloc(void *ptr, size_t sz)
+{
+	FBChunk	   *chunk = (FBChunk *)((char *)ptr - offsetof(FBChunk, data));
+	void	   *temp = fb_palloc0(sz);
+
+	memcpy(temp, ptr, Min(chunk->sz, sz));
+	return temp;
+}
+
+static void
+fb_release(void)
+{
+	FBChunk	   *chunk;
+
+	while ((chunk = fb_chunks) != NULL)
+	{
+		fb_chunks = chunk->next;
+		free(chunk);
+	}
+}
+
 typedef struct
 {
 	uint16		vlen;	/* vtable length */
@@ -33,9 +82,9 @@ __allocFBTableBuf(int nattrs, const char *func_name)
 											  vtable.offset[nattrs])) +
 							MAXALIGN(sizeof(int32) +
 									 sizeof(Datum) * nattrs));
-	buf = palloc0(required);
-	buf->extra_buf		= palloc0(sizeof(void *) * nattrs);
-	buf->extra_sz		= palloc0(sizeof(int) * nattrs);
+	buf = fb_palloc0(required);
+	buf->extra_buf		= fb_palloc0(sizeof(void *) * nattrs);
+	buf->extra_sz		= fb_palloc0(sizeof(int) * nattrs);
 	buf->nattrs			= nattrs;
 	buf->length			= -1;	/* not flatten yet */
 	buf->vtable.vlen	= sizeof(int32);
@@ -136,7 +185,7 @@ addBufferString(FBTableBuf *buf, int index, const char *cstring)
 	if (cstring && (slen = strlen(cstring)) > 0)
 	{
 		blen = sizeof(int32) + INTALIGN(slen + 1);
-		temp = palloc0(blen);
+		temp = fb_palloc0(blen);
 		*((int32 *)temp) = slen;
 		strcpy(temp + sizeof(int32), cstring);
 		__addBufferBinary(buf, index, temp, blen, 0);
@@ -174,7 +223,7 @@ addBufferVector(FBTableBuf *buf, int index, int nitems, FBTableBuf **elements)
 
 		len += MAXALIGN(e->length) + MAXIMUM_ALIGNOF; /* with margin */
 	}
-	vector = palloc0(len);
+	vector = fb_palloc0(len);
 	vector[0] = nitems;
 	pos = (char *)&vector[1 + nitems];
 	for (i=0; i < nitems; i++)
@@ -231,7 +280,7 @@ __makeBufferFlatten(FBTableBuf *buf, const char *func_name)
 		buf->length = base_sz;
 	else
 	{
-		buf = repalloc(buf, offsetof(FBTableBuf,
+		buf = fb_repalloc(buf, offsetof(FBTableBuf,
 									 vtable) + MAXALIGN(base_sz) + extra_sz);
 		table = (char *)&buf->vtable + buf->vtable.vlen;
 		/*
@@ -470,6 +519,9 @@ createArrowType(ArrowType *node, ArrowTypeTag *p_type_tag)
 			Elog("unknown ArrowNodeTag: %d", node->tag);
 			break;
 	}
+	/* types without attributes still need an empty table */
+	if (!buf)
+		buf = makeBufferFlatten(allocFBTableBuf(0));
 	*p_type_tag = tag;
 	return buf;
 }
@@ -492,7 +544,7 @@ addBufferArrowBufferVector(FBTableBuf *buf, int index,
 	size_t		length = offsetof(ArrowBufferVector, buffers[nitems]);
 	int			i;
 
-	vector = palloc0(length);
+	vector = fb_palloc0(length);
 	vector->nitems = nitems;
 	for (i=0; i < nitems; i++)
 	{
@@ -523,7 +575,7 @@ addBufferArrowFieldNodeVector(FBTableBuf *buf, int index,
 	size_t		length = offsetof(ArrowFieldNodeVector, nodes[nitems]);
 	int			i;
 
-	vector = palloc0(length);
+	vector = fb_palloc0(length);
 	vector->nitems = nitems;
 	for (i=0; i < nitems; i++)
 	{
@@ -633,10 +685,22 @@ createArrowSchema(ArrowSchema *node)
 	return makeBufferFlatten(buf);
 }
 
+static FBTableBuf *
+createArrowBodyCompression(ArrowBodyCompression *node)
+{
+	FBTableBuf *buf = allocFBTableBuf(2);
+
+	assert(node->tag == ArrowNodeTag__BodyCompression);
+	addBufferChar(buf, 0, node->codec);
+	addBufferChar(buf, 1, node->method);
+
+	return makeBufferFlatten(buf);
+}
+
 static FBTableBuf *
 createArrowRecordBatch(ArrowRecordBatch *node)
 {
-	FBTableBuf *buf = allocFBTableBuf(3);
+	FBTableBuf *buf = allocFBTableBuf(4);
 
 	assert(node->tag == ArrowNodeTag__RecordBatch);
 	addBufferLong(buf, 0, node->length);
@@ -646,6 +710,8 @@ createArrowRecordBatch(ArrowRecordBatch *node)
 	addBufferArrowBufferVector(buf, 2,
 							   node->_num_buffers,
 							   node->buffers);
+	if (node->compression)
+		addBufferOffset(buf, 3, createArrowBodyCompression(node->compression));
 	return makeBufferFlatten(buf);
 }
 
@@ -718,7 +784,7 @@ addBufferArrowBlockVector(FBTableBuf *buf, int index,
 	size_t		length = offsetof(ArrowBlockVector, blocks[nitems]);
 	int			i;
 
-	vector = palloc0(length);
+	vector = fb_palloc0(length);
     vector->nitems = nitems;
     for (i=0; i < nitems; i++)
 	{
@@ -752,7 +818,7 @@ createArrowFooter(ArrowFooter *node)
 }
 
 /* ----------------------------------------------------------------
- * Routines for File I/O
+ * Routines for serialization
  * ---------------------------------------------------------------- */
 
 /*
@@ -766,7 +832,7 @@ typedef struct
 } FBMessageFileImage;
 
 ssize_t
-writeFlatBufferMessage(int fdesc, ArrowMessage *message)
+writeFlatBufferMessage(SQLbuffer *out, ArrowMessage *message)
 {
 	FBTableBuf *payload = createArrowMessage(message);
 	FBMessageFileImage *image;
@@ -776,7 +842,8 @@ writeFlatBufferMessage(int fdesc, ArrowMessage *message)
 
 	assert(payload->length > 0);
 	offset = INTALIGN(payload->vtable.vlen) - payload->vtable.vlen;
-    nbytes = INTALIGN(offset + payload->length);
+	/* the message body has to begin at 8-bytes aligned position */
+    nbytes = TYPEALIGN(8, offset + payload->length);
 	length = offsetof(FBMessageFileImage, data[nbytes]);
 	image = alloca(length);
 	image->metaLength = sizeof(int32) + nbytes;
@@ -787,8 +854,8 @@ writeFlatBufferMessage(int fdesc, ArrowMessage *message)
 	offset += payload->length;
 	if (offset < nbytes)
 		memset(image->data + offset, 0, nbytes - offset);
-	if (write(fdesc, image, length) != length)
-		Elog("failed on write: %m");
+	fb_release();
+	sql_buffer_append(out, image, length);
 	return length;
 }
 
@@ -808,7 +875,7 @@ typedef struct
 } FBFooterTailImage;
 
 ssize_t
-writeFlatBufferFooter(int fdesc, ArrowFooter *footer)
+writeFlatBufferFooter(SQLbuffer *out, ArrowFooter *footer)
 {
 	FBTableBuf *payload = createArrowFooter(footer);
 	FBFooterFileImage *image;
@@ -833,7 +900,7 @@ writeFlatBufferFooter(int fdesc, ArrowFooter *footer)
 	tail = (FBFooterTailImage *)(image->data + nbytes);
 	tail->metaOffset = nbytes + sizeof(int32);
 	strcpy(tail->signature, "ARROW1");
-	if (write(fdesc, image, length) != length)
-		Elog("failed on write: %m");
+	fb_release();
+	sql_buffer_append(out, image, length);
 	return length;
 }
@@ -0,0 +1,82 @@
+package pg2arrow
+
+// #include "pg2arrow.h"
+import "C"
+import (
+	"errors"
+	"sync"
+)
+
+// errCanceledBeforeStart is returned when the context was done before the
+// query got the connection; the caller reports ctx.Err() instead.
+var errCanceledBeforeStart = errors.New("pg2arrow: query canceled before start")
+
+// canceler cancels a single query on behalf of its context. A nil canceler
+// is valid, and never cancels anything.
+type canceler struct {
+	mu       sync.Mutex
+	cancel   *C.PGcancel // valid only while the query is running
+	canceled bool
+	logger   Logger // of the Conn running the query
+}
+
+// start is called when the query is about to run on conn, whose events
+// are logged to logger. It returns false if the query was canceled before
+// it started.
+func (q *canceler) start(conn *C.PGconn, logger Logger) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.canceled {
+		return false
+	}
+	q.cancel = C.PQgetCancel(conn)
+	q.logger = logger
+	return true
+}
+
+// finish is called when the query is completed. The cancel request is sent
+// under the same lock, so it never reaches an already-finished connection,
+// nor the next query on it.
+func (q *canceler) finish() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.cancel != nil {
+		C.PQfreeCancel(q.cancel)
+		q.cancel = nil
+	}
+}
+
+// Cancel asks the server to stop the query, if it is still running.
+// PQcancel returns once the server has received the request.
+func (q *canceler) Cancel() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.canceled = true
+	if q.cancel != nil {
+		var errbuf [256]C.char
+		q.logger.Info("pg2arrow: canceling the query")
+		if C.PQcancel(q.cancel, &errbuf[0], C.int(len(errbuf))) == 0 {
+			q.logger.Warn("pg2arrow: unable to cancel the query", "error", C.GoString(&errbuf[0]))
+		}
+	}
+}
+
+// wasCanceled reports whether Cancel has been called.
+func (q *canceler) wasCanceled() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.canceled
+}
@@ -0,0 +1,154 @@
+// Command pg2arrow runs a query on PostgreSQL, then writes its result to
+// a file in Apache Arrow or Parquet format.
+//
+//	pg2arrow --dsn="host=localhost dbname=postgres" \
+//	    --query="SELECT * FROM t" --output=t.arrow
+//
+// The query is read from --file, or from stdin if neither --query nor
+// --file is given.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rocketbitz/pg2arrow"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		dsn       = flag.String("dsn", "", "libpq connection string, in keyword/value or URI form; PG* environment variables fill the missing parameters")
+		query     = flag.String("query", "", "SQL command to run")
+		file      = flag.String("file", "", "file to read the SQL command from")
+		output    = flag.String("output", "", "output file (required)")
+		format    = flag.String("format", "", "output format: arrow or parquet (default: by the extension of --output, or arrow)")
+		batchSize = flag.Int("batch-size", 65536, "number of rows per record batch")
+		dictCols  = flag.String("dictionary-columns", "", "comma-separated text columns to write dictionary-encoded")
+		compress  = flag.String("compression", "none", "compression of the record batches in Arrow format: none, lz4 or zstd")
+		level     = flag.Int("compression-level", 0, "compression level (default: by the codec)")
+		timeout   = flag.Duration("statement-timeout", 0, "statement_timeout of the server for the query, like 30s (default: by the server)")
+		maxRows   = flag.Int64("max-rows", 0, "fail rather than write the result beyond this number of rows (default: no limit)")
+		numeric   = flag.String("numeric", "", "precision and scale of numeric columns without their own, like 38,10 (default: 38,18)")
+		verbose   = flag.Bool("verbose", false, "log the connection attempts, the record batches and the columns fetched in text to stderr")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] --output=FILE\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Runs a query on PostgreSQL, then writes its result in Apache Arrow or Parquet format.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		return fmt.Errorf("pg2arrow: unexpected arguments: %s", strings.Join(flag.Args(), " "))
+	}
+	if *output == "" {
+		return errors.New("pg2arrow: --output is required")
+	}
+	if *format == "" {
+		*format = "arrow"
+		if strings.EqualFold(filepath.Ext(*output), ".parquet") {
+			*format = "parquet"
+		}
+	}
+	if *format != "arrow" && *format != "parquet" {
+		return fmt.Errorf("pg2arrow: unknown format %q; either arrow or parquet", *format)
+	}
+
+	codec, ok := compressionCodecs[*compress]
+	if !ok {
+		return fmt.Errorf("pg2arrow: unknown compression %q; either none, lz4 or zstd", *compress)
+	}
+
+	sql, err := readQuery(*query, *file)
+	if err != nil {
+		return err
+	}
+
+	opts := []pg2arrow.Option{pg2arrow.WithBatchSize(*batchSize)}
+	if *dictCols != "" {
+		opts = append(opts, pg2arrow.WithDictionaryColumns(strings.Split(*dictCols, ",")...))
+	}
+	if codec != pg2arrow.CompressionNone {
+		opts = append(opts, pg2arrow.WithCompression(pg2arrow.Compression{Codec: codec, Level: *level}))
+	}
+	if *timeout != 0 {
+		opts = append(opts, pg2arrow.WithStatementTimeout(*timeout))
+	}
+	if *maxRows != 0 {
+		opts = append(opts, pg2arrow.WithMaxRows(*maxRows))
+	}
+	if *numeric != "" {
+		var precision, scale int
+		if _, err := fmt.Sscanf(*numeric, "%d,%d", &precision, &scale); err != nil {
+			return fmt.Errorf("pg2arrow: invalid --numeric %q; like 38,10", *numeric)
+		}
+		opts = append(opts, pg2arrow.WithNumericPrecision(precision, scale))
+	}
+	if *verbose {
+		h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+		opts = append(opts, pg2arrow.WithLogger(slogLogger{slog.New(h)}))
+	}
+	conn, err := pg2arrow.Connect(*dsn, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if *format == "parquet" {
+		return conn.QueryToParquet(sql, *output, pg2arrow.ParquetOptions{})
+	}
+	return conn.QueryToFile(sql, *output)
+}
+
+var compressionCodecs = map[string]pg2arrow.CompressionCodec{
+	"none": pg2arrow.CompressionNone,
+	"lz4":  pg2arrow.CompressionLZ4,
+	"zstd": pg2arrow.CompressionZSTD,
+}
+
+// readQuery returns the SQL command given by --query, --file, or stdin.
+func readQuery(query, file string) (string, error) {
+	if query != "" && file != "" {
+		return "", errors.New("pg2arrow: --query and --file are exclusive")
+	}
+	if query != "" {
+		return query, nil
+	}
+
+	var buf []byte
+	var err error
+	if file != "" {
+		buf, err = os.ReadFile(file)
+	} else {
+		buf, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return "", fmt.Errorf("pg2arrow: unable to read the SQL command: %w", err)
+	}
+	sql := strings.TrimSpace(string(buf))
+	if sql == "" {
+		return "", errors.New("pg2arrow: empty SQL command")
+	}
+	return sql, nil
+}
+
+// slogLogger adapts a *slog.Logger to pg2arrow.Logger.
+type slogLogger struct{ *slog.Logger }
+
+func (l slogLogger) Debug(msg string, kv ...interface{}) { l.Logger.Debug(msg, kv...) }
+func (l slogLogger) Info(msg string, kv ...interface{})  { l.Logger.Info(msg, kv...) }
+func (l slogLogger) Warn(msg string, kv ...interface{})  { l.Logger.Warn(msg, kv...) }
+func (l slogLogger) Error(msg string, kv ...interface{}) { l.Logger.Error(msg, kv...) }
@@ -0,0 +1,272 @@
+package pg2arrow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// withParams returns the dsn overridden by the keyword/value params, which
+// win by coming later. A dsn of URI form skips the test.
+func withParams(t *testing.T, dsn, params string) string {
+	t.Helper()
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		t.Skip("PG2ARROW_TEST_DSN is not of keyword/value form")
+	}
+	return dsn + " " + params
+}
+
+// testSetting returns the current setting of the server parameter.
+func testSetting(t *testing.T, c *Conn, name string) string {
+	t.Helper()
+	col := testColumn(t, c, "SELECT current_setting('"+name+"')")
+	return col.(*array.String).Value(0)
+}
+
+func TestConnectEnvironment(t *testing.T) {
+	dsn := testDSN(t)
+
+	// the parameters missing in the dsn come from the environment
+	t.Setenv("PGAPPNAME", "pg2arrow-env")
+	t.Setenv("PGOPTIONS", "-c work_mem=1234kB")
+	c := testConn(t)
+	if got := testSetting(t, c, "application_name"); got != "pg2arrow-env" {
+		t.Errorf("got application_name %q, want the one of PGAPPNAME", got)
+	}
+	if got := testSetting(t, c, "work_mem"); got != "1234kB" {
+		t.Errorf("got work_mem %q, want the one of PGOPTIONS", got)
+	}
+
+	// but the dsn overrides the environment
+	c, err := Connect(withParams(t, dsn, "application_name=pg2arrow-dsn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := testSetting(t, c, "application_name"); got != "pg2arrow-dsn" {
+		t.Errorf("got application_name %q, want the one of the dsn", got)
+	}
+}
+
+func TestConnectMultipleHosts(t *testing.T) {
+	dsn := testDSN(t)
+	host, port := testConn(t).Host()
+
+	// the first candidate is unreachable, so the second one is connected
+	c, err := Connect(withParams(t, dsn,
+		"host=/nonexistent,"+host+" port="+port+","+port+" target_session_attrs=read-write"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if h, p := c.Host(); h != host || p != port {
+		t.Errorf("got the host %s:%s, want %s:%s", h, p, host, port)
+	}
+
+	// no standby is there; so target_session_attrs reaches libpq as is
+	_, recs := testQuery(t, c, "SELECT pg_is_in_recovery()")
+	if recs[0].Column(0).(*array.Boolean).Value(0) {
+		t.Skip("the test server is a standby")
+	}
+	c2, err := Connect(withParams(t, dsn, "target_session_attrs=standby"))
+	if err == nil {
+		c2.Close()
+		t.Fatal("got no error of target_session_attrs=standby on the primary")
+	}
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("got %v, want a connection failure", err)
+	}
+	c2, err = Connect(withParams(t, dsn, "target_session_attrs=prefer-standby"))
+	if err != nil {
+		t.Fatalf("target_session_attrs=prefer-standby: %v", err)
+	}
+	c2.Close()
+}
+
+// testDatabase creates the database of the encoding, then returns the dsn
+// connecting to it. It is dropped at the end of the test, after the Conns
+// to it are closed. A server refusing to create it skips the test.
+func testDatabase(t *testing.T, c *Conn, name, encoding string) string {
+	t.Helper()
+	dsn := withParams(t, testDSN(t), "dbname="+name)
+	c.Query("DROP DATABASE IF EXISTS " + name)
+	if _, err := c.Query("CREATE DATABASE " + name + " ENCODING " + encoding +
+		" LC_COLLATE 'C' LC_CTYPE 'C' TEMPLATE template0"); err != nil {
+		t.Skipf("unable to create the database of %s: %v", encoding, err)
+	}
+	t.Cleanup(func() { c.Query("DROP DATABASE IF EXISTS " + name) })
+	return dsn
+}
+
+func TestClientEncoding(t *testing.T) {
+	dsn := testDatabase(t, testConn(t), "pg2arrow_test_latin1", "LATIN1")
+
+	// whatever the dsn or the environment says, the text comes in UTF-8
+	t.Setenv("PGCLIENTENCODING", "LATIN1")
+	for _, dsn := range []string{dsn, dsn + " client_encoding=LATIN1", dsn + " options='-c client_encoding=WIN1252'"} {
+		c, err := Connect(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testSetting(t, c, "client_encoding"); got != "UTF8" {
+			t.Errorf("%s: got client_encoding %s, want UTF8", dsn, got)
+		}
+		_, recs := testQuery(t, c, "SELECT 'café Ünïcödé ÿ'::text AS t, 'ß'::char(3) AS c, 'ø'::varchar AS v, 'é'::name AS n")
+		want := []string{"café Ünïcödé ÿ", "ß", "ø", "é"}
+		for j, w := range want {
+			if got := recs[0].Column(j).(*array.String).Value(0); got != w {
+				t.Errorf("%s: column %d: got %q, want %q", dsn, j, got, w)
+			}
+		}
+		// beyond LATIN1
+		if _, err := c.Query("SELECT '日本'::text"); err == nil {
+			t.Errorf("%s: got no error of the character beyond LATIN1", dsn)
+		}
+		c.Close()
+	}
+}
+
+func TestClientEncodingSQLASCII(t *testing.T) {
+	dsn := testDatabase(t, testConn(t), "pg2arrow_test_ascii", "SQL_ASCII")
+	c, err := Connect(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// no encoding to transcode from; the bytes not of UTF-8 are an error
+	if got := testColumn(t, c, "SELECT 'café'::text").(*array.String).Value(0); got != "café" {
+		t.Errorf("got %q, want café", got)
+	}
+	if _, err := c.Query(`SELECT E'a\377b'::text`); err == nil {
+		t.Errorf("got no error of the bytes not of UTF-8")
+	}
+}
+
+// untimed returns a Conn sharing the connection of c, but without its
+// statement timeout, to look at the setting of the session as is. It must
+// not be closed.
+func untimed(t *testing.T, c *Conn) *Conn {
+	t.Helper()
+	cfg, err := newConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Conn{conn: c.conn, cfg: cfg, notices: c.notices,
+		enums: c.enums, postgis: c.postgis, session: c.session}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	t.Setenv("PGOPTIONS", "-c statement_timeout=7s")
+	c := testConn(t, WithStatementTimeout(100*time.Millisecond))
+	u := untimed(t, c)
+
+	if _, err := c.Query("SELECT pg_sleep(1)"); !errors.Is(err, ErrStatementTimeout) {
+		t.Errorf("got %v, want ErrStatementTimeout", err)
+	}
+	if got := testSetting(t, u, "statement_timeout"); got != "7s" {
+		t.Errorf("got statement_timeout %s after the timeout, want 7s", got)
+	}
+
+	// BEGIN opened by the query with the timeout; ROLLBACK undoes the
+	// restore in the block
+	for _, tc := range []struct {
+		name string
+		sqls []string
+	}{
+		{"commit", []string{"BEGIN", "SELECT 1", "COMMIT"}},
+		{"rollback", []string{"BEGIN", "SELECT 1", "ROLLBACK"}},
+		{"failed", []string{"BEGIN", "SELECT 1/0", "ROLLBACK"}},
+		{"caller", []string{"BEGIN", "SELECT 1", "ROLLBACK"}},
+	} {
+		for i, sql := range tc.sqls {
+			conn := c
+			if tc.name == "caller" && i == 0 {
+				conn = u // the block of the caller, restored by SET LOCAL
+			}
+			if _, err := conn.Query(sql); err != nil {
+				continue // nothing runs in the failed block
+			}
+			if got := testSetting(t, u, "statement_timeout"); got != "7s" {
+				t.Errorf("%s: got statement_timeout %s after %s, want 7s", tc.name, got, sql)
+			}
+		}
+	}
+
+	// so is by QueryMulti
+	m, err := c.QueryMulti("BEGIN; SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testExec(t, c, "ROLLBACK")
+	if got := testSetting(t, u, "statement_timeout"); got != "7s" {
+		t.Errorf("got statement_timeout %s after QueryMulti, want 7s", got)
+	}
+}
+
+func TestStatementTimeoutRestoreError(t *testing.T) {
+	l := new(testLogger)
+	c := testConn(t, WithStatementTimeout(time.Second), WithLogger(l))
+
+	// no SET of statement_timeout fails but by a broken connection, which
+	// is not restored, so the failure is put in the session as if it did
+	msg := "unable to restore statement_timeout: test\x00"
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&c.session.error[0])), len(msg)), msg)
+	testExec(t, c, "SELECT 1")
+	if warns := l.logged("warn", ""); len(warns) != 1 || warns[0].msg != "pg2arrow: statement_timeout not restored" {
+		t.Errorf("got warnings %v, want the failure to restore", warns)
+	}
+	if c.session.error[0] != 0 {
+		t.Errorf("got the failure not cleared")
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	c := testConn(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.QueryContext(ctx, "SELECT 1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled before the query", err)
+	}
+
+	// it returns as soon as ctx is done, then the server stops the query, so
+	// the Conn is usable right after
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.QueryContext(ctx, "SELECT pg_sleep(30)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	testExec(t, c, "SELECT 1")
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("took %v, want the query canceled", d)
+	}
+
+	if buf, err := c.QueryContext(context.Background(), "SELECT 1"); err != nil || len(buf) == 0 {
+		t.Errorf("got %v, want the result", err)
+	}
+}
+
+func TestQueryContextRace(t *testing.T) {
+	c := testConn(t)
+
+	// ctx done about when the query completes; the cancel request never
+	// reaches the next query
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%5)*time.Millisecond)
+		c.QueryContext(ctx, "SELECT pg_sleep(0.002)")
+		cancel()
+		if _, err := c.Query("SELECT pg_sleep(0.01)"); err != nil {
+			t.Fatalf("%d: the next query: %v", i, err)
+		}
+	}
+}
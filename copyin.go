@@ -0,0 +1,732 @@
+package pg2arrow
+
+// #include <stdlib.h>
+// #include "pg2arrow.h"
+import "C"
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// copyHeader is the header of the binary format of COPY; the signature,
+// the flags and the length of the header extension.
+const copyHeader = "PGCOPY\n\xff\r\n\x00" + "\x00\x00\x00\x00" + "\x00\x00\x00\x00"
+
+// copyChunkSize is the size of the COPY data sent at once.
+const copyChunkSize = 1 << 20
+
+// pgEpochDays and pgEpochMicros are the PostgreSQL epoch, 2000-01-01, since
+// the Unix epoch.
+const (
+	pgEpochDays   = 10957
+	pgEpochMicros = pgEpochDays * 86400 * 1000000
+)
+
+// CopyIn loads the record batches of the reader into the table by
+// COPY table (columns) FROM STDIN (FORMAT binary), then returns the number
+// of rows loaded. The columns are the fields of the schema of the reader,
+// by name. The table is put in the command as is, so it may be qualified
+// by the schema like "public.t", and must be quoted if necessary. The
+// reader must be of another Conn, because this one is busy by the COPY;
+// it is read to the end, but not closed.
+//
+// Each value is converted to the binary format of the type of the table
+// column, which is the reverse of the mapping of Query:
+//
+//   - bool from Boolean
+//   - int2, int4 and int8 from any integers; out of range is an error
+//   - float4 from Float32, and float8 from Float32 or Float64
+//   - numeric from Decimal128, and money from Decimal128 of scale 2 or less
+//   - text, varchar, char(n), name, json and enum from Utf8
+//   - jsonb from Utf8, or Binary of the wire format like WithJSONMode
+//   - bytea from Binary or FixedSizeBinary
+//   - uuid from FixedSizeBinary(16), or Utf8 of the text form
+//   - date from Date32 or Date64, and time from Time32 or Time64
+//   - timestamp and timestamptz from Timestamp of any unit; INT64 max and
+//     min are infinity and -infinity
+//   - interval from Interval(MonthDayNano); below microseconds are truncated
+//   - arrays from List, and composite types from Struct of the same fields
+//
+// Dictionary of any of them is decoded by its values, and a domain column
+// by the conversion of its base type. Any other pair is an error, like the
+// types without the binary format known by pg2arrow, which Query casts to
+// text; they are checked before the COPY begins, so nothing is sent.
+//
+// If any batch fails to read or to convert, the COPY is aborted, so none
+// of the rows are loaded; in a transaction block of the caller, it is
+// aborted too.
+func (c *Conn) CopyIn(table string, reader *RecordReader) (rowsAffected int64, err error) {
+	r := &recordStream{r: reader, buf: reader.Schema()}
+	rdr, err := ipc.NewReader(r, ipc.WithAllocator(c.cfg.allocator))
+	if err != nil {
+		return 0, r.wrapErr(err)
+	}
+	defer rdr.Release()
+
+	schema := rdr.Schema()
+	if schema.NumFields() == 0 {
+		return 0, fmt.Errorf("pg2arrow: no columns to copy")
+	}
+	cols := make([]string, schema.NumFields())
+	for j, f := range schema.Fields() {
+		cols[j] = quoteIdent(f.Name)
+	}
+	list := strings.Join(cols, ", ")
+	target, err := c.DescribeQuery("SELECT " + list + " FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.checkEncoders(target, schema); err != nil {
+		return 0, err
+	}
+	command := C.CString("COPY " + table + " (" + list + ") FROM STDIN (FORMAT binary)")
+	defer C.free(unsafe.Pointer(command))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return 0, ErrConnClosed
+	}
+	var errinfo C.ErrorInfo
+	if C.pgsql_begin_copy_in(c.conn, command, &errinfo) != 0 {
+		return 0, newQueryError(&errinfo)
+	}
+
+	buf := []byte(copyHeader)
+	for rdr.Next() {
+		buf, err = c.copyRecord(buf, target, rdr.Record())
+		if err != nil {
+			return 0, c.abortCopyIn(err)
+		}
+	}
+	if err := rdr.Err(); err != nil && err != io.EOF {
+		return 0, c.abortCopyIn(r.wrapErr(err))
+	}
+	buf = binary.BigEndian.AppendUint16(buf, math.MaxUint16) // trailer
+	if err := c.putCopyData(buf); err != nil {
+		return 0, c.abortCopyIn(err)
+	}
+	n := C.pgsql_end_copy_in(c.conn, nil, &errinfo)
+	if n < 0 {
+		return 0, newQueryError(&errinfo)
+	}
+	return int64(n), nil
+}
+
+// checkEncoders tells whether every field of the schema converts to its
+// target column, by the empty arrays of the fields, so a column of no known
+// binary format, like the one cast to text by Query, is an error before the
+// COPY begins.
+func (c *Conn) checkEncoders(target, schema *arrow.Schema) error {
+	for j, f := range schema.Fields() {
+		col := array.MakeArrayOfNull(c.cfg.allocator, f.Type, 0)
+		_, err := newEncoder(target.Field(j), col)
+		col.Release()
+		if err != nil {
+			return fmt.Errorf("pg2arrow: unable to copy column %q: %w",
+				target.Field(j).Name, err)
+		}
+	}
+	return nil
+}
+
+// copyRecord appends the rows of the record in the binary format of COPY,
+// sending the data to the server chunk by chunk. It returns the data not
+// sent yet.
+func (c *Conn) copyRecord(buf []byte, target *arrow.Schema, rec arrow.Record) ([]byte, error) {
+	encs := make([]encoder, rec.NumCols())
+	for j, col := range rec.Columns() {
+		enc, err := newEncoder(target.Field(j), col)
+		if err != nil {
+			return nil, fmt.Errorf("pg2arrow: unable to copy column %q: %w",
+				target.Field(j).Name, err)
+		}
+		encs[j] = enc
+	}
+
+	var err error
+	for row := 0; row < int(rec.NumRows()); row++ {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(encs)))
+		for j, col := range rec.Columns() {
+			buf, err = appendValue(buf, col, encs[j], row)
+			if err != nil {
+				return nil, fmt.Errorf("pg2arrow: unable to copy column %q: %w",
+					target.Field(j).Name, err)
+			}
+		}
+		if len(buf) >= copyChunkSize {
+			if err := c.putCopyData(buf); err != nil {
+				return nil, err
+			}
+			buf = buf[:0]
+		}
+	}
+	return buf, nil
+}
+
+// putCopyData sends the COPY data to the server.
+func (c *Conn) putCopyData(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	var errinfo C.ErrorInfo
+	if C.pgsql_put_copy_data(c.conn, (*C.char)(unsafe.Pointer(&buf[0])),
+		C.size_t(len(buf)), &errinfo) != 0 {
+		return newQueryError(&errinfo)
+	}
+	return nil
+}
+
+// abortCopyIn makes the COPY fail by the error, so the server discards the
+// rows sent so far, then returns the error as is.
+func (c *Conn) abortCopyIn(err error) error {
+	msg := C.CString(err.Error())
+	defer C.free(unsafe.Pointer(msg))
+
+	var errinfo C.ErrorInfo
+	C.pgsql_end_copy_in(c.conn, msg, &errinfo)
+	return err
+}
+
+// recordStream reads the messages of the RecordReader as an Arrow IPC
+// stream, for the readers of the Arrow library.
+type recordStream struct {
+	r   *RecordReader
+	buf []byte
+	err error // of the RecordReader; io.EOF after the end-of-stream marker
+}
+
+func (s *recordStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.buf, s.err = s.r.Next()
+		if s.err == io.EOF {
+			s.buf = []byte(ipcEOS)
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// wrapErr returns the error of the RecordReader instead, if any, because
+// the Arrow reader only tells it failed to read.
+func (s *recordStream) wrapErr(err error) error {
+	if s.err != nil && s.err != io.EOF {
+		return s.err
+	}
+	return err
+}
+
+// encoder appends the binary format of the value at the row of the
+// column, which is not NULL.
+type encoder func(buf []byte, row int) ([]byte, error)
+
+// appendValue appends the value at the row of the column with its length,
+// or the length of -1 if NULL.
+func appendValue(buf []byte, col arrow.Array, enc encoder, row int) ([]byte, error) {
+	if col.IsNull(row) {
+		return binary.BigEndian.AppendUint32(buf, math.MaxUint32), nil
+	}
+	pos := len(buf)
+	buf, err := enc(append(buf, 0, 0, 0, 0), row)
+	if err != nil {
+		return nil, err
+	}
+	n := len(buf) - pos - 4
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("value of %d bytes is too large", n)
+	}
+	binary.BigEndian.PutUint32(buf[pos:], uint32(n))
+	return buf, nil
+}
+
+// newEncoder returns the encoder of the column to the PostgreSQL type of
+// the target field, which is described by DescribeQuery.
+func newEncoder(target arrow.Field, col arrow.Array) (encoder, error) {
+	if d, ok := col.(*array.Dictionary); ok {
+		enc, err := newEncoder(target, d.Dictionary())
+		if err != nil {
+			return nil, err
+		}
+		return func(buf []byte, row int) ([]byte, error) {
+			return enc(buf, d.GetValueIndex(row))
+		}, nil
+	}
+
+	typname := fieldMetadata(target, "pg_typname")
+	var enc encoder
+	switch typname {
+	case "bool":
+		enc = boolEncoder(col)
+	case "int2":
+		enc = intEncoder(col, 16)
+	case "int4":
+		enc = intEncoder(col, 32)
+	case "int8":
+		enc = intEncoder(col, 64)
+	case "float4":
+		if a, ok := col.(*array.Float32); ok {
+			enc = func(buf []byte, row int) ([]byte, error) {
+				return binary.BigEndian.AppendUint32(buf, math.Float32bits(a.Value(row))), nil
+			}
+		}
+	case "float8":
+		enc = float8Encoder(col)
+	case "numeric":
+		enc = numericEncoder(col)
+	case "money":
+		enc = moneyEncoder(col)
+	case "text", "varchar", "bpchar", "name", "unknown":
+		enc = textEncoder(col)
+	case "json":
+		if enc = textEncoder(col); enc == nil {
+			enc = byteaEncoder(col)
+		}
+	case "jsonb":
+		if enc = textEncoder(col); enc != nil {
+			text := enc
+			enc = func(buf []byte, row int) ([]byte, error) {
+				return text(append(buf, 1), row) // version of the format
+			}
+		} else {
+			enc = byteaEncoder(col)
+		}
+	case "bytea":
+		enc = byteaEncoder(col)
+	case "uuid":
+		enc = uuidEncoder(col)
+	case "date":
+		enc = dateEncoder(col)
+	case "time":
+		enc = timeEncoder(col)
+	case "timestamp", "timestamptz":
+		enc = timestampEncoder(col)
+	case "interval":
+		enc = intervalEncoder(col)
+	default:
+		switch t := target.Type.(type) {
+		case *arrow.ListType:
+			if a, ok := col.(*array.List); ok {
+				return arrayEncoder(t.ElemField(), a)
+			}
+		case *arrow.StructType:
+			if a, ok := col.(*array.Struct); ok && a.NumField() == t.NumFields() {
+				return recordEncoder(t, a)
+			}
+		case *arrow.DictionaryType:
+			enc = textEncoder(col) // labels of the enum
+		}
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("no conversion from %s to %s", col.DataType(), typname)
+	}
+	return enc, nil
+}
+
+// fieldMetadata returns the value of the custom metadata of the field, or
+// an empty string if none.
+func fieldMetadata(f arrow.Field, key string) string {
+	if i := f.Metadata.FindKey(key); i >= 0 {
+		return f.Metadata.Values()[i]
+	}
+	return ""
+}
+
+// fieldOid returns the type OID of the field, for the binary format of
+// the arrays and the composite types.
+func fieldOid(f arrow.Field) (uint32, error) {
+	oid, err := strconv.ParseUint(fieldMetadata(f, "pg_oid"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("no type OID of field %q", f.Name)
+	}
+	return uint32(oid), nil
+}
+
+func boolEncoder(col arrow.Array) encoder {
+	a, ok := col.(*array.Boolean)
+	if !ok {
+		return nil
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		if a.Value(row) {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	}
+}
+
+func intEncoder(col arrow.Array, bits int) encoder {
+	var value func(row int) (v int64, ok bool)
+	switch a := col.(type) {
+	case *array.Int8:
+		value = func(row int) (int64, bool) { return int64(a.Value(row)), true }
+	case *array.Int16:
+		value = func(row int) (int64, bool) { return int64(a.Value(row)), true }
+	case *array.Int32:
+		value = func(row int) (int64, bool) { return int64(a.Value(row)), true }
+	case *array.Int64:
+		value = func(row int) (int64, bool) { return a.Value(row), true }
+	case *array.Uint8:
+		value = func(row int) (int64, bool) { return int64(a.Value(row)), true }
+	case *array.Uint16:
+		value = func(row int) (int64, bool) { return int64(a.Value(row)), true }
+	case *array.Uint32:
+		value = func(row int) (int64, bool) { return int64(a.Value(row)), true }
+	case *array.Uint64:
+		value = func(row int) (int64, bool) {
+			v := a.Value(row)
+			return int64(v), v <= math.MaxInt64
+		}
+	default:
+		return nil
+	}
+
+	max := int64(math.MaxInt64 >> (64 - bits))
+	min := -max - 1
+	return func(buf []byte, row int) ([]byte, error) {
+		v, ok := value(row)
+		if !ok || v < min || v > max {
+			return nil, fmt.Errorf("value %s is out of range of int%d", col.ValueStr(row), bits/8)
+		}
+		switch bits {
+		case 16:
+			return binary.BigEndian.AppendUint16(buf, uint16(v)), nil
+		case 32:
+			return binary.BigEndian.AppendUint32(buf, uint32(v)), nil
+		}
+		return binary.BigEndian.AppendUint64(buf, uint64(v)), nil
+	}
+}
+
+func float8Encoder(col arrow.Array) encoder {
+	switch a := col.(type) {
+	case *array.Float32:
+		return func(buf []byte, row int) ([]byte, error) {
+			return binary.BigEndian.AppendUint64(buf, math.Float64bits(float64(a.Value(row)))), nil
+		}
+	case *array.Float64:
+		return func(buf []byte, row int) ([]byte, error) {
+			return binary.BigEndian.AppendUint64(buf, math.Float64bits(a.Value(row))), nil
+		}
+	}
+	return nil
+}
+
+func numericEncoder(col arrow.Array) encoder {
+	a, ok := col.(*array.Decimal128)
+	if !ok {
+		return nil
+	}
+	scale := int(a.DataType().(*arrow.Decimal128Type).Scale)
+	return func(buf []byte, row int) ([]byte, error) {
+		v := a.Value(row).BigInt()
+		neg := v.Sign() < 0
+		return appendNumeric(buf, v.Abs(v).String(), neg, scale), nil
+	}
+}
+
+// appendNumeric appends the numeric of the decimal digits, scaled by the
+// scale. The binary format is the number of the base-10000 digits, the
+// weight of the first one, the sign, the display scale, then the digits.
+func appendNumeric(buf []byte, digits string, neg bool, scale int) []byte {
+	if scale < 0 {
+		digits += strings.Repeat("0", -scale)
+		scale = 0
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	ipart := digits[:len(digits)-scale]
+	fpart := digits[len(digits)-scale:]
+	ipart = strings.Repeat("0", (4-len(ipart)%4)%4) + ipart
+	fpart += strings.Repeat("0", (4-len(fpart)%4)%4)
+
+	weight := len(ipart)/4 - 1
+	var groups []uint16
+	for s := ipart + fpart; s != ""; s = s[4:] {
+		n, _ := strconv.Atoi(s[:4])
+		groups = append(groups, uint16(n))
+	}
+	for len(groups) > 0 && groups[0] == 0 {
+		groups = groups[1:]
+		weight--
+	}
+	for len(groups) > 0 && groups[len(groups)-1] == 0 {
+		groups = groups[:len(groups)-1]
+	}
+	var sign uint16
+	if len(groups) == 0 {
+		weight = 0
+	} else if neg {
+		sign = 0x4000
+	}
+
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(groups)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(int16(weight)))
+	buf = binary.BigEndian.AppendUint16(buf, sign)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(scale))
+	for _, g := range groups {
+		buf = binary.BigEndian.AppendUint16(buf, g)
+	}
+	return buf
+}
+
+func moneyEncoder(col arrow.Array) encoder {
+	a, ok := col.(*array.Decimal128)
+	if !ok {
+		return nil
+	}
+	scale := a.DataType().(*arrow.Decimal128Type).Scale
+	if scale > 2 {
+		return nil
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		v, err := a.Value(row).Rescale(scale, 2)
+		if err != nil || !v.BigInt().IsInt64() {
+			return nil, fmt.Errorf("value %s is out of range of money", col.ValueStr(row))
+		}
+		return binary.BigEndian.AppendUint64(buf, uint64(v.BigInt().Int64())), nil
+	}
+}
+
+func textEncoder(col arrow.Array) encoder {
+	switch a := col.(type) {
+	case *array.String:
+		return func(buf []byte, row int) ([]byte, error) {
+			return append(buf, a.Value(row)...), nil
+		}
+	case *array.LargeString:
+		return func(buf []byte, row int) ([]byte, error) {
+			return append(buf, a.Value(row)...), nil
+		}
+	}
+	return nil
+}
+
+func byteaEncoder(col arrow.Array) encoder {
+	switch a := col.(type) {
+	case *array.Binary:
+		return func(buf []byte, row int) ([]byte, error) {
+			return append(buf, a.Value(row)...), nil
+		}
+	case *array.LargeBinary:
+		return func(buf []byte, row int) ([]byte, error) {
+			return append(buf, a.Value(row)...), nil
+		}
+	case *array.FixedSizeBinary:
+		return func(buf []byte, row int) ([]byte, error) {
+			return append(buf, a.Value(row)...), nil
+		}
+	}
+	return nil
+}
+
+func uuidEncoder(col arrow.Array) encoder {
+	switch a := col.(type) {
+	case *array.FixedSizeBinary:
+		if a.DataType().(*arrow.FixedSizeBinaryType).ByteWidth != 16 {
+			return nil
+		}
+		return func(buf []byte, row int) ([]byte, error) {
+			return append(buf, a.Value(row)...), nil
+		}
+	case *array.String:
+		return func(buf []byte, row int) ([]byte, error) {
+			s := strings.ReplaceAll(a.Value(row), "-", "")
+			b, err := hex.DecodeString(s)
+			if err != nil || len(b) != 16 {
+				return nil, fmt.Errorf("invalid uuid %q", a.Value(row))
+			}
+			return append(buf, b...), nil
+		}
+	}
+	return nil
+}
+
+func dateEncoder(col arrow.Array) encoder {
+	var value func(row int) int64 // days since the Unix epoch
+	switch a := col.(type) {
+	case *array.Date32:
+		value = func(row int) int64 { return int64(a.Value(row)) }
+	case *array.Date64:
+		value = func(row int) int64 { return floorDiv(int64(a.Value(row)), 86400000) }
+	default:
+		return nil
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		v := value(row) - pgEpochDays
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("value %s is out of range of date", col.ValueStr(row))
+		}
+		return binary.BigEndian.AppendUint32(buf, uint32(v)), nil
+	}
+}
+
+func timeEncoder(col arrow.Array) encoder {
+	var value func(row int) int64 // microseconds since midnight
+	switch a := col.(type) {
+	case *array.Time32:
+		mul := int64(1000000)
+		if a.DataType().(*arrow.Time32Type).Unit == arrow.Millisecond {
+			mul = 1000
+		}
+		value = func(row int) int64 { return int64(a.Value(row)) * mul }
+	case *array.Time64:
+		div := int64(1)
+		if a.DataType().(*arrow.Time64Type).Unit == arrow.Nanosecond {
+			div = 1000
+		}
+		value = func(row int) int64 { return int64(a.Value(row)) / div }
+	default:
+		return nil
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		return binary.BigEndian.AppendUint64(buf, uint64(value(row))), nil
+	}
+}
+
+func timestampEncoder(col arrow.Array) encoder {
+	a, ok := col.(*array.Timestamp)
+	if !ok {
+		return nil
+	}
+	unit := a.DataType().(*arrow.TimestampType).Unit
+	mul := int64(1)
+	switch unit {
+	case arrow.Second:
+		mul = 1000000
+	case arrow.Millisecond:
+		mul = 1000
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		v := int64(a.Value(row))
+		if v == math.MaxInt64 || v == math.MinInt64 {
+			// infinity or -infinity
+			return binary.BigEndian.AppendUint64(buf, uint64(v)), nil
+		}
+		usecs := v * mul
+		if unit == arrow.Nanosecond {
+			usecs = floorDiv(v, 1000)
+		} else if v > math.MaxInt64/mul || v < math.MinInt64/mul {
+			return nil, fmt.Errorf("value %s is out of range of timestamp", col.ValueStr(row))
+		}
+		if usecs < math.MinInt64+pgEpochMicros {
+			return nil, fmt.Errorf("value %s is out of range of timestamp", col.ValueStr(row))
+		}
+		return binary.BigEndian.AppendUint64(buf, uint64(usecs-pgEpochMicros)), nil
+	}
+}
+
+func intervalEncoder(col arrow.Array) encoder {
+	a, ok := col.(*array.MonthDayNanoInterval)
+	if !ok {
+		return nil
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		v := a.Value(row)
+		usecs := v.Nanoseconds / 1000
+		if v.Nanoseconds == math.MaxInt64 || v.Nanoseconds == math.MinInt64 {
+			usecs = v.Nanoseconds // infinity or -infinity
+		}
+		buf = binary.BigEndian.AppendUint64(buf, uint64(usecs))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(v.Days))
+		return binary.BigEndian.AppendUint32(buf, uint32(v.Months)), nil
+	}
+}
+
+// arrayEncoder returns the encoder of the one-dimensional arrays of the
+// elements of the target field.
+func arrayEncoder(elem arrow.Field, a *array.List) (encoder, error) {
+	oid, err := fieldOid(elem)
+	if err != nil {
+		return nil, err
+	}
+	values := a.ListValues()
+	enc, err := newEncoder(elem, values)
+	if err != nil {
+		return nil, err
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		start, end := a.ValueOffsets(row)
+		var ndim, hasnull uint32
+		if end > start {
+			ndim = 1
+		}
+		for i := start; i < end; i++ {
+			if values.IsNull(int(i)) {
+				hasnull = 1
+				break
+			}
+		}
+		buf = binary.BigEndian.AppendUint32(buf, ndim)
+		buf = binary.BigEndian.AppendUint32(buf, hasnull)
+		buf = binary.BigEndian.AppendUint32(buf, oid)
+		if ndim > 0 {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(end-start))
+			buf = binary.BigEndian.AppendUint32(buf, 1) // lower bound
+		}
+		var err error
+		for i := start; i < end; i++ {
+			buf, err = appendValue(buf, values, enc, int(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}, nil
+}
+
+// recordEncoder returns the encoder of the composite type of the fields,
+// which are matched by position.
+func recordEncoder(t *arrow.StructType, a *array.Struct) (encoder, error) {
+	n := t.NumFields()
+	oids := make([]uint32, n)
+	encs := make([]encoder, n)
+	for j, f := range t.Fields() {
+		oid, err := fieldOid(f)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := newEncoder(f, a.Field(j))
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", f.Name, err)
+		}
+		oids[j], encs[j] = oid, enc
+	}
+	return func(buf []byte, row int) ([]byte, error) {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		var err error
+		for j := range encs {
+			buf = binary.BigEndian.AppendUint32(buf, oids[j])
+			buf, err = appendValue(buf, a.Field(j), encs[j], row)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", t.Field(j).Name, err)
+			}
+		}
+		return buf, nil
+	}, nil
+}
+
+// floorDiv divides x by y rounding toward negative infinity, like the
+// dates and the times before the epoch.
+func floorDiv(x, y int64) int64 {
+	q := x / y
+	if (x%y != 0) && ((x < 0) != (y < 0)) {
+		q--
+	}
+	return q
+}
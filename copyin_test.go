@@ -0,0 +1,176 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+)
+
+func TestCopyIn(t *testing.T) {
+	c := testConn(t)
+	testTable(t, c, "pg2arrow_test_copy", "k int, v text, n numeric(10,2)")
+
+	r, err := testConn(t, WithBatchSize(100)).QueryStream(
+		"SELECT i AS k, 'v' || i AS v, i / 8.0 AS n FROM generate_series(1, 1000) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n, err := c.CopyIn("pg2arrow_test_copy", r); err != nil || n != 1000 {
+		t.Fatalf("CopyIn: got %d rows, %v", n, err)
+	}
+	got := testColumn(t, c, "SELECT count(*) FROM pg2arrow_test_copy "+
+		"WHERE v = 'v' || k AND n = round(k / 8.0, 2)").(*array.Int64).Value(0)
+	if got != 1000 {
+		t.Errorf("got %d rows of the values, want 1000", got)
+	}
+}
+
+func TestCopyInAbort(t *testing.T) {
+	c := testConn(t)
+	testTable(t, c, "pg2arrow_test_copy", "k int2, v text")
+	src := testConn(t, WithBatchSize(10))
+
+	// the value out of range in the last batch, after 2MB of the rows sent
+	// to the server, beyond copyChunkSize
+	const sql = "SELECT CASE WHEN i = 195 THEN 100000 ELSE i END AS k, repeat('x', 10000) AS v " +
+		"FROM generate_series(1, 200) i"
+	for _, block := range []bool{false, true} {
+		if block {
+			testExec(t, c, "BEGIN")
+		}
+		r, err := src.QueryStream(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.CopyIn("pg2arrow_test_copy", r)
+		r.Close()
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("block %v: got %v, want the value out of range", block, err)
+		}
+		if block {
+			// the block of the caller is aborted too
+			if _, err := c.Query("SELECT 1"); err == nil {
+				t.Errorf("got the block not aborted")
+			}
+			testExec(t, c, "ROLLBACK")
+		}
+		if got := testColumn(t, c, "SELECT count(*) FROM pg2arrow_test_copy").(*array.Int64).Value(0); got != 0 {
+			t.Errorf("block %v: got %d rows loaded, want none", block, got)
+		}
+	}
+}
+
+func TestCopyInUnsupported(t *testing.T) {
+	c := testConn(t)
+	testTable(t, c, "pg2arrow_test_copy", "k int, r int4range")
+
+	// a column cast to text by Query is rejected before the COPY begins
+	r, err := testConn(t).QueryStream("SELECT 1 AS k, int4range(1, 5) AS r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = c.CopyIn("pg2arrow_test_copy", r)
+	if err == nil || !strings.Contains(err.Error(), `unable to copy column "r"`) {
+		t.Errorf("got %v, want column r unable to copy", err)
+	}
+	if got := testColumn(t, c, "SELECT count(*) FROM pg2arrow_test_copy").(*array.Int64).Value(0); got != 0 {
+		t.Errorf("got %d rows loaded, want none", got)
+	}
+}
+
+// numericWire returns the binary format of numeric.
+func numericWire(weight int16, sign, dscale uint16, groups ...uint16) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(groups)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(weight))
+	buf = binary.BigEndian.AppendUint16(buf, sign)
+	buf = binary.BigEndian.AppendUint16(buf, dscale)
+	for _, g := range groups {
+		buf = binary.BigEndian.AppendUint16(buf, g)
+	}
+	return buf
+}
+
+func TestAppendNumeric(t *testing.T) {
+	for _, tc := range []struct {
+		digits string
+		neg    bool
+		scale  int
+		want   []byte
+	}{
+		{"12345678", false, 2, numericWire(1, 0, 2, 12, 3456, 7800)}, // 123456.78
+		{"12345678", true, 0, numericWire(1, 0x4000, 0, 1234, 5678)}, // -12345678
+		{"0", false, 0, numericWire(0, 0, 0)},                        // 0
+		{"0", true, 3, numericWire(0, 0, 3)},                         // -0.000 is 0
+		{"5", false, 6, numericWire(-2, 0, 6, 500)},                  // 0.000005
+		{"15", true, 1, numericWire(0, 0x4000, 1, 1, 5000)},          // -1.5
+		{"12", false, -5, numericWire(1, 0, 0, 120)},                 // 1200000
+		{"100000000", false, 0, numericWire(2, 0, 0, 1)},             // 10^8
+		{"1", false, 38, numericWire(-10, 0, 38, 100)},               // 10^-38
+		{"99999999999999999999", false, 20, numericWire(-1, 0, 20, 9999, 9999, 9999, 9999, 9999)},
+	} {
+		if got := appendNumeric(nil, tc.digits, tc.neg, tc.scale); !bytes.Equal(got, tc.want) {
+			t.Errorf("appendNumeric(%q, %v, %d) = %x, want %x", tc.digits, tc.neg, tc.scale, got, tc.want)
+		}
+	}
+}
+
+func TestTimestampEncoder(t *testing.T) {
+	mem := memory.NewGoAllocator()
+	encode := func(unit arrow.TimeUnit, v int64) (int64, error) {
+		b := array.NewTimestampBuilder(mem, &arrow.TimestampType{Unit: unit})
+		defer b.Release()
+		b.Append(arrow.Timestamp(v))
+		a := b.NewArray()
+		defer a.Release()
+
+		buf, err := timestampEncoder(a)(nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.BigEndian.Uint64(buf)), nil
+	}
+
+	// microseconds since 2000-01-01 of any unit, rounded down
+	for _, tc := range []struct {
+		unit arrow.TimeUnit
+		v    int64
+		want int64
+	}{
+		{arrow.Second, 0, -pgEpochMicros},
+		{arrow.Second, 1, 1000000 - pgEpochMicros},
+		{arrow.Millisecond, -1, -1000 - pgEpochMicros},
+		{arrow.Microsecond, pgEpochMicros, 0},
+		{arrow.Nanosecond, -1, -1 - pgEpochMicros},
+		{arrow.Nanosecond, 1999, 1 - pgEpochMicros},
+		{arrow.Second, math.MaxInt64, math.MaxInt64}, // infinity
+		{arrow.Nanosecond, math.MinInt64, math.MinInt64},
+	} {
+		got, err := encode(tc.unit, tc.v)
+		if err != nil || got != tc.want {
+			t.Errorf("%s %d: got %d, %v, want %d", tc.unit, tc.v, got, err, tc.want)
+		}
+	}
+
+	// beyond int64 of microseconds, or of the PostgreSQL epoch
+	for _, tc := range []struct {
+		unit arrow.TimeUnit
+		v    int64
+	}{
+		{arrow.Second, math.MaxInt64/1000000 + 1},
+		{arrow.Second, math.MinInt64/1000000 - 1},
+		{arrow.Millisecond, math.MaxInt64/1000 + 1},
+		{arrow.Microsecond, math.MinInt64 + 1},
+	} {
+		if _, err := encode(tc.unit, tc.v); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s %d: got %v, want out of range", tc.unit, tc.v, err)
+		}
+	}
+}
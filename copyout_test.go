@@ -0,0 +1,67 @@
+package pg2arrow
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// copyOutQuery has the types of every binary receiver, with NULLs, so the
+// rows by COPY are compared with those of the extended query protocol.
+const copyOutQuery = `SELECT i, 'v' || i AS s, i::numeric / 3 AS n, i % 2 = 0 AS b,
+       timestamptz '2024-01-02 03:04:05+00' + i * interval '1 hour' AS ts,
+       ARRAY[i, NULL, -i] AS a, ('{"k": ' || i || '}')::jsonb AS j,
+       md5(i::text)::uuid AS u, CASE WHEN i % 3 <> 0 THEN i END AS z
+  FROM generate_series(1, 10) i`
+
+func TestCopyOut(t *testing.T) {
+	c := testConn(t, WithBatchSize(3))
+
+	r, err := c.CopyOut(copyOutQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, recs := testReader(t, copyOutQuery, r)
+	wantSchema, want := testStream(t, c, copyOutQuery)
+	if !schema.Equal(wantSchema) {
+		t.Fatalf("got the schema %v, want %v", schema, wantSchema)
+	}
+	if len(recs) != len(want) || len(recs) != 4 {
+		t.Fatalf("got %d record batches, want %d of QueryStream", len(recs), len(want))
+	}
+	for k := range recs {
+		if !array.RecordEqual(recs[k], want[k]) {
+			t.Errorf("batch %d: got %v, want %v", k, recs[k], want[k])
+		}
+	}
+	// the command tag of COPY has the number of rows too
+	if st := r.Stats(); st.Rows != 10 || st.CommandRows != 10 {
+		t.Errorf("got %d rows and %d by the command tag, want 10 and 10", st.Rows, st.CommandRows)
+	}
+}
+
+func TestCopyOutError(t *testing.T) {
+	c := testConn(t, WithBatchSize(2))
+
+	// not a source of COPY
+	var qe *QueryError
+	if _, err := c.CopyOut("SET search_path = public"); !errors.As(err, &qe) {
+		t.Errorf("got %v, want QueryError", err)
+	}
+
+	// the division by zero fails after a few batches
+	r, err := c.CopyOut("SELECT 1 / (i - 7) AS r FROM generate_series(1, 10) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrows, err := testRows(t, r)
+	if !errors.As(err, &qe) || qe.SQLState != "22012" {
+		t.Errorf("got %v, want the division by zero", err)
+	}
+	if nrows >= 7 {
+		t.Errorf("got %d rows, want those before the failure", nrows)
+	}
+	// the Conn is released
+	testExec(t, c, "SELECT 1")
+}
@@ -0,0 +1,50 @@
+package pg2arrow
+
+// #include <stdlib.h>
+// #include "pg2arrow.h"
+import "C"
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// DescribeQuery returns the schema of the result of the SQL command,
+// without running it; the statement is prepared and described only. The
+// fields are the same as Query would produce.
+func (c *Conn) DescribeQuery(sql string) (*arrow.Schema, error) {
+	cs := C.CString(sql)
+	defer C.free(unsafe.Pointer(cs))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil, ErrConnClosed
+	}
+	opts, free := c.options()
+	defer free()
+	var errinfo C.ErrorInfo
+	table := C.pgsql_describe_query(c.conn, cs, &opts, &errinfo)
+	if table == nil {
+		return nil, newQueryError(&errinfo)
+	}
+	defer C.pgsql_close_query(table)
+
+	out := &table.output
+	return readSchema(C.GoBytes(unsafe.Pointer(out.ptr), C.int(out.usage)))
+}
+
+// readSchema decodes the schema message built by the C code.
+func readSchema(buf []byte) (*arrow.Schema, error) {
+	rdr, err := ipc.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("pg2arrow: invalid schema message: %w", err)
+	}
+	defer rdr.Release()
+
+	return rdr.Schema(), nil
+}
@@ -0,0 +1,43 @@
+package pg2arrow
+
+import "io"
+
+// QueryEach runs the SQL command, then calls fn with each record batch
+// message of its result as soon as the C code builds it, on the calling
+// goroutine; unlike QueryStream, no batch is fetched ahead. The first
+// batch is preceded by the schema message and the dictionary batches, and
+// each batch by the delta dictionary batches of its new values, so the
+// batches form an Arrow IPC stream in order. A result without rows calls
+// fn once with the schema message and the dictionary batches only.
+//
+// The batch aliases the buffer of the C code, and is valid only until fn
+// returns; fn must copy it to retain. If fn returns an error, the query
+// still in progress is canceled, then QueryEach returns the error as is.
+func (c *Conn) QueryEach(sql string, fn func(batch []byte) error) error {
+	s, err := c.openStream(sql, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	header := s.header()
+	for {
+		b, err := s.nextView()
+		if err == io.EOF {
+			if header != nil {
+				return fn(header)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			b = append(header, b...)
+			header = nil
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+}
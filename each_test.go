@@ -0,0 +1,96 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// testEach runs the SQL command by QueryEach, then returns the number of
+// the calls of fn, and the IPC stream of the batches followed by the
+// end-of-stream marker.
+func testEach(t *testing.T, c *Conn, sql string) (int, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	calls := 0
+	err := c.QueryEach(sql, func(b []byte) error {
+		calls++
+		buf.Write(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	buf.WriteString(ipcEOS)
+	return calls, buf.Bytes()
+}
+
+func TestQueryEach(t *testing.T) {
+	c := testConn(t, WithBatchSize(4))
+	_, want := testStream(t, c, nullsQuery)
+
+	// the batches, the first one preceded by the schema, form a stream
+	calls, buf := testEach(t, c, nullsQuery)
+	if calls != len(want) {
+		t.Errorf("got %d calls, want one for each of %d batches", calls, len(want))
+	}
+	rdr, err := ipc.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("invalid Arrow stream: %v", err)
+	}
+	defer rdr.Release()
+	k := 0
+	for ; rdr.Next(); k++ {
+		if k >= len(want) || !array.RecordEqual(rdr.Record(), want[k]) {
+			t.Errorf("batch %d differs from QueryStream", k)
+		}
+	}
+	if err := rdr.Err(); err != nil || k != len(want) {
+		t.Errorf("got %d record batches and %v, want %d", k, err, len(want))
+	}
+
+	// no rows is one call of the schema only
+	calls, buf = testEach(t, c, "SELECT i FROM generate_series(1, 10) i WHERE false")
+	if calls != 1 {
+		t.Errorf("got %d calls of no rows, want 1", calls)
+	}
+	rdr, err = ipc.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("invalid Arrow stream of no rows: %v", err)
+	}
+	defer rdr.Release()
+	if rdr.Next() || rdr.Schema().NumFields() != 1 {
+		t.Errorf("got a record batch, or the schema of %d fields", rdr.Schema().NumFields())
+	}
+}
+
+func TestQueryEachError(t *testing.T) {
+	c := testConn(t, WithBatchSize(1000))
+
+	// the error of fn stops the query still in progress, and is returned
+	// as is
+	errStop := errors.New("stop")
+	calls := 0
+	start := time.Now()
+	err := c.QueryEach("SELECT generate_series(1, 100000000) AS i", func([]byte) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("got %v of %d calls, want the error of fn at once", err, calls)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("took %v, want the query stopped", d)
+	}
+
+	var qe *QueryError
+	if err := c.QueryEach("SELECT 1 / (i - 7) AS r FROM generate_series(1, 10) i",
+		func([]byte) error { return nil }); !errors.As(err, &qe) || qe.SQLState != "22012" {
+		t.Errorf("got %v, want the division by zero", err)
+	}
+	testExec(t, c, "SELECT 1")
+}
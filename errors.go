@@ -0,0 +1,126 @@
+package pg2arrow
+
+// #include "pg2arrow.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrConnClosed is returned when the connection is already closed.
+var ErrConnClosed = errors.New("pg2arrow: connection is closed")
+
+// ErrReaderClosed is returned by RecordReader.Next, or the Read of
+// QueryReader, after Close.
+var ErrReaderClosed = errors.New("pg2arrow: reader is closed")
+
+// ErrWriterClosed is returned by FileWriter.WriteQuery after Close.
+var ErrWriterClosed = errors.New("pg2arrow: writer is closed")
+
+// ErrConnectionLost matches the QueryError of a connection-level failure by
+// errors.Is, like the server shutting down or the network broken in the
+// middle of a query. The batches and records delivered before the failure
+// remain valid, but the rest of the result is lost; the Conn needs to be
+// reconnected, as QueryRetry does.
+var ErrConnectionLost = errors.New("pg2arrow: connection lost")
+
+// ErrStatementTimeout matches the QueryError of a query aborted by the
+// server for WithStatementTimeout, by errors.Is. A query canceled by the
+// client, like by the context of QueryContext, never matches it.
+var ErrStatementTimeout = errors.New("pg2arrow: statement timeout")
+
+// ErrRowLimitExceeded matches the QueryError of a query stopped by the
+// limit of WithMaxRows, by errors.Is.
+var ErrRowLimitExceeded = errors.New("pg2arrow: row limit exceeded")
+
+// ErrStmtClosed is returned by Stmt.Query after Close.
+var ErrStmtClosed = errors.New("pg2arrow: statement is closed")
+
+// ErrPoolClosed is returned by Pool.Query after Close.
+var ErrPoolClosed = errors.New("pg2arrow: pool is closed")
+
+// sqlStateQueryCanceled is the SQLSTATE of a query canceled by either the
+// cancel request or the statement timeout.
+const sqlStateQueryCanceled = "57014"
+
+// ErrorCode classifies the failure reported by a QueryError.
+type ErrorCode int
+
+const (
+	// CodeInternal is a failure inside pg2arrow itself, like an
+	// unsupported data type or a data conversion error.
+	CodeInternal ErrorCode = C.PG2ARROW_ERR_INTERNAL
+	// CodeConnection means the connection to the server could not be
+	// established or was broken; it is usually worth retrying.
+	CodeConnection ErrorCode = C.PG2ARROW_ERR_CONNECTION
+	// CodeQuery is an error reported by the server, like a syntax error
+	// or a constraint violation; retrying it makes no sense.
+	CodeQuery ErrorCode = C.PG2ARROW_ERR_QUERY
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeInternal:
+		return "internal error"
+	case CodeConnection:
+		return "connection error"
+	case CodeQuery:
+		return "query error"
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// QueryError is returned when a query could not be run to completion.
+// Use errors.As to inspect the Code and SQLState of the failure.
+type QueryError struct {
+	Code     ErrorCode
+	SQLState string // empty, unless reported by the server
+	Message  string
+
+	timeout  bool // canceled by statement_timeout
+	rowLimit bool // stopped by WithMaxRows
+}
+
+func (e *QueryError) Error() string {
+	if e.SQLState != "" {
+		return fmt.Sprintf("pg2arrow: %s: %s (SQLSTATE %s)", e.Code, e.Message, e.SQLState)
+	}
+	return fmt.Sprintf("pg2arrow: %s: %s", e.Code, e.Message)
+}
+
+// Is reports whether the error is a connection-level failure, if target is
+// ErrConnectionLost, the query aborted by the statement timeout, if target
+// is ErrStatementTimeout, or the query stopped by the row limit, if target
+// is ErrRowLimitExceeded.
+func (e *QueryError) Is(target error) bool {
+	switch target {
+	case ErrConnectionLost:
+		return e.connectionLost()
+	case ErrStatementTimeout:
+		return e.timeout
+	case ErrRowLimitExceeded:
+		return e.rowLimit
+	}
+	return false
+}
+
+// connectionLost reports whether the error is a connection-level failure,
+// which may go away by reconnecting.
+func (e *QueryError) connectionLost() bool {
+	if e.Code == CodeConnection {
+		return true
+	}
+	// connection_exception, or the server shutting down or starting up
+	return strings.HasPrefix(e.SQLState, "08") ||
+		e.SQLState == "57P01" || e.SQLState == "57P02" || e.SQLState == "57P03"
+}
+
+// newQueryError converts the error information filled up by the C code.
+func newQueryError(info *C.ErrorInfo) *QueryError {
+	return &QueryError{
+		Code:     ErrorCode(info.code),
+		SQLState: C.GoString(&info.sqlstate[0]),
+		Message:  C.GoString(&info.message[0]),
+	}
+}
@@ -0,0 +1,133 @@
+package pg2arrow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// Estimate is the size of a query result estimated by the planner. It is
+// as rough as the statistics of the tables; stale statistics, or filters
+// the planner cannot estimate, may be off by orders of magnitude.
+type Estimate struct {
+	Rows     int64 // estimated number of rows
+	RowWidth int   // estimated average width of a row in PostgreSQL, in bytes
+	Batches  int64 // estimated number of record batches
+	Bytes    int64 // estimated size of the record batch bodies
+}
+
+// EstimateQuery estimates the size of the result of the SQL command by
+// EXPLAIN (FORMAT JSON), without running it. The rows and the row width
+// are of the top-level plan node. The bytes add up the buffers of the
+// Arrow types of the result: the fixed-width columns by their widths, and
+// the variable-length ones by the rest of the row width with their
+// offsets. The framing of the messages, and the dictionaries, are not
+// counted, nor is compression.
+func (c *Conn) EstimateQuery(sql string) (Estimate, error) {
+	schema, err := c.DescribeQuery(sql)
+	if err != nil {
+		return Estimate{}, err
+	}
+	rows, width, err := c.explain(sql)
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	est := Estimate{Rows: rows, RowWidth: width}
+	if rows > 0 {
+		n := int64(c.cfg.batchSize)
+		est.Batches = (rows + n - 1) / n
+	}
+	var fixedBits, fixedBytes int64
+	var variable bool
+	for _, f := range schema.Fields() {
+		bits, ok := fieldBits(f)
+		fixedBits += bits
+		if ok {
+			fixedBytes += (bits + 7) / 8
+		} else {
+			variable = true
+		}
+	}
+	rowBytes := float64(fixedBits) / 8
+	if variable && int64(width) > fixedBytes {
+		rowBytes += float64(int64(width) - fixedBytes)
+	}
+	est.Bytes = int64(math.Ceil(rowBytes * float64(rows)))
+	return est, nil
+}
+
+// fieldBits returns the bits per row of the field in its buffers; the
+// validity bitmap, the values of a fixed-width type, or the offsets of a
+// variable-length type. ok is false for the latter, whose values are not
+// counted.
+func fieldBits(f arrow.Field) (bits int64, ok bool) {
+	if f.Nullable {
+		bits++
+	}
+	switch t := f.Type.(type) {
+	case *arrow.NullType:
+		return 0, true
+	case *arrow.DictionaryType:
+		return bits + int64(t.IndexType.(arrow.FixedWidthDataType).BitWidth()), true
+	case *arrow.StructType:
+		ok = true
+		for _, child := range t.Fields() {
+			n, fixed := fieldBits(child)
+			bits += n
+			ok = ok && fixed
+		}
+		return bits, ok
+	case *arrow.ListType:
+		n, _ := fieldBits(t.ElemField())
+		return bits + 32 + n, false
+	case arrow.FixedWidthDataType:
+		return bits + int64(t.BitWidth()), true
+	}
+	// Utf8 and Binary
+	return bits + 32, false
+}
+
+// explain returns the estimated rows and width of the top-level plan node.
+// EXPLAIN runs without the options of the result, like the dictionary
+// columns or the row limit, which would fail it or change its shape.
+func (c *Conn) explain(sql string) (rows int64, width int, err error) {
+	s, err := c.openInternal("EXPLAIN (FORMAT JSON) " + sql)
+	if err != nil {
+		return 0, 0, err
+	}
+	it, err := c.newRecordIterator(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer it.Close()
+
+	rec, err := it.Next()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rec.Release()
+
+	var plan []byte
+	if col, ok := rec.Column(0).(*array.String); ok && col.Len() > 0 {
+		plan = []byte(col.Value(0))
+	}
+	if plan == nil {
+		return 0, 0, errors.New("pg2arrow: unexpected result of EXPLAIN")
+	}
+
+	var nodes []struct {
+		Plan struct {
+			Rows  float64 `json:"Plan Rows"`
+			Width int     `json:"Plan Width"`
+		}
+	}
+	if err := json.Unmarshal(plan, &nodes); err != nil || len(nodes) != 1 {
+		return 0, 0, fmt.Errorf("pg2arrow: unexpected result of EXPLAIN: %s", plan)
+	}
+	return int64(nodes[0].Plan.Rows), nodes[0].Plan.Width, nil
+}
@@ -0,0 +1,77 @@
+package pg2arrow
+
+import (
+	"math"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+)
+
+func TestFieldBits(t *testing.T) {
+	int32Field := arrow.Field{Name: "i", Type: arrow.PrimitiveTypes.Int32}
+	utf8Field := arrow.Field{Name: "s", Type: arrow.BinaryTypes.String}
+	for _, tc := range []struct {
+		name string
+		f    arrow.Field
+		bits int64
+		ok   bool
+	}{
+		{"int32", int32Field, 32, true},
+		{"nullable int32", arrow.Field{Type: arrow.PrimitiveTypes.Int32, Nullable: true}, 33, true},
+		{"bool", arrow.Field{Type: arrow.FixedWidthTypes.Boolean, Nullable: true}, 2, true},
+		{"timestamp", arrow.Field{Type: &arrow.TimestampType{Unit: arrow.Microsecond}}, 64, true},
+		{"uuid", arrow.Field{Type: &arrow.FixedSizeBinaryType{ByteWidth: 16}}, 128, true},
+		{"decimal", arrow.Field{Type: &arrow.Decimal128Type{Precision: 38, Scale: 2}}, 128, true},
+		{"null", arrow.Field{Type: arrow.Null, Nullable: true}, 0, true},
+		{"enum", arrow.Field{Type: &arrow.DictionaryType{
+			IndexType: arrow.PrimitiveTypes.Int16, ValueType: arrow.BinaryTypes.String}, Nullable: true}, 17, true},
+		// the offsets of the variable-length types
+		{"utf8", utf8Field, 32, false},
+		{"nullable binary", arrow.Field{Type: arrow.BinaryTypes.Binary, Nullable: true}, 33, false},
+		{"list", arrow.Field{Type: arrow.ListOfField(arrow.Field{Name: "item", Type: arrow.PrimitiveTypes.Int32, Nullable: true}),
+			Nullable: true}, 1 + 32 + 33, false},
+		{"composite", arrow.Field{Type: arrow.StructOf(int32Field, int32Field), Nullable: true}, 65, true},
+		{"composite of text", arrow.Field{Type: arrow.StructOf(int32Field, utf8Field)}, 64, false},
+	} {
+		if bits, ok := fieldBits(tc.f); bits != tc.bits || ok != tc.ok {
+			t.Errorf("%s: got %d bits and %v, want %d and %v", tc.name, bits, ok, tc.bits, tc.ok)
+		}
+	}
+}
+
+func TestEstimateQuery(t *testing.T) {
+	// EXPLAIN runs without the row limit
+	c := testConn(t, WithBatchSize(100), WithMaxRows(1))
+
+	// the planner knows the rows of generate_series by its constants
+	est, err := c.EstimateQuery("SELECT i, 'v' || i AS s FROM generate_series(1, 1000) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Rows != 1000 || est.Batches != 10 {
+		t.Errorf("got %d rows and %d batches, want 1000 and 10", est.Rows, est.Batches)
+	}
+	if est.RowWidth <= 4 {
+		t.Fatalf("got the row width %d, want more than int4", est.RowWidth)
+	}
+	// the nullable int4 and the offsets of the nullable text, then the rest
+	// of the row width for the text values
+	want := int64(math.Ceil((float64(33+33)/8 + float64(est.RowWidth-5)) * 1000))
+	if est.Bytes != want {
+		t.Errorf("got %d bytes, want %d by the row width %d", est.Bytes, want, est.RowWidth)
+	}
+
+	// the fixed-width columns only by their widths
+	est, err = c.EstimateQuery("SELECT i::int8 AS a, i % 2 = 0 AS b FROM generate_series(1, 800) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Rows != 800 || est.Batches != 8 || est.Bytes != (65+2)*800/8 {
+		t.Errorf("got %+v, want 800 rows, 8 batches and %d bytes", est, (65+2)*800/8)
+	}
+
+	if _, err := c.EstimateQuery("SELECT * FROM pg2arrow_test_none"); err == nil {
+		t.Errorf("got no error of the table not existing")
+	}
+	testExec(t, c, "SELECT 1")
+}
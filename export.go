@@ -0,0 +1,14 @@
+package pg2arrow
+
+// #include <stdint.h>
+import "C"
+import "runtime/cgo"
+
+// Callbacks from the C code. This file must not define C functions in the
+// preamble, because of the //export directives.
+
+//export goNoticeReceiver
+func goNoticeReceiver(handle C.uintptr_t, severity, message *C.char) {
+	n := cgo.Handle(handle).Value().(*notices)
+	n.push(C.GoString(severity), C.GoString(message))
+}
@@ -0,0 +1,31 @@
+package pg2arrow
+
+import "os"
+
+// QueryToFile runs the SQL command, then writes its result to the file at
+// path in Apache Arrow file format (also known as Feather v2), which is
+// readable by pyarrow.feather.read_table. The record batches are written
+// as they arrive, so the whole result never stays in memory. If the query
+// fails midway, the partial file is removed.
+func (c *Conn) QueryToFile(sql, path string) (err error) {
+	s, err := c.openStream(sql, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	return s.writeTo(f)
+}
@@ -0,0 +1,129 @@
+package pg2arrow
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// FileWriter appends the results of multiple queries into one file in
+// Apache Arrow file format, like the same SELECT run on the partitions of
+// a table. The file is valid once the FileWriter is closed.
+type FileWriter struct {
+	c      *Conn
+	f      *os.File
+	w      *ipc.FileWriter
+	schema *arrow.Schema
+}
+
+// OpenFileWriter creates the file at path, then returns a FileWriter of
+// the schema, which is usually the one returned by DescribeQuery. The
+// record batches are compressed by the codec of WithCompression, at its
+// default level. The caller must Close the writer.
+func (c *Conn) OpenFileWriter(path string, schema *arrow.Schema) (*FileWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []ipc.Option{ipc.WithSchema(schema), ipc.WithAllocator(c.cfg.allocator)}
+	switch c.cfg.compression.Codec {
+	case CompressionLZ4:
+		opts = append(opts, ipc.WithLZ4())
+	case CompressionZSTD:
+		opts = append(opts, ipc.WithZstd())
+	}
+	w, err := ipc.NewFileWriter(f, opts...)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &FileWriter{c: c, f: f, w: w, schema: schema}, nil
+}
+
+// WriteQuery runs the SQL command, then appends the record batches of its
+// result. The result must have the columns of the same names and types as
+// the schema of the writer, in the same order; a nullable column does not
+// match a non-nullable one of the schema, like the one of WithNotNullHints,
+// but the opposite does. Otherwise, it returns an error naming the column,
+// without writing anything.
+//
+// If the query fails midway, the batches written so far stay in the file.
+// A dictionary-encoded column must have the same dictionary across all
+// the batches, because the Arrow file format allows only one for each
+// column; so do enum columns unless their labels are altered, but not the
+// columns of WithDictionaryColumns.
+func (w *FileWriter) WriteQuery(sql string) error {
+	if w.w == nil {
+		return ErrWriterClosed
+	}
+	it, err := w.c.QueryRecords(sql)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	if err := matchSchema(w.schema, it.Schema()); err != nil {
+		return err
+	}
+	for {
+		rec, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the field metadata of the result may differ from the schema
+		out := array.NewRecord(w.schema, rec.Columns(), rec.NumRows())
+		err = w.w.Write(out)
+		out.Release()
+		rec.Release()
+		if err != nil {
+			return fmt.Errorf("pg2arrow: unable to append the result: %w", err)
+		}
+	}
+}
+
+// Close writes the footer of the file, then closes it. It is safe to call
+// Close more than once.
+func (w *FileWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+	err := w.w.Close()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.w = nil
+	return err
+}
+
+// matchSchema tells whether the result of the schema got is appendable to
+// the file of the schema want.
+func matchSchema(want, got *arrow.Schema) error {
+	if got.NumFields() != want.NumFields() {
+		return fmt.Errorf("pg2arrow: the result has %d columns, but the file has %d",
+			got.NumFields(), want.NumFields())
+	}
+	for i, g := range got.Fields() {
+		f := want.Field(i)
+		switch {
+		case g.Name != f.Name:
+			return fmt.Errorf("pg2arrow: column %d of the result is %q, but %q in the file",
+				i+1, g.Name, f.Name)
+		case !arrow.TypeEqual(g.Type, f.Type):
+			return fmt.Errorf("pg2arrow: column %q of the result is %s, but %s in the file",
+				g.Name, g.Type, f.Type)
+		case g.Nullable && !f.Nullable:
+			return fmt.Errorf("pg2arrow: column %q of the result is nullable, but not in the file",
+				g.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package pg2arrow
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+func TestMatchSchema(t *testing.T) {
+	want := arrow.NewSchema([]arrow.Field{
+		{Name: "i", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "s", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	for _, tc := range []struct {
+		name   string
+		fields []arrow.Field
+		err    string
+	}{
+		{"same", want.Fields(), ""},
+		// the non-nullable column is appendable to the nullable one
+		{"not null", []arrow.Field{want.Field(0), {Name: "s", Type: arrow.BinaryTypes.String}}, ""},
+		{"nullable", []arrow.Field{{Name: "i", Type: arrow.PrimitiveTypes.Int32, Nullable: true}, want.Field(1)},
+			`column "i" of the result is nullable`},
+		{"columns", want.Fields()[:1], "the result has 1 columns, but the file has 2"},
+		{"name", []arrow.Field{want.Field(0), {Name: "t", Type: arrow.BinaryTypes.String, Nullable: true}},
+			`column 2 of the result is "t", but "s" in the file`},
+		{"type", []arrow.Field{{Name: "i", Type: arrow.PrimitiveTypes.Int64}, want.Field(1)},
+			`column "i" of the result is int64, but int32 in the file`},
+	} {
+		err := matchSchema(want, arrow.NewSchema(tc.fields, nil))
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestFileWriter(t *testing.T) {
+	c := testConn(t, WithBatchSize(3), WithCompression(Compression{Codec: CompressionLZ4}))
+	const sql = "SELECT i, 'v' || i AS s FROM generate_series(1, 10) i"
+	schema, err := c.DescribeQuery(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "result.arrow")
+	w, err := c.OpenFileWriter(path, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the partitions are appended, but not the result of another schema
+	for _, where := range []string{" WHERE i <= 4", " WHERE i > 4"} {
+		if err := w.WriteQuery(sql + where); err != nil {
+			t.Fatalf("%s: %v", where, err)
+		}
+	}
+	if err := w.WriteQuery("SELECT i::int8 AS i, 'v' AS s FROM generate_series(1, 3) i"); err == nil ||
+		!strings.Contains(err.Error(), `column "i"`) {
+		t.Errorf("got %v, want the column of another type", err)
+	}
+	// the batches before the failure stay in the file
+	if err := w.WriteQuery(sql + " WHERE 1 / (i - 7) > -1"); err == nil {
+		t.Errorf("got no error of the division by zero")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("got %v of the second Close", err)
+	}
+	if err := w.WriteQuery(sql); err != ErrWriterClosed {
+		t.Errorf("got %v, want ErrWriterClosed", err)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, recs := testFile(t, path, buf)
+	if !got.Equal(schema) {
+		t.Errorf("got the schema %v, want %v", got, schema)
+	}
+	var ids []int32
+	for _, rec := range recs {
+		ids = append(ids, rec.Column(0).(*array.Int32).Int32Values()...)
+	}
+	// 1..4 and 5..10, then the batches of the failed query fetched before
+	// the failure, up to the 6 rows before it
+	for i, id := range ids {
+		want := int32(i + 1)
+		if i >= 10 {
+			want -= 10
+		}
+		if id != want || len(ids) > 16 {
+			t.Fatalf("got the rows %v", ids)
+		}
+	}
+	if len(ids) < 10 {
+		t.Errorf("got the rows %v, want 1..10 at least", ids)
+	}
+	testExec(t, c, "SELECT 1")
+}
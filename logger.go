@@ -0,0 +1,47 @@
+package pg2arrow
+
+// Logger receives the events of a Conn, like the connection attempts, the
+// record batches built, the columns fetched in text, and the cancellations
+// of queries. The keysAndValues are pairs of a string key and its value,
+// like "attempt", 2, which map to the attributes of log/slog or the fields
+// of zap; for example, a *slog.Logger is adapted by
+//
+//	type slogLogger struct{ *slog.Logger }
+//
+//	func (l slogLogger) Debug(msg string, kv ...interface{}) { l.Logger.Debug(msg, kv...) }
+//
+// and so on for Info, Warn and Error. The methods may be called on any
+// goroutine, including the one fetching the rows of QueryStream, so they
+// must be safe for concurrent use and return quickly.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// nopLogger discards everything, which is the default.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// WithLogger sets the Logger of the Conn. The connections opened by the
+// same options, like the workers of QueryParallel and the connections of a
+// Pool, log to it too. By default, nothing is logged.
+//
+// A column which has no known binary format, like a range, is
+// cast to text by the server; it is logged at Info with the source type
+// and the Arrow type written, since it is slower than the binary transfer
+// and the values lose their own type.
+func WithLogger(l Logger) Option {
+	return func(cfg *config) error {
+		if l == nil {
+			l = nopLogger{}
+		}
+		cfg.logger = l
+		return nil
+	}
+}
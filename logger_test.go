@@ -0,0 +1,163 @@
+package pg2arrow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logEntry is a message logged at the level, with its keys and values.
+type logEntry struct {
+	level string
+	msg   string
+	kv    []interface{}
+}
+
+// value returns the value of the key, or nil if none.
+func (e logEntry) value(key string) interface{} {
+	for i := 0; i+1 < len(e.kv); i += 2 {
+		if e.kv[i] == key {
+			return e.kv[i+1]
+		}
+	}
+	return nil
+}
+
+func (e logEntry) String() string {
+	return fmt.Sprintf("%s %q %v", e.level, e.msg, e.kv)
+}
+
+// testLogger records the messages logged at every level.
+type testLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *testLogger) log(level, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, kv})
+}
+
+func (l *testLogger) Debug(msg string, kv ...interface{}) { l.log("debug", msg, kv) }
+func (l *testLogger) Info(msg string, kv ...interface{})  { l.log("info", msg, kv) }
+func (l *testLogger) Warn(msg string, kv ...interface{})  { l.log("warn", msg, kv) }
+func (l *testLogger) Error(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+// logged returns the entries of the level and the message, or of any
+// message if msg is empty.
+func (l *testLogger) logged(level, msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []logEntry
+	for _, e := range l.entries {
+		if e.level == level && (msg == "" || e.msg == msg) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// reset discards the entries recorded so far.
+func (l *testLogger) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
+
+func TestLoggerConnect(t *testing.T) {
+	l := new(testLogger)
+	c := testConn(t, WithLogger(l))
+
+	if got := l.logged("debug", "pg2arrow: connecting"); len(got) != 1 || got[0].value("attempt") != 1 {
+		t.Errorf("got %v, want the first attempt", got)
+	}
+	host, port := c.Host()
+	if got := l.logged("info", "pg2arrow: connected"); len(got) != 1 ||
+		got[0].value("host") != host || got[0].value("port") != port {
+		t.Errorf("got %v, want the host %q and the port %q", got, host, port)
+	}
+
+	// each failed attempt is a warning
+	l.reset()
+	dsn := withParams(t, testDSN(t), "port=1 connect_timeout=1")
+	if _, err := Connect(dsn, WithLogger(l), WithRetryPolicy(RetryPolicy{MaxAttempts: 2, Factor: 1})); err == nil {
+		t.Fatal("got no error of port 1")
+	}
+	warns := l.logged("warn", "pg2arrow: connection failed")
+	if len(warns) != 2 {
+		t.Fatalf("got %v, want 2 failed attempts", warns)
+	}
+	for i, e := range warns {
+		if e.value("attempt") != i+1 || e.value("error") == nil {
+			t.Errorf("attempt %d: got %v", i+1, e)
+		}
+	}
+	if got := l.logged("info", "pg2arrow: connected"); len(got) != 0 {
+		t.Errorf("got %v, want no connection", got)
+	}
+}
+
+func TestLoggerQuery(t *testing.T) {
+	l := new(testLogger)
+	c := testConn(t, WithLogger(l), WithBatchSize(4))
+
+	testExec(t, c, "SELECT i FROM generate_series(1, 10) i")
+	batches := l.logged("debug", "pg2arrow: record batch flushed")
+	if len(batches) != 3 {
+		t.Fatalf("got %v, want 3 record batches", batches)
+	}
+	for i, want := range []int64{4, 4, 2} {
+		if got := batches[i].value("rows"); got != want {
+			t.Errorf("batch %d: got %v rows, want %d", i, got, want)
+		}
+	}
+
+	if _, err := c.Query("SELECT * FROM pg2arrow_test_none"); err == nil {
+		t.Fatal("got no error of the table not existing")
+	}
+	if got := l.logged("error", "pg2arrow: query failed"); len(got) != 1 || got[0].value("sqlstate") != "42P01" {
+		t.Errorf("got %v, want the failure of 42P01", got)
+	}
+}
+
+func TestLoggerCancel(t *testing.T) {
+	l := new(testLogger)
+	c := testConn(t, WithLogger(l))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.QueryContext(ctx, "SELECT pg_sleep(30)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if got := l.logged("info", "pg2arrow: canceling the query"); len(got) != 1 {
+		t.Errorf("got %v, want the query canceled once", got)
+	}
+	if got := l.logged("warn", ""); len(got) != 0 {
+		t.Errorf("got warnings %v", got)
+	}
+}
+
+func TestLoggerShared(t *testing.T) {
+	l := new(testLogger)
+	c := testConn(t, WithLogger(l))
+
+	// the workers of QueryParallel connect by the same options
+	r, err := c.QueryParallel("SELECT i FROM generate_series(1, 100) i", "i", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testRows(t, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.logged("info", "pg2arrow: connected"); len(got) < 2 {
+		t.Errorf("got %v, want the workers connected too", got)
+	}
+
+	// nil is the default, which logs nothing
+	testConn(t, WithLogger(nil))
+}
@@ -0,0 +1,149 @@
+package pg2arrow
+
+/*
+#include <stdlib.h>
+#include "pg2arrow.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// MultiReader iterates the results of QueryMulti, one RecordReader for
+// each statement, as they come from the server.
+type MultiReader struct {
+	c     *Conn
+	q     *canceler   // cancels the statements still running
+	multi *C.SQLmulti // nil once released
+	n     int         // statements returned so far
+	cur   *RecordReader
+	err   error // io.EOF, or the error of the failed statement
+}
+
+// QueryMulti runs the SQL commands separated by semicolons in sql at once,
+// by the simple query protocol of libpq, then returns a MultiReader over
+// the result of each statement in order. The statements returning no
+// rows, like SET, yield a result with no fields and no record batches, so
+// the i-th result always belongs to the i-th statement. Empty statements
+// are ignored.
+//
+// The server runs the statements in one implicit transaction, unless sql
+// itself has BEGIN and COMMIT, and splits them by its own parser. If a
+// statement fails, the rest are skipped, and the preceding ones are rolled
+// back unless committed explicitly; the MultiReader returns the results of
+// the preceding statements, then the error, which tells the position of
+// the failed statement and wraps the QueryError. QueryMulti itself returns
+// an error only if sql cannot be run at all. COPY is not allowed.
+//
+// The rows are received as they come, like QueryStream, so the results
+// need not fit in memory; the server sends them as its output buffer fills
+// up, so a few rows may wait for the statements after them. The Conn
+// stays busy until Next returns io.EOF or an error, or Close. Closing the
+// RecordReader of a statement early skips the rest of its rows, which the
+// server still sends, while Close of the MultiReader cancels the
+// statements still running.
+//
+// The simple query protocol has no binary format, and the connection
+// running the statements cannot look up the data types in the catalog.
+// So the values of the built-in types, like int4, numeric, timestamptz,
+// uuid and their arrays, are converted from their text forms to the same
+// Arrow types as Query, and the options like WithJSONMode, WithUUIDAsString
+// or WithNumericPrecision apply to them. Any other types, like enum,
+// domain, composite and those of extensions, are Utf8 of their text forms,
+// with the pg_oid metadata but empty pg_typname; and so are the date and
+// time types unless DateStyle is ISO, and interval unless IntervalStyle is
+// postgres, the defaults. The server reports a change of them by SET at
+// the end of all the statements, so the values of those types after such
+// a SET in sql fail to convert. WithDictionaryColumns applies to the
+// statements which have the columns. WithMaxRows limits each statement;
+// the one exceeding it fails, and the rest are canceled.
+func (c *Conn) QueryMulti(sql string) (*MultiReader, error) {
+	cs := C.CString(sql)
+	defer C.free(unsafe.Pointer(cs))
+
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	q := new(canceler)
+	q.start(c.conn, c.cfg.logger)
+	opts, free := c.options()
+	defer free()
+	var errinfo C.ErrorInfo
+	multi := C.pgsql_begin_multi(c.conn, cs, &opts, &errinfo)
+	c.logSessionError()
+	if multi == nil {
+		q.finish()
+		c.mu.Unlock()
+		err := newQueryError(&errinfo)
+		c.cfg.logger.Error("pg2arrow: query failed", "sqlstate", err.SQLState, "error", err)
+		return nil, err
+	}
+	return &MultiReader{c: c, q: q, multi: multi}, nil
+}
+
+// Next returns the RecordReader over the result of the next statement, or
+// io.EOF if no more statements. The RecordReader returned by the last call
+// is closed, and the caller must Close the new one, or Close the
+// MultiReader.
+func (m *MultiReader) Next() (*RecordReader, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.multi == nil {
+		return nil, ErrReaderClosed
+	}
+	if m.cur != nil {
+		m.cur.Close()
+		m.cur = nil
+	}
+	// the statement failed in the middle of its rows reports the error
+	// again, at the same position
+	if !m.multi.failed {
+		m.n++
+	}
+	s, err := m.c.begin(nil, func(opts *C.SQLoptions, errinfo *C.ErrorInfo) *C.SQLtable {
+		return C.pgsql_next_result(m.multi, opts, errinfo)
+	})
+	if err != nil {
+		if qe, ok := err.(*QueryError); ok {
+			qe.rowLimit = bool(m.multi.row_limit_exceeded)
+			err = fmt.Errorf("pg2arrow: statement %d: %w", m.n, err)
+		}
+		m.err = err
+		m.release()
+		return nil, err
+	}
+	s.nested = true
+	// a canceler never started, so closing the reader skips the statement,
+	// rather than canceling all the rest
+	m.cur = newRecordReader(s, new(canceler))
+	return m.cur, nil
+}
+
+// Close cancels the statements still running, including the one of the
+// RecordReader returned by the last Next, which is closed too, then
+// releases the Conn. It is safe to call Close more than once.
+func (m *MultiReader) Close() error {
+	if m.multi == nil {
+		return nil
+	}
+	m.q.Cancel()
+	if m.cur != nil {
+		m.cur.Close()
+		m.cur = nil
+	}
+	m.release()
+	return nil
+}
+
+// release terminates the statements, then unlocks the Conn.
+func (m *MultiReader) release() {
+	C.pgsql_close_multi(m.multi)
+	m.multi = nil
+	m.c.logSessionError()
+	m.q.finish()
+	m.c.mu.Unlock()
+}
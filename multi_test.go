@@ -0,0 +1,350 @@
+package pg2arrow
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// testResult is the result of a statement of QueryMulti.
+type testResult struct {
+	schema *arrow.Schema
+	recs   []arrow.Record
+	nrows  int64
+}
+
+// testMulti runs the SQL commands by QueryMulti, then returns the results
+// of the statements, and the error of Next which stopped them if any. The
+// result of the failed statement has the rows came prior to the error. The
+// records are released at the end of the test.
+func testMulti(t *testing.T, c *Conn, sql string) ([]testResult, error) {
+	t.Helper()
+	m, err := c.QueryMulti(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	defer m.Close()
+
+	var results []testResult
+	for {
+		r, err := m.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		s := &recordStream{r: r, buf: r.Schema()}
+		rdr, err := ipc.NewReader(s)
+		if err != nil {
+			t.Fatalf("%s: statement %d: %v", sql, len(results)+1, s.wrapErr(err))
+		}
+		res := testResult{schema: rdr.Schema()}
+		for rdr.Next() {
+			rec := rdr.Record()
+			rec.Retain()
+			t.Cleanup(rec.Release)
+			res.recs = append(res.recs, rec)
+			res.nrows += rec.NumRows()
+		}
+		rdr.Release()
+		results = append(results, res)
+		if err := rdr.Err(); err != nil && err != io.EOF {
+			// the error of the statement comes by Next too
+			if _, err := m.Next(); err == nil || err == io.EOF {
+				t.Fatalf("%s: got %v after the error of the statement: %v", sql, err, s.wrapErr(err))
+			}
+			_, err = m.Next()
+			return results, err
+		}
+	}
+}
+
+func TestQueryMulti(t *testing.T) {
+	c := testConn(t, WithBatchSize(100))
+	results, err := testMulti(t, c, "SET work_mem = '8MB'; SELECT x FROM generate_series(1, 1000) x; ;"+
+		" SELECT 1 AS a WHERE false; SELECT current_setting('work_mem') AS w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 4", len(results))
+	}
+	if n := results[0].schema.NumFields(); n != 0 || len(results[0].recs) != 0 {
+		t.Errorf("SET: got %d fields and %d batches, want none", n, len(results[0].recs))
+	}
+	if r := results[1]; r.nrows != 1000 || len(r.recs) != 10 {
+		t.Errorf("generate_series: got %d rows of %d batches, want 1000 of 10", r.nrows, len(r.recs))
+	}
+	if r := results[2]; r.schema.NumFields() != 1 || r.nrows != 0 {
+		t.Errorf("no rows: got %d fields and %d rows, want 1 and 0", r.schema.NumFields(), r.nrows)
+	}
+	if got := results[3].recs[0].Column(0).(*array.String).Value(0); got != "8MB" {
+		t.Errorf("got work_mem %q, want the one by the first statement", got)
+	}
+	// the Conn is available again
+	if got := testColumn(t, c, "SELECT 1").(*array.Int32).Value(0); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+func TestQueryMultiTypes(t *testing.T) {
+	exprs := []string{
+		"true AS bool", "12::int2 AS int2", "-123456::int4 AS int4",
+		"9007199254740993::int8 AS int8", "4000000000::oid AS oid",
+		"1.5::float4 AS float4", "0.1::float8 AS float8",
+		"'NaN'::float8 AS nan", "'-Infinity'::float4 AS ninf",
+		"123.45::numeric(10,3) AS numeric", "-0.00012::numeric AS small",
+		"12345678901234.5678::numeric AS big", "0::numeric AS zero",
+		"1000::numeric AS round", "'12.34'::money AS money",
+		"'2024-02-29'::date AS date", "'0044-03-15 BC'::date AS bc",
+		"'infinity'::date AS dinf", "'23:59:59.999999'::time AS time",
+		"'2024-01-02 03:04:05.678'::timestamp AS ts",
+		"'1999-12-31 23:59:59+09'::timestamptz AS tstz",
+		"'-infinity'::timestamptz AS tsinf",
+		"'0010-01-01 12:00:00 BC'::timestamp AS tsbc",
+		"'1 year 2 mons -3 days 04:05:06.5'::interval AS iv",
+		"'-1 day -00:00:01'::interval AS iv2", "'0'::interval AS iv0",
+		`'\x00ff5c'::bytea AS bytea`, `'a'::"char" AS ch`, "'n'::name AS name",
+		"'t'::text AS text", "'v'::varchar(3) AS varchar", "'b'::char(3) AS bpchar",
+		"'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'::uuid AS uuid",
+		"'192.168.0.1/24'::inet AS inet", "'::1'::inet AS inet6",
+		"'10.0.0.0/8'::cidr AS cidr", "'08:00:2b:01:02:03'::macaddr AS macaddr",
+		"'08:00:2b:01:02:03:04:05'::macaddr8 AS macaddr8",
+		`'{"a": 1}'::json AS json`, `'{"b": [1, 2]}'::jsonb AS jsonb`,
+		"ARRAY[1, NULL, 3]::int4[] AS int4s",
+		`ARRAY['a b', NULL, 'c"d', 'NULL', '', 'e\f', '{x}']::text[] AS texts`,
+		"ARRAY[1.5, -2]::numeric[] AS numerics", "'[0:1]={1,2}'::int8[] AS lbound",
+		"ARRAY['2024-01-01 00:00:00+00']::timestamptz[] AS tstzs",
+		"NULL::int4 AS null",
+	}
+	sql := "SELECT " + strings.Join(exprs, ", ")
+	for _, tt := range []struct {
+		name  string
+		setup string
+		opts  []Option
+	}{
+		{"default", "SET timezone = 'Asia/Kolkata'", nil},
+		{"options", "SET bytea_output = 'escape'", []Option{
+			WithJSONMode(JSONBinary), WithUUIDAsString(),
+			WithNetworkAsBinary(), WithNumericPrecision(20, 4),
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConn(t, tt.opts...)
+			testExec(t, c, tt.setup)
+			schema, recs := testQuery(t, c, sql)
+			results, err := testMulti(t, c, "SELECT 1; "+sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 2 || len(results[1].recs) != 1 {
+				t.Fatalf("got %d results, want 2 of a record batch", len(results))
+			}
+			// the same as by the binary format, including the metadata
+			got := results[1]
+			if !got.schema.Equal(schema) {
+				t.Fatalf("got the schema\n%s\nwant\n%s", got.schema, schema)
+			}
+			for j, f := range schema.Fields() {
+				if !array.ApproxEqual(got.recs[0].Column(j), recs[0].Column(j),
+					array.WithNaNsEqual(true), array.WithAbsTolerance(0)) {
+					t.Errorf("%s: got %v, want %v", f.Name, got.recs[0].Column(j), recs[0].Column(j))
+				}
+			}
+		})
+	}
+}
+
+func TestQueryMultiTextForm(t *testing.T) {
+	c := testConn(t)
+
+	// no built-in types, like range types
+	results, err := testMulti(t, c, "SELECT '[1,3)'::int4range AS r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := results[0].schema.Field(0)
+	if f.Type.ID() != arrow.STRING {
+		t.Errorf("int4range: got %s, want Utf8", f.Type)
+	}
+	if v, _ := f.Metadata.GetValue("pg_oid"); v != "3904" {
+		t.Errorf("int4range: got pg_oid %q, want 3904", v)
+	}
+	if got := results[0].recs[0].Column(0).(*array.String).Value(0); got != "[1,3)" {
+		t.Errorf("int4range: got %q, want [1,3)", got)
+	}
+
+	// the date of DateStyle other than ISO is of its text form
+	testExec(t, c, "SET DateStyle = 'German'")
+	results, err = testMulti(t, c, "SELECT '2024-01-02'::date AS d, 1 AS i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := results[0].schema.Field(0); f.Type.ID() != arrow.STRING {
+		t.Errorf("date: got %s, want Utf8", f.Type)
+	}
+	if got := results[0].recs[0].Column(0).(*array.String).Value(0); got != "02.01.2024" {
+		t.Errorf("date: got %q, want 02.01.2024", got)
+	}
+	if f := results[0].schema.Field(1); f.Type.ID() != arrow.INT32 {
+		t.Errorf("int4: got %s, want Int32", f.Type)
+	}
+}
+
+func TestQueryMultiOptions(t *testing.T) {
+	c := testConn(t, WithDictionaryColumns("s"), WithColumnNaming(ColumnNamesPosition))
+	results, err := testMulti(t, c, "SELECT 'a' AS s, 1, 2; SELECT 1 AS i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range results[0].schema.Fields() {
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, ","); got != "s,column_2,column_3" {
+		t.Errorf("got the names %s, want s,column_2,column_3", got)
+	}
+	if f := results[0].schema.Field(0); f.Type.ID() != arrow.DICTIONARY {
+		t.Errorf("s: got %s, want Dictionary", f.Type)
+	}
+	// the statement without the dictionary column
+	if f := results[1].schema.Field(0); f.Type.ID() != arrow.INT32 {
+		t.Errorf("i: got %s, want Int32", f.Type)
+	}
+}
+
+func TestQueryMultiError(t *testing.T) {
+	c := testConn(t, WithBatchSize(10))
+
+	// the statement fails prior to the rows
+	results, err := testMulti(t, c, "SELECT 1; SELECT 1/0; SELECT 2")
+	var qe *QueryError
+	if !errors.As(err, &qe) || qe.SQLState != "22012" {
+		t.Fatalf("got %v, want the division by zero", err)
+	}
+	if len(results) != 1 || !strings.Contains(err.Error(), "statement 2:") {
+		t.Errorf("got %d results, then %v, want 1 then the error of statement 2", len(results), err)
+	}
+
+	// the statement fails in the middle of the rows
+	results, err = testMulti(t, c, "SELECT 1/(500-x) FROM generate_series(1, 1000) x; SELECT 2")
+	if !errors.As(err, &qe) || qe.SQLState != "22012" || !strings.Contains(err.Error(), "statement 1:") {
+		t.Fatalf("got %v, want the division by zero of statement 1", err)
+	}
+	if len(results) != 1 || results[0].nrows == 0 || results[0].nrows >= 500 {
+		t.Errorf("got %d results, want 1 of the rows prior to the error", len(results))
+	}
+
+	// COPY is not allowed
+	if _, err := testMulti(t, c, "SELECT 1; COPY (SELECT 1) TO STDOUT"); err == nil {
+		t.Errorf("got no error of COPY")
+	}
+	// the Conn is available again
+	if got := testColumn(t, c, "SELECT 1").(*array.Int32).Value(0); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+func TestQueryMultiStreaming(t *testing.T) {
+	c := testConn(t, WithBatchSize(10))
+
+	// the rows come prior to the end of the statements
+	start := time.Now()
+	m, err := c.QueryMulti("SELECT x FROM generate_series(1, 100000) x; SELECT pg_sleep(3); SELECT 'next' AS s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	r, err := m.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("got the first record batch in %s, want prior to the next statement", d)
+	}
+
+	// closing the reader skips the rest of its rows, then the next follows
+	r.Close()
+	for _, want := range []int{1, 1} {
+		r, err := m.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := testRows(t, r)
+		if err != nil || n != int64(want) {
+			t.Errorf("got %d rows by %v, want %d", n, err, want)
+		}
+	}
+	if _, err := m.Next(); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+
+	// Close cancels the statements still running
+	m, err = c.QueryMulti("SELECT x FROM generate_series(1, 100000) x; SELECT pg_sleep(30); SELECT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = m.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	m.Close()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Close took %s, want the statements canceled", d)
+	}
+	if _, err := m.Next(); err != ErrReaderClosed {
+		t.Errorf("got %v after Close, want ErrReaderClosed", err)
+	}
+	if got := testColumn(t, c, "SELECT 1").(*array.Int32).Value(0); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+func TestQueryMultiMaxRows(t *testing.T) {
+	c := testConn(t, WithMaxRows(100), WithBatchSize(30))
+	m, err := c.QueryMulti("SELECT x FROM generate_series(1, 100) x;" +
+		" SELECT x FROM generate_series(1, 1000) x; SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// each statement is limited, not the sum of them
+	for i, want := range []int64{100, 100} {
+		r, err := m.Next()
+		if err != nil {
+			t.Fatalf("statement %d: %v", i+1, err)
+		}
+		n, err := testRows(t, r)
+		if n != want {
+			t.Errorf("statement %d: got %d rows, want %d", i+1, n, want)
+		}
+		if i == 0 && err != nil {
+			t.Errorf("statement 1: got %v, want no error", err)
+		}
+		if i == 1 && !errors.Is(err, ErrRowLimitExceeded) {
+			t.Errorf("statement 2: got %v, want ErrRowLimitExceeded", err)
+		}
+	}
+	// the rest are canceled
+	if _, err := m.Next(); !errors.Is(err, ErrRowLimitExceeded) || !strings.Contains(err.Error(), "statement 2:") {
+		t.Errorf("got %v, want ErrRowLimitExceeded of statement 2", err)
+	}
+	if got := testColumn(t, c, "SELECT 1").(*array.Int32).Value(0); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
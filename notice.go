@@ -0,0 +1,139 @@
+package pg2arrow
+
+/*
+#include "pg2arrow.h"
+
+extern void goNoticeReceiver(uintptr_t handle, char *severity, char *message);
+
+static void
+pg2arrow_notice_receiver(void *arg, const PGresult *res)
+{
+	char	   *severity = PQresultErrorField(res, PG_DIAG_SEVERITY_NONLOCALIZED);
+	char	   *message = PQresultErrorField(res, PG_DIAG_MESSAGE_PRIMARY);
+
+	if (!severity)
+		severity = PQresultErrorField(res, PG_DIAG_SEVERITY);
+	goNoticeReceiver((uintptr_t)arg, severity, message);
+}
+
+static void
+pg2arrow_set_notice_receiver(PGconn *conn, uintptr_t handle)
+{
+	PQsetNoticeReceiver(conn, pg2arrow_notice_receiver, (void *)handle);
+}
+*/
+import "C"
+import (
+	"runtime/cgo"
+	"sync"
+)
+
+// notice is a NOTICE, WARNING or other message reported by the server
+// aside the query results.
+type notice struct {
+	level   string
+	message string
+}
+
+// notices delivers the notices of a Conn to its handler. The notices are
+// queued by the libpq callback, then the handler is called by another
+// goroutine, so the handler may use the Conn, and a slow handler never
+// stalls the query.
+type notices struct {
+	handle cgo.Handle
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	handler func(level, message string)
+	queue   []notice
+	running bool // true, if the delivery goroutine is running
+	closed  bool
+	exited  chan struct{}
+}
+
+func newNotices() *notices {
+	n := &notices{exited: make(chan struct{})}
+	n.cond = sync.NewCond(&n.mu)
+	n.handle = cgo.NewHandle(n)
+	return n
+}
+
+// register makes the notices of conn delivered to n.
+func (n *notices) register(conn *C.PGconn) {
+	C.pg2arrow_set_notice_receiver(conn, C.uintptr_t(n.handle))
+}
+
+// setHandler replaces the handler; nil drops the notices.
+func (n *notices) setHandler(fn func(level, message string)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.handler = fn
+	if fn != nil && !n.running && !n.closed {
+		n.running = true
+		go n.deliver()
+	}
+}
+
+// push is called by the libpq callback.
+func (n *notices) push(level, message string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.handler == nil || n.closed {
+		return
+	}
+	n.queue = append(n.queue, notice{level, message})
+	n.cond.Signal()
+}
+
+func (n *notices) deliver() {
+	defer close(n.exited)
+
+	n.mu.Lock()
+	for {
+		for len(n.queue) == 0 && !n.closed {
+			n.cond.Wait()
+		}
+		if len(n.queue) == 0 {
+			break
+		}
+		q, fn := n.queue, n.handler
+		n.queue = nil
+		n.mu.Unlock()
+		for _, m := range q {
+			if fn != nil {
+				fn(m.level, m.message)
+			}
+		}
+		n.mu.Lock()
+	}
+	n.mu.Unlock()
+}
+
+// close delivers the queued notices, then stops. It must be called after
+// the connections using n are finished.
+func (n *notices) close() {
+	n.mu.Lock()
+	n.closed = true
+	running := n.running
+	n.cond.Signal()
+	n.mu.Unlock()
+
+	if running {
+		<-n.exited
+	}
+	n.handle.Delete()
+}
+
+// SetNoticeHandler sets the handler of the NOTICE, WARNING and other
+// messages reported by the server, like RAISE NOTICE of PL/pgSQL. The
+// level is the severity in English, like "NOTICE" or "WARNING", and the
+// message is the primary message. The handler is called on its own
+// goroutine, in the order of the messages, so it may use the Conn;
+// however, it may be called after the query returned. A nil handler
+// drops the messages, which is the default. The handler is never called
+// after Close returns.
+func (c *Conn) SetNoticeHandler(fn func(level, message string)) {
+	c.notices.setHandler(fn)
+}
@@ -0,0 +1,67 @@
+package pg2arrow
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNoticeHandler(t *testing.T) {
+	c := testConn(t)
+	testExec(t, c, "SET client_min_messages = notice")
+
+	var mu sync.Mutex
+	var got []notice
+	c.SetNoticeHandler(func(level, message string) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, notice{level, message})
+	})
+	testExec(t, c, "DROP TABLE IF EXISTS pg2arrow_test_none", "COMMIT",
+		"DROP TABLE IF EXISTS pg2arrow_test_none")
+
+	// Close delivers the queued ones, then no more calls
+	c.Close()
+	const skipped = `table "pg2arrow_test_none" does not exist, skipping`
+	want := []notice{{"NOTICE", skipped}, {"WARNING", "there is no transaction in progress"}, {"NOTICE", skipped}}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("notice %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestNoticeHandlerConn(t *testing.T) {
+	c := testConn(t)
+
+	// the handler may run a query on the Conn
+	done := make(chan error, 1)
+	c.SetNoticeHandler(func(level, message string) {
+		_, err := c.Query("SELECT 1")
+		done <- err
+	})
+	testExec(t, c, "COMMIT")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("query in the handler: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the handler never returned")
+	}
+
+	// nil drops them
+	c.SetNoticeHandler(nil)
+	testExec(t, c, "COMMIT")
+	c.Close()
+	select {
+	case <-done:
+		t.Errorf("got the notice after the handler cleared")
+	default:
+	}
+}
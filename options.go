@@ -0,0 +1,406 @@
+package pg2arrow
+
+// #include <stdlib.h>
+// #include "pg2arrow.h"
+import "C"
+import (
+	"fmt"
+	"math"
+	"time"
+	"unsafe"
+
+	"github.com/apache/arrow/go/v17/arrow/memory"
+)
+
+// defaultBatchSize is the number of rows per record batch, unless
+// WithBatchSize is given.
+const defaultBatchSize = 65536
+
+// Option configures a Conn. It is given to Connect.
+type Option func(*config) error
+
+type config struct {
+	batchSize       int
+	jsonMode        JSONMode
+	uuidAsString    bool
+	networkAsBinary bool
+	notNullHints    bool
+	dictColumns     []string
+	compression     Compression
+	retry           RetryPolicy
+	maxBatches      int   // 0 means the default of the reader
+	maxBytes        int64 // 0 means no limit
+	onBatch         func(BatchStats)
+	allocator       memory.Allocator
+	timeout         time.Duration // 0 means the server default
+	maxRows         int64         // 0 means no limit
+	columnNaming    ColumnNaming
+	logger          Logger
+	numPrecision    int // 0 means Decimal128(38,18)
+	numScale        int
+}
+
+func newConfig(opts []Option) (config, error) {
+	cfg := config{
+		batchSize: defaultBatchSize,
+		jsonMode:  JSONText,
+		retry:     RetryPolicy{MaxAttempts: 1, Factor: 1},
+		allocator: memory.DefaultAllocator,
+		logger:    nopLogger{},
+	}
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// options returns the options for the C code, and the function to free
+// the C memory they refer to. They are valid until the function is called.
+func (cfg *config) options() (C.SQLoptions, func()) {
+	opts := C.SQLoptions{
+		batch_nrows:       C.size_t(cfg.batchSize),
+		json_mode:         C.int(cfg.jsonMode),
+		uuid_as_string:    C.bool(cfg.uuidAsString),
+		network_as_binary: C.bool(cfg.networkAsBinary),
+		not_null_hints:    C.bool(cfg.notNullHints),
+		compression:       C.int(cfg.compression.Codec),
+		compression_level: C.int(cfg.compression.Level),
+		statement_timeout: C.int(cfg.timeout.Milliseconds()),
+		max_rows:          C.int64(cfg.maxRows),
+		column_names:      C.int(cfg.columnNaming),
+		numeric_precision: C.int(cfg.numPrecision),
+		numeric_scale:     C.int(cfg.numScale),
+	}
+	n := len(cfg.dictColumns)
+	if n == 0 {
+		return opts, func() {}
+	}
+	p := C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil))))
+	names := unsafe.Slice((**C.char)(p), n)
+	for i, name := range cfg.dictColumns {
+		names[i] = C.CString(name)
+	}
+	opts.dict_columns = (**C.char)(p)
+	opts.num_dict_columns = C.int(n)
+	return opts, func() {
+		for _, name := range names {
+			C.free(unsafe.Pointer(name))
+		}
+		C.free(p)
+	}
+}
+
+// clearResultOptions clears the options which shape the results of the
+// caller's own queries, like the dictionary columns, the row limit and the
+// column naming, for the queries whose results come in a fixed shape, like
+// EXPLAIN of EstimateQuery.
+func clearResultOptions(opts *C.SQLoptions) {
+	opts.json_mode = C.PG2ARROW_JSON_UTF8
+	opts.uuid_as_string = false
+	opts.network_as_binary = false
+	opts.not_null_hints = false
+	opts.dict_columns = nil
+	opts.num_dict_columns = 0
+	opts.max_rows = 0
+	opts.column_names = C.PG2ARROW_NAMES_SUFFIX
+	opts.numeric_precision = 0
+	opts.numeric_scale = 0
+}
+
+// WithBatchSize sets the number of rows per record batch. The last batch
+// of a result holds the remaining rows, and a batch is also flushed
+// early if its buffer exceeds 1GB. Small batches waste space on the
+// framing overhead, and large ones consume more memory, especially for
+// wide rows.
+func WithBatchSize(n int) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("pg2arrow: batch size must be positive, got %d", n)
+		}
+		cfg.batchSize = n
+		return nil
+	}
+}
+
+// WithAllocator sets the allocator of the record buffers returned by
+// QueryRecords. The default is memory.DefaultAllocator.
+func WithAllocator(mem memory.Allocator) Option {
+	return func(cfg *config) error {
+		if mem == nil {
+			return fmt.Errorf("pg2arrow: allocator must not be nil")
+		}
+		cfg.allocator = mem
+		return nil
+	}
+}
+
+// WithMaxBufferedBatches sets the number of record batches which
+// QueryStream, CopyOut and QueryParallel fetch ahead of the consumer. Once
+// that many batches are not consumed yet, the fetch stops until Next is
+// called, and the server is paced by the TCP flow control in turn. The
+// default is 1 for QueryStream and CopyOut, and the number of workers for
+// QueryParallel.
+func WithMaxBufferedBatches(n int) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("pg2arrow: max buffered batches must be positive, got %d", n)
+		}
+		cfg.maxBatches = n
+		return nil
+	}
+}
+
+// WithMaxBufferedBytes is like WithMaxBufferedBatches, but limits the total
+// size of the batches fetched ahead of the consumer. A batch larger than
+// the limit is still fetched when no other batches are buffered. The
+// batch being built by the C code is not counted; it is bounded by
+// WithBatchSize. The default is no limit.
+func WithMaxBufferedBytes(n int64) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("pg2arrow: max buffered bytes must be positive, got %d", n)
+		}
+		cfg.maxBytes = n
+		return nil
+	}
+}
+
+// WithStatementTimeout sets statement_timeout of the server for each
+// query, so the server itself aborts the query running longer than d,
+// even if the client is stuck; the query fails with an error matching
+// ErrStatementTimeout. The query is never wrapped in a transaction for
+// it: out of a transaction block, it is set by SET for the session, and in
+// a transaction block opened by the caller, by SET LOCAL. Either way, the
+// former value is restored after the query, even if it failed, so it never
+// lasts to the next queries on the Conn. The query opening a transaction
+// block, like BEGIN, restores it in the block, and once more after the
+// block ends, because ROLLBACK undoes the former; in the failed block,
+// only its end runs, without the timeout. A failure to restore is logged
+// as a warning, not an error of the query. d is rounded down to
+// milliseconds, and 0 means the default of the server.
+func WithStatementTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 || (d > 0 && d < time.Millisecond) || d.Milliseconds() > math.MaxInt32 {
+			return fmt.Errorf("pg2arrow: statement timeout %v out of range", d)
+		}
+		cfg.timeout = d
+		return nil
+	}
+}
+
+// WithMaxRows limits the rows of each query to n, as a safety cap against
+// a result unexpectedly huge. The limit is checked by the client as the
+// rows arrive, so the SQL command is never rewritten, and COPY is limited
+// as well. Once a row beyond n arrives, the query is canceled, and fails
+// with an error matching ErrRowLimitExceeded.
+//
+// The partial result is delivered only by the streams; QueryStream,
+// CopyOut, QueryRecords, QueryReader and QueryEach return the batches of
+// exactly n rows at first, then the error. Query and its variants return
+// the error without the result, and QueryToFile removes the file. 0 means
+// no limit, which is the default.
+//
+// QueryParallel counts the rows of all the partitions together, and cancels
+// all of them once a batch would exceed n; the batch is dropped, so the
+// batches delivered prior to the error may have fewer than n rows.
+// QueryMulti limits each statement to n rows; the RecordReader of the
+// statement beyond it returns exactly n rows, then the error, and so does
+// the MultiReader, because the rest of the statements are canceled.
+func WithMaxRows(n int64) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("pg2arrow: max rows must not be negative, got %d", n)
+		}
+		cfg.maxRows = n
+		return nil
+	}
+}
+
+// WithNumericPrecision sets the Decimal128 precision and scale of numeric
+// columns without a typmod, like the result of an aggregate or a column
+// declared just numeric, which have neither of their own. The default is
+// Decimal128(38,18), which holds 20 integer digits and 18 fraction digits;
+// a value beyond the integer digits is an error of the query, and more
+// fraction digits are rounded half away from zero. A value which needs
+// more than 38 digits in total cannot be a Decimal128, so cast it to text
+// or to numeric(p,s) in the SQL command instead. numeric(p,s) columns keep
+// their own precision and scale.
+func WithNumericPrecision(precision, scale int) Option {
+	return func(cfg *config) error {
+		if precision < 1 || precision > 38 {
+			return fmt.Errorf("pg2arrow: numeric precision %d out of range [1, 38]", precision)
+		}
+		if scale < 0 || scale > precision {
+			return fmt.Errorf("pg2arrow: numeric scale %d out of range [0, %d]", scale, precision)
+		}
+		cfg.numPrecision = precision
+		cfg.numScale = scale
+		return nil
+	}
+}
+
+// JSONMode is the representation of json and jsonb columns.
+type JSONMode int
+
+const (
+	// JSONText writes json and jsonb as Utf8 of their text.
+	JSONText JSONMode = C.PG2ARROW_JSON_UTF8
+	// JSONBinary writes json and jsonb as Binary of their wire format;
+	// that is the text for json, and a version byte followed by the text
+	// for jsonb.
+	JSONBinary JSONMode = C.PG2ARROW_JSON_BINARY
+)
+
+// WithJSONMode sets the representation of json and jsonb columns. The
+// default is JSONText, for portability. In either mode, jsonb values of an
+// unknown wire format version are an error.
+func WithJSONMode(m JSONMode) Option {
+	return func(cfg *config) error {
+		if m != JSONText && m != JSONBinary {
+			return fmt.Errorf("pg2arrow: unknown JSON mode %d", int(m))
+		}
+		cfg.jsonMode = m
+		return nil
+	}
+}
+
+// ColumnNaming is how the duplicate or anonymous column names of a result
+// are renamed, so the fields of the schema have unique names, in the order
+// of the result. The anonymous ones, like the "?column?" of PostgreSQL for
+// an expression, are named "column" at first. A new name taken by another
+// column is suffixed by the count again, like "id_1_1", until unique.
+type ColumnNaming int
+
+const (
+	// ColumnNamesSuffix suffixes the duplicates by the count; so
+	// "SELECT a.id, b.id" has "id" and "id_1", and "SELECT 1, 2, 3" has
+	// "column", "column_1" and "column_2".
+	ColumnNamesSuffix ColumnNaming = C.PG2ARROW_NAMES_SUFFIX
+	// ColumnNamesPosition suffixes the duplicates and all the anonymous
+	// ones by their 1-based position in the result; so "SELECT a.id, b.id"
+	// has "id" and "id_2", and "SELECT 1, 2, 3" has "column_1", "column_2"
+	// and "column_3".
+	ColumnNamesPosition ColumnNaming = C.PG2ARROW_NAMES_POSITION
+)
+
+// WithColumnNaming sets how the duplicate or anonymous column names are
+// renamed. The default is ColumnNamesSuffix. WithDictionaryColumns refers
+// to the columns by the new names.
+func WithColumnNaming(m ColumnNaming) Option {
+	return func(cfg *config) error {
+		if m != ColumnNamesSuffix && m != ColumnNamesPosition {
+			return fmt.Errorf("pg2arrow: unknown column naming %d", int(m))
+		}
+		cfg.columnNaming = m
+		return nil
+	}
+}
+
+// CompressionCodec is the codec to compress the record batch bodies.
+type CompressionCodec int
+
+const (
+	// CompressionNone writes the record batches as is.
+	CompressionNone CompressionCodec = C.PG2ARROW_COMPRESSION_NONE
+	// CompressionLZ4 compresses the buffers by LZ4 frame format; it is
+	// fast, with a moderate ratio.
+	CompressionLZ4 CompressionCodec = C.PG2ARROW_COMPRESSION_LZ4_FRAME
+	// CompressionZSTD compresses the buffers by Zstandard; it takes more
+	// CPU than LZ4, with a better ratio.
+	CompressionZSTD CompressionCodec = C.PG2ARROW_COMPRESSION_ZSTD
+)
+
+// Compression is the compression of the record batch bodies, and its
+// level. Level 0 is the default of the codec; that is the fast mode for
+// LZ4, up to 12, and 3 for ZSTD, up to 22.
+type Compression struct {
+	Codec CompressionCodec
+	Level int
+}
+
+// WithCompression compresses the buffers of the record batches by the
+// codec, with the compression metadata of the Arrow IPC format, so the
+// readers of the Arrow library decompress them transparently. A record
+// batch smaller than 1KB is left uncompressed, and so is a buffer which
+// the compression does not shrink. The schema and the dictionary batches
+// are never compressed. The default is CompressionNone, because not all
+// the Arrow readers support compression.
+func WithCompression(c Compression) Option {
+	return func(cfg *config) error {
+		var max int
+		switch c.Codec {
+		case CompressionNone:
+		case CompressionLZ4:
+			max = 12
+		case CompressionZSTD:
+			max = 22
+		default:
+			return fmt.Errorf("pg2arrow: unknown compression codec %d", int(c.Codec))
+		}
+		if c.Level < 0 || c.Level > max {
+			return fmt.Errorf("pg2arrow: compression level %d out of range [0, %d]", c.Level, max)
+		}
+		cfg.compression = c
+		return nil
+	}
+}
+
+// WithUUIDAsString writes uuid columns as Utf8 of the canonical text form,
+// like "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", for readability. By
+// default, they are FixedSizeBinary(16) of the bytes as is, which takes
+// less than half the space.
+func WithUUIDAsString() Option {
+	return func(cfg *config) error {
+		cfg.uuidAsString = true
+		return nil
+	}
+}
+
+// WithNetworkAsBinary writes inet and cidr columns as FixedSizeBinary(17),
+// and macaddr and macaddr8 columns as FixedSizeBinary(6) and (8) of the
+// bytes. An inet or cidr value is the prefix length in the first byte,
+// then the IPv6 address, or the IPv4-mapped IPv6 address (::ffff:a.b.c.d)
+// for IPv4; the prefix length is of the original family, like 24 for
+// 192.168.0.0/24. By default, they are Utf8 of the canonical text form,
+// like "2001:db8::1/64" or "08:00:2b:01:02:03".
+func WithNetworkAsBinary() Option {
+	return func(cfg *config) error {
+		cfg.networkAsBinary = true
+		return nil
+	}
+}
+
+// WithNotNullHints marks the fields non-nullable if their columns simply
+// reference a table column with NOT NULL constraint, by a catalog lookup
+// of each such column. By default, all the fields are nullable, because
+// outer joins and aggregates may still produce NULLs on those columns,
+// while PostgreSQL reports the table column regardless of them; so use it
+// only for the queries like plain table scans. The results of QueryMulti
+// are always nullable, without the catalog.
+func WithNotNullHints() Option {
+	return func(cfg *config) error {
+		cfg.notNullHints = true
+		return nil
+	}
+}
+
+// WithDictionaryColumns writes the text columns of the names as
+// Dictionary<Int32, Utf8>, which saves much space for low-cardinality
+// columns like status codes. The dictionary is built from the values: the
+// record batch is preceded by a delta dictionary batch of the values
+// which first appear in it. The names are matched to the result columns
+// exactly; a name missing in the result, or a column of a non-text type,
+// is an error of the query. Enum columns are always dictionary-encoded.
+func WithDictionaryColumns(names ...string) Option {
+	return func(cfg *config) error {
+		for _, name := range names {
+			if name == "" {
+				return fmt.Errorf("pg2arrow: dictionary column name must not be empty")
+			}
+		}
+		cfg.dictColumns = append(cfg.dictColumns, names...)
+		return nil
+	}
+}
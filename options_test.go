@@ -0,0 +1,83 @@
+package pg2arrow
+
+import (
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// compressionQuery has a column which compresses well, and one of random
+// bytes which does not shrink.
+const compressionQuery = `SELECT i, repeat('pg2arrow', 10) AS s, decode(md5(random()::text), 'hex') AS r
+  FROM generate_series(1, 1000) i`
+
+func TestCompression(t *testing.T) {
+	plain := testConn(t)
+	buf, err := plain.Query(compressionQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want := testFile(t, "none", buf)
+
+	for _, tc := range []struct {
+		name string
+		c    Compression
+	}{
+		{"lz4", Compression{Codec: CompressionLZ4}},
+		{"lz4 level 12", Compression{Codec: CompressionLZ4, Level: 12}},
+		{"zstd", Compression{Codec: CompressionZSTD}},
+		{"zstd level 22", Compression{Codec: CompressionZSTD, Level: 22}},
+	} {
+		c := testConn(t, WithCompression(tc.c))
+		got, err := c.Query(compressionQuery)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(got) >= len(buf)/2 {
+			t.Errorf("%s: got %d bytes, want much less than %d uncompressed", tc.name, len(got), len(buf))
+		}
+
+		// the readers of the Arrow library decompress them transparently,
+		// of the file and of the stream
+		_, recs := testFile(t, tc.name, got)
+		_, stream := testStream(t, c, compressionQuery)
+		for _, recs := range [][]arrow.Record{recs, stream} {
+			if len(recs) != 1 || recs[0].NumRows() != 1000 {
+				t.Fatalf("%s: got %d record batches, want one of 1000 rows", tc.name, len(recs))
+			}
+			for j := 0; j < 2; j++ {
+				if !array.Equal(recs[0].Column(j), want[0].Column(j)) {
+					t.Errorf("%s: column %d differs from uncompressed", tc.name, j)
+				}
+			}
+			if n := recs[0].Column(2).(*array.Binary).Len(); n != 1000 {
+				t.Errorf("%s: got %d random values, want 1000", tc.name, n)
+			}
+		}
+	}
+
+	// a record batch smaller than 1KB is left uncompressed
+	small, err := plain.Query("SELECT 1 AS i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConn(t, WithCompression(Compression{Codec: CompressionZSTD}))
+	if got, err := c.Query("SELECT 1 AS i"); err != nil || len(got) != len(small) {
+		t.Errorf("got %d bytes and %v, want %d uncompressed", len(got), err, len(small))
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	for _, c := range []Compression{
+		{Codec: CompressionLZ4, Level: -1},
+		{Codec: CompressionLZ4, Level: 13},
+		{Codec: CompressionZSTD, Level: 23},
+		{Codec: CompressionNone, Level: 1},
+		{Codec: CompressionCodec(99)},
+	} {
+		if _, err := newConfig([]Option{WithCompression(c)}); err == nil {
+			t.Errorf("%+v: got no error", c)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// partitionsPerWorker is the number of partitions per worker. The workers
+// pick up the partitions one by one, so a skewed partition never keeps
+// the other workers idle.
+const partitionsPerWorker = 4
+
+// partition is a part of the query run by a worker.
+type partition struct {
+	sql  string
+	args []interface{}
+}
+
+// QueryParallel runs the SQL command on numWorkers connections in
+// parallel, then returns a RecordReader over the whole result. The rows
+// are split into the ranges of partitionCol, an integer column of the
+// result, between its min and max values; the rows with NULL are in the
+// first range. The ranges are of the same width, and there are more
+// ranges than workers, so a worker picks up the next range as soon as it
+// completes one even if the values of partitionCol are skewed.
+//
+// The connections are opened with the DSN and options of c, and closed
+// when the reader is closed. The order of the record batches across the
+// ranges is not preserved, and each range is run in its own snapshot.
+func (c *Conn) QueryParallel(sql, partitionCol string, numWorkers int) (*RecordReader, error) {
+	if numWorkers < 1 {
+		return nil, fmt.Errorf("pg2arrow: number of workers must be positive, got %d", numWorkers)
+	}
+	if len(c.cfg.dictColumns) > 0 {
+		// each worker would build its own dictionaries
+		return nil, errors.New("pg2arrow: QueryParallel does not support WithDictionaryColumns")
+	}
+	sql = strings.TrimRight(sql, "; \t\r\n")
+	col := quoteIdent(partitionCol)
+
+	parts, err := c.partitions(sql, col, numWorkers*partitionsPerWorker)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) < numWorkers {
+		numWorkers = len(parts)
+	}
+
+	conns := make([]*Conn, 0, numWorkers)
+	closeAll := func() {
+		for _, w := range conns {
+			w.Close()
+		}
+	}
+	for i := 0; i < numWorkers; i++ {
+		w, err := Connect(c.dsn, c.opts...)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		conns = append(conns, w)
+	}
+
+	// the first partition gives the schema of all of them
+	qs := make([]*canceler, numWorkers)
+	for i := range qs {
+		qs[i] = new(canceler)
+	}
+	first, err := conns[0].openStream(parts[0].sql, parts[0].args, qs[0])
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	queue := make(chan partition, len(parts))
+	for _, p := range parts[1:] {
+		queue <- p
+	}
+	close(queue)
+
+	maxBatches := c.cfg.maxBatches
+	if maxBatches == 0 {
+		maxBatches = numWorkers
+	}
+	r := &RecordReader{
+		schema: first.header(),
+		rec:    first.rec,
+		cancel: func() {
+			for _, q := range qs {
+				q.Cancel()
+			}
+		},
+		limit:  &rowLimit{max: c.cfg.maxRows},
+		ch:     make(chan batch, maxBatches),
+		budget: newBudget(c.cfg.maxBytes),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for i, w := range conns {
+		var s *stream
+		if i == 0 {
+			s = first
+		}
+		wg.Add(1)
+		go func(w *Conn, q *canceler, s *stream) {
+			defer wg.Done()
+			r.producePartitions(w, q, s, queue)
+		}(w, qs[i], s)
+	}
+	go func() {
+		defer close(r.exited)
+		defer closeAll()
+
+		wg.Wait()
+		r.send(batch{nil, io.EOF})
+	}()
+	return r, nil
+}
+
+// producePartitions runs the partitions on the connection w, until no
+// more partitions or an error. The stream s, if any, is already opened.
+func (r *RecordReader) producePartitions(w *Conn, q *canceler, s *stream, queue <-chan partition) {
+	for {
+		if s == nil {
+			p, ok := <-queue
+			if !ok {
+				return
+			}
+			var err error
+			if s, err = w.openStream(p.sql, p.args, q); err != nil {
+				r.send(batch{nil, r.limit.wrap(err)})
+				return
+			}
+			// the partitions count as one query
+			s.rec = r.rec
+			r.rec.attach()
+			if !bytes.Equal(s.header(), r.schema) {
+				s.close()
+				r.send(batch{nil, errors.New("pg2arrow: schema of the partitions mismatched")})
+				return
+			}
+		}
+
+		nrows := s.nrows
+		b, err := s.next()
+		if err == io.EOF {
+			s.close()
+			s = nil
+			continue
+		}
+		if err == nil && !r.limit.admit(s.nrows-nrows) {
+			// the others are canceled, then fail by the limit too
+			r.cancel()
+			err = r.limit.err()
+		}
+		if err != nil {
+			s.close()
+			r.send(batch{nil, r.limit.wrap(err)})
+			return
+		}
+		if !r.send(batch{b, nil}) {
+			s.close()
+			return
+		}
+	}
+}
+
+// rowLimit counts the rows of all the partitions of QueryParallel against
+// WithMaxRows, because each of them is limited by its own stream only.
+type rowLimit struct {
+	max int64 // 0 means no limit
+
+	mu      sync.Mutex
+	rows    int64
+	reached bool
+}
+
+// admit counts the rows of a batch, unless they exceed the limit; then the
+// batch is dropped, and the rest of the partitions as well.
+func (l *rowLimit) admit(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.reached || (l.max > 0 && l.rows+n > l.max) {
+		l.reached = true
+		return false
+	}
+	l.rows += n
+	return true
+}
+
+// wrap returns the error of the limit instead of err, once a batch was
+// dropped by the limit; the partitions canceled then fail by any error.
+func (l *rowLimit) wrap(err error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.reached {
+		return l.err()
+	}
+	return err
+}
+
+// err returns the error of the limit, like the one of the C code.
+func (l *rowLimit) err() error {
+	return &QueryError{
+		Code:     CodeInternal,
+		Message:  fmt.Sprintf("the result exceeds the limit of %d rows", l.max),
+		rowLimit: true,
+	}
+}
+
+// partitions splits the query into n ranges of col at most.
+func (c *Conn) partitions(sql, col string, n int) ([]partition, error) {
+	it, err := c.QueryRecords(fmt.Sprintf(
+		"SELECT min(%s)::bigint, max(%s)::bigint FROM (%s) AS __pg2arrow_part", col, col, sql))
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	rec, err := it.Next()
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Release()
+
+	lo, ok1 := rec.Column(0).(*array.Int64)
+	hi, ok2 := rec.Column(1).(*array.Int64)
+	if !ok1 || !ok2 || rec.NumRows() != 1 {
+		return nil, errors.New("pg2arrow: unexpected result of the partition range")
+	}
+	if lo.IsNull(0) {
+		// no rows, or all NULL; nothing to split
+		return []partition{{sql: sql}}, nil
+	}
+
+	bounds := splitRange(lo.Value(0), hi.Value(0), n)
+	parts := make([]partition, len(bounds))
+	for i, b := range bounds {
+		switch {
+		case len(bounds) == 1:
+			parts[i] = partition{sql: sql}
+		case i == 0:
+			parts[i] = partition{
+				sql: fmt.Sprintf("SELECT * FROM (%s) AS __pg2arrow_part WHERE %s < $1 OR %s IS NULL",
+					sql, col, col),
+				args: []interface{}{bounds[i+1]},
+			}
+		case i == len(bounds)-1:
+			parts[i] = partition{
+				sql:  fmt.Sprintf("SELECT * FROM (%s) AS __pg2arrow_part WHERE %s >= $1", sql, col),
+				args: []interface{}{b},
+			}
+		default:
+			parts[i] = partition{
+				sql: fmt.Sprintf("SELECT * FROM (%s) AS __pg2arrow_part WHERE %s >= $1 AND %s < $2",
+					sql, col, col),
+				args: []interface{}{b, bounds[i+1]},
+			}
+		}
+	}
+	return parts, nil
+}
+
+// splitRange returns the lower bounds of at most n ranges of the same
+// width, covering lo to hi inclusive.
+func splitRange(lo, hi int64, n int) []int64 {
+	diff := uint64(hi) - uint64(lo)
+	step := diff/uint64(n) + 1
+
+	var bounds []int64
+	for off := uint64(0); ; off += step {
+		bounds = append(bounds, int64(uint64(lo)+off))
+		if diff-off < step {
+			break
+		}
+	}
+	return bounds
+}
+
+// quoteIdent quotes the name as an SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
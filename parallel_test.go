@@ -0,0 +1,138 @@
+package pg2arrow
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+func TestMaxRowsParallel(t *testing.T) {
+	c := testConn(t, WithMaxRows(100), WithBatchSize(10))
+
+	// the limit is of the whole result, not of each partition
+	r, err := c.QueryParallel("SELECT i FROM generate_series(1, 1000) i", "i", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrows, err := testRows(t, r)
+	if !errors.Is(err, ErrRowLimitExceeded) {
+		t.Fatalf("got %v, want ErrRowLimitExceeded", err)
+	}
+	if nrows > 100 {
+		t.Errorf("got %d rows, want 100 at most", nrows)
+	}
+
+	r, err = c.QueryParallel("SELECT i FROM generate_series(1, 100) i", "i", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nrows, err := testRows(t, r); err != nil || nrows != 100 {
+		t.Errorf("got %d rows and %v, want 100 rows of the limit exactly", nrows, err)
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	for _, tc := range []struct {
+		lo, hi int64
+		n      int
+		want   []int64
+	}{
+		{5, 5, 4, []int64{5}},
+		{0, 2, 5, []int64{0, 1, 2}},
+		{0, 99, 4, []int64{0, 25, 50, 75}},
+		{-10, 10, 3, []int64{-10, -3, 4}},
+		{1, 1000, 1, []int64{1}},
+		{math.MinInt64, math.MaxInt64, 4, []int64{math.MinInt64, -1 << 62, 0, 1 << 62}},
+		{math.MaxInt64 - 1, math.MaxInt64, 4, []int64{math.MaxInt64 - 1, math.MaxInt64}},
+	} {
+		got := splitRange(tc.lo, tc.hi, tc.n)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("splitRange(%d, %d, %d) = %v, want %v", tc.lo, tc.hi, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestQueryParallel(t *testing.T) {
+	c := testConn(t, WithBatchSize(50))
+	testTable(t, c, "pg2arrow_test_parallel", "i int")
+	testExec(t, c, "INSERT INTO pg2arrow_test_parallel "+
+		"SELECT i FROM generate_series(-500, 499) i UNION ALL SELECT NULL FROM generate_series(1, 3)")
+
+	// the rows with NULL are in the first range, and each row in one range
+	for _, tc := range []struct {
+		sql   string
+		nrows int64
+	}{
+		{"SELECT * FROM pg2arrow_test_parallel", 1003},
+		{"SELECT * FROM pg2arrow_test_parallel WHERE i IS NULL", 3},
+		{"SELECT * FROM pg2arrow_test_parallel WHERE i = 7 OR i IS NULL", 4},
+		{"SELECT * FROM pg2arrow_test_parallel WHERE i < 5;", 505},
+		{"SELECT * FROM pg2arrow_test_parallel WHERE false", 0},
+	} {
+		want := testColumn(t, c, "SELECT count(*) FROM ("+
+			strings.TrimSuffix(tc.sql, ";")+") AS t").(*array.Int64).Value(0)
+		if want != tc.nrows {
+			t.Fatalf("%s: got %d rows by Query, want %d", tc.sql, want, tc.nrows)
+		}
+		for _, n := range []int{1, 3, 8} {
+			r, err := c.QueryParallel(tc.sql, "i", n)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.sql, err)
+			}
+			if nrows, err := testRows(t, r); err != nil || nrows != want {
+				t.Errorf("%s: got %d rows and %v by %d workers, want %d rows", tc.sql, nrows, err, n, want)
+			}
+		}
+	}
+}
+
+func TestQueryParallelSchemaMismatch(t *testing.T) {
+	c := testConn(t)
+
+	// a partition of another schema than the first one, like by ALTER TABLE
+	// in the middle, stops the reader
+	r := &RecordReader{
+		schema: []byte("schema of the first partition"),
+		rec:    newStatsRecorder(nil),
+		limit:  &rowLimit{},
+		ch:     make(chan batch, 1),
+		budget: newBudget(0),
+		done:   make(chan struct{}),
+	}
+	queue := make(chan partition, 1)
+	queue <- partition{sql: "SELECT 1"}
+	close(queue)
+	r.producePartitions(c, new(canceler), nil, queue)
+	if b := <-r.ch; b.err == nil || !strings.Contains(b.err.Error(), "schema of the partitions mismatched") {
+		t.Errorf("got %v, want the schema mismatched", b.err)
+	}
+	// the Conn is released
+	testExec(t, c, "SELECT 1")
+}
+
+func TestQueryParallelClose(t *testing.T) {
+	c := testConn(t)
+
+	// the partitions sleep, but not the query of their range, which has
+	// min( in its text
+	sql := "SELECT i FROM generate_series(1, 8) i " +
+		"WHERE current_query() LIKE '%' || 'mi' || 'n(%' OR (SELECT true FROM pg_sleep(30))"
+	r, err := c.QueryParallel(sql, "i", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSleeping(t, c, 2)
+	start := time.Now()
+	r.Close()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Close took %v, want the partitions canceled", d)
+	}
+	if _, err := r.Next(); err != ErrReaderClosed {
+		t.Errorf("got %v, want ErrReaderClosed", err)
+	}
+}
@@ -0,0 +1,154 @@
+package pg2arrow
+
+// #include <stdlib.h>
+// #include "pg2arrow.h"
+import "C"
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+// byteaOID is the type of binary parameters; the binary representation of
+// bytea is the raw bytes.
+const byteaOID = 17
+
+// params holds the parameters of the SQL command in C memory, because
+// libpq takes arrays of pointers which cgo never allows for Go memory.
+type params struct {
+	c C.SQLparams
+}
+
+// newParams converts the Go values to the parameters of the SQL command.
+// The types are inferred by the server from the SQL command, except for
+// []byte which is sent as bytea in binary. A nil value, or a nil pointer,
+// is sent as SQL NULL. The caller must free the params.
+func newParams(args []interface{}) (*params, error) {
+	p := new(params)
+	if len(args) == 0 {
+		return p, nil
+	}
+
+	n := len(args)
+	p.c.nparams = C.int(n)
+	p.c.types = (*C.Oid)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(C.Oid(0)))))
+	p.c.values = (**C.char)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+	p.c.lengths = (*C.int)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(C.int(0)))))
+	p.c.formats = (*C.int)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(C.int(0)))))
+
+	types := unsafe.Slice(p.c.types, n)
+	values := unsafe.Slice(p.c.values, n)
+	lengths := unsafe.Slice(p.c.lengths, n)
+	formats := unsafe.Slice(p.c.formats, n)
+	for i, arg := range args {
+		v, err := paramValue(arg)
+		if err != nil {
+			p.free()
+			return nil, fmt.Errorf("pg2arrow: parameter $%d: %w", i+1, err)
+		}
+		switch v := v.(type) {
+		case nil:
+			values[i] = nil
+		case []byte:
+			types[i] = byteaOID
+			values[i] = (*C.char)(C.CBytes(v))
+			lengths[i] = C.int(len(v))
+			formats[i] = 1
+		case string:
+			values[i] = C.CString(v)
+		}
+	}
+	return p, nil
+}
+
+// paramValue returns the value to be sent; either nil, []byte for binary
+// or string for text representation.
+func paramValue(arg interface{}) (interface{}, error) {
+	if v, ok := arg.(driver.Valuer); ok {
+		if rv := reflect.ValueOf(arg); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return nil, nil
+		}
+		var err error
+		if arg, err = v.Value(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch v := arg.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if v == nil {
+			return nil, nil
+		}
+		return v, nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int8:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int16:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return formatFloat(float64(v), 32), nil
+	case float64:
+		return formatFloat(v, 64), nil
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999999Z07:00"), nil
+	}
+
+	// pointers to the supported types; nil pointer is SQL NULL
+	if rv := reflect.ValueOf(arg); rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return paramValue(rv.Elem().Interface())
+	}
+	return nil, fmt.Errorf("unsupported type %T", arg)
+}
+
+// formatFloat returns the text representation of float4/float8.
+func formatFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, bitSize)
+}
+
+func (p *params) free() {
+	if p.c.nparams == 0 {
+		return
+	}
+	for _, v := range unsafe.Slice(p.c.values, int(p.c.nparams)) {
+		C.free(unsafe.Pointer(v))
+	}
+	C.free(unsafe.Pointer(p.c.types))
+	C.free(unsafe.Pointer(p.c.values))
+	C.free(unsafe.Pointer(p.c.lengths))
+	C.free(unsafe.Pointer(p.c.formats))
+	p.c = C.SQLparams{}
+}
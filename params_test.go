@@ -0,0 +1,139 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// failingValuer is a driver.Valuer which fails.
+type failingValuer struct{}
+
+func (failingValuer) Value() (interface{}, error) { return nil, errors.New("no value") }
+
+func TestParamValue(t *testing.T) {
+	n := int32(-7)
+	var nilInt *int
+	var nilNull *sql.NullString
+	for _, tc := range []struct {
+		arg  interface{}
+		want interface{}
+	}{
+		{nil, nil},
+		{"text", "text"},
+		{"", ""},
+		{[]byte{0, 0xff}, []byte{0, 0xff}},
+		{[]byte(nil), nil},
+		{true, "true"},
+		{int8(-128), "-128"},
+		{int16(32767), "32767"},
+		{n, "-7"},
+		{int64(math.MinInt64), "-9223372036854775808"},
+		{uint8(255), "255"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{float32(0.1), "0.1"},
+		{0.1, "0.1"},
+		{math.Inf(-1), "-Infinity"},
+		{time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC), "2024-01-02 03:04:05.000006Z"},
+		{time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 9*3600)), "2024-01-02 03:04:05+09:00"},
+		{&n, "-7"},
+		{nilInt, nil},
+		{sql.NullString{String: "v", Valid: true}, "v"},
+		{sql.NullString{}, nil},
+		{sql.NullInt64{Int64: 5, Valid: true}, "5"},
+		{nilNull, nil},
+	} {
+		got, err := paramValue(tc.arg)
+		if err != nil {
+			t.Errorf("%T %v: %v", tc.arg, tc.arg, err)
+			continue
+		}
+		if b, ok := tc.want.([]byte); ok {
+			if gotb, ok := got.([]byte); !ok || !bytes.Equal(gotb, b) {
+				t.Errorf("%T %v: got %#v, want %#v", tc.arg, tc.arg, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("%T %v: got %#v, want %#v", tc.arg, tc.arg, got, tc.want)
+		}
+	}
+
+	for _, arg := range []interface{}{struct{}{}, []int{1}, failingValuer{}} {
+		if got, err := paramValue(arg); err == nil {
+			t.Errorf("%T: got %#v, want an error", arg, got)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	for _, tc := range []struct {
+		f       float64
+		bitSize int
+		want    string
+	}{
+		{0, 64, "0"},
+		{1.5, 64, "1.5"},
+		{-2.5e-300, 64, "-2.5e-300"},
+		{float64(float32(0.1)), 32, "0.1"},
+		{float64(float32(0.1)), 64, "0.10000000149011612"},
+		{math.Inf(1), 64, "Infinity"},
+		{math.Inf(-1), 32, "-Infinity"},
+		{math.NaN(), 64, "NaN"},
+	} {
+		if got := formatFloat(tc.f, tc.bitSize); got != tc.want {
+			t.Errorf("%v of %d bits: got %q, want %q", tc.f, tc.bitSize, got, tc.want)
+		}
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	c := testConn(t)
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	buf, err := c.QueryParams(`SELECT $1::int8 AS a, $2::text AS b, $3::bytea AS c,
+	                                  $4::float8 AS d, $5::timestamptz AS e, $6::bool AS f, $7::text AS g`,
+		int64(42), "it's $2", []byte{0, 0xff}, math.Inf(1), ts, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, recs := testFile(t, "QueryParams", buf)
+	if len(recs) != 1 || recs[0].NumRows() != 1 {
+		t.Fatalf("got %d record batches, want a row", len(recs))
+	}
+	rec := recs[0]
+	if got := rec.Column(0).(*array.Int64).Value(0); got != 42 {
+		t.Errorf("a: got %d, want 42", got)
+	}
+	// the values are never interpolated into the SQL command
+	if got := rec.Column(1).(*array.String).Value(0); got != "it's $2" {
+		t.Errorf("b: got %q", got)
+	}
+	if got := rec.Column(2).(*array.Binary).Value(0); !bytes.Equal(got, []byte{0, 0xff}) {
+		t.Errorf("c: got %x, want 00ff", got)
+	}
+	if got := rec.Column(3).(*array.Float64).Value(0); !math.IsInf(got, 1) {
+		t.Errorf("d: got %v, want +Inf", got)
+	}
+	if got := rec.Column(4).(*array.Timestamp).Value(0).ToTime(arrow.Microsecond); !got.Equal(ts) {
+		t.Errorf("e: got %s, want %v", got, ts)
+	}
+	if got := rec.Column(5).(*array.Boolean).Value(0); !got {
+		t.Errorf("f: got false, want true")
+	}
+	if !rec.Column(6).IsNull(0) {
+		t.Errorf("g: got %s, want NULL", rec.Column(6).ValueStr(0))
+	}
+
+	// the unsupported value fails before the query, which releases the Conn
+	if _, err := c.QueryParams("SELECT $1::int, $2::int", 1, struct{}{}); err == nil ||
+		!strings.Contains(err.Error(), "parameter $2") {
+		t.Errorf("got %v, want the error of $2", err)
+	}
+	testExec(t, c, "SELECT 1")
+}
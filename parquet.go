@@ -0,0 +1,123 @@
+package pg2arrow
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+	"github.com/apache/arrow/go/v17/parquet"
+	"github.com/apache/arrow/go/v17/parquet/compress"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+)
+
+// ParquetCodec is the compression codec of the Parquet column chunks.
+type ParquetCodec int
+
+const (
+	ParquetSnappy ParquetCodec = iota
+	ParquetZstd
+	ParquetUncompressed
+)
+
+func (c ParquetCodec) compression() (compress.Compression, error) {
+	switch c {
+	case ParquetSnappy:
+		return compress.Codecs.Snappy, nil
+	case ParquetZstd:
+		return compress.Codecs.Zstd, nil
+	case ParquetUncompressed:
+		return compress.Codecs.Uncompressed, nil
+	}
+	return 0, fmt.Errorf("pg2arrow: unknown Parquet codec %d", int(c))
+}
+
+// ParquetOptions controls the Parquet file written by QueryToParquet. The
+// zero value is a snappy compressed and dictionary encoded file with the
+// default row group size of the Arrow library.
+type ParquetOptions struct {
+	// RowGroupSize is the maximum number of rows per row group. The rows
+	// of consecutive record batches are gathered into a row group.
+	RowGroupSize int64
+	// Codec is the compression codec of the column chunks.
+	Codec ParquetCodec
+	// DisableDictionary turns off the dictionary encoding of the columns.
+	DisableDictionary bool
+}
+
+// QueryToParquet runs the SQL command, then writes its result to the file
+// at path in Parquet format. The result is converted by the same type
+// mapping as Query, then translated to Parquet by the Arrow library, and
+// the Arrow schema is stored in the file metadata.
+//
+// Some Arrow types don't round-trip through Parquet as is:
+//
+//   - enum types (Dictionary of Utf8) are stored as plain strings; the
+//     Arrow readers restore the dictionary using the stored schema only.
+//   - float2 (Float16) requires a reader aware of the FLOAT16 logical type.
+//   - unsigned integers, used for unknown fixed-length types of 1, 2, 4
+//     or 8 bytes, are stored with the unsigned INT logical type, which
+//     some readers (like Spark) read back as signed integers.
+//   - interval (Interval of MonthDayNano) is not supported by the Parquet
+//     writer of the Arrow library; cast the column to text, or extract
+//     its epoch, in the query.
+//
+// If the query fails midway, the partial file is removed.
+func (c *Conn) QueryToParquet(sql, path string, opts ParquetOptions) (err error) {
+	codec, err := opts.Codec.compression()
+	if err != nil {
+		return err
+	}
+	props := []parquet.WriterProperty{
+		parquet.WithCompression(codec),
+		parquet.WithDictionaryDefault(!opts.DisableDictionary),
+	}
+	if opts.RowGroupSize > 0 {
+		props = append(props, parquet.WithMaxRowGroupLength(opts.RowGroupSize))
+	}
+
+	s, err := c.openStream(sql, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	r := newIPCReader(s)
+	rdr, err := ipc.NewReader(r)
+	if err != nil {
+		return r.wrapErr(err)
+	}
+	defer rdr.Release()
+
+	// the file is closed by ourselves, not by the Parquet writer
+	w, err := pqarrow.NewFileWriter(rdr.Schema(), struct{ io.Writer }{f},
+		parquet.NewWriterProperties(props...),
+		pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return err
+	}
+	for rdr.Next() {
+		if err := w.WriteBuffered(rdr.Record()); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := rdr.Err(); err != nil && err != io.EOF {
+		w.Close()
+		return r.wrapErr(err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,114 @@
+package pg2arrow
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet/compress"
+	"github.com/apache/arrow/go/v17/parquet/file"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+)
+
+// testParquet opens the Parquet file, which is closed at the end of the
+// test, then returns it with the table read by the stored schema.
+func testParquet(t *testing.T, path string) (*file.Reader, arrow.Table) {
+	t.Helper()
+	rdr, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		t.Fatalf("%s: invalid Parquet file: %v", path, err)
+	}
+	t.Cleanup(func() { rdr.Close() })
+
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := fr.ReadTable(context.Background())
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	t.Cleanup(tbl.Release)
+	return rdr, tbl
+}
+
+func TestQueryToParquet(t *testing.T) {
+	c := testConn(t, WithBatchSize(3))
+	sql := `SELECT i, CASE WHEN i % 2 = 0 THEN 'v' || i END AS s, i / 4.0 AS f
+	          FROM generate_series(1, 10) i`
+
+	for _, tc := range []struct {
+		codec ParquetCodec
+		want  compress.Compression
+	}{
+		{ParquetSnappy, compress.Codecs.Snappy},
+		{ParquetZstd, compress.Codecs.Zstd},
+		{ParquetUncompressed, compress.Codecs.Uncompressed},
+	} {
+		path := filepath.Join(t.TempDir(), "result.parquet")
+		// the rows of the batches are gathered into the row groups
+		if err := c.QueryToParquet(sql, path, ParquetOptions{RowGroupSize: 4, Codec: tc.codec}); err != nil {
+			t.Fatalf("%v: %v", tc.want, err)
+		}
+		rdr, tbl := testParquet(t, path)
+		if n := rdr.NumRowGroups(); n != 3 {
+			t.Errorf("%v: got %d row groups, want 3", tc.want, n)
+		}
+		chunk, err := rdr.MetaData().RowGroup(0).ColumnChunk(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := chunk.Compression(); got != tc.want {
+			t.Errorf("%v: got the column chunk of %v", tc.want, got)
+		}
+		if tbl.NumRows() != 10 || tbl.NumCols() != 3 {
+			t.Fatalf("%v: got %d rows and %d columns, want 10 and 3", tc.want, tbl.NumRows(), tbl.NumCols())
+		}
+
+		// the Arrow types are restored by the stored schema
+		if got := tbl.Schema().Field(0).Type; !arrow.TypeEqual(got, arrow.PrimitiveTypes.Int32) {
+			t.Errorf("%v: got i of %v, want int32", tc.want, got)
+		}
+		n := 1
+		for _, chunk := range tbl.Column(1).Data().Chunks() {
+			s := chunk.(*array.String)
+			for row := 0; row < s.Len(); row, n = row+1, n+1 {
+				if s.IsNull(row) != (n%2 != 0) || (!s.IsNull(row) && s.Value(row) != fmt.Sprintf("v%d", n)) {
+					t.Errorf("%v: i = %d: got s = %s", tc.want, n, s.ValueStr(row))
+				}
+			}
+		}
+	}
+}
+
+func TestQueryToParquetFailure(t *testing.T) {
+	c := testConn(t, WithBatchSize(2))
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		name string
+		sql  string
+		opts ParquetOptions
+	}{
+		// the division by zero fails after a few batches written
+		{"midway", "SELECT 1 / (i - 7) AS r FROM generate_series(1, 10) i", ParquetOptions{}},
+		// the Parquet writer of the Arrow library has no interval
+		{"interval", "SELECT interval '1 day' AS d", ParquetOptions{}},
+		{"codec", "SELECT 1", ParquetOptions{Codec: ParquetCodec(99)}},
+	} {
+		path := filepath.Join(dir, tc.name+".parquet")
+		if err := c.QueryToParquet(tc.sql, path, tc.opts); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: got the file left, %v", tc.name, err)
+		}
+	}
+	// the Conn is released
+	testExec(t, c, "SELECT 1")
+}
@@ -7,25 +7,107 @@
  * it under the terms of the PostgreSQL License. See the LICENSE file.
  */
 #include "pg2arrow.h"
+#include <lz4frame.h>
+#include <zstd.h>
 
 /* static functions */
-#define CURSOR_NAME		"curr_pg2arrow"
-static PGresult *pgsql_begin_query(PGconn *conn, const char *query);
-static PGresult *pgsql_next_result(PGconn *conn);
-static void      pgsql_end_query(PGconn *conn);
+static char     *pgsql_trim_query(const char *query);
+static SQLtable *pgsql_prepare_query(PGconn *conn, const char *stmt_name,
+									 const char *query,
+									 const SQLparams *params,
+									 const SQLoptions *options);
+static void      pgsql_begin_query(SQLtable *table, const SQLparams *params);
+static void      pgsql_begin_copy(SQLtable *table);
+static bool      pgsql_fetch_batch(SQLtable *table);
+static bool      pgsql_fetch_copy_batch(SQLtable *table);
+static void      pgsql_abort_query(PGconn *conn);
+static void      __vElog(int code, const char *sqlstate,
+						 const char *filename, int lineno,
+						 const char *fmt, va_list va_args)
+			pg_attribute_noreturn();
 
 /* command options */
 //static char	   *sql_command = NULL;
 static char	   *output_filename = NULL;
 static size_t	batch_segment_sz = (1UL << 30);
-static char	   *pgsql_hostname = "127.0.0.1";
-static char	   *pgsql_portno = "5432";
-static char	   *pgsql_username = "postgres";
-static int		pgsql_password_prompt = 0;
-static char	   *pgsql_database = "postgres";
 static char	   *dump_arrow_filename = NULL;
 int				shows_progress = 0;
 
+/* error handler of the current thread */
+__thread ErrorInfo	   *pg2arrow_error_info = NULL;
+__thread sigjmp_buf	   *pg2arrow_error_jmp = NULL;
+
+static void
+__vElog(int code, const char *sqlstate,
+		const char *filename, int lineno,
+		const char *fmt, va_list va_args)
+{
+	ErrorInfo  *errinfo = pg2arrow_error_info;
+	ErrorInfo	temp;
+	size_t		len;
+
+	if (!errinfo)
+		errinfo = &temp;
+	memset(errinfo, 0, sizeof(ErrorInfo));
+	errinfo->code = code;
+	if (sqlstate)
+		strncpy(errinfo->sqlstate, sqlstate, sizeof(errinfo->sqlstate) - 1);
+	vsnprintf(errinfo->message, sizeof(errinfo->message), fmt, va_args);
+	/* libpq's messages usually have a trailing newline */
+	len = strlen(errinfo->message);
+	while (len > 0 && isspace(errinfo->message[len-1]))
+		errinfo->message[--len] = '\0';
+
+	if (pg2arrow_error_jmp)
+		siglongjmp(*pg2arrow_error_jmp, 1);
+	fprintf(stderr, "%s:%d  %s\n", filename, lineno, errinfo->message);
+	exit(1);
+}
+
+void
+__Elog(int code, const char *sqlstate,
+	   const char *filename, int lineno,
+	   const char *fmt, ...)
+{
+	va_list		va_args;
+
+	va_start(va_args, fmt);
+	__vElog(code, sqlstate, filename, lineno, fmt, va_args);
+	va_end(va_args);
+}
+
+/*
+ * __ElogResult
+ *
+ * NOTE: PGresult is released here, because we never return to the caller.
+ */
+void
+__ElogResult(PGconn *conn, PGresult *res,
+			 const char *filename, int lineno,
+			 const char *fmt, ...)
+{
+	char		sqlstate[6];
+	int			code = PG2ARROW_ERR_QUERY;
+	char		message[1024];
+	va_list		va_args;
+
+	memset(sqlstate, 0, sizeof(sqlstate));
+	if (res && PQresultErrorField(res, PG_DIAG_SQLSTATE))
+		strncpy(sqlstate, PQresultErrorField(res, PG_DIAG_SQLSTATE),
+				sizeof(sqlstate) - 1);
+	if (!conn || PQstatus(conn) != CONNECTION_OK)
+		code = PG2ARROW_ERR_CONNECTION;
+
+	va_start(va_args, fmt);
+	vsnprintf(message, sizeof(message), fmt, va_args);
+	va_end(va_args);
+	if (res)
+		PQclear(res);
+
+	__Elog(code, *sqlstate ? sqlstate : NULL,
+		   filename, lineno, "%s", message);
+}
+
 static void
 usage(void)
 {
@@ -231,309 +313,1316 @@ usage(void)
 // 		Elog("Neither -c nor -f options are specified");
 // }
 
-static PGconn *
-pgsql_server_connect(void)
+/*
+ * pgsql_server_connect
+ *
+ * It opens a new connection according to the libpq connection string;
+ * either of keyword/value form or URI form. An empty string connects by
+ * the libpq environment variables and defaults only.
+ *
+ * client_encoding is always UTF8, overriding the connection string and
+ * PGCLIENTENCODING, because Arrow strings are UTF-8; the server transcodes
+ * the text of the other encodings, like LATIN1.
+ */
+PGconn *
+pgsql_server_connect(const char *dsn, ErrorInfo *errinfo)
 {
-	PGconn	   *conn;
-	const char *keys[20];
-	const char *values[20];
+	PGconn	   *volatile conn = NULL;
+	const char *keys[5];
+	const char *values[5];
 	int			index = 0;
-	int			status;
 
-	if (pgsql_hostname)
-	{
-		keys[index] = "host";
-		values[index] = pgsql_hostname;
-		index++;
-	}
-	if (pgsql_portno)
-	{
-		keys[index] = "port";
-		values[index] = pgsql_portno;
-		index++;
-	}
-	if (pgsql_database)
+	/*
+	 * application_name of the connection string shall be preferable,
+	 * if any.
+	 */
+	keys[index] = "fallback_application_name";
+	values[index] = "pg2arrow";
+	index++;
+	if (dsn && *dsn != '\0')
 	{
 		keys[index] = "dbname";
-		values[index] = pgsql_database;
-		index++;
-	}
-	if (pgsql_username)
-	{
-		keys[index] = "user";
-		values[index] = pgsql_username;
-		index++;
-	}
-	if (pgsql_password_prompt > 0)
-	{
-		keys[index] = "password";
-		values[index] = getpass("Password: ");
+		values[index] = dsn;
 		index++;
 	}
-	keys[index] = "application_name";
-	values[index] = "pg2arrow";
+	/* the latter keyword overrides the one in the connection string */
+	keys[index] = "client_encoding";
+	values[index] = "UTF8";
 	index++;
 	/* terminal */
 	keys[index] = NULL;
 	values[index] = NULL;
 
-	conn = PQconnectdbParams(keys, values, 0);
-	if (!conn)
-		Elog("out of memory");
-	status = PQstatus(conn);
-	if (status != CONNECTION_OK)
-		Elog("failed on PostgreSQL connection: %s",
-			 PQerrorMessage(conn));
+	PG2ARROW_TRY(errinfo);
+	{
+		conn = PQconnectdbParams(keys, values, 1);
+		if (!conn)
+			Elog("out of memory");
+		if (PQstatus(conn) != CONNECTION_OK)
+			ElogResult(conn, NULL, "failed on PostgreSQL connection: %s",
+					   PQerrorMessage(conn));
+		if (strcmp(pg_encoding_to_char(PQclientEncoding(conn)), "UTF8") != 0)
+			Elog("the server cannot send the text in UTF8 (client_encoding is %s)",
+				 pg_encoding_to_char(PQclientEncoding(conn)));
+	}
+	PG2ARROW_CATCH();
+	{
+		if (conn)
+			PQfinish(conn);
+		conn = NULL;
+	}
+	PG2ARROW_END_TRY();
+
 	return conn;
 }
 
 /*
- * pgsql_begin_query
+ * pgsql_trim_query
+ *
+ * It returns a copy of the SQL command without the trailing semicolon,
+ * which is not allowed in the sub-query.
  */
-static PGresult *
-pgsql_begin_query(PGconn *conn, const char *query)
+static char *
+pgsql_trim_query(const char *query)
 {
-	PGresult   *res;
-	char	   *buffer;
-
-	/* set transaction read-only */
-	res = PQexec(conn, "BEGIN READ ONLY");
-	if (PQresultStatus(res) != PGRES_COMMAND_OK)
-		Elog("unable to begin transaction: %s", PQresultErrorMessage(res));
-	PQclear(res);
+	char	   *temp = pstrdup(query);
+	size_t		len = strlen(temp);
 
-	/* declare cursor */
-	buffer = palloc(strlen(query) + 2048);
-	sprintf(buffer, "DECLARE %s BINARY CURSOR FOR %s", CURSOR_NAME, query);
-	res = PQexec(conn, buffer);
-	if (PQresultStatus(res) != PGRES_COMMAND_OK)
-		Elog("unable to declare a SQL cursor: %s", PQresultErrorMessage(res));
-	PQclear(res);
-
-	return pgsql_next_result(conn);
+	while (len > 0 && (isspace(temp[len-1]) || temp[len-1] == ';'))
+		temp[--len] = '\0';
+	return temp;
 }
 
 /*
- * pgsql_next_result
+ * pgsql_text_query
+ *
+ * It wraps the SQL command to cast the columns marked in astext[] to text,
+ * with the same column names. The sub-query renames its columns at first,
+ * because the original names may be duplicated or missing.
  */
-static PGresult *
-pgsql_next_result(PGconn *conn)
+static char *
+pgsql_text_query(PGconn *conn, const char *query,
+				 PGresult *res, const bool *astext)
 {
-	PGresult   *res;
-	/* fetch results per half million rows */
-	res = PQexecParams(conn,
-					   "FETCH FORWARD 500000 FROM " CURSOR_NAME,
-					   0, NULL, NULL, NULL, NULL,
-					   1);	/* results in binary mode */
-	if (PQresultStatus(res) != PGRES_TUPLES_OK)
-		Elog("SQL execution failed: %s", PQresultErrorMessage(res));
-	if (PQntuples(res) == 0)
+	SQLbuffer	buf;
+	char	   *temp;
+	char		label[64];
+	int			j, nfields = PQnfields(res);
+
+	/* SQLbuffer is mmap'ed, so the result is copied to palloc'ed memory */
+	sql_buffer_init(&buf);
+	sql_buffer_append(&buf, "SELECT ", 7);
+	for (j=0; j < nfields; j++)
 	{
-		PQclear(res);
-		return NULL;
+		const char *attname = PQfname(res, j);
+		char	   *ident;
+
+		ident = PQescapeIdentifier(conn, attname, strlen(attname));
+		if (!ident)
+			ElogResult(conn, NULL, "unable to quote the column name: %s",
+					   PQerrorMessage(conn));
+		snprintf(label, sizeof(label), "%s__pg2arrow_%d%s AS ",
+				 j == 0 ? "" : ", ", j + 1, astext[j] ? "::text" : "");
+		sql_buffer_append(&buf, label, strlen(label));
+		sql_buffer_append(&buf, ident, strlen(ident));
+		PQfreemem(ident);
 	}
-	return res;
+	temp = pgsql_trim_query(query);
+	sql_buffer_append(&buf, " FROM (", 7);
+	sql_buffer_append(&buf, temp, strlen(temp));
+	sql_buffer_append(&buf, ") AS __pg2arrow (", 17);
+	pfree(temp);
+	for (j=0; j < nfields; j++)
+	{
+		snprintf(label, sizeof(label), "%s__pg2arrow_%d",
+				 j == 0 ? "" : ", ", j + 1);
+		sql_buffer_append(&buf, label, strlen(label));
+	}
+	sql_buffer_append(&buf, ")", 2);	/* with '\0' */
+	temp = pstrdup(buf.ptr);
+	sql_buffer_free(&buf);
+
+	return temp;
 }
 
 /*
- * pgsql_end_query
+ * pgsql_set_text_type
+ *
+ * It sets the source type of the column cast to text.
  */
 static void
-pgsql_end_query(PGconn *conn)
+pgsql_set_text_type(SQLattribute *attr, Oid typid, int typmod,
+					const char *typnamespace, const char *typname,
+					const char *text_typname)
 {
-	PGresult   *res;
-	/* close the cursor */
-	res = PQexec(conn, "CLOSE " CURSOR_NAME);
-	if (PQresultStatus(res) != PGRES_COMMAND_OK)
-		Elog("failed on close cursor '%s': %s", CURSOR_NAME,
-			 PQresultErrorMessage(res));
-	PQclear(res);
-
-	/* close the connection */
-	PQfinish(conn);
+	attr->text_typname = pstrdup(text_typname);
+	attr->atttypid = typid;
+	attr->atttypmod = typmod;
+	pfree((char *)attr->typnamespace);
+	attr->typnamespace = pstrdup(typnamespace);
+	pfree((char *)attr->typname);
+	attr->typname = pstrdup(typname);
 }
 
 /*
- * setupArrowFieldNode
+ * pgsql_setup_text_types
+ *
+ * It puts back the source types of the columns cast to text, so the field
+ * metadata reports them rather than text, and the readers like CopyIn can
+ * tell the values are their text forms. It also records them as
+ * format_type() tells, so the caller can report the columns which are
+ * never fetched in binary. typids[] are of the original columns, or
+ * InvalidOid if not cast.
  */
-static int
-setupArrowFieldNode(ArrowFieldNode *node, SQLattribute *attr)
+static void
+pgsql_setup_text_types(PGconn *conn, SQLtable *table,
+					   const Oid *typids, const int *typmods)
 {
-	SQLtable   *subtypes = attr->subtypes;
-	SQLattribute *element = attr->element;
-	int			i, count = 1;
+	int			j;
 
-	memset(node, 0, sizeof(ArrowFieldNode));
-	node->tag = ArrowNodeTag__FieldNode;
-	node->length = attr->nitems;
-	node->null_count = attr->nullcount;
-	/* array types */
-	if (element)
-		count += setupArrowFieldNode(node + count, element);
-	/* composite types */
-	if (subtypes)
+	for (j=0; j < table->nfields; j++)
 	{
-		for (i=0; i < subtypes->nfields; i++)
-			count += setupArrowFieldNode(node + count, &subtypes->attrs[i]);
+		SQLattribute *attr = &table->attrs[j];
+		PGresult   *res;
+		char		query[512];
+
+		if (typids[j] == InvalidOid)
+			continue;
+		snprintf(query, sizeof(query),
+				 "SELECT pg_catalog.format_type(t.oid, %d), nspname, typname"
+				 "  FROM pg_catalog.pg_type t,"
+				 "       pg_catalog.pg_namespace n"
+				 " WHERE t.typnamespace = n.oid"
+				 "   AND t.oid = %u", typmods[j], typids[j]);
+		res = PQexec(conn, query);
+		if (PQresultStatus(res) != PGRES_TUPLES_OK)
+			ElogResult(conn, res, "failed on pg_type system catalog query: %s",
+					   PQresultErrorMessage(res));
+		if (PQntuples(res) != 1)
+			Elog("unexpected number of result rows: %d", PQntuples(res));
+		pgsql_set_text_type(attr, typids[j], typmods[j],
+							PQgetvalue(res, 0, 1),
+							PQgetvalue(res, 0, 2),
+							PQgetvalue(res, 0, 0));
+		PQclear(res);
 	}
-	return count;
 }
 
-void
-writeArrowRecordBatch(SQLtable *table,
-					  size_t *p_metaLength,
-					  size_t *p_bodyLength)
+/*
+ * pgsql_save_text_types
+ *
+ * It copies the source types of the columns cast to text, set up by
+ * pgsql_setup_text_types(), for pgsql_apply_text_types() of each run of
+ * the prepared statement. It returns NULL if none are cast.
+ */
+static SQLtextType *
+pgsql_save_text_types(SQLtable *table)
 {
-	ArrowMessage	message;
-	ArrowRecordBatch *rbatch;
-	ArrowFieldNode *nodes;
-	ArrowBuffer	   *buffers;
-	int32			i, j;
-	size_t			metaLength;
-	size_t			bodyLength = 0;
+	SQLtextType *types = NULL;
+	int			j;
 
-	/* fill up [nodes] vector */
-	nodes = alloca(sizeof(ArrowFieldNode) * table->numFieldNodes);
-	for (i=0, j=0; i < table->nfields; i++)
+	for (j=0; j < table->nfields; j++)
 	{
-		SQLattribute   *attr = &table->attrs[i];
-		assert(table->nitems == attr->nitems);
-		j += setupArrowFieldNode(nodes + j, attr);
-	}
-	assert(j == table->numFieldNodes);
+		SQLattribute *attr = &table->attrs[j];
 
-	/* fill up [buffers] vector */
-	buffers = alloca(sizeof(ArrowBuffer) * table->numBuffers);
-	for (i=0, j=0; i < table->nfields; i++)
-	{
-		SQLattribute   *attr = &table->attrs[i];
-		j += attr->setup_buffer(attr, buffers+j, &bodyLength);
+		if (!attr->text_typname)
+			continue;
+		if (!types)
+			types = palloc0(sizeof(SQLtextType) * table->nfields);
+		types[j].atttypid = attr->atttypid;
+		types[j].atttypmod = attr->atttypmod;
+		types[j].typnamespace = pstrdup(attr->typnamespace);
+		types[j].typname = pstrdup(attr->typname);
+		types[j].text_typname = pstrdup(attr->text_typname);
 	}
-	assert(j == table->numBuffers);
+	return types;
+}
 
-	/* setup Message of Schema */
-	memset(&message, 0, sizeof(ArrowMessage));
-	message.tag = ArrowNodeTag__Message;
-	message.version = ArrowMetadataVersion__V4;
-	message.bodyLength = bodyLength;
+/*
+ * pgsql_apply_text_types
+ *
+ * It puts back the source types saved by pgsql_save_text_types(), like
+ * pgsql_setup_text_types() does on the preparation.
+ */
+static void
+pgsql_apply_text_types(SQLtable *table, const SQLtextType *types)
+{
+	int			j;
 
-	rbatch = &message.body.recordBatch;
-	rbatch->tag = ArrowNodeTag__RecordBatch;
-	rbatch->length = table->nitems;
-	rbatch->nodes = nodes;
-	rbatch->_num_nodes = table->numFieldNodes;
-	rbatch->buffers = buffers;
-	rbatch->_num_buffers = table->numBuffers;
-	/* serialization */
-	metaLength = writeFlatBufferMessage(table->fdesc, &message);
-	for (i=0; i < table->nfields; i++)
+	for (j=0; j < table->nfields; j++)
 	{
-		SQLattribute   *attr = &table->attrs[i];
-		attr->write_buffer(attr, table->fdesc);
+		if (types[j].atttypid == InvalidOid)
+			continue;
+		pgsql_set_text_type(&table->attrs[j],
+							types[j].atttypid,
+							types[j].atttypmod,
+							types[j].typnamespace,
+							types[j].typname,
+							types[j].text_typname);
 	}
-	*p_metaLength = metaLength;
-	*p_bodyLength = bodyLength;
 }
 
+/*
+ * pgsql_free_text_types
+ */
 static void
-setupArrowDictionaryEncoding(ArrowDictionaryEncoding *dict,
-							 SQLattribute *attr)
+pgsql_free_text_types(SQLtextType *types, int nfields)
 {
-	dict->tag = ArrowNodeTag__DictionaryEncoding;
-	if (attr->enumdict)
+	int			j;
+
+	for (j=0; j < nfields; j++)
 	{
-		dict->id = attr->enumdict->dict_id;
-		dict->indexType.tag = ArrowNodeTag__Int;
-		dict->indexType.bitWidth = 32;	/* OID in PostgreSQL */
-		dict->indexType.is_signed = true;
-		dict->isOrdered = false;
+		if (types[j].atttypid == InvalidOid)
+			continue;
+		pfree(types[j].typnamespace);
+		pfree(types[j].typname);
+		pfree(types[j].text_typname);
 	}
+	pfree(types);
+}
+
+/*
+ * pgsql_describe_prepared
+ */
+static PGresult *
+pgsql_describe_prepared(PGconn *conn, const char *stmt_name,
+						const char *query, const SQLparams *params)
+{
+	PGresult   *res;
+
+	res = PQprepare(conn, stmt_name, query,
+					params ? params->nparams : 0,
+					params ? params->types : NULL);
+	if (PQresultStatus(res) != PGRES_COMMAND_OK)
+		ElogResult(conn, res, "unable to prepare the SQL command: %s",
+				   PQresultErrorMessage(res));
+	PQclear(res);
+
+	res = PQdescribePrepared(conn, stmt_name);
+	if (PQresultStatus(res) != PGRES_COMMAND_OK)
+		ElogResult(conn, res, "unable to describe the SQL command: %s",
+				   PQresultErrorMessage(res));
+	return res;
 }
 
+/*
+ * pgsql_deallocate
+ *
+ * It drops the prepared statement of the name.
+ */
 static void
-setupArrowField(ArrowField *field, SQLattribute *attr)
+pgsql_deallocate(PGconn *conn, const char *stmt_name)
 {
-	memset(field, 0, sizeof(ArrowField));
-	field->tag = ArrowNodeTag__Field;
-	field->name = attr->attname;
-	field->_name_len = strlen(attr->attname);
-	field->nullable = true;
-	field->type = attr->arrow_type;
-	setupArrowDictionaryEncoding(&field->dictionary, attr);
-	/* array type */
-	if (attr->element)
-	{
-		field->children = palloc0(sizeof(ArrowField));
-		field->_num_children = 1;
-		setupArrowField(field->children, attr->element);
-	}
-	/* composite type */
-	if (attr->subtypes)
+	PGresult   *res;
+	char	   *ident;
+	char	   *buffer;
+
+	ident = PQescapeIdentifier(conn, stmt_name, strlen(stmt_name));
+	if (!ident)
+		ElogResult(conn, NULL, "unable to quote the statement name: %s",
+				   PQerrorMessage(conn));
+	buffer = psprintf("DEALLOCATE %s", ident);
+	PQfreemem(ident);
+
+	res = PQexec(conn, buffer);
+	pfree(buffer);
+	if (PQresultStatus(res) != PGRES_COMMAND_OK)
+		ElogResult(conn, res, "unable to deallocate the prepared statement: %s",
+				   PQresultErrorMessage(res));
+	PQclear(res);
+}
+
+/*
+ * pgsql_prepare_query
+ *
+ * It prepares the SQL command as the statement of stmt_name, or the
+ * unnamed statement if "", then builds the buffer according to its result
+ * description. The results are always fetched in binary; if any of the
+ * columns have no known binary format, the SQL command is wrapped to cast
+ * them to text, then table->query is the wrapped one. By not_null_hints,
+ * the fields are marked non-nullable if they simply reference a NOT NULL
+ * table column.
+ */
+static SQLtable *
+pgsql_prepare_query(PGconn *conn, const char *stmt_name, const char *query,
+					const SQLparams *params, const SQLoptions *options)
+{
+	PGresult   *res;
+	PGresult   *orig = NULL;
+	SQLtable   *table;
+	char	   *temp = NULL;
+	bool	   *astext;
+
+	res = pgsql_describe_prepared(conn, stmt_name, query, params);
+	astext = alloca(sizeof(bool) * PQnfields(res));
+	table = pgsql_create_buffer(conn, res, options, batch_segment_sz, astext);
+	if (!table)
 	{
-		SQLtable   *sub = attr->subtypes;
-		int			i;
+		int			j, nfields = PQnfields(res);
+		Oid		   *typids = alloca(sizeof(Oid) * nfields);
+		int		   *typmods = alloca(sizeof(int) * nfields);
 
-		field->children = palloc0(sizeof(ArrowField) * sub->nfields);
-		field->_num_children = sub->nfields;
-		for (i=0; i < sub->nfields; i++)
-			setupArrowField(&field->children[i], &sub->attrs[i]);
+		/* astext[] is overwritten by the next pgsql_create_buffer */
+		for (j=0; j < nfields; j++)
+		{
+			typids[j] = (astext[j] ? PQftype(res, j) : InvalidOid);
+			typmods[j] = PQfmod(res, j);
+		}
+		temp = pgsql_text_query(conn, query, res, astext);
+		/* the NOT NULL hints are of the columns before the cast */
+		orig = res;
+		/* unlike the unnamed one, a named statement is never replaced */
+		if (*stmt_name != '\0')
+			pgsql_deallocate(conn, stmt_name);
+		res = pgsql_describe_prepared(conn, stmt_name, temp, params);
+		table = pgsql_create_buffer(conn, res, options, batch_segment_sz,
+									astext);
+		if (!table)
+			Elog("unable to fetch the SQL command results in text");
+		pgsql_setup_text_types(conn, table, typids, typmods);
 	}
-	//custom_metadata here?
-	//min_values,max_values
+	table->conn = conn;
+	table->stmt_name = pstrdup(stmt_name);
+	table->query = (temp ? temp : pstrdup(query));
+	table->f_pos = 8;	/* "ARROW1\0\0" */
+	if (options->not_null_hints)
+		pgsql_setup_attnotnull(conn, orig ? orig : res, table);
+	PQclear(res);
+	if (orig)
+		PQclear(orig);
+
+	return table;
 }
 
-static ssize_t
-writeArrowSchema(SQLtable *table)
+/*
+ * pgsql_create_session / pgsql_free_session
+ */
+SQLsession *
+pgsql_create_session(void)
 {
-	ArrowMessage	message;
-	ArrowSchema	   *schema;
-	int32			i;
+	return palloc0(sizeof(SQLsession));
+}
 
-	/* setup Message of Schema */
-	memset(&message, 0, sizeof(ArrowMessage));
-	message.tag = ArrowNodeTag__Message;
-	message.version = ArrowMetadataVersion__V4;
-	schema = &message.body.schema;
-	schema->tag = ArrowNodeTag__Schema;
-	schema->endianness = ArrowEndianness__Little;
-	schema->fields = alloca(sizeof(ArrowField) * table->nfields);
-	schema->_num_fields = table->nfields;
-	for (i=0; i < table->nfields; i++)
-		setupArrowField(&schema->fields[i], &table->attrs[i]);
-	/* serialization */
-	return writeFlatBufferMessage(table->fdesc, &message);
+void
+pgsql_free_session(SQLsession *session)
+{
+	if (session->pending_timeout)
+		pfree(session->pending_timeout);
+	pfree(session);
 }
 
+/*
+ * pgsql_restore_timeout
+ *
+ * It runs SET [LOCAL] statement_timeout of the value. A failure is not
+ * raised, because the query itself is done, but kept in the session, if
+ * any, for the caller to report.
+ */
 static void
-__writeArrowDictionaryBatch(int fdesc, ArrowBlock *block, SQLdictionary *dict)
+pgsql_restore_timeout(PGconn *conn, SQLsession *session,
+					  const char *value, bool local)
 {
-	ArrowMessage	message;
-	ArrowDictionaryBatch *dbatch;
-	ArrowRecordBatch *rbatch;
-	ArrowBuffer	   *buffer;
-	loff_t			currPos;
-	size_t			metaLength = 0;
-	size_t			bodyLength = 0;
+	PGresult   *res = NULL;
+	char	   *literal;
+	size_t		len;
 
-	/* setup Message of DictionaryBatch */
-	memset(&message, 0, sizeof(ArrowMessage));
-    message.tag = ArrowNodeTag__Message;
-    message.version = ArrowMetadataVersion__V4;
+	literal = PQescapeLiteral(conn, value, strlen(value));
+	if (literal)
+	{
+		char   *query = psprintf("SET %sstatement_timeout = %s",
+								 local ? "LOCAL " : "", literal);
 
-	/* DictionaryBatch portion */
+		res = PQexec(conn, query);
+		pfree(query);
+		PQfreemem(literal);
+	}
+	if (PQresultStatus(res) != PGRES_COMMAND_OK && session)
+	{
+		snprintf(session->error, sizeof(session->error),
+				 "unable to restore statement_timeout: %s",
+				 PQerrorMessage(conn));
+		/* libpq's messages usually have a trailing newline */
+		len = strlen(session->error);
+		while (len > 0 && isspace(session->error[len-1]))
+			session->error[--len] = '\0';
+	}
+	PQclear(res);
+}
+
+/*
+ * pgsql_restore_pending
+ *
+ * It restores statement_timeout of the session saved by the query which
+ * opened a transaction block, once the block ended.
+ */
+static void
+pgsql_restore_pending(PGconn *conn, SQLsession *session)
+{
+	if (!session || !session->pending_timeout ||
+		PQtransactionStatus(conn) != PQTRANS_IDLE)
+		return;
+	pgsql_restore_timeout(conn, session, session->pending_timeout, false);
+	pfree(session->pending_timeout);
+	session->pending_timeout = NULL;
+}
+
+/*
+ * pgsql_set_timeout
+ *
+ * It sets statement_timeout of the options prior to the execution, so the
+ * server aborts the query running longer. No transaction is opened for
+ * it; out of a transaction block, it is set by SET for the session, and in
+ * the transaction block of the caller, by SET LOCAL. Either way, the former
+ * value is saved, then pgsql_reset_timeout() puts it back. In the failed
+ * block, where no SET runs, it is not set.
+ */
+static void
+pgsql_set_timeout(SQLtable *table)
+{
+	PGconn	   *conn = table->conn;
+	PGresult   *res;
+	char		query[256];
+
+	/* nothing runs in the failed block but its end, like ROLLBACK */
+	if (table->options.statement_timeout <= 0 ||
+		PQtransactionStatus(conn) == PQTRANS_INERROR)
+		return;
+	/* in case the block ended by no query with the timeout */
+	pgsql_restore_pending(conn, table->options.session);
+
+	res = PQexec(conn, "SELECT pg_catalog.current_setting('statement_timeout')");
+	if (PQresultStatus(res) != PGRES_TUPLES_OK || PQntuples(res) != 1)
+		ElogResult(conn, res, "unable to fetch statement_timeout: %s",
+				   PQresultErrorMessage(res));
+	table->saved_timeout = pstrdup(PQgetvalue(res, 0, 0));
+	table->local_timeout = (PQtransactionStatus(conn) != PQTRANS_IDLE);
+	PQclear(res);
+
+	snprintf(query, sizeof(query),
+			 "SET %sstatement_timeout = %d",
+			 table->local_timeout ? "LOCAL " : "",
+			 table->options.statement_timeout);
+	res = PQexec(conn, query);
+	if (PQresultStatus(res) != PGRES_COMMAND_OK)
+		ElogResult(conn, res, "unable to set statement_timeout: %s",
+				   PQresultErrorMessage(res));
+	PQclear(res);
+}
+
+/*
+ * pgsql_reset_timeout
+ *
+ * It restores the former statement_timeout saved by pgsql_set_timeout(),
+ * after the query is completed or aborted, including by the timeout, by
+ * the transaction status after the query:
+ *
+ * - SET for the session out of a transaction block is restored by SET.
+ * - SET for the session, if the query opened a transaction block like
+ *   BEGIN, is restored by SET in the block, but ROLLBACK of the block
+ *   undoes it, so it is restored once more after the block ends.
+ * - SET LOCAL is restored by SET LOCAL, unless the query ended or failed
+ *   the block, which ends SET LOCAL anyway.
+ *
+ * A broken connection is left as is, and the other failures are kept in
+ * the session, because the query itself is done.
+ */
+static void
+pgsql_reset_timeout(SQLtable *table)
+{
+	PGconn	   *conn = table->conn;
+	SQLsession *session = table->options.session;
+	PGTransactionStatusType status = PQtransactionStatus(conn);
+
+	if (table->saved_timeout && PQstatus(conn) == CONNECTION_OK)
+	{
+		if (!table->local_timeout)
+		{
+			if (status != PQTRANS_IDLE && session)
+			{
+				if (session->pending_timeout)
+					pfree(session->pending_timeout);
+				session->pending_timeout = pstrdup(table->saved_timeout);
+			}
+			/* nothing runs in the failed block but its end */
+			if (status != PQTRANS_INERROR)
+				pgsql_restore_timeout(conn, session,
+									  table->saved_timeout, false);
+		}
+		else if (status == PQTRANS_INTRANS)
+			pgsql_restore_timeout(conn, session, table->saved_timeout, true);
+	}
+	if (table->saved_timeout)
+	{
+		pfree(table->saved_timeout);
+		table->saved_timeout = NULL;
+	}
+	/*
+	 * The query may have ended the block opened by an earlier one, even if
+	 * it set no timeout, like ROLLBACK of the failed block. Nothing runs
+	 * unless the connection is idle, out of any query.
+	 */
+	pgsql_restore_pending(conn, session);
+}
+
+/*
+ * pgsql_begin_query
+ *
+ * It kicks the prepared SQL command in single-row mode, so the result
+ * rows are fetched chunk by chunk. Note that any catalog lookups must be
+ * done prior to the execution, because the connection is busy until all
+ * the rows are fetched. The params may be NULL, if the SQL command has
+ * no parameters.
+ *
+ * The unnamed statement is parsed again with the execution, because the
+ * simple queries of the catalog lookups have dropped it on the server.
+ */
+static void
+pgsql_begin_query(SQLtable *table, const SQLparams *params)
+{
+	PGconn	   *conn = table->conn;
+	SQLparams	noparams;
+	int			sent;
+
+	if (!params)
+	{
+		memset(&noparams, 0, sizeof(SQLparams));
+		params = &noparams;
+	}
+	pgsql_set_timeout(table);
+
+	/* run the SQL command; results in binary mode */
+	if (*table->stmt_name == '\0')
+		sent = PQsendQueryParams(conn, table->query,
+								 params->nparams,
+								 params->types,
+								 params->values,
+								 params->lengths,
+								 params->formats,
+								 1);
+	else
+		sent = PQsendQueryPrepared(conn, table->stmt_name,
+								   params->nparams,
+								   params->values,
+								   params->lengths,
+								   params->formats,
+								   1);
+	if (!sent)
+		ElogResult(conn, NULL, "unable to run the SQL command: %s",
+				   PQerrorMessage(conn));
+	table->in_progress = true;
+	if (!PQsetSingleRowMode(conn))
+		Elog("unable to switch the connection to single-row mode");
+}
+
+/*
+ * pgsql_begin_copy
+ *
+ * It runs the SQL command by COPY ... TO STDOUT (FORMAT binary), which
+ * streams the rows without the overhead of the extended query protocol.
+ * The result description comes from the prepared statement, because COPY
+ * tells nothing about the data types.
+ */
+static void
+pgsql_begin_copy(SQLtable *table)
+{
+	PGconn	   *conn = table->conn;
+	PGresult   *res;
+	char	   *temp;
+	char	   *buffer;
+
+	pgsql_set_timeout(table);
+	temp = pgsql_trim_query(table->query);
+	buffer = psprintf("COPY (%s) TO STDOUT (FORMAT binary)", temp);
+	pfree(temp);
+
+	res = PQexec(conn, buffer);
+	pfree(buffer);
+	if (PQresultStatus(res) != PGRES_COPY_OUT)
+		ElogResult(conn, res, "the SQL command is not a valid COPY source: %s",
+				   PQresultErrorMessage(res));
+	PQclear(res);
+	table->in_progress = true;
+	table->copy_out = true;
+}
+
+/*
+ * pgsql_command_ntuples
+ *
+ * It picks up the number of rows in the command tag, like "SELECT 100" or
+ * "COPY 100", of the final result of the query.
+ */
+static void
+pgsql_command_ntuples(SQLtable *table, PGresult *res)
+{
+	const char *ntuples = PQcmdTuples(res);
+
+	if (*ntuples != '\0')
+		table->cmd_ntuples = strtoll(ntuples, NULL, 10);
+}
+
+/*
+ * pgsql_check_row_limit
+ *
+ * It raises an error if a row beyond options.max_rows came. The fetch
+ * stops at the row, but the rows up to the limit are written out at first,
+ * so the error comes after exactly max_rows rows.
+ */
+static void
+pgsql_check_row_limit(SQLtable *table)
+{
+	if (table->row_limit_exceeded)
+		Elog("the result exceeds the limit of %ld rows",
+			 table->options.max_rows);
+}
+
+/*
+ * pgsql_fetch_batch
+ *
+ * It accumulates the result rows until the buffer reaches either of the
+ * thresholds (number of rows or memory usage), then writes out a record
+ * batch. It returns false if no more rows.
+ */
+static bool
+pgsql_fetch_batch(SQLtable *table)
+{
+	PGconn	   *conn = table->conn;
+	PGresult   *res;
+	size_t		usage;
+
+	if (table->copy_out)
+		return pgsql_fetch_copy_batch(table);
+
+	while (table->in_progress && !table->row_limit_exceeded)
+	{
+		if (table->pending)
+		{
+			/* the first row came with the next statement of multi */
+			res = table->pending;
+			table->pending = NULL;
+		}
+		else
+			res = PQgetResult(conn);
+		if (!res)
+		{
+			/* a broken connection also ends the results */
+			if (PQstatus(conn) != CONNECTION_OK)
+				ElogResult(conn, NULL, "connection lost: %s",
+						   PQerrorMessage(conn));
+			table->in_progress = false;
+			break;
+		}
+		switch (PQresultStatus(res))
+		{
+			case PGRES_TUPLES_OK:
+				/* PGRES_TUPLES_OK terminates the rows with the command tag */
+				pgsql_command_ntuples(table, res);
+				/* the next result belongs to the next statement */
+				if (table->multi)
+					table->in_progress = false;
+				/* fall through */
+			case PGRES_SINGLE_TUPLE:
+				usage = pgsql_append_results(table, res);
+				PQclear(res);
+				if (table->nitems > 0 &&
+					(table->nitems >= table->options.batch_nrows ||
+					 usage > table->segment_sz))
+				{
+					pgsql_writeout_buffer(table);
+					return true;
+				}
+				break;
+			case PGRES_COMMAND_OK:
+				PQclear(res);
+				break;
+			default:
+				ElogResult(conn, res, "SQL execution failed: %s",
+						   PQresultErrorMessage(res));
+		}
+	}
+	/* flush the remaining rows, if any */
+	if (table->nitems > 0)
+	{
+		pgsql_writeout_buffer(table);
+		return true;
+	}
+	pgsql_check_row_limit(table);
+	return false;
+}
+
+/*
+ * pgsql_fetch_copy_batch
+ *
+ * Like pgsql_fetch_batch, but the rows come by COPY ... TO STDOUT.
+ */
+static bool
+pgsql_fetch_copy_batch(SQLtable *table)
+{
+	PGconn	   *conn = table->conn;
+	PGresult   *res;
+	char	   *buf;
+	int			nbytes;
+	size_t		usage;
+
+	while (table->in_progress && !table->row_limit_exceeded)
+	{
+		nbytes = PQgetCopyData(conn, &buf, 0);
+		if (nbytes == -2)
+			ElogResult(conn, NULL, "failed on PQgetCopyData: %s",
+					   PQerrorMessage(conn));
+		if (nbytes == -1)
+		{
+			/* end of the COPY; pick up the final status */
+			res = PQgetResult(conn);
+			if (PQresultStatus(res) != PGRES_COMMAND_OK)
+				ElogResult(conn, res, "SQL execution failed: %s",
+						   PQresultErrorMessage(res));
+			pgsql_command_ntuples(table, res);
+			PQclear(res);
+			while ((res = PQgetResult(conn)) != NULL)
+				PQclear(res);
+			table->in_progress = false;
+			break;
+		}
+		usage = pgsql_append_copy_data(table, buf, nbytes);
+		PQfreemem(buf);
+		if (table->nitems > 0 &&
+			(table->nitems >= table->options.batch_nrows ||
+			 usage > table->segment_sz))
+		{
+			pgsql_writeout_buffer(table);
+			return true;
+		}
+	}
+	/* flush the remaining rows, if any */
+	if (table->nitems > 0)
+	{
+		pgsql_writeout_buffer(table);
+		return true;
+	}
+	pgsql_check_row_limit(table);
+	return false;
+}
+
+/*
+ * pgsql_abort_query
+ *
+ * It makes the connection available for the next query again, after
+ * the errors or interruption in the middle of the query.
+ */
+static void
+pgsql_abort_query(PGconn *conn)
+{
+	PGresult   *res;
+
+	if (PQtransactionStatus(conn) == PQTRANS_ACTIVE)
+	{
+		PGcancel   *cancel = PQgetCancel(conn);
+		char		errbuf[256];
+
+		if (cancel)
+		{
+			PQcancel(cancel, errbuf, sizeof(errbuf));
+			PQfreeCancel(cancel);
+		}
+	}
+	/* discard the remaining results, including COPY data if any */
+	while ((res = PQgetResult(conn)) != NULL)
+	{
+		ExecStatusType status = PQresultStatus(res);
+
+		PQclear(res);
+		if (status == PGRES_COPY_OUT)
+		{
+			char   *buf;
+			int		nbytes;
+
+			while ((nbytes = PQgetCopyData(conn, &buf, 0)) > 0)
+				PQfreemem(buf);
+			if (nbytes == -2)
+				break;
+		}
+	}
+}
+
+/*
+ * pgsql_fail_multi
+ *
+ * It marks the statements failed by the error, so pgsql_next_result()
+ * returns it from then on; the rest of the statements are skipped.
+ */
+static void
+pgsql_fail_multi(SQLmulti *multi, const ErrorInfo *errinfo,
+				 bool row_limit_exceeded)
+{
+	multi->in_progress = false;
+	if (multi->pending)
+	{
+		PQclear(multi->pending);
+		multi->pending = NULL;
+	}
+	if (!multi->failed)
+	{
+		multi->failed = true;
+		memcpy(&multi->error, errinfo, sizeof(ErrorInfo));
+		multi->row_limit_exceeded = row_limit_exceeded;
+	}
+}
+
+/*
+ * pgsql_skip_result
+ *
+ * It discards the remaining rows of the statement closed in the middle,
+ * so the next statement follows it. Unlike pgsql_abort_query, the query
+ * is not canceled, because the rest of the statements still have to run.
+ * The error of the statement, if any, is kept for pgsql_next_result().
+ */
+static void
+pgsql_skip_result(SQLtable *table)
+{
+	SQLmulti   *multi = table->multi;
+	PGresult   *res;
+
+	if (table->pending)
+	{
+		PQclear(table->pending);
+		table->pending = NULL;
+	}
+	while ((res = PQgetResult(multi->conn)) != NULL)
+	{
+		ExecStatusType status = PQresultStatus(res);
+
+		if (status == PGRES_SINGLE_TUPLE)
+		{
+			PQclear(res);
+			continue;
+		}
+		if (status == PGRES_TUPLES_OK)
+			PQclear(res);
+		else
+			multi->pending = res;
+		return;
+	}
+	multi->in_progress = false;
+}
+
+/*
+ * pgsql_consume_output
+ *
+ * It advances the file position by the messages already consumed.
+ */
+static void
+pgsql_consume_output(SQLtable *table)
+{
+	table->f_pos += table->output.usage;
+	sql_buffer_clear(&table->output);
+}
+
+/*
+ * setupArrowFieldNode
+ */
+static int
+setupArrowFieldNode(ArrowFieldNode *node, SQLattribute *attr)
+{
+	SQLtable   *subtypes = attr->subtypes;
+	SQLattribute *element = attr->element;
+	int			i, count = 1;
+
+	memset(node, 0, sizeof(ArrowFieldNode));
+	node->tag = ArrowNodeTag__FieldNode;
+	node->length = attr->nitems;
+	node->null_count = attr->nullcount;
+	/* array types */
+	if (element)
+		count += setupArrowFieldNode(node + count, element);
+	/* composite types */
+	if (subtypes)
+	{
+		for (i=0; i < subtypes->nfields; i++)
+			count += setupArrowFieldNode(node + count, &subtypes->attrs[i]);
+	}
+	return count;
+}
+
+/*
+ * The record batch whose body is smaller than this is written without
+ * compression, because the compression hardly saves any space, or even
+ * expands the tiny buffers.
+ */
+#define ARROW_COMPRESSION_MIN_BODY	1024
+
+/*
+ * compressArrowBuffer
+ *
+ * It compresses src by the codec, then returns the length of the compressed
+ * data in dest. If dest is NULL, it returns the worst-case length instead.
+ */
+static size_t
+compressArrowBuffer(const SQLoptions *options,
+					char *dest, size_t dest_sz,
+					const char *src, size_t src_sz)
+{
+	size_t		rv;
+
+	switch (options->compression)
+	{
+		case PG2ARROW_COMPRESSION_LZ4_FRAME:
+			{
+				LZ4F_preferences_t prefs;
+
+				memset(&prefs, 0, sizeof(LZ4F_preferences_t));
+				prefs.frameInfo.contentSize = src_sz;
+				prefs.compressionLevel = options->compression_level;
+				if (!dest)
+					return LZ4F_compressFrameBound(src_sz, &prefs);
+				rv = LZ4F_compressFrame(dest, dest_sz, src, src_sz, &prefs);
+				if (LZ4F_isError(rv))
+					Elog("failed on LZ4F_compressFrame: %s",
+						 LZ4F_getErrorName(rv));
+			}
+			break;
+		case PG2ARROW_COMPRESSION_ZSTD:
+			if (!dest)
+				return ZSTD_compressBound(src_sz);
+			rv = ZSTD_compress(dest, dest_sz, src, src_sz,
+							   options->compression_level);
+			if (ZSTD_isError(rv))
+				Elog("failed on ZSTD_compress: %s", ZSTD_getErrorName(rv));
+			break;
+		default:
+			Elog("unknown compression codec: %d", options->compression);
+	}
+	return rv;
+}
+
+/*
+ * compressArrowBody
+ *
+ * It compresses the buffers of the record batch body into
+ * table->compressed, then updates the buffers vector for the compressed
+ * body. Each buffer is prefixed by its uncompressed length, or -1 if it is
+ * left as is because the compression does not save space. It returns the
+ * length of the compressed body.
+ */
+static size_t
+compressArrowBody(SQLtable *table, ArrowBuffer *buffers, int nbuffers,
+				  const char *body)
+{
+	SQLbuffer  *out = &table->compressed;
+	size_t		offset = 0;
+	int			i;
+
+	sql_buffer_clear(out);
+	for (i=0; i < nbuffers; i++)
+	{
+		ArrowBuffer *node = &buffers[i];
+		const char *src = body + node->offset;
+		size_t		src_sz = node->length;
+		size_t		dest_sz;
+		size_t		length;
+		int64		prefix;
+		char	   *dest;
+
+		node->offset = offset;
+		if (src_sz == 0)
+			continue;	/* empty buffer has no prefix */
+		dest_sz = compressArrowBuffer(&table->options, NULL, 0, src, src_sz);
+		sql_buffer_expand(out, out->usage + sizeof(int64) + dest_sz);
+		dest = out->ptr + out->usage + sizeof(int64);
+		length = compressArrowBuffer(&table->options, dest, dest_sz,
+									 src, src_sz);
+		if (length > 0 && length < src_sz)
+			prefix = src_sz;
+		else
+		{
+			memcpy(dest, src, src_sz);
+			length = src_sz;
+			prefix = -1;
+		}
+		memcpy(out->ptr + out->usage, &prefix, sizeof(int64));
+		out->usage += sizeof(int64) + length;
+		node->length = sizeof(int64) + length;
+		if (node->length != ARROWALIGN(node->length))
+			sql_buffer_append_zero(out, ARROWALIGN(node->length) - node->length);
+		offset += ARROWALIGN(node->length);
+	}
+	assert(offset == out->usage);
+	return offset;
+}
+
+void
+writeArrowRecordBatch(SQLtable *table,
+					  size_t *p_metaLength,
+					  size_t *p_bodyLength)
+{
+	ArrowMessage	message;
+	ArrowRecordBatch *rbatch;
+	ArrowBodyCompression compression;
+	ArrowFieldNode *nodes;
+	ArrowBuffer	   *buffers;
+	int32			i, j;
+	size_t			metaLength;
+	size_t			bodyLength = 0;
+	bool			compressed = false;
+
+	/* fill up [nodes] vector */
+	nodes = alloca(sizeof(ArrowFieldNode) * table->numFieldNodes);
+	for (i=0, j=0; i < table->nfields; i++)
+	{
+		SQLattribute   *attr = &table->attrs[i];
+		assert(table->nitems == attr->nitems);
+		j += setupArrowFieldNode(nodes + j, attr);
+	}
+	assert(j == table->numFieldNodes);
+
+	/* fill up [buffers] vector */
+	buffers = alloca(sizeof(ArrowBuffer) * table->numBuffers);
+	for (i=0, j=0; i < table->nfields; i++)
+	{
+		SQLattribute   *attr = &table->attrs[i];
+		j += attr->setup_buffer(attr, buffers+j, &bodyLength);
+	}
+	assert(j == table->numBuffers);
+
+	/*
+	 * The compressed body is built from the plain one, which is written
+	 * at the tail of the output temporarily, then replaced by the message.
+	 */
+	if (table->options.compression != PG2ARROW_COMPRESSION_NONE &&
+		bodyLength >= ARROW_COMPRESSION_MIN_BODY)
+	{
+		size_t		base = table->output.usage;
+
+		for (i=0; i < table->nfields; i++)
+		{
+			SQLattribute   *attr = &table->attrs[i];
+			attr->write_buffer(attr, &table->output);
+		}
+		assert(table->output.usage == base + bodyLength);
+		bodyLength = compressArrowBody(table, buffers, table->numBuffers,
+									   table->output.ptr + base);
+		table->output.usage = base;
+
+		memset(&compression, 0, sizeof(ArrowBodyCompression));
+		compression.tag = ArrowNodeTag__BodyCompression;
+		if (table->options.compression == PG2ARROW_COMPRESSION_ZSTD)
+			compression.codec = ArrowCompressionType__ZSTD;
+		else
+			compression.codec = ArrowCompressionType__LZ4_FRAME;
+		compression.method = ArrowBodyCompressionMethod__BUFFER;
+		compressed = true;
+	}
+
+	/* setup Message of Schema */
+	memset(&message, 0, sizeof(ArrowMessage));
+	message.tag = ArrowNodeTag__Message;
+	message.version = ArrowMetadataVersion__V4;
+	message.bodyLength = bodyLength;
+
+	rbatch = &message.body.recordBatch;
+	rbatch->tag = ArrowNodeTag__RecordBatch;
+	rbatch->length = table->nitems;
+	rbatch->nodes = nodes;
+	rbatch->_num_nodes = table->numFieldNodes;
+	rbatch->buffers = buffers;
+	rbatch->_num_buffers = table->numBuffers;
+	if (compressed)
+		rbatch->compression = &compression;
+	/* serialization */
+	metaLength = writeFlatBufferMessage(&table->output, &message);
+	if (compressed)
+		sql_buffer_append(&table->output, table->compressed.ptr,
+						  table->compressed.usage);
+	else
+	{
+		for (i=0; i < table->nfields; i++)
+		{
+			SQLattribute   *attr = &table->attrs[i];
+			attr->write_buffer(attr, &table->output);
+		}
+	}
+	*p_metaLength = metaLength;
+	*p_bodyLength = bodyLength;
+}
+
+static void
+setupArrowDictionaryEncoding(ArrowDictionaryEncoding *dict,
+							 SQLattribute *attr)
+{
+	dict->tag = ArrowNodeTag__DictionaryEncoding;
+	if (attr->enumdict)
+	{
+		dict->id = attr->enumdict->dict_id;
+		dict->indexType.tag = ArrowNodeTag__Int;
+		dict->indexType.bitWidth = 32;	/* OID in PostgreSQL */
+		dict->indexType.is_signed = true;
+		dict->isOrdered = false;
+	}
+}
+
+/*
+ * setupArrowFieldMetadata
+ *
+ * It describes the source PostgreSQL type of the field by the custom
+ * metadata; pg_oid, pg_typname and pg_typmod. The extension type, if any,
+ * follows them.
+ */
+static void
+setupArrowFieldMetadata(ArrowField *field, SQLattribute *attr)
+{
+	struct {
+		ArrowKeyValue kv[5];
+		char		oid[16];
+		char		typmod[16];
+	}		   *meta = palloc0(sizeof(*meta));
+	int			i, nitems = 3;
+
+	snprintf(meta->oid, sizeof(meta->oid), "%u", attr->atttypid);
+	snprintf(meta->typmod, sizeof(meta->typmod), "%d", attr->atttypmod);
+	meta->kv[0].key = "pg_oid";
+	meta->kv[0].value = meta->oid;
+	meta->kv[1].key = "pg_typname";
+	meta->kv[1].value = attr->typname;
+	meta->kv[2].key = "pg_typmod";
+	meta->kv[2].value = meta->typmod;
+	if (attr->extension_name)
+	{
+		meta->kv[nitems].key = "ARROW:extension:name";
+		meta->kv[nitems++].value = attr->extension_name;
+		meta->kv[nitems].key = "ARROW:extension:metadata";
+		meta->kv[nitems++].value = attr->extension_metadata;
+	}
+	for (i=0; i < nitems; i++)
+	{
+		ArrowKeyValue *kv = &meta->kv[i];
+
+		kv->tag = ArrowNodeTag__KeyValue;
+		kv->_key_len = strlen(kv->key);
+		kv->_value_len = strlen(kv->value);
+	}
+	field->custom_metadata = meta->kv;
+	field->_num_custom_metadata = nitems;
+}
+
+static void
+setupArrowField(ArrowField *field, SQLattribute *attr)
+{
+	memset(field, 0, sizeof(ArrowField));
+	field->tag = ArrowNodeTag__Field;
+	field->name = attr->attname;
+	field->_name_len = strlen(attr->attname);
+	field->nullable = !attr->attnotnull;
+	field->type = attr->arrow_type;
+	setupArrowDictionaryEncoding(&field->dictionary, attr);
+	/* array type */
+	if (attr->element)
+	{
+		field->children = palloc0(sizeof(ArrowField));
+		field->_num_children = 1;
+		setupArrowField(field->children, attr->element);
+	}
+	/* composite type */
+	if (attr->subtypes)
+	{
+		SQLtable   *sub = attr->subtypes;
+		int			i;
+
+		field->children = palloc0(sizeof(ArrowField) * sub->nfields);
+		field->_num_children = sub->nfields;
+		for (i=0; i < sub->nfields; i++)
+			setupArrowField(&field->children[i], &sub->attrs[i]);
+	}
+	setupArrowFieldMetadata(field, attr);
+}
+
+static void
+releaseArrowField(ArrowField *field)
+{
+	int			i;
+
+	for (i=0; i < field->_num_children; i++)
+		releaseArrowField(&field->children[i]);
+	if (field->children)
+		pfree(field->children);
+	/* see setupArrowFieldMetadata */
+	if (field->custom_metadata)
+		pfree(field->custom_metadata);
+}
+
+static ssize_t
+writeArrowSchema(SQLtable *table)
+{
+	ArrowMessage	message;
+	ArrowSchema	   *schema;
+	ssize_t			length;
+	int32			i;
+
+	/* setup Message of Schema */
+	memset(&message, 0, sizeof(ArrowMessage));
+	message.tag = ArrowNodeTag__Message;
+	message.version = ArrowMetadataVersion__V4;
+	schema = &message.body.schema;
+	schema->tag = ArrowNodeTag__Schema;
+	schema->endianness = ArrowEndianness__Little;
+	schema->fields = alloca(sizeof(ArrowField) * table->nfields);
+	schema->_num_fields = table->nfields;
+	for (i=0; i < table->nfields; i++)
+		setupArrowField(&schema->fields[i], &table->attrs[i]);
+	/* serialization */
+	length = writeFlatBufferMessage(&table->output, &message);
+	for (i=0; i < table->nfields; i++)
+		releaseArrowField(&schema->fields[i]);
+	return length;
+}
+
+/*
+ * __writeArrowDictionaryBatch
+ *
+ * It writes out the dictionary items not written yet. The first batch of
+ * the dictionary has all the items known at that time, then the next ones
+ * are deltas for the items added since the last batch.
+ */
+static void
+__writeArrowDictionaryBatch(SQLtable *table, ArrowBlock *block,
+							SQLdictionary *dict, bool isDelta)
+{
+	ArrowMessage	message;
+	ArrowDictionaryBatch *dbatch;
+	ArrowRecordBatch *rbatch;
+	ArrowBuffer	   *buffer;
+	loff_t			currPos;
+	size_t			metaLength = 0;
+	size_t			bodyLength = 0;
+	int				nitems = dict->nitems - dict->nemitted;
+	const uint32   *offsets = (const uint32 *)dict->values.ptr + dict->nemitted;
+	uint32		   *values = palloc(sizeof(uint32) * (nitems + 1));
+	size_t			values_sz = sizeof(uint32) * (nitems + 1);
+	const char	   *extra = dict->extra.ptr + offsets[0];
+	size_t			extra_sz = offsets[nitems] - offsets[0];
+	int				i;
+
+	/* offsets of the items in this batch */
+	for (i=0; i <= nitems; i++)
+		values[i] = offsets[i] - offsets[0];
+
+	/* setup Message of DictionaryBatch */
+	memset(&message, 0, sizeof(ArrowMessage));
+    message.tag = ArrowNodeTag__Message;
+    message.version = ArrowMetadataVersion__V4;
+
+	/* DictionaryBatch portion */
 	dbatch = &message.body.dictionaryBatch;
 	dbatch->tag = ArrowNodeTag__DictionaryBatch;
 	dbatch->id = dict->dict_id;
-	dbatch->isDelta = false;
+	dbatch->isDelta = isDelta;
 
 	/* RecordBatch portion */
 	rbatch = &dbatch->data;
 	rbatch->tag = ArrowNodeTag__RecordBatch;
-	rbatch->length = dict->nitems;
+	rbatch->length = nitems;
 	rbatch->_num_nodes = 1;
     rbatch->nodes = alloca(sizeof(ArrowFieldNode));
 	rbatch->nodes[0].tag = ArrowNodeTag__FieldNode;
-	rbatch->nodes[0].length = dict->nitems;
+	rbatch->nodes[0].length = nitems;
 	rbatch->nodes[0].null_count = 0;
 	rbatch->_num_buffers = 3;	/* empty nullmap + offset + extra buffer */
 	rbatch->buffers = alloca(sizeof(ArrowBuffer) * 3);
@@ -546,23 +1635,23 @@ __writeArrowDictionaryBatch(int fdesc, ArrowBlock *block, SQLdictionary *dict)
 	buffer = &rbatch->buffers[1];
     buffer->tag = ArrowNodeTag__Buffer;
     buffer->offset = bodyLength;
-    buffer->length = ARROWALIGN(dict->values.usage);
+    buffer->length = ARROWALIGN(values_sz);
 	bodyLength += buffer->length;
 	/* buffer:2 - extra buffer */
 	buffer = &rbatch->buffers[2];
 	buffer->tag = ArrowNodeTag__Buffer;
     buffer->offset = bodyLength;
-	buffer->length = ARROWALIGN(dict->extra.usage);
+	buffer->length = ARROWALIGN(extra_sz);
 	bodyLength += buffer->length;
 
 	/* serialization */
 	message.bodyLength = bodyLength;
-	currPos = lseek(fdesc, 0, SEEK_CUR);
-	if (currPos < 0)
-		Elog("unable to get current position of the file");
-	metaLength = writeFlatBufferMessage(fdesc, &message);
-	__write_buffer_common(fdesc, dict->values.ptr, dict->values.usage);
-	__write_buffer_common(fdesc, dict->extra.ptr,  dict->extra.usage);
+	currPos = table->f_pos + table->output.usage;
+	metaLength = writeFlatBufferMessage(&table->output, &message);
+	__write_buffer_common(&table->output, values, values_sz);
+	__write_buffer_common(&table->output, extra, extra_sz);
+	pfree(values);
+	dict->nemitted = dict->nitems;
 
 	/* setup Block of Footer */
 	block->tag = ArrowNodeTag__Block;
@@ -577,22 +1666,47 @@ writeArrowDictionaryBatches(SQLtable *table)
 	SQLdictionary  *dict;
 	int				index, count;
 
-	if (!pgsql_dictionary_list)
+	if (!table->dictionary_list)
 		return;
 
-	for (dict = pgsql_dictionary_list, count=0;
+	for (dict = table->dictionary_list, count=0;
 		 dict != NULL;
 		 dict = dict->next, count++);
 	table->numDictionaries = count;
 	table->dictionaries = palloc0(sizeof(ArrowBlock) * count);
 
-	for (dict = pgsql_dictionary_list, index=0;
+	for (dict = table->dictionary_list, index=0;
 		 dict != NULL;
 		 dict = dict->next, index++)
 	{
-		__writeArrowDictionaryBatch(table->fdesc,
+		__writeArrowDictionaryBatch(table,
+									table->dictionaries + index,
+									dict, false);
+	}
+}
+
+/*
+ * writeArrowDictionaryDeltas
+ *
+ * It writes out the delta dictionary batches for the items added since
+ * the last batch, prior to the record batch which references them.
+ */
+void
+writeArrowDictionaryDeltas(SQLtable *table)
+{
+	SQLdictionary  *dict;
+	int				index;
+
+	for (dict = table->dictionary_list; dict != NULL; dict = dict->next)
+	{
+		if (dict->nitems == dict->nemitted)
+			continue;
+		index = table->numDictionaries++;
+		table->dictionaries = repalloc(table->dictionaries,
+									   sizeof(ArrowBlock) * (index+1));
+		__writeArrowDictionaryBatch(table,
 									table->dictionaries + index,
-									dict);
+									dict, true);
 	}
 }
 
@@ -601,6 +1715,7 @@ writeArrowFooter(SQLtable *table)
 {
 	ArrowFooter		footer;
 	ArrowSchema	   *schema;
+	ssize_t			length;
 	int				i;
 
 	/* setup Footer */
@@ -624,59 +1739,602 @@ writeArrowFooter(SQLtable *table)
 	footer._num_recordBatches = table->numRecordBatches;
 
 	/* serialization */
-	return writeFlatBufferFooter(table->fdesc, &footer);
+	length = writeFlatBufferFooter(&table->output, &footer);
+	for (i=0; i < table->nfields; i++)
+		releaseArrowField(&schema->fields[i]);
+	return length;
 }
 
 /*
- * Entrypoint of pg2arrow
+ * Entrypoints of pg2arrow
+ *
+ * pgsql_open_query() runs the SQL command on the supplied connection, then
+ * pgsql_fetch_next() and pgsql_fetch_footer() serialize the result messages
+ * step by step. Each call replaces the table->output buffer by the messages
+ * built in this step, so the caller has to consume them before the next
+ * call. The messages are placed as if they follow the "ARROW1\0\0" magic
+ * of the Apache Arrow file format. On errors, they fill up *errinfo.
  */
-char * query(char * sql_command)
+SQLtable *
+pgsql_open_query(PGconn *conn, const char *sql_command,
+				 const SQLparams *params,
+				 const SQLoptions *options, ErrorInfo *errinfo)
 {
-	PGconn	   *conn;
-	PGresult   *res;
-	SQLtable   *table = NULL;
-	ssize_t		nbytes;
-	int p[2]; pipe(p);
-	char * buf;
-
-
-
-	/* open PostgreSQL connection */
-	conn = pgsql_server_connect();
-	/* run SQL command */
-	res = pgsql_begin_query(conn, sql_command);
-	if (!res)
-		Elog("SQL command returned an empty result");
-	table = pgsql_create_buffer(conn, res, batch_segment_sz);
-	/* open the output file */
-	table->fdesc = p[1];
-	if (table->fdesc < 0)
-		Elog("failed to open '%s'", output_filename);
-	table->filename = output_filename;
-	//pgsql_dump_buffer(table);
-	/* write header portion */
-	nbytes = write(table->fdesc, "ARROW1\0\0", 8);
-	if (nbytes != 8)
-		Elog("failed on write(2): %m");
-	nbytes = writeArrowSchema(table);
-	writeArrowDictionaryBatches(table);
-	do {
-		pgsql_append_results(table, res);
+	SQLtable   *volatile table = NULL;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		if (options->batch_nrows == 0)
+			Elog("batch size must be positive");
+		table = pgsql_prepare_query(conn, "", sql_command, params, options);
+		pgsql_begin_query(table, params);
+		/* write header portion */
+		writeArrowSchema(table);
+		writeArrowDictionaryBatches(table);
+	}
+	PG2ARROW_CATCH();
+	{
+		pgsql_abort_query(conn);
+		if (table)
+		{
+			pgsql_reset_timeout(table);
+			pgsql_free_buffer(table);
+		}
+		table = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return table;
+}
+
+/*
+ * pgsql_open_copy
+ *
+ * Like pgsql_open_query, but the rows come by COPY ... TO STDOUT.
+ */
+SQLtable *
+pgsql_open_copy(PGconn *conn, const char *sql_command,
+				const SQLoptions *options, ErrorInfo *errinfo)
+{
+	SQLtable   *volatile table = NULL;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		if (options->batch_nrows == 0)
+			Elog("batch size must be positive");
+		table = pgsql_prepare_query(conn, "", sql_command, NULL, options);
+		pgsql_begin_copy(table);
+		/* write header portion */
+		writeArrowSchema(table);
+		writeArrowDictionaryBatches(table);
+	}
+	PG2ARROW_CATCH();
+	{
+		pgsql_abort_query(conn);
+		if (table)
+		{
+			pgsql_reset_timeout(table);
+			pgsql_free_buffer(table);
+		}
+		table = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return table;
+}
+
+/*
+ * pgsql_prepare_statement
+ *
+ * It prepares the SQL command as the statement of stmt_name, to be run by
+ * pgsql_open_statement() as many times as needed. The result description
+ * is kept, with the source types of the columns cast to text and the NOT
+ * NULL hints, so each run needs no round trip for them.
+ */
+SQLstatement *
+pgsql_prepare_statement(PGconn *conn, const char *stmt_name,
+						const char *sql_command,
+						const SQLoptions *options, ErrorInfo *errinfo)
+{
+	SQLtable   *volatile table = NULL;
+	SQLstatement *volatile stmt = NULL;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		PGresult   *res;
+
+		if (*stmt_name == '\0')
+			Elog("prepared statement must have a name");
+		table = pgsql_prepare_query(conn, stmt_name, sql_command,
+									NULL, options);
+		res = PQdescribePrepared(conn, stmt_name);
+		if (PQresultStatus(res) != PGRES_COMMAND_OK)
+			ElogResult(conn, res, "unable to describe the SQL command: %s",
+					   PQresultErrorMessage(res));
+		stmt = palloc0(sizeof(SQLstatement));
+		stmt->name = pstrdup(stmt_name);
+		stmt->desc = res;
+		stmt->text_types = pgsql_save_text_types(table);
+		if (options->not_null_hints)
+		{
+			int			j;
+
+			stmt->attnotnull = palloc(sizeof(bool) * table->nfields);
+			for (j=0; j < table->nfields; j++)
+				stmt->attnotnull[j] = table->attrs[j].attnotnull;
+		}
+		pgsql_free_buffer(table);
+	}
+	PG2ARROW_CATCH();
+	{
+		if (table)
+			pgsql_free_buffer(table);
+		stmt = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return stmt;
+}
+
+/*
+ * pgsql_open_statement
+ *
+ * Like pgsql_open_query, but runs the statement prepared by
+ * pgsql_prepare_statement().
+ */
+SQLtable *
+pgsql_open_statement(PGconn *conn, const SQLstatement *stmt,
+					 const SQLparams *params,
+					 const SQLoptions *options, ErrorInfo *errinfo)
+{
+	SQLtable   *volatile table = NULL;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		bool	   *astext;
+
+		if (options->batch_nrows == 0)
+			Elog("batch size must be positive");
+		astext = alloca(sizeof(bool) * PQnfields(stmt->desc));
+		table = pgsql_create_buffer(conn, stmt->desc, options,
+									batch_segment_sz, astext);
+		if (!table)
+			Elog("unable to fetch the SQL command results in binary");
+		if (stmt->text_types)
+			pgsql_apply_text_types(table, stmt->text_types);
+		if (stmt->attnotnull)
+		{
+			int			j;
+
+			for (j=0; j < table->nfields; j++)
+				table->attrs[j].attnotnull = stmt->attnotnull[j];
+		}
+		table->conn = conn;
+		table->stmt_name = pstrdup(stmt->name);
+		table->f_pos = 8;	/* "ARROW1\0\0" */
+		pgsql_begin_query(table, params);
+		/* write header portion */
+		writeArrowSchema(table);
+		writeArrowDictionaryBatches(table);
+	}
+	PG2ARROW_CATCH();
+	{
+		pgsql_abort_query(conn);
+		if (table)
+		{
+			pgsql_reset_timeout(table);
+			pgsql_free_buffer(table);
+		}
+		table = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return table;
+}
+
+/*
+ * pgsql_close_statement
+ *
+ * It deallocates the statement on the server, unless conn is NULL, then
+ * releases the statement. It returns 0 on success, or -1 on errors; the
+ * statement is released anyway.
+ */
+int
+pgsql_close_statement(PGconn *conn, SQLstatement *stmt, ErrorInfo *errinfo)
+{
+	volatile int	retval = -1;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		if (conn)
+			pgsql_deallocate(conn, stmt->name);
+		retval = 0;
+	}
+	PG2ARROW_CATCH();
+	PG2ARROW_END_TRY();
+
+	if (stmt->text_types)
+		pgsql_free_text_types(stmt->text_types, PQnfields(stmt->desc));
+	if (stmt->attnotnull)
+		pfree(stmt->attnotnull);
+	PQclear(stmt->desc);
+	pfree(stmt->name);
+	pfree(stmt);
+
+	return retval;
+}
+
+/*
+ * pgsql_begin_multi
+ *
+ * It runs the SQL commands separated by semicolons at once by the simple
+ * query protocol, in single-row mode, then pgsql_next_result() returns
+ * the result of each statement in order, as it comes. Unlike PQexec,
+ * which keeps only the last one, every result is returned, including those
+ * of no rows like SET; the empty statements have none. The results are in
+ * text, because the simple query protocol has no binary format. The caller
+ * has to release the SQLmulti by pgsql_close_multi().
+ */
+SQLmulti *
+pgsql_begin_multi(PGconn *conn, const char *sql_command,
+				  const SQLoptions *options, ErrorInfo *errinfo)
+{
+	SQLmulti   *volatile multi = NULL;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		multi = palloc0(sizeof(SQLmulti));
+		multi->conn = conn;
+		/* statement_timeout needs the table of the query */
+		multi->holder = palloc0(sizeof(SQLtable));
+		multi->holder->conn = conn;
+		multi->holder->options = *options;
+		pgsql_set_timeout(multi->holder);
+
+		if (!PQsendQuery(conn, sql_command))
+			ElogResult(conn, NULL, "unable to run the SQL command: %s",
+					   PQerrorMessage(conn));
+		multi->in_progress = true;
+		if (!PQsetSingleRowMode(conn))
+			Elog("unable to switch the connection to single-row mode");
+	}
+	PG2ARROW_CATCH();
+	{
+		if (multi)
+			pgsql_close_multi(multi);
+		else
+			pgsql_abort_query(conn);
+		multi = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return multi;
+}
+
+/*
+ * pgsql_next_result
+ *
+ * Like pgsql_open_query, but the rows come from the next statement of
+ * pgsql_begin_multi(); the SQLtable is positioned at its first row, if
+ * any, and the rest are fetched by pgsql_fetch_next() as usual. It
+ * returns NULL with PG2ARROW_OK if no more statements. Once a statement
+ * failed, it returns the error of the statement, because the server skips
+ * the rest.
+ */
+SQLtable *
+pgsql_next_result(SQLmulti *multi, const SQLoptions *options,
+				  ErrorInfo *errinfo)
+{
+	SQLtable   *volatile table = NULL;
+
+	if (multi->failed)
+	{
+		memcpy(errinfo, &multi->error, sizeof(ErrorInfo));
+		return NULL;
+	}
+	PG2ARROW_TRY(errinfo);
+	{
+		PGconn	   *conn = multi->conn;
+		PGresult   *res;
+
+		if (options->batch_nrows == 0)
+			Elog("batch size must be positive");
+		while (multi->in_progress && !table)
+		{
+			if (multi->pending)
+			{
+				res = multi->pending;
+				multi->pending = NULL;
+			}
+			else
+				res = PQgetResult(conn);
+			if (!res)
+			{
+				/* a broken connection also ends the results */
+				if (PQstatus(conn) != CONNECTION_OK)
+					ElogResult(conn, NULL, "connection lost: %s",
+							   PQerrorMessage(conn));
+				multi->in_progress = false;
+				break;
+			}
+			switch (PQresultStatus(res))
+			{
+				case PGRES_EMPTY_QUERY:
+					PQclear(res);
+					break;
+				case PGRES_COMMAND_OK:
+				case PGRES_TUPLES_OK:
+					/* no rows, like SET, or SELECT of no rows */
+					table = pgsql_create_text_buffer(multi, res, options,
+													 batch_segment_sz);
+					pgsql_command_ntuples(table, res);
+					PQclear(res);
+					break;
+				case PGRES_SINGLE_TUPLE:
+					/* the first row of the statement */
+					table = pgsql_create_text_buffer(multi, res, options,
+													 batch_segment_sz);
+					table->pending = res;
+					table->in_progress = true;
+					break;
+				case PGRES_COPY_IN:
+				case PGRES_COPY_OUT:
+				case PGRES_COPY_BOTH:
+					/* the rest are discarded by pgsql_abort_query */
+					if (PQresultStatus(res) == PGRES_COPY_IN)
+						PQputCopyEnd(conn, "COPY is not supported here");
+					PQclear(res);
+					Elog("COPY is not supported in the multiple statements");
+				default:
+					ElogResult(conn, res, "SQL execution failed: %s",
+							   PQresultErrorMessage(res));
+			}
+		}
+		if (table)
+		{
+			table->f_pos = 8;	/* "ARROW1\0\0" */
+			/* write header portion */
+			writeArrowSchema(table);
+			writeArrowDictionaryBatches(table);
+		}
+		else
+			pgsql_reset_timeout(multi->holder);
+	}
+	PG2ARROW_CATCH();
+	{
+		pgsql_abort_query(multi->conn);
+		pgsql_fail_multi(multi, errinfo, false);
+		if (table)
+			pgsql_free_buffer(table);
+		table = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return table;
+}
+
+/*
+ * pgsql_close_multi
+ *
+ * It terminates the statements still running, then releases the SQLmulti.
+ * The SQLtable of the last statement must be closed prior to the call.
+ */
+void
+pgsql_close_multi(SQLmulti *multi)
+{
+	if (multi->in_progress)
+	{
+		multi->in_progress = false;
+		pgsql_abort_query(multi->conn);
+	}
+	if (multi->pending)
+		PQclear(multi->pending);
+	pgsql_reset_timeout(multi->holder);
+	pfree(multi->holder);
+	pfree(multi);
+}
+
+/*
+ * pgsql_describe_query
+ *
+ * It builds the schema message of the SQL command without execution.
+ */
+SQLtable *
+pgsql_describe_query(PGconn *conn, const char *sql_command,
+					 const SQLoptions *options, ErrorInfo *errinfo)
+{
+	SQLtable   *volatile table = NULL;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		table = pgsql_prepare_query(conn, "", sql_command, NULL, options);
+		writeArrowSchema(table);
+	}
+	PG2ARROW_CATCH();
+	{
+		if (table)
+			pgsql_free_buffer(table);
+		table = NULL;
+	}
+	PG2ARROW_END_TRY();
+
+	return table;
+}
+
+/*
+ * pgsql_fetch_next
+ *
+ * It returns 1 if a record batch is in the output buffer, 0 if no more
+ * results, or -1 on errors.
+ */
+int
+pgsql_fetch_next(SQLtable *table, ErrorInfo *errinfo)
+{
+	volatile int	retval = -1;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		pgsql_consume_output(table);
+		retval = (pgsql_fetch_batch(table) ? 1 : 0);
+	}
+	PG2ARROW_CATCH();
+	{
+		table->in_progress = false;
+		pgsql_abort_query(table->conn);
+		if (table->multi)
+			pgsql_fail_multi(table->multi, errinfo,
+							 table->row_limit_exceeded);
+	}
+	PG2ARROW_END_TRY();
+
+	return retval;
+}
+
+/*
+ * pgsql_fetch_footer
+ *
+ * It writes the footer portion of the Apache Arrow file format, according
+ * to the record batches written in the past. It returns 0 on success, or
+ * -1 on errors.
+ */
+int
+pgsql_fetch_footer(SQLtable *table, ErrorInfo *errinfo)
+{
+	volatile int	retval = -1;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		pgsql_consume_output(table);
+		writeArrowFooter(table);
+		retval = 0;
+	}
+	PG2ARROW_END_TRY();
+
+	return retval;
+}
+
+/*
+ * pgsql_close_query
+ *
+ * It terminates the query, even if it is still in progress, then makes the
+ * connection available for the next query; a statement of multi skips its
+ * remaining rows instead, for the next statement. It also releases the
+ * table, including the output buffer, so the caller must copy the messages
+ * out prior to the call. It is also used to release the table built by
+ * pgsql_describe_query.
+ */
+void
+pgsql_close_query(SQLtable *table)
+{
+	if (table->in_progress)
+	{
+		table->in_progress = false;
+		if (table->multi)
+			pgsql_skip_result(table);
+		else
+			pgsql_abort_query(table->conn);
+	}
+	pgsql_reset_timeout(table);
+	pgsql_free_buffer(table);
+}
+
+/*
+ * pgsql_begin_copy_in
+ *
+ * It runs the SQL command of COPY ... FROM STDIN (FORMAT binary), then the
+ * caller sends the rows by pgsql_put_copy_data() and pgsql_end_copy_in().
+ * It returns 0 on success, or -1 on errors.
+ */
+int
+pgsql_begin_copy_in(PGconn *conn, const char *sql_command, ErrorInfo *errinfo)
+{
+	volatile int	retval = -1;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		PGresult   *res = PQexec(conn, sql_command);
+
+		if (PQresultStatus(res) != PGRES_COPY_IN)
+			ElogResult(conn, res, "unable to begin COPY FROM STDIN: %s",
+					   PQresultErrorMessage(res));
 		PQclear(res);
-		res = pgsql_next_result(conn);
-	} while (res != NULL);
-	pgsql_end_query(conn);
-	if (table->nitems > 0)
-		pgsql_writeout_buffer(table);
-	nbytes = writeArrowFooter(table);
+		retval = 0;
+	}
+	PG2ARROW_CATCH();
+	{
+		pgsql_abort_query(conn);
+	}
+	PG2ARROW_END_TRY();
+
+	return retval;
+}
 
-	buf = (char *)malloc(nbytes);
+/*
+ * pgsql_put_copy_data
+ *
+ * It sends a chunk of the COPY data in the binary format; the chunk does
+ * not have to be aligned to the rows. It returns 0 on success, or -1 on
+ * errors.
+ */
+int
+pgsql_put_copy_data(PGconn *conn, const char *buf, size_t len,
+					ErrorInfo *errinfo)
+{
+	volatile int	retval = -1;
 
-	FILE *f = fdopen( p[0], "r" );
+	PG2ARROW_TRY(errinfo);
+	{
+		while (len > 0)
+		{
+			int		nbytes = Min(len, PG_INT32_MAX);
 
-	fgets(buf, nbytes, f);
+			if (PQputCopyData(conn, buf, nbytes) != 1)
+				ElogResult(conn, NULL, "failed on PQputCopyData: %s",
+						   PQerrorMessage(conn));
+			buf += nbytes;
+			len -= nbytes;
+		}
+		retval = 0;
+	}
+	PG2ARROW_CATCH();
+	PG2ARROW_END_TRY();
 
-	return buf;
+	return retval;
 }
 
+/*
+ * pgsql_end_copy_in
+ *
+ * It ends the COPY data, then returns the number of rows loaded, or -1
+ * on errors. If errmsg is not NULL, it makes the COPY fail by the message
+ * instead, so the server discards the rows sent so far; then the result
+ * is -1 whatever the server reports.
+ */
+int64
+pgsql_end_copy_in(PGconn *conn, const char *errmsg, ErrorInfo *errinfo)
+{
+	volatile int64	retval = -1;
+
+	PG2ARROW_TRY(errinfo);
+	{
+		PGresult   *res;
+		const char *ntuples;
+
+		if (PQputCopyEnd(conn, errmsg) != 1)
+			ElogResult(conn, NULL, "failed on PQputCopyEnd: %s",
+					   PQerrorMessage(conn));
+		res = PQgetResult(conn);
+		if (PQresultStatus(res) != PGRES_COMMAND_OK)
+			ElogResult(conn, res, "failed on COPY FROM STDIN: %s",
+					   PQresultErrorMessage(res));
+		ntuples = PQcmdTuples(res);
+		retval = (*ntuples != '\0' ? strtoll(ntuples, NULL, 10) : 0);
+		PQclear(res);
+	}
+	PG2ARROW_CATCH();
+	PG2ARROW_END_TRY();
+	/* discard the remaining results, if any */
+	pgsql_abort_query(conn);
 
+	return errmsg ? -1 : retval;
+}
@@ -1,32 +1,16 @@
-package main
+// Package pg2arrow runs queries on PostgreSQL, and returns the results in
+// Apache Arrow format. The rows are fetched in the binary transfer mode of
+// libpq, and converted to Arrow record batches by the C code, keeping the
+// exact data types of PostgreSQL as far as possible.
+//
+// All the []byte returned by this package are Go memory owned by the
+// caller; they are copied out of the C buffers, which are reused for the
+// next batch, and released when the query completes or its reader is
+// closed. So they stay valid after the Conn is closed, and need no
+// explicit free.
+package pg2arrow
 
 // #cgo CFLAGS: -g -Wall -I/usr/include/postgresql/server
-// #include <stdlib.h>
+// #cgo LDFLAGS: -lpq -lpgcommon -lpgport -llz4 -lzstd
 // #include "pg2arrow.h"
 import "C"
-import (
-	"fmt"
-	"unsafe"
-)
-
-func query(sql string) ([]byte, error) {
-	q := C.CString(sql)
-	defer C.free(unsafe.Pointer(q))
-
-	buf := C.query(q)
-
-	if len(buf) == 0 {
-		return nil, fmt.Errorf("failed to query postgres")
-	}
-
-	return buf, nil
-}
-
-func main() {
-	buf, err := query("SELECT 1")
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Println(string(buf))
-}
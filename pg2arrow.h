@@ -10,11 +10,13 @@
 #include "access/htup_details.h"
 #include "datatype/timestamp.h"
 #include "utils/date.h"
+#include <arpa/inet.h>
 #include <assert.h>
 #include <ctype.h>
 #include <errno.h>
 #include <fcntl.h>
 #include <getopt.h>
+#include <setjmp.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <sys/mman.h>
@@ -32,6 +34,79 @@ typedef struct SQLbuffer		SQLbuffer;
 typedef struct SQLtable			SQLtable;
 typedef struct SQLattribute		SQLattribute;
 typedef struct SQLdictionary	SQLdictionary;
+typedef struct SQLstatement		SQLstatement;
+typedef struct SQLtextType		SQLtextType;
+typedef struct SQLenumCache		SQLenumCache;
+typedef struct SQLpostgisTypes	SQLpostgisTypes;
+typedef struct SQLmulti			SQLmulti;
+typedef struct SQLsession		SQLsession;
+
+/*
+ * Options of the query given by the caller
+ */
+#define PG2ARROW_JSON_UTF8		0	/* json/jsonb as Utf8 text */
+#define PG2ARROW_JSON_BINARY	1	/* json/jsonb as Binary of wire format */
+
+#define PG2ARROW_NAMES_SUFFIX	0	/* duplicates are suffixed by count */
+#define PG2ARROW_NAMES_POSITION	1	/* duplicates are suffixed by position */
+
+#define PG2ARROW_COMPRESSION_NONE		0
+#define PG2ARROW_COMPRESSION_LZ4_FRAME	1
+#define PG2ARROW_COMPRESSION_ZSTD		2
+
+typedef struct
+{
+	size_t		batch_nrows;	/* number of rows per record batch */
+	int			json_mode;		/* one of PG2ARROW_JSON_* */
+	bool		uuid_as_string;	/* true, if uuid is written as Utf8 */
+	bool		network_as_binary;	/* true, if inet, cidr and macaddr are
+									 * written as FixedSizeBinary */
+	bool		not_null_hints;	/* true, if the columns of NOT NULL table
+								 * columns are non-nullable */
+	const char *const *dict_columns;	/* text columns to be dictionary-
+										 * encoded; valid only while the
+										 * buffer is being set up */
+	int			num_dict_columns;
+	int			compression;	/* one of PG2ARROW_COMPRESSION_* */
+	int			compression_level;	/* 0 means the default of the codec */
+	SQLenumCache *enum_cache;	/* labels of enum types cached by the
+								 * connection, or NULL */
+	SQLpostgisTypes *postgis_types;	/* PostGIS types resolved by the
+									 * connection, or NULL */
+	int			statement_timeout;	/* in milliseconds, or 0 */
+	SQLsession *session;		/* state of the session kept by the
+								 * connection, or NULL */
+	int64		max_rows;		/* rows to be fetched at most, or 0 */
+	int			column_names;	/* one of PG2ARROW_NAMES_* */
+	int			numeric_precision;	/* Decimal128 precision of numeric
+									 * without typmod, or 0 for 38 */
+	int			numeric_scale;	/* ditto, for the scale of 18 */
+} SQLoptions;
+
+/*
+ * OIDs of the PostGIS types, resolved once per connection, because the
+ * extension is installed in any schema with the dynamic OIDs.
+ */
+struct SQLpostgisTypes
+{
+	bool		resolved;		/* true, if looked up already */
+	Oid			geometry_typid;	/* InvalidOid, if PostGIS is absent */
+	Oid			geography_typid;	/* ditto */
+};
+
+/*
+ * State of the session kept by the connection across the queries. The
+ * statement_timeout of a query which opened a transaction block, like
+ * BEGIN, is restored once more after the block ends, because its ROLLBACK
+ * undoes the restore in the block.
+ */
+struct SQLsession
+{
+	char	   *pending_timeout;	/* statement_timeout to be restored once
+									 * the transaction block ends, or NULL */
+	char		error[1024];	/* failure to restore statement_timeout,
+								 * or "" once reported */
+};
 
 struct SQLbuffer
 {
@@ -50,12 +125,22 @@ struct SQLattribute
 	uint8		attalign;		/* 1, 2, 4 or 8 */
 	SQLtable   *subtypes;		/* valid, if composite type */
 	SQLattribute *element;		/* valid, if array type */
-	SQLdictionary *enumdict;	/* valid, if enum type */
+	SQLdictionary *enumdict;	/* valid, if enum or dictionary-encoded */
 	const char *typnamespace;	/* name of pg_type.typnamespace */
 	const char *typname;		/* pg_type.typname */
 	char		typtype;		/* pg_type.typtype */
+	bool		attnotnull;		/* true, if known to be NOT NULL */
+	Oid			domaintypid;	/* domain sent as atttypid, or InvalidOid */
+	const char *text_typname;	/* source type of the column cast to text
+									 * by the server, or NULL */
+	void	  (*text_recv)(SQLattribute *attr, const char *text,
+						   SQLbuffer *out);	/* converts the text form to
+											 * the binary format, if the
+											 * value comes in text */
 	ArrowType	arrow_type;		/* type in apache arrow */
 	const char *arrow_typename;	/* typename in apache arrow */
+	const char *extension_name;	/* ARROW:extension:name, or NULL */
+	const char *extension_metadata;	/* ARROW:extension:metadata */
 	/* data buffer and handler */
 	void   (*put_value)(SQLattribute *attr,
 						const char *addr, int sz);
@@ -65,7 +150,7 @@ struct SQLattribute
 	int	   (*setup_buffer)(SQLattribute *attr,
 						   ArrowBuffer *node,
 						   size_t *p_offset);
-	void   (*write_buffer)(SQLattribute *attr, int fdesc);
+	void   (*write_buffer)(SQLattribute *attr, SQLbuffer *out);
 
 	long		nitems;			/* number of rows */
 	long		nullcount;		/* number of null values */
@@ -81,16 +166,42 @@ struct SQLattribute
 
 struct SQLtable
 {
-	const char *filename;		/* output filename */
-	int			fdesc;			/* output file descriptor */
+	PGconn	   *conn;			/* connection which runs the query */
+	char	   *query;			/* SQL command to run, maybe wrapped */
+	char	   *stmt_name;		/* prepared statement to run; "" for the
+								 * unnamed one */
+	SQLoptions	options;		/* options of the query */
+	bool		in_progress;	/* true, if more results may come */
+	bool		copy_out;		/* true, if results come by COPY TO STDOUT */
+	bool		copy_header;	/* true, if COPY header is already read */
+	SQLmulti   *multi;			/* statements this result belongs to, if it
+								 * comes by the simple query protocol */
+	PGresult   *pending;		/* first row of the result, not appended
+								 * yet, or NULL */
+	SQLbuffer	recv_buf;		/* binary format converted by text_recv */
+	char	   *saved_timeout;	/* statement_timeout to be restored after
+								 * the query, or NULL if not set */
+	bool		local_timeout;	/* true, if set by SET LOCAL in the
+								 * transaction block of the caller */
+	bool		row_limit_exceeded;	/* true, if a row beyond max_rows came */
+	SQLpostgisTypes postgis_local;	/* PostGIS types of this query, if the
+									 * connection has no cache */
+	SQLbuffer	output;			/* serialized messages not consumed yet */
+	SQLbuffer	compressed;		/* compressed body of the record batch */
+	size_t		f_pos;			/* file offset of the output buffer */
 	ArrowBlock *recordBatches;	/* recordBatches written in the past */
 	int			numRecordBatches;
 	ArrowBlock *dictionaries;	/* dictionaryBatches written in the past */
 	int			numDictionaries;
+	SQLdictionary *dictionary_list;	/* dictionaries used by the attributes */
+	int			dictionary_count;
 	int			numFieldNodes;	/* # of FieldNode vector elements */
 	int			numBuffers;		/* # of Buffer vector elements */
 	size_t		segment_sz;		/* threshold of the memory usage */
 	size_t		nitems;			/* current number of rows */
+	int64		nrows;			/* number of rows written out so far */
+	int64		cmd_ntuples;	/* number of rows by the command tag, or -1
+								 * if not reported (yet) */
 	int			nfields;		/* number of attributes */
 	SQLattribute attrs[FLEXIBLE_ARRAY_MEMBER];
 };
@@ -108,32 +219,228 @@ struct hashItem
 struct SQLdictionary
 {
 	struct SQLdictionary *next;
-	Oid			enum_typeid;
+	Oid			enum_typeid;	/* InvalidOid, if built from the values */
+	SQLenumCache *enum_cache;	/* cache of the enum labels, if any */
 	int			dict_id;
 	SQLbuffer	values;
 	SQLbuffer	extra;
 	int			nitems;
+	int			nemitted;		/* number of items already written out */
 	int			nslots;			/* width of hash slot */
 	hashItem   *hslots[FLEXIBLE_ARRAY_MEMBER];
 };
 
+/*
+ * Labels of the enum types, cached per connection to save the catalog
+ * query of every query. An entry is dropped once a label unknown to it
+ * appears, like the one added by ALTER TYPE ... ADD VALUE.
+ */
+typedef struct SQLenumType
+{
+	struct SQLenumType *next;
+	Oid			enum_typeid;
+	int			nlabels;
+	char	   *labels;			/* NUL-terminated, in enumsortorder */
+} SQLenumType;
+
+struct SQLenumCache
+{
+	SQLenumType *types;
+};
+
+/*
+ * Error information reported to the caller
+ */
+#define PG2ARROW_OK				0	/* no error */
+#define PG2ARROW_ERR_INTERNAL	1	/* internal or data conversion error */
+#define PG2ARROW_ERR_CONNECTION	2	/* connection to the server is broken */
+#define PG2ARROW_ERR_QUERY		3	/* error reported by the server */
+
+typedef struct
+{
+	int			code;			/* one of PG2ARROW_* */
+	char		sqlstate[6];	/* SQLSTATE, if reported by the server */
+	char		message[1024];	/* error message */
+} ErrorInfo;
+
+/*
+ * Prepared statement to be run repeatedly
+ */
+struct SQLstatement
+{
+	char	   *name;			/* name of the prepared statement */
+	PGresult   *desc;			/* result description of the statement */
+	SQLtextType *text_types;	/* source types of the columns, for each
+								 * field of desc, or NULL if none are cast
+								 * to text */
+	bool	   *attnotnull;		/* NOT NULL hints for each field of desc,
+								 * or NULL unless not_null_hints */
+};
+
+/*
+ * Source type of a column cast to text, kept by the prepared statement for
+ * each run of it without the catalog lookups
+ */
+struct SQLtextType
+{
+	Oid			atttypid;		/* InvalidOid, if not cast to text */
+	int			atttypmod;
+	char	   *typnamespace;
+	char	   *typname;
+	char	   *text_typname;	/* as format_type() tells */
+};
+
+/*
+ * Multiple statements run at once by the simple query protocol; their
+ * results come one after another, each of them as a SQLtable.
+ */
+struct SQLmulti
+{
+	PGconn	   *conn;
+	SQLtable   *holder;			/* statement_timeout of the whole */
+	bool		in_progress;	/* true, if more results may come */
+	PGresult   *pending;		/* result of the next statement already
+								 * received, or NULL */
+	bool		failed;			/* true, if a statement failed */
+	ErrorInfo	error;			/* ...and its error */
+	bool		row_limit_exceeded;	/* true, if it failed by max_rows */
+};
+
+/*
+ * Built-in types of the fixed catalog entries, with the conversion from
+ * their text forms to the binary formats
+ */
+typedef struct
+{
+	Oid			typid;
+	const char *typname;
+	int			typlen;
+	bool		typbyval;
+	char		typalign;
+	char		typtype;
+	Oid			typelem;
+	void	  (*text_recv)(SQLattribute *attr, const char *text,
+						   SQLbuffer *out);
+} SQLbuiltinType;
+
+/*
+ * Parameters of the SQL command; arguments of PQprepare/PQsendQueryPrepared
+ */
+typedef struct
+{
+	int			nparams;
+	Oid		   *types;			/* 0 to let the server infer the type */
+	const char **values;		/* NULL for SQL NULL */
+	int		   *lengths;		/* only used for binary parameters */
+	int		   *formats;		/* 0 = text, 1 = binary */
+} SQLparams;
+
 /* pg2arrow.c */
 extern int			shows_progress;
+extern __thread ErrorInfo  *pg2arrow_error_info;
+extern __thread sigjmp_buf *pg2arrow_error_jmp;
+extern void			__Elog(int code, const char *sqlstate,
+						   const char *filename, int lineno,
+						   const char *fmt, ...)
+					pg_attribute_printf(5, 6) pg_attribute_noreturn();
+extern void			__ElogResult(PGconn *conn, PGresult *res,
+								 const char *filename, int lineno,
+								 const char *fmt, ...)
+					pg_attribute_printf(5, 6) pg_attribute_noreturn();
 extern void			writeArrowRecordBatch(SQLtable *table,
 										  size_t *p_metaLength,
 										  size_t *p_bodyLength);
+extern void			writeArrowDictionaryDeltas(SQLtable *table);
+extern PGconn	   *pgsql_server_connect(const char *dsn,
+										 ErrorInfo *errinfo);
+extern SQLtable	   *pgsql_open_query(PGconn *conn,
+									 const char *sql_command,
+									 const SQLparams *params,
+									 const SQLoptions *options,
+									 ErrorInfo *errinfo);
+extern SQLtable	   *pgsql_open_copy(PGconn *conn,
+									const char *sql_command,
+									const SQLoptions *options,
+									ErrorInfo *errinfo);
+extern SQLmulti	   *pgsql_begin_multi(PGconn *conn,
+									  const char *sql_command,
+									  const SQLoptions *options,
+									  ErrorInfo *errinfo);
+extern SQLtable	   *pgsql_next_result(SQLmulti *multi,
+									  const SQLoptions *options,
+									  ErrorInfo *errinfo);
+extern void			pgsql_close_multi(SQLmulti *multi);
+extern SQLstatement *pgsql_prepare_statement(PGconn *conn,
+											 const char *stmt_name,
+											 const char *sql_command,
+											 const SQLoptions *options,
+											 ErrorInfo *errinfo);
+extern SQLtable	   *pgsql_open_statement(PGconn *conn,
+										 const SQLstatement *stmt,
+										 const SQLparams *params,
+										 const SQLoptions *options,
+										 ErrorInfo *errinfo);
+extern int			pgsql_close_statement(PGconn *conn,
+										  SQLstatement *stmt,
+										  ErrorInfo *errinfo);
+extern SQLtable	   *pgsql_describe_query(PGconn *conn,
+										 const char *sql_command,
+										 const SQLoptions *options,
+										 ErrorInfo *errinfo);
+extern int			pgsql_fetch_next(SQLtable *table, ErrorInfo *errinfo);
+extern int			pgsql_fetch_footer(SQLtable *table, ErrorInfo *errinfo);
+extern void			pgsql_close_query(SQLtable *table);
+extern int			pgsql_begin_copy_in(PGconn *conn,
+										const char *sql_command,
+										ErrorInfo *errinfo);
+extern int			pgsql_put_copy_data(PGconn *conn,
+										const char *buf, size_t len,
+										ErrorInfo *errinfo);
+extern int64		pgsql_end_copy_in(PGconn *conn, const char *errmsg,
+									  ErrorInfo *errinfo);
+extern SQLsession  *pgsql_create_session(void);
+extern void			pgsql_free_session(SQLsession *session);
 /* query.c */
-extern SQLdictionary *pgsql_dictionary_list;
 extern SQLtable	   *pgsql_create_buffer(PGconn *conn, PGresult *res,
-								size_t segment_sz);
-extern void			pgsql_append_results(SQLtable *table, PGresult *res);
+										const SQLoptions *options,
+										size_t segment_sz,
+										bool *astext);
+extern void			pgsql_setup_attnotnull(PGconn *conn, PGresult *res,
+										   SQLtable *table);
+extern SQLtable	   *pgsql_create_text_buffer(SQLmulti *multi, PGresult *res,
+											 const SQLoptions *options,
+											 size_t segment_sz);
+extern size_t		pgsql_append_results(SQLtable *table, PGresult *res);
+extern size_t		pgsql_append_copy_data(SQLtable *table,
+										   const char *buf, size_t nbytes);
+extern hashItem	   *pgsql_append_dictionary(SQLdictionary *dict,
+											const char *label, size_t len,
+											uint32 hash);
+extern SQLenumCache *pgsql_create_enum_cache(void);
+extern void			pgsql_free_enum_cache(SQLenumCache *cache);
+extern void			pgsql_invalidate_enum_type(SQLenumCache *cache,
+											   Oid enum_typeid);
+extern SQLpostgisTypes *pgsql_create_postgis_types(void);
+extern void			pgsql_free_postgis_types(SQLpostgisTypes *types);
 extern void 		pgsql_writeout_buffer(SQLtable *table);
+extern void			pgsql_free_buffer(SQLtable *table);
 extern void			pgsql_dump_buffer(SQLtable *table);
 /* arrow_write.c */
-extern ssize_t		writeFlatBufferMessage(int fdesc, ArrowMessage *message);
-extern ssize_t		writeFlatBufferFooter(int fdesc, ArrowFooter *footer);
+extern ssize_t		writeFlatBufferMessage(SQLbuffer *out,
+										   ArrowMessage *message);
+extern ssize_t		writeFlatBufferFooter(SQLbuffer *out,
+										  ArrowFooter *footer);
 /* arrow_types.c */
-extern void			assignArrowType(SQLattribute *attr, int *p_numBuffers);
+extern bool			assignArrowType(SQLattribute *attr,
+									const SQLoptions *options,
+									int *p_numBuffers);
+extern void			assignArrowTypeTextForm(SQLattribute *attr,
+											int *p_numBuffers);
+extern void			assignArrowTypeTextDictionary(SQLattribute *attr,
+												  int *p_numBuffers);
+/* text_recv.c */
+extern const SQLbuiltinType *pgsql_lookup_builtin_type(PGconn *conn,
+													   Oid typid);
 /* arrow_read.c */
 extern void			readArrowFile(const char *pathname);
 /* arrow_dump.c */
@@ -141,12 +448,51 @@ extern void			dumpArrowNode(ArrowNode *node, FILE *out);
 
 /*
  * Error message and exit
+ *
+ * Elog() saves the error information on pg2arrow_error_info, then jumps
+ * back to the entrypoint which set up pg2arrow_error_jmp. It terminates
+ * the process only if nobody set up the error handler.
+ * ElogResult() also picks up SQLSTATE from the PGresult, and reports the
+ * error as connection failure if PGconn is already broken.
  */
-#define Elog(fmt, ...)								\
-	do {											\
-		fprintf(stderr,"%s:%d  " fmt "\n",			\
-				__FILE__,__LINE__, ##__VA_ARGS__);	\
-		exit(1);									\
+#define Elog(fmt, ...)										\
+	__Elog(PG2ARROW_ERR_INTERNAL, NULL,						\
+		   __FILE__, __LINE__, fmt, ##__VA_ARGS__)
+#define ElogResult(conn, res, fmt, ...)						\
+	__ElogResult((conn), (res),								\
+				 __FILE__, __LINE__, fmt, ##__VA_ARGS__)
+
+/*
+ * PG2ARROW_TRY / PG2ARROW_CATCH / PG2ARROW_END_TRY
+ *
+ * Entrypoints called by the Go code have to set up the error handler,
+ * because Elog() jumps back to here. Like PG_TRY() of PostgreSQL, local
+ * variables modified within the block must be declared volatile, and
+ * never 'return' from the inside of the block.
+ */
+#define PG2ARROW_TRY(errinfo)									\
+	do {														\
+		sigjmp_buf *__save_error_jmp = pg2arrow_error_jmp;		\
+		ErrorInfo  *__save_error_info = pg2arrow_error_info;	\
+		sigjmp_buf	__local_error_jmp;							\
+																\
+		memset((errinfo), 0, sizeof(ErrorInfo));				\
+		pg2arrow_error_info = (errinfo);						\
+		if (sigsetjmp(__local_error_jmp, 0) == 0)				\
+		{														\
+			pg2arrow_error_jmp = &__local_error_jmp;
+
+#define PG2ARROW_CATCH()										\
+		}														\
+		else													\
+		{														\
+			pg2arrow_error_jmp = __save_error_jmp;				\
+			pg2arrow_error_info = __save_error_info;
+
+#define PG2ARROW_END_TRY()										\
+		}														\
+		pg2arrow_error_jmp = __save_error_jmp;					\
+		pg2arrow_error_info = __save_error_info;				\
 	} while(0)
 
 /*
@@ -235,6 +581,14 @@ sql_buffer_clrbit(SQLbuffer *buf, size_t __index)
 	buf->usage = Max(buf->usage, index + 1);
 }
 
+static inline void
+sql_buffer_free(SQLbuffer *buf)
+{
+	if (buf->ptr)
+		munmap(buf->ptr, buf->length);
+	sql_buffer_init(buf);
+}
+
 static inline void
 sql_buffer_clear(SQLbuffer *buf)
 {
@@ -242,45 +596,14 @@ sql_buffer_clear(SQLbuffer *buf)
 }
 
 /*
- * File operations
+ * Output operations
  */
 static inline void
-__write_buffer_common(int fdesc, const void *buffer, size_t length)
+__write_buffer_common(SQLbuffer *out, const void *buffer, size_t length)
 {
-	ssize_t		nbytes;
-	ssize_t		offset = 0;
-
-	while (offset < length)
-	{
-		nbytes = write(fdesc, (const char *)buffer + offset, length - offset);
-		if (nbytes < 0)
-		{
-			if (errno == EINTR)
-				continue;
-			Elog("failed on write(2): %m");
-		}
-		offset += nbytes;
-	}
-
+	sql_buffer_append(out, buffer, length);
 	if (length != ARROWALIGN(length))
-	{
-		ssize_t	gap = ARROWALIGN(length) - length;
-		char	zero[64];
-
-		offset = 0;
-		memset(zero, 0, sizeof(zero));
-		while (offset < gap)
-		{
-			nbytes = write(fdesc, (const char *)&zero + offset, gap - offset);
-			if (nbytes < 0)
-			{
-				if (errno == EINTR)
-					continue;
-				Elog("failed on write(2): %m");
-			}
-			offset += nbytes;
-		}
-	}
+		sql_buffer_append_zero(out, ARROWALIGN(length) - length);
 }
 
 /*
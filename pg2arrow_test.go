@@ -0,0 +1,179 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// testDSN returns the DSN of the test server by PG2ARROW_TEST_DSN, or skips
+// the test if not set; the tests need a PostgreSQL server to run against.
+func testDSN(t *testing.T) string {
+	t.Helper()
+	dsn, ok := os.LookupEnv("PG2ARROW_TEST_DSN")
+	if !ok {
+		t.Skip("PG2ARROW_TEST_DSN is not set")
+	}
+	return dsn
+}
+
+// testConn connects to the test server, and closes the Conn at the end of
+// the test.
+func testConn(t *testing.T, opts ...Option) *Conn {
+	t.Helper()
+	c, err := Connect(testDSN(t), opts...)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testExec runs the SQL commands in order, discarding their results.
+func testExec(t *testing.T, c *Conn, sqls ...string) {
+	t.Helper()
+	for _, sql := range sqls {
+		if _, err := c.Query(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+}
+
+// testQuery runs the SQL command by Query, then returns the schema and the
+// records of the file decoded by the IPC file reader. The records are
+// released at the end of the test.
+func testQuery(t *testing.T, c *Conn, sql string) (*arrow.Schema, []arrow.Record) {
+	t.Helper()
+	buf, err := c.Query(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return testFile(t, sql, buf)
+}
+
+// testFile decodes the Arrow file of the query by the IPC file reader, then
+// returns the schema and the records, which are released at the end of the
+// test.
+func testFile(t *testing.T, sql string, buf []byte) (*arrow.Schema, []arrow.Record) {
+	t.Helper()
+	rdr, err := ipc.NewFileReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("%s: invalid Arrow file: %v", sql, err)
+	}
+	defer rdr.Close()
+
+	recs := make([]arrow.Record, rdr.NumRecords())
+	for i := range recs {
+		rec, err := rdr.Record(i)
+		if err != nil {
+			t.Fatalf("%s: record batch %d: %v", sql, i, err)
+		}
+		rec.Retain()
+		recs[i] = rec
+		t.Cleanup(rec.Release)
+	}
+	return rdr.Schema(), recs
+}
+
+// testColumn runs the SQL command by Query, then returns the first column of
+// its single record batch.
+func testColumn(t *testing.T, c *Conn, sql string) arrow.Array {
+	t.Helper()
+	_, recs := testQuery(t, c, sql)
+	if len(recs) != 1 {
+		t.Fatalf("%s: got %d record batches, want 1", sql, len(recs))
+	}
+	return recs[0].Column(0)
+}
+
+// testStream runs the SQL command by QueryStream, then returns the schema
+// and the records of the messages decoded by the IPC stream reader. The
+// records are released at the end of the test.
+func testStream(t *testing.T, c *Conn, sql string) (*arrow.Schema, []arrow.Record) {
+	t.Helper()
+	r, err := c.QueryStream(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return testReader(t, sql, r)
+}
+
+// testReader is like testStream, but of the RecordReader of the SQL
+// command, which is closed.
+func testReader(t *testing.T, sql string, r *RecordReader) (*arrow.Schema, []arrow.Record) {
+	t.Helper()
+	defer r.Close()
+
+	s := &recordStream{r: r, buf: r.Schema()}
+	rdr, err := ipc.NewReader(s)
+	if err != nil {
+		t.Fatalf("%s: invalid Arrow stream: %v", sql, s.wrapErr(err))
+	}
+	defer rdr.Release()
+
+	var recs []arrow.Record
+	for rdr.Next() {
+		rec := rdr.Record()
+		rec.Retain()
+		recs = append(recs, rec)
+		t.Cleanup(rec.Release)
+	}
+	if err := rdr.Err(); err != nil && err != io.EOF {
+		t.Fatalf("%s: %v", sql, s.wrapErr(err))
+	}
+	return rdr.Schema(), recs
+}
+
+// testRows reads the RecordReader up to the end, then returns the number
+// of the rows, and the error which stopped it if any. The reader is closed.
+func testRows(t *testing.T, r *RecordReader) (int64, error) {
+	t.Helper()
+	defer r.Close()
+
+	s := &recordStream{r: r, buf: r.Schema()}
+	rdr, err := ipc.NewReader(s)
+	if err != nil {
+		return 0, s.wrapErr(err)
+	}
+	defer rdr.Release()
+
+	var nrows int64
+	for rdr.Next() {
+		nrows += rdr.Record().NumRows()
+	}
+	if err := rdr.Err(); err != nil && err != io.EOF {
+		return nrows, s.wrapErr(err)
+	}
+	return nrows, nil
+}
+
+// testSleeping waits until n other backends sleep by pg_sleep, which is
+// queried by the Conn. A cancel request before the server runs the query
+// is ignored, so the tests of a cancel wait for the query first.
+func testSleeping(t *testing.T, c *Conn, n int64) {
+	t.Helper()
+	const sleeping = "SELECT count(*) FROM pg_stat_activity " +
+		"WHERE wait_event = 'PgSleep' AND pid <> pg_backend_pid()"
+	deadline := time.Now().Add(10 * time.Second)
+	for testColumn(t, c, sleeping).(*array.Int64).Value(0) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got less than %d backends sleeping", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testTable creates the table of the columns, which is dropped at the end
+// of the test. Unlike a temporary table, it is visible to the other Conns,
+// like the target of CopyIn.
+func testTable(t *testing.T, c *Conn, name, columns string) {
+	t.Helper()
+	testExec(t, c, "DROP TABLE IF EXISTS "+name, "CREATE TABLE "+name+" ("+columns+")")
+	t.Cleanup(func() { c.Query("DROP TABLE IF EXISTS " + name) })
+}
@@ -0,0 +1,148 @@
+package pg2arrow
+
+// #include "pg2arrow.h"
+import "C"
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Pool is a pool of up to maxConns connections to the same server, for
+// many concurrent queries. It is safe for concurrent use. The connections
+// are opened on demand, and kept idle for the next query until Close.
+type Pool struct {
+	dsn   string
+	opts  []Option
+	slots chan struct{} // one per connection acquired
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewPool returns a pool of up to maxConns connections, which are opened
+// by Connect with the dsn and the options. No connections are opened until
+// the first query.
+func NewPool(dsn string, maxConns int, opts ...Option) (*Pool, error) {
+	if maxConns <= 0 {
+		return nil, fmt.Errorf("pg2arrow: maxConns must be positive, got %d", maxConns)
+	}
+	if _, err := newConfig(opts); err != nil {
+		return nil, err
+	}
+	return &Pool{
+		dsn:   dsn,
+		opts:  opts,
+		slots: make(chan struct{}, maxConns),
+	}, nil
+}
+
+// Query is like QueryContext on a connection of the pool. If all the
+// connections are in use, it waits for one of them returned, until ctx is
+// done. The connection of the query canceled by ctx is in use until the
+// server stops the query.
+func (p *Pool) Query(ctx context.Context, sql string) ([]byte, error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(c)
+
+	return c.QueryContext(ctx, sql)
+}
+
+// acquire returns an idle connection if any, or opens a new one. The idle
+// connections which libpq knows broken, like by the connection lost in the
+// last query, are closed instead.
+func (p *Pool) acquire(ctx context.Context) (*Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			<-p.slots
+			return nil, ErrPoolClosed
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if c.healthy() {
+			return c, nil
+		}
+		c.Close()
+	}
+
+	c, err := Connect(p.dsn, p.opts...)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// release returns the connection to the pool, or closes it if the pool is
+// closed. The connection still running the query canceled by QueryContext
+// is returned once the query ends, holding its slot until then, so acquire
+// waits for a slot by ctx, never for the query.
+func (p *Pool) release(c *Conn) {
+	if !c.mu.TryLock() {
+		go func() {
+			c.mu.Lock()
+			c.mu.Unlock()
+			p.put(c)
+		}()
+		return
+	}
+	c.mu.Unlock()
+	p.put(c)
+}
+
+// put puts the connection released into the idle ones, then frees its
+// slot.
+func (p *Pool) put(c *Conn) {
+	p.mu.Lock()
+	if p.closed {
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+	}
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// Close closes the idle connections; the ones in use are closed when their
+// queries end. Query returns ErrPoolClosed after Close. It is safe to call
+// Close more than once.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+	p.closed = true
+	return nil
+}
+
+// healthy tells whether the connection is still usable, by PQstatus. It
+// may wait for the query canceled by QueryContext before it began, which
+// fails at once; release keeps the ones already running out of the pool.
+func (c *Conn) healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn != nil && C.PQstatus(c.conn) == C.CONNECTION_OK
+}
@@ -0,0 +1,112 @@
+package pg2arrow
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+// testPool returns a pool of the test server, which is closed at the end of
+// the test.
+func testPool(t *testing.T, maxConns int, opts ...Option) *Pool {
+	t.Helper()
+	p, err := NewPool(testDSN(t), maxConns, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPoolSaturated(t *testing.T) {
+	p := testPool(t, 1)
+
+	c, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all the connections in use; it waits until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.Query(ctx, "SELECT 1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// then the one returned is reused
+	p.release(c)
+	d, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.release(d)
+	if d != c {
+		t.Errorf("got a new connection, want the idle one")
+	}
+}
+
+func TestPoolBusy(t *testing.T) {
+	p := testPool(t, 1)
+
+	// the query canceled by QueryContext may be still running, as if it
+	// holds the lock, then the connection is out of the pool until it ends
+	c, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	p.release(c)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("acquire took %v beyond ctx", d)
+	}
+
+	c.mu.Unlock()
+	d, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.release(d)
+	if d != c {
+		t.Errorf("got a new connection, want the one of the query ended")
+	}
+}
+
+func TestPoolBroken(t *testing.T) {
+	p := testPool(t, 1)
+	ctx := context.Background()
+
+	pid := func() (int32, error) {
+		buf, err := p.Query(ctx, "SELECT pg_backend_pid()")
+		if err != nil {
+			return 0, err
+		}
+		_, recs := testFile(t, "SELECT pg_backend_pid()", buf)
+		return recs[0].Column(0).(*array.Int32).Value(0), nil
+	}
+	old, err := pid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExec(t, testConn(t), "SELECT pg_terminate_backend("+strconv.Itoa(int(old))+")")
+
+	// the query on the connection lost fails, then it is discarded
+	if _, err := pid(); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("got %v, want ErrConnectionLost", err)
+	}
+	got, err := pid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == old {
+		t.Errorf("got the connection lost, want a new one")
+	}
+}
@@ -11,15 +11,13 @@
 #define atooid(x)		((Oid) strtoul((x), NULL, 10))
 #define InvalidOid		((Oid) 0)
 
-/* Dictionary Batch */
-SQLdictionary  *pgsql_dictionary_list = NULL;
-static int		pgsql_dictionary_count = 0;
-
 /* forward declarations */
 static SQLtable *
-pgsql_create_composite_type(PGconn *conn, Oid comptype_relid);
+pgsql_create_composite_type(SQLtable *root, PGconn *conn,
+							Oid comptype_relid);
 static SQLattribute *
-pgsql_create_array_element(PGconn *conn, Oid array_elemid,
+pgsql_create_array_element(SQLtable *root, PGconn *conn,
+						   Oid array_elemid,
 						   int *p_numFieldNode,
 						   int *p_numBuffers);
 static inline bool
@@ -46,77 +44,280 @@ pg_strtochar(const char *v)
 	return *v;
 }
 
+/*
+ * pgsql_alloc_dictionary
+ */
 static SQLdictionary *
-pgsql_create_dictionary(PGconn *conn, Oid enum_typeid)
+pgsql_alloc_dictionary(SQLtable *root, Oid enum_typeid, int nslots)
 {
 	SQLdictionary *dict;
+
+	dict = palloc0(offsetof(SQLdictionary, hslots[nslots]));
+	dict->enum_typeid = enum_typeid;
+	dict->dict_id = root->dictionary_count++;
+	sql_buffer_init(&dict->values);
+	sql_buffer_init(&dict->extra);
+	dict->nslots = nslots;
+	sql_buffer_append_zero(&dict->values, sizeof(int32));
+	dict->next = root->dictionary_list;
+	root->dictionary_list = dict;
+
+	return dict;
+}
+
+/*
+ * pgsql_append_dictionary
+ *
+ * It adds a new label to the dictionary, then returns the hash item.
+ */
+hashItem *
+pgsql_append_dictionary(SQLdictionary *dict,
+						const char *label, size_t len, uint32 hash)
+{
+	hashItem   *hitem;
+	int			j = hash % dict->nslots;
+
+	hitem = palloc0(offsetof(hashItem, label[len + 1]));
+	memcpy(hitem->label, label, len);
+	hitem->label_len = len;
+	hitem->index = dict->nitems++;
+	hitem->hash = hash;
+	hitem->next = dict->hslots[j];
+	dict->hslots[j] = hitem;
+
+	sql_buffer_append(&dict->extra, label, len);
+	sql_buffer_append(&dict->values, &dict->extra.usage, sizeof(int32));
+
+	return hitem;
+}
+
+/*
+ * pgsql_create_enum_cache / pgsql_free_enum_cache
+ */
+SQLenumCache *
+pgsql_create_enum_cache(void)
+{
+	return palloc0(sizeof(SQLenumCache));
+}
+
+void
+pgsql_free_enum_cache(SQLenumCache *cache)
+{
+	SQLenumType *etype;
+
+	while ((etype = cache->types) != NULL)
+	{
+		cache->types = etype->next;
+		pfree(etype->labels);
+		pfree(etype);
+	}
+	pfree(cache);
+}
+
+/*
+ * pgsql_invalidate_enum_type
+ *
+ * It drops the cached labels of the enum type, if any, so the next query
+ * fetches them again.
+ */
+void
+pgsql_invalidate_enum_type(SQLenumCache *cache, Oid enum_typeid)
+{
+	SQLenumType **prev;
+	SQLenumType *etype;
+
+	if (!cache)
+		return;
+	for (prev = &cache->types; (etype = *prev) != NULL; prev = &etype->next)
+	{
+		if (etype->enum_typeid == enum_typeid)
+		{
+			*prev = etype->next;
+			pfree(etype->labels);
+			pfree(etype);
+			return;
+		}
+	}
+}
+
+/*
+ * pgsql_fetch_enum_type
+ *
+ * It fetches the labels of the enum type in the declared order, or returns
+ * the cached ones if any.
+ */
+static SQLenumType *
+pgsql_fetch_enum_type(SQLenumCache *cache, PGconn *conn, Oid enum_typeid)
+{
+	SQLenumType *etype;
 	PGresult   *res;
 	char		query[4096];
-	int			i, j, nitems;
-	int			nslots;
+	size_t		len;
+	int			i, nitems;
 
-	for (dict = pgsql_dictionary_list; dict != NULL; dict = dict->next)
+	for (etype = cache->types; etype != NULL; etype = etype->next)
 	{
-		if (dict->enum_typeid == enum_typeid)
-			return dict;
+		if (etype->enum_typeid == enum_typeid)
+			return etype;
 	}
 
 	snprintf(query, sizeof(query),
 			 "SELECT enumlabel"
 			 "  FROM pg_catalog.pg_enum"
-			 " WHERE enumtypid = %u", enum_typeid);
+			 " WHERE enumtypid = %u"
+			 " ORDER BY enumsortorder", enum_typeid);
 	res = PQexec(conn, query);
 	if (PQresultStatus(res) != PGRES_TUPLES_OK)
-		Elog("failed on pg_enum system catalog query: %s",
-			 PQresultErrorMessage(res));
+		ElogResult(conn, res, "failed on pg_enum system catalog query: %s",
+				   PQresultErrorMessage(res));
 
 	nitems = PQntuples(res);
-	nslots = Min(Max(nitems, 1<<10), 1<<18);
-	dict = palloc0(offsetof(SQLdictionary, hslots[nslots]));
-	dict->enum_typeid = enum_typeid;
-	dict->dict_id = pgsql_dictionary_count++;
-	sql_buffer_init(&dict->values);
-	sql_buffer_init(&dict->extra);
-	dict->nitems = nitems;
-	dict->nslots = nslots;
-	sql_buffer_append_zero(&dict->values, sizeof(int32));
-	for (i=0; i < nitems; i++)
+	for (i=0, len=0; i < nitems; i++)
+	{
+		if (PQgetisnull(res, i, 0) != 0)
+			ElogResult(conn, res, "Unexpected result from pg_enum system catalog");
+		len += PQgetlength(res, i, 0) + 1;
+	}
+	etype = palloc0(sizeof(SQLenumType));
+	etype->enum_typeid = enum_typeid;
+	etype->nlabels = nitems;
+	etype->labels = palloc(len + 1);
+	for (i=0, len=0; i < nitems; i++)
 	{
 		const char *enumlabel = PQgetvalue(res, i, 0);
-		hashItem   *hitem;
-		uint32		hash;
-		size_t		len;
+		size_t		sz = PQgetlength(res, i, 0);
 
-		if (PQgetisnull(res, i, 0) != 0)
-			Elog("Unexpected result from pg_enum system catalog");
-
-		len = strlen(enumlabel);
-		hash = hash_any((const unsigned char *)enumlabel, len);
-		j = hash % nslots;
-		hitem = palloc0(offsetof(hashItem, label[len + 1]));
-		strcpy(hitem->label, enumlabel);
-		hitem->label_len = len;
-		hitem->index = i;
-		hitem->hash = hash;
-		hitem->next = dict->hslots[j];
-		dict->hslots[j] = hitem;
-
-		sql_buffer_append(&dict->extra, enumlabel, len);
-		sql_buffer_append(&dict->values, &dict->extra.usage, sizeof(int32));
+		memcpy(etype->labels + len, enumlabel, sz + 1);
+		len += sz + 1;
+	}
+	PQclear(res);
+
+	etype->next = cache->types;
+	cache->types = etype;
+
+	return etype;
+}
+
+/*
+ * pgsql_create_postgis_types / pgsql_free_postgis_types
+ */
+SQLpostgisTypes *
+pgsql_create_postgis_types(void)
+{
+	return palloc0(sizeof(SQLpostgisTypes));
+}
+
+void
+pgsql_free_postgis_types(SQLpostgisTypes *types)
+{
+	pfree(types);
+}
+
+/*
+ * pgsql_resolve_postgis_types
+ *
+ * It looks up geometry and geography of the PostGIS extension, unless
+ * resolved already. They stay InvalidOid without PostGIS, so no column is
+ * taken for them, even of the same names in another schema.
+ */
+static void
+pgsql_resolve_postgis_types(PGconn *conn, SQLpostgisTypes *types)
+{
+	PGresult   *res;
+	int			i;
+
+	if (types->resolved)
+		return;
+	res = PQexec(conn,
+				 "SELECT t.oid, t.typname"
+				 "  FROM pg_catalog.pg_type t,"
+				 "       pg_catalog.pg_extension e"
+				 " WHERE t.typnamespace = e.extnamespace"
+				 "   AND e.extname = 'postgis'"
+				 "   AND t.typname IN ('geometry', 'geography')");
+	if (PQresultStatus(res) != PGRES_TUPLES_OK)
+		ElogResult(conn, res, "failed on pg_extension system catalog query: %s",
+				   PQresultErrorMessage(res));
+	for (i=0; i < PQntuples(res); i++)
+	{
+		Oid			typid = atooid(PQgetvalue(res, i, 0));
+		const char *typname = PQgetvalue(res, i, 1);
+
+		if (strcmp(typname, "geometry") == 0)
+			types->geometry_typid = typid;
+		else
+			types->geography_typid = typid;
 	}
-	dict->nitems = nitems;
-	dict->next = pgsql_dictionary_list;
-	pgsql_dictionary_list = dict;
 	PQclear(res);
+	types->resolved = true;
+}
+
+/*
+ * pgsql_create_dictionary
+ *
+ * Dictionaries are tracked by the root table, because a particular enum
+ * type may appear multiple times, even within composite or array types.
+ * The labels are in the declared order, so the indexes sort like the enum
+ * values. It returns NULL if the enum type has no labels, like the one
+ * dropped concurrently; the column is written as Utf8 then.
+ */
+static SQLdictionary *
+pgsql_create_dictionary(SQLtable *root, PGconn *conn, Oid enum_typeid)
+{
+	SQLenumCache *cache = root->options.enum_cache;
+	SQLenumCache local = { NULL };
+	SQLdictionary *dict;
+	SQLenumType *etype;
+	const char *label;
+	int			i;
+
+	for (dict = root->dictionary_list; dict != NULL; dict = dict->next)
+	{
+		if (dict->enum_typeid == enum_typeid)
+			return dict;
+	}
+
+	/* without the cache of the connection, the labels live in this call */
+	etype = pgsql_fetch_enum_type(cache ? cache : &local, conn, enum_typeid);
+	if (etype->nlabels > 0)
+	{
+		dict = pgsql_alloc_dictionary(root, enum_typeid,
+									  Min(Max(etype->nlabels, 1<<10), 1<<18));
+		dict->enum_cache = cache;
+		for (i=0, label = etype->labels;
+			 i < etype->nlabels;
+			 i++, label += strlen(label) + 1)
+		{
+			size_t	len = strlen(label);
+
+			pgsql_append_dictionary(dict, label, len,
+									hash_any((const unsigned char *)label,
+											 len));
+		}
+	}
+	if (!cache)
+		pgsql_invalidate_enum_type(&local, enum_typeid);
 
 	return dict;
 }
 
+static bool pgsql_setup_domain_attribute(SQLtable *root, PGconn *conn,
+										 SQLattribute *attr,
+										 const char *attname,
+										 Oid domain_typid,
+										 int atttypmod,
+										 int *p_numFieldNodes,
+										 int *p_numBuffers);
+
 /*
  * pgsql_setup_attribute
+ *
+ * It returns false if the data type, or any of its sub-types, has no known
+ * binary format.
  */
-static void
-pgsql_setup_attribute(PGconn *conn,
+static bool
+pgsql_setup_attribute(SQLtable *root,
+					  PGconn *conn,
 					  SQLattribute *attr,
 					  const char *attname,
 					  Oid atttypid,
@@ -132,6 +333,10 @@ pgsql_setup_attribute(PGconn *conn,
 					  int *p_numFieldNodes,
 					  int *p_numBuffers)
 {
+	if (typtype == 'd')
+		return pgsql_setup_domain_attribute(root, conn, attr,
+											attname, atttypid, atttypmod,
+											p_numFieldNodes, p_numBuffers);
 	attr->attname   = pstrdup(attname);
 	attr->atttypid  = atttypid;
 	attr->atttypmod = atttypmod;
@@ -154,10 +359,16 @@ pgsql_setup_attribute(PGconn *conn,
 	attr->typtype = typtype;
 	if (typtype == 'b')
 	{
-		if (array_elemid != InvalidOid)
-			attr->element = pgsql_create_array_element(conn, array_elemid,
+		/* fixed-length types like name or point have typelem too */
+		if (array_elemid != InvalidOid && attlen == -1)
+		{
+			attr->element = pgsql_create_array_element(root, conn,
+													   array_elemid,
 													   p_numFieldNodes,
 													   p_numBuffers);
+			if (!attr->element)
+				return false;
+		}
 	}
 	else if (typtype == 'c')
 	{
@@ -165,7 +376,9 @@ pgsql_setup_attribute(PGconn *conn,
 		SQLtable   *subtypes;
 
 		assert(comp_typrelid != 0);
-		subtypes = pgsql_create_composite_type(conn, comp_typrelid);
+		subtypes = pgsql_create_composite_type(root, conn, comp_typrelid);
+		if (!subtypes)
+			return false;
 		*p_numFieldNodes += subtypes->numFieldNodes;
 		*p_numBuffers += subtypes->numBuffers;
 
@@ -173,10 +386,8 @@ pgsql_setup_attribute(PGconn *conn,
 	}
 	else if (typtype == 'e')
 	{
-		attr->enumdict = pgsql_create_dictionary(conn, atttypid);
+		attr->enumdict = pgsql_create_dictionary(root, conn, atttypid);
 	}
-	else
-		Elog("unknown state pf typtype: %c", typtype);
 
 	/* init statistics */
 	attr->min_isnull = true;
@@ -184,15 +395,82 @@ pgsql_setup_attribute(PGconn *conn,
 	attr->min_value  = 0UL;
 	attr->max_value  = 0UL;
 	/* assign properties of Apache Arrow Type */
-	assignArrowType(attr, p_numBuffers);
+	if (!assignArrowType(attr, &root->options, p_numBuffers))
+		return false;
 	*p_numFieldNodes += 1;
+	return true;
+}
+
+/*
+ * pgsql_setup_domain_attribute
+ *
+ * A domain is sent in the binary format of its base type, so the attribute
+ * is set up as the base type, with the typmod of the domain unless the
+ * column has its own. A domain over another domain is resolved in turn.
+ * The wire format of arrays and composite types still carries the OID of
+ * the domain, so it is kept in attr->domaintypid.
+ */
+static bool
+pgsql_setup_domain_attribute(SQLtable *root, PGconn *conn,
+							 SQLattribute *attr,
+							 const char *attname,
+							 Oid domain_typid,
+							 int atttypmod,
+							 int *p_numFieldNodes,
+							 int *p_numBuffers)
+{
+	PGresult   *res;
+	char		query[4096];
+	bool		retval;
+
+	snprintf(query, sizeof(query),
+			 "SELECT b.oid, d.typtypmod, b.typlen, b.typbyval, b.typalign,"
+			 "       b.typtype, b.typrelid, b.typelem, nspname, b.typname"
+			 "  FROM pg_catalog.pg_type d,"
+			 "       pg_catalog.pg_type b,"
+			 "       pg_catalog.pg_namespace n"
+			 " WHERE b.oid = d.typbasetype"
+			 "   AND b.typnamespace = n.oid"
+			 "   AND d.oid = %u", domain_typid);
+	res = PQexec(conn, query);
+	if (PQresultStatus(res) != PGRES_TUPLES_OK)
+		ElogResult(conn, res, "failed on pg_type system catalog query: %s",
+				   PQresultErrorMessage(res));
+	if (PQntuples(res) != 1)
+		Elog("unexpected number of result rows: %d", PQntuples(res));
+	if (atttypmod < 0)
+		atttypmod = atoi(PQgetvalue(res, 0, 1));
+	retval = pgsql_setup_attribute(root,
+								   conn,
+								   attr,
+								   attname,
+								   atooid(PQgetvalue(res, 0, 0)),
+								   atttypmod,
+								   atoi(PQgetvalue(res, 0, 2)),
+								   pg_strtobool(PQgetvalue(res, 0, 3)),
+								   pg_strtochar(PQgetvalue(res, 0, 4)),
+								   pg_strtochar(PQgetvalue(res, 0, 5)),
+								   atooid(PQgetvalue(res, 0, 6)),
+								   atooid(PQgetvalue(res, 0, 7)),
+								   PQgetvalue(res, 0, 8),
+								   PQgetvalue(res, 0, 9),
+								   p_numFieldNodes,
+								   p_numBuffers);
+	PQclear(res);
+	/* the outermost domain is the one on the wire */
+	attr->domaintypid = domain_typid;
+
+	return retval;
 }
 
 /*
  * pgsql_create_composite_type
+ *
+ * It returns NULL if any of the attributes are not supported.
  */
 static SQLtable *
-pgsql_create_composite_type(PGconn *conn, Oid comptype_relid)
+pgsql_create_composite_type(SQLtable *root, PGconn *conn,
+							Oid comptype_relid)
 {
 	PGresult   *res;
 	SQLtable   *table;
@@ -211,8 +489,8 @@ pgsql_create_composite_type(PGconn *conn, Oid comptype_relid)
 			 "   AND a.attrelid = %u", comptype_relid);
 	res = PQexec(conn, query);
 	if (PQresultStatus(res) != PGRES_TUPLES_OK)
-		Elog("failed on pg_type system catalog query: %s",
-			 PQresultErrorMessage(res));
+		ElogResult(conn, res, "failed on pg_type system catalog query: %s",
+				   PQresultErrorMessage(res));
 
 	nfields = PQntuples(res);
 	table = palloc0(offsetof(SQLtable, attrs[nfields]));
@@ -235,8 +513,9 @@ pgsql_create_composite_type(PGconn *conn, Oid comptype_relid)
 
 		if (index < 1 || index > nfields)
 			Elog("attribute number is out of range");
-		pgsql_setup_attribute(conn,
-							  &table->attrs[index-1],
+		if (!pgsql_setup_attribute(root,
+								   conn,
+								   &table->attrs[index-1],
 							  attname,
 							  atooid(atttypid),
 							  atoi(atttypmod),
@@ -246,15 +525,17 @@ pgsql_create_composite_type(PGconn *conn, Oid comptype_relid)
 							  pg_strtochar(typtype),
 							  atooid(typrelid),
 							  atooid(typelem),
-							  nspname, typname,
-							  &table->numFieldNodes,
-							  &table->numBuffers);
+								   nspname, typname,
+								   &table->numFieldNodes,
+								   &table->numBuffers))
+			return NULL;
 	}
 	return table;
 }
 
 static SQLattribute *
-pgsql_create_array_element(PGconn *conn, Oid array_elemid,
+pgsql_create_array_element(SQLtable *root, PGconn *conn,
+						   Oid array_elemid,
 						   int *p_numFieldNode,
 						   int *p_numBuffers)
 {
@@ -270,6 +551,32 @@ pgsql_create_array_element(PGconn *conn, Oid array_elemid,
 	const char	   *typrelid;
 	const char	   *typelem;
 
+	if (root->multi)
+	{
+		/* no catalog lookups while the statements are running */
+		const SQLbuiltinType *bt = pgsql_lookup_builtin_type(conn,
+															 array_elemid);
+
+		if (!bt || !pgsql_setup_attribute(root,
+										  conn,
+										  attr,
+										  bt->typname,
+										  array_elemid,
+										  -1,
+										  bt->typlen,
+										  bt->typbyval,
+										  bt->typalign,
+										  bt->typtype,
+										  InvalidOid,
+										  bt->typelem,
+										  "pg_catalog",
+										  bt->typname,
+										  p_numFieldNode,
+										  p_numBuffers))
+			return NULL;
+		attr->text_recv = bt->text_recv;
+		return attr;
+	}
 	snprintf(query, sizeof(query),
 			 "SELECT nspname, typname,"
 			 "       typlen, typbyval, typalign, typtype,"
@@ -280,8 +587,8 @@ pgsql_create_array_element(PGconn *conn, Oid array_elemid,
 			 "   AND t.oid = %u", array_elemid);
 	res = PQexec(conn, query);
 	if (PQresultStatus(res) != PGRES_TUPLES_OK)
-		Elog("failed on pg_type system catalog query: %s",
-			 PQresultErrorMessage(res));
+		ElogResult(conn, res, "failed on pg_type system catalog query: %s",
+				   PQresultErrorMessage(res));
 	if (PQntuples(res) != 1)
 		Elog("unexpected number of result rows: %d", PQntuples(res));
 	nspname  = PQgetvalue(res, 0, 0);
@@ -293,9 +600,10 @@ pgsql_create_array_element(PGconn *conn, Oid array_elemid,
 	typrelid = PQgetvalue(res, 0, 6);
 	typelem  = PQgetvalue(res, 0, 7);
 
-	pgsql_setup_attribute(conn,
-						  attr,
-						  typname,
+	if (!pgsql_setup_attribute(root,
+							   conn,
+							   attr,
+							   typname,
 						  array_elemid,
 						  -1,
 						  atoi(typlen),
@@ -304,26 +612,152 @@ pgsql_create_array_element(PGconn *conn, Oid array_elemid,
 						  pg_strtochar(typtype),
 						  atooid(typrelid),
 						  atooid(typelem),
-						  nspname,
-						  typname,
-						  p_numFieldNode,
-						  p_numBuffers);
+							   nspname,
+							   typname,
+							   p_numFieldNode,
+							   p_numBuffers))
+		return NULL;
 	return attr;
 }
 
+/*
+ * pgsql_setup_dictionary_columns
+ *
+ * It switches the text columns in options.dict_columns to dictionary-
+ * encoded. Unlike enum types, the dictionary is built from the values,
+ * then the new labels are written out as delta dictionary batches prior
+ * to the record batch which references them. Unless missing_ok, all the
+ * columns must be in the result.
+ */
+static void
+pgsql_setup_dictionary_columns(SQLtable *table, bool missing_ok)
+{
+	const SQLoptions *options = &table->options;
+	int			i, j;
+
+	for (i=0; i < options->num_dict_columns; i++)
+	{
+		const char *attname = options->dict_columns[i];
+		bool		found = false;
+
+		for (j=0; j < table->nfields; j++)
+		{
+			SQLattribute *attr = &table->attrs[j];
+
+			if (strcmp(attr->attname, attname) != 0)
+				continue;
+			/* enum types are already dictionary-encoded */
+			if (!attr->enumdict)
+			{
+				assignArrowTypeTextDictionary(attr, &table->numBuffers);
+				attr->enumdict = pgsql_alloc_dictionary(table, InvalidOid,
+														1<<10);
+			}
+			found = true;
+		}
+		if (!found && !missing_ok)
+			Elog("dictionary column \"%s\" is not in the result", attname);
+	}
+}
+
+/*
+ * pgsql_setup_column_names
+ *
+ * It makes the column names unique and non-empty, because the readers of
+ * Arrow look up the fields by name. The columns keep the order of the
+ * result; a name which appears earlier, or an anonymous one like the
+ * "?column?" of an expression, is renamed on options.column_names. The
+ * anonymous ones are named "column" at first.
+ *
+ * PG2ARROW_NAMES_SUFFIX suffixes the duplicates by the count, like "id",
+ * "id_1" and "id_2"; so "SELECT 1, 2" has "column" and "column_1".
+ * PG2ARROW_NAMES_POSITION suffixes them by the 1-based position in the
+ * result, like "id" and "id_3"; the anonymous ones always are, like
+ * "column_1" and "column_2".
+ *
+ * If the new name is taken by any other column, it is suffixed by the
+ * count again, until unique.
+ */
+static bool
+__column_name_taken(SQLtable *table, int index, const char *name)
+{
+	int			j;
+
+	for (j=0; j < table->nfields; j++)
+	{
+		if (j != index && strcmp(table->attrs[j].attname, name) == 0)
+			return true;
+	}
+	return false;
+}
+
+static void
+pgsql_setup_column_names(SQLtable *table)
+{
+	bool		by_position = (table->options.column_names ==
+							   PG2ARROW_NAMES_POSITION);
+	int			i, j, k;
+
+	if (table->options.column_names != PG2ARROW_NAMES_SUFFIX &&
+		table->options.column_names != PG2ARROW_NAMES_POSITION)
+		Elog("unknown column naming: %d", table->options.column_names);
+
+	for (j=0; j < table->nfields; j++)
+	{
+		SQLattribute *attr = &table->attrs[j];
+		bool		anonymous;
+		bool		duplicate = false;
+		char	   *stem;
+		char	   *name;
+
+		anonymous = (*attr->attname == '\0' ||
+					 strcmp(attr->attname, "?column?") == 0);
+		for (i=0; !anonymous && !duplicate && i < j; i++)
+			duplicate = (strcmp(table->attrs[i].attname, attr->attname) == 0);
+		if (!anonymous && !duplicate)
+			continue;
+
+		if (by_position)
+			stem = psprintf("%s_%d", anonymous ? "column" : attr->attname, j+1);
+		else
+			stem = pstrdup(anonymous ? "column" : attr->attname);
+		name = pstrdup(stem);
+		for (k=1; __column_name_taken(table, j, name); k++)
+		{
+			pfree(name);
+			name = psprintf("%s_%d", stem, k);
+		}
+		pfree(stem);
+		pfree(attr->attname);
+		attr->attname = name;
+	}
+}
+
 /*
  * pgsql_create_buffer
+ *
+ * If any of the columns have no known binary format, it sets astext[] of
+ * the columns, then returns NULL; the caller shall fetch them in text.
  */
 SQLtable *
-pgsql_create_buffer(PGconn *conn, PGresult *res, size_t segment_sz)
+pgsql_create_buffer(PGconn *conn, PGresult *res,
+					const SQLoptions *options, size_t segment_sz,
+					bool *astext)
 {
 	int			j, nfields = PQnfields(res);
 	SQLtable   *table;
+	bool		supported = true;
 
 	table = palloc0(offsetof(SQLtable, attrs[nfields]));
+	table->options = *options;
 	table->segment_sz = segment_sz;
 	table->nitems = 0;
+	table->cmd_ntuples = -1;
 	table->nfields = nfields;
+	/* without the cache of the connection, they are resolved every time */
+	if (!table->options.postgis_types)
+		table->options.postgis_types = &table->postgis_local;
+	pgsql_resolve_postgis_types(conn, table->options.postgis_types);
 	for (j=0; j < nfields; j++)
 	{
 		const char *attname = PQfname(res, j);
@@ -349,8 +783,8 @@ pgsql_create_buffer(PGconn *conn, PGresult *res, size_t segment_sz)
 				 "   AND t.oid = %u", atttypid);
 		__res = PQexec(conn, query);
 		if (PQresultStatus(__res) != PGRES_TUPLES_OK)
-			Elog("failed on pg_type system catalog query: %s",
-				 PQresultErrorMessage(res));
+			ElogResult(conn, __res, "failed on pg_type system catalog query: %s",
+					   PQresultErrorMessage(__res));
 		if (PQntuples(__res) != 1)
 			Elog("unexpected number of result rows: %d", PQntuples(__res));
 		typlen   = PQgetvalue(__res, 0, 0);
@@ -361,25 +795,147 @@ pgsql_create_buffer(PGconn *conn, PGresult *res, size_t segment_sz)
 		typelem  = PQgetvalue(__res, 0, 5);
 		nspname  = PQgetvalue(__res, 0, 6);
 		typname  = PQgetvalue(__res, 0, 7);
-		pgsql_setup_attribute(conn,
-							  &table->attrs[j],
-                              attname,
-							  atttypid,
-							  atttypmod,
-							  atoi(typlen),
-							  *typbyval,
-							  *typalign,
-							  *typtype,
-							  atoi(typrelid),
-							  atoi(typelem),
-							  nspname, typname,
-							  &table->numFieldNodes,
-							  &table->numBuffers);
+		astext[j] = !pgsql_setup_attribute(table,
+										   conn,
+										   &table->attrs[j],
+										   attname,
+										   atttypid,
+										   atttypmod,
+										   atoi(typlen),
+										   *typbyval,
+										   *typalign,
+										   *typtype,
+										   atoi(typrelid),
+										   atoi(typelem),
+										   nspname, typname,
+										   &table->numFieldNodes,
+										   &table->numBuffers);
+		if (astext[j])
+			supported = false;
 		PQclear(__res);
 	}
+	if (!supported)
+		return NULL;
+	pgsql_setup_column_names(table);
+	pgsql_setup_dictionary_columns(table, false);
+
+	return table;
+}
+
+/*
+ * pgsql_create_text_buffer
+ *
+ * Like pgsql_create_buffer, but for the result of the multiple statements,
+ * which comes in text by the simple query protocol. The connection is busy
+ * until all the statements end, so no catalog lookups are possible. The
+ * built-in types are set up by their fixed catalog entries, then their
+ * values are converted to the binary formats by text_recv. Any other types,
+ * like enum, domain, composite or those of extensions, and the date and
+ * time types of a DateStyle other than ISO, are written as Utf8 of their
+ * text forms, whose pg_typname is unknown. The dictionary columns missing
+ * in the result are ignored, because they may be of another statement.
+ */
+SQLtable *
+pgsql_create_text_buffer(SQLmulti *multi, PGresult *res,
+						 const SQLoptions *options, size_t segment_sz)
+{
+	PGconn	   *conn = multi->conn;
+	int			j, nfields = PQnfields(res);
+	SQLtable   *table;
+
+	table = palloc0(offsetof(SQLtable, attrs[nfields]));
+	table->conn = conn;
+	table->multi = multi;
+	table->options = *options;
+	/* PostGIS types are never built in */
+	table->options.postgis_types = NULL;
+	table->segment_sz = segment_sz;
+	table->nitems = 0;
+	table->cmd_ntuples = -1;
+	table->nfields = nfields;
+	for (j=0; j < nfields; j++)
+	{
+		SQLattribute *attr = &table->attrs[j];
+		const SQLbuiltinType *bt = pgsql_lookup_builtin_type(conn,
+															 PQftype(res, j));
+
+		if (bt)
+		{
+			if (!pgsql_setup_attribute(table,
+									   conn,
+									   attr,
+									   PQfname(res, j),
+									   bt->typid,
+									   PQfmod(res, j),
+									   bt->typlen,
+									   bt->typbyval,
+									   bt->typalign,
+									   bt->typtype,
+									   InvalidOid,
+									   bt->typelem,
+									   "pg_catalog",
+									   bt->typname,
+									   &table->numFieldNodes,
+									   &table->numBuffers))
+				Elog("unable to set up the built-in type %s", bt->typname);
+			attr->text_recv = bt->text_recv;
+			continue;
+		}
+		attr->attname = pstrdup(PQfname(res, j));
+		attr->atttypid = PQftype(res, j);
+		attr->atttypmod = PQfmod(res, j);
+		attr->attlen = -1;
+		attr->attalign = sizeof(int);
+		attr->typnamespace = pstrdup("");
+		attr->typname = pstrdup("");
+		attr->typtype = 'b';
+		attr->min_isnull = true;
+		attr->max_isnull = true;
+		assignArrowTypeTextForm(attr, &table->numBuffers);
+		table->numFieldNodes++;
+	}
+	pgsql_setup_column_names(table);
+	pgsql_setup_dictionary_columns(table, true);
+
 	return table;
 }
 
+/*
+ * pgsql_setup_attnotnull
+ *
+ * It picks up the NOT NULL constraint of the result columns which simply
+ * reference a table column. Note that it is just a hint, because outer
+ * joins and aggregates may produce NULLs on such columns.
+ */
+void
+pgsql_setup_attnotnull(PGconn *conn, PGresult *res, SQLtable *table)
+{
+	int			j;
+
+	for (j=0; j < table->nfields; j++)
+	{
+		Oid			relid = PQftable(res, j);
+		int			attnum = PQftablecol(res, j);
+		PGresult   *__res;
+		char		query[4096];
+
+		if (relid == InvalidOid || attnum <= 0)
+			continue;
+		snprintf(query, sizeof(query),
+				 "SELECT attnotnull"
+				 "  FROM pg_catalog.pg_attribute"
+				 " WHERE attrelid = %u"
+				 "   AND attnum = %d", relid, attnum);
+		__res = PQexec(conn, query);
+		if (PQresultStatus(__res) != PGRES_TUPLES_OK)
+			ElogResult(conn, __res, "failed on pg_attribute system catalog query: %s",
+					   PQresultErrorMessage(__res));
+		if (PQntuples(__res) == 1)
+			table->attrs[j].attnotnull = (*PQgetvalue(__res, 0, 0) == 't');
+		PQclear(__res);
+	}
+}
+
 /*
  * pgsql_clear_attribute
  */
@@ -409,6 +965,78 @@ pgsql_clear_attribute(SQLattribute *attr)
 	attr->max_value  = 0UL;
 }
 
+/*
+ * pgsql_free_attribute
+ */
+static void
+pgsql_free_attribute(SQLattribute *attr)
+{
+	sql_buffer_free(&attr->nullmap);
+	sql_buffer_free(&attr->values);
+	sql_buffer_free(&attr->extra);
+	if (attr->subtypes)
+		pgsql_free_buffer(attr->subtypes);
+	if (attr->element)
+	{
+		pgsql_free_attribute(attr->element);
+		pfree(attr->element);
+	}
+	/* enumdict is owned by the root table */
+	if (attr->attname)
+		pfree(attr->attname);
+	if (attr->typnamespace)
+		pfree((char *)attr->typnamespace);
+	if (attr->typname)
+		pfree((char *)attr->typname);
+}
+
+/*
+ * pgsql_free_buffer
+ *
+ * It releases the table, and all the memory it owns: the buffers of the
+ * attributes, the dictionaries and the output buffer.
+ */
+void
+pgsql_free_buffer(SQLtable *table)
+{
+	SQLdictionary *dict;
+	int			i, j;
+
+	for (j=0; j < table->nfields; j++)
+		pgsql_free_attribute(&table->attrs[j]);
+	while ((dict = table->dictionary_list) != NULL)
+	{
+		table->dictionary_list = dict->next;
+		for (i=0; i < dict->nslots; i++)
+		{
+			hashItem   *hitem;
+
+			while ((hitem = dict->hslots[i]) != NULL)
+			{
+				dict->hslots[i] = hitem->next;
+				pfree(hitem);
+			}
+		}
+		sql_buffer_free(&dict->values);
+		sql_buffer_free(&dict->extra);
+		pfree(dict);
+	}
+	sql_buffer_free(&table->output);
+	sql_buffer_free(&table->compressed);
+	if (table->query)
+		pfree(table->query);
+	if (table->stmt_name)
+		pfree(table->stmt_name);
+	if (table->recordBatches)
+		pfree(table->recordBatches);
+	if (table->dictionaries)
+		pfree(table->dictionaries);
+	sql_buffer_free(&table->recv_buf);
+	if (table->pending)
+		PQclear(table->pending);
+	pfree(table);
+}
+
 /*
  * pgsql_writeout_buffer
  */
@@ -421,10 +1049,9 @@ pgsql_writeout_buffer(SQLtable *table)
 	int			j, index;
 	ArrowBlock *b;
 
-	/* write a new record batch */
-	currPos = lseek(table->fdesc, 0, SEEK_CUR);
-	if (currPos < 0)
-		Elog("unable to get current position of the file");
+	/* write the new dictionary items, then a new record batch */
+	writeArrowDictionaryDeltas(table);
+	currPos = table->f_pos + table->output.usage;
 	writeArrowRecordBatch(table, &metaSize, &bodySize);
 
 	index = table->numRecordBatches++;
@@ -447,42 +1074,179 @@ pgsql_writeout_buffer(SQLtable *table)
 	}
 
 	/* makes table/attributes empty again */
+	table->nrows += table->nitems;
 	table->nitems = 0;
 	for (j=0; j < table->nfields; j++)
 		pgsql_clear_attribute(&table->attrs[j]);
 }
 
+/*
+ * pgsql_row_limit_reached
+ *
+ * It tells whether the result already has options.max_rows rows, prior to
+ * append the next one. Then the row is dropped, and the fetch stops by
+ * table->row_limit_exceeded.
+ */
+static bool
+pgsql_row_limit_reached(SQLtable *table)
+{
+	int64		max_rows = table->options.max_rows;
+
+	if (max_rows > 0 && table->nrows + (int64) table->nitems >= max_rows)
+	{
+		table->row_limit_exceeded = true;
+		return true;
+	}
+	return false;
+}
+
+/*
+ * pgsql_append_row
+ *
+ * It appends the row of the PGresult to the buffer, then returns the
+ * buffer usage.
+ */
+static size_t
+pgsql_append_row(SQLtable *table, PGresult *res, int row)
+{
+	int		j, nfields = PQnfields(res);
+	size_t	usage = 0;
+
+	assert(nfields == table->nfields);
+	for (j=0; j < nfields; j++)
+	{
+		SQLattribute   *attr = &table->attrs[j];
+		const char	   *addr;
+		size_t			sz;
+		/* data must be binary format, unless of the simple query protocol */
+		assert(PQfformat(res, j) == (table->multi ? 0 : 1));
+		if (PQgetisnull(res, row, j))
+		{
+			addr = NULL;
+			sz = 0;
+		}
+		else if (attr->text_recv)
+		{
+			SQLbuffer  *buf = &table->recv_buf;
+
+			sql_buffer_clear(buf);
+			sql_buffer_expand(buf, 1);	/* addr must not be NULL */
+			attr->text_recv(attr, PQgetvalue(res, row, j), buf);
+			addr = buf->ptr;
+			sz = buf->usage;
+		}
+		else
+		{
+			addr = PQgetvalue(res, row, j);
+			sz = PQgetlength(res, row, j);
+		}
+		assert(attr->nitems == table->nitems);
+		attr->put_value(attr, addr, sz);
+		if (attr->stat_update)
+			attr->stat_update(attr, addr, sz);
+		usage += attr->buffer_usage(attr);
+	}
+	table->nitems++;
+	return usage;
+}
+
 /*
  * pgsql_append_results
+ *
+ * It appends the rows in the PGresult to the buffer, then returns the
+ * buffer usage by the last row. Caller has to write out the buffer
+ * when it exceeds the threshold.
  */
-void
+size_t
 pgsql_append_results(SQLtable *table, PGresult *res)
 {
 	int		i, ntuples = PQntuples(res);
-	int		j, nfields = PQnfields(res);
-	size_t	usage;
+	size_t	usage = 0;
 
-	assert(nfields == table->nfields);
 	for (i=0; i < ntuples; i++)
 	{
-		usage = 0;
+		if (pgsql_row_limit_reached(table))
+			break;
+		usage = pgsql_append_row(table, res, i);
+	}
+	return usage;
+}
 
+/*
+ * pgsql_append_copy_data
+ *
+ * It appends the rows in the chunk of binary COPY data to the buffer, then
+ * returns the buffer usage by the last row. The chunk returned by
+ * PQgetCopyData() never splits a row, and the first one also carries the
+ * header of the binary COPY format.
+ */
+#define COPY_BINARY_SIGNATURE	"PGCOPY\n\377\r\n\0"
+#define COPY_BINARY_SIGLEN		11
+
+size_t
+pgsql_append_copy_data(SQLtable *table, const char *buf, size_t nbytes)
+{
+	const char *pos = buf;
+	const char *end = buf + nbytes;
+	size_t		usage = 0;
+	int			j;
+
+#define COPY_DATA_REQUIRED(len)											\
+	do {																\
+		if (pos + (len) > end)											\
+			Elog("binary COPY data is truncated at offset %zu",		\
+				 (size_t)(pos - buf));									\
+	} while(0)
+
+	if (!table->copy_header)
+	{
+		uint32		extlen;
+
+		COPY_DATA_REQUIRED(COPY_BINARY_SIGLEN + 2 * sizeof(uint32));
+		if (memcmp(pos, COPY_BINARY_SIGNATURE, COPY_BINARY_SIGLEN) != 0)
+			Elog("invalid signature of binary COPY data");
+		pos += COPY_BINARY_SIGLEN;
+		pos += sizeof(uint32);		/* flags; nothing to do */
+		extlen = ntohl(*((const uint32 *)pos));
+		pos += sizeof(uint32);
+		COPY_DATA_REQUIRED(extlen);
+		pos += extlen;				/* header extension; skipped */
+		table->copy_header = true;
+	}
+
+	while (pos < end)
+	{
+		int16		nfields;
+
+		COPY_DATA_REQUIRED(sizeof(int16));
+		nfields = (int16)ntohs(*((const uint16 *)pos));
+		pos += sizeof(int16);
+		/* trailer of the binary COPY data */
+		if (nfields == -1)
+			continue;
+		if (nfields != table->nfields)
+			Elog("unexpected number of fields in binary COPY data: %d, but %d expected",
+				 nfields, table->nfields);
+		if (pgsql_row_limit_reached(table))
+			break;
+
+		usage = 0;
 		for (j=0; j < nfields; j++)
 		{
 			SQLattribute   *attr = &table->attrs[j];
-			const char	   *addr;
-			size_t			sz;
-			/* data must be binary format */
-			assert(PQfformat(res, j) == 1);
-			if (PQgetisnull(res, i, j))
-			{
-				addr = NULL;
-				sz = 0;
-			}
+			const char	   *addr = NULL;
+			int32			sz;
+
+			COPY_DATA_REQUIRED(sizeof(int32));
+			sz = (int32)ntohl(*((const uint32 *)pos));
+			pos += sizeof(int32);
+			if (sz < 0)
+				sz = 0;		/* NULL */
 			else
 			{
-				addr = PQgetvalue(res, i, j);
-				sz = PQgetlength(res, i, j);
+				COPY_DATA_REQUIRED(sz);
+				addr = pos;
+				pos += sz;
 			}
 			assert(attr->nitems == table->nitems);
 			attr->put_value(attr, addr, sz);
@@ -491,14 +1255,9 @@ pgsql_append_results(SQLtable *table, PGresult *res)
 			usage += attr->buffer_usage(attr);
 		}
 		table->nitems++;
-		/* exceeds the threshold to write? */
-		if (usage > table->segment_sz)
-		{
-			if (table->nitems == 0)
-				Elog("A result row is larger than size of record batch!!");
-			pgsql_writeout_buffer(table);
-		}
 	}
+#undef COPY_DATA_REQUIRED
+	return usage;
 }
 
 /*
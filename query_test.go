@@ -0,0 +1,78 @@
+package pg2arrow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+)
+
+func TestColumnNames(t *testing.T) {
+	tests := []struct {
+		sql              string
+		suffix, position []string
+	}{
+		{
+			"SELECT a.id, b.id FROM ta a JOIN tb b ON a.id = b.id",
+			[]string{"id", "id_1"},
+			[]string{"id", "id_2"},
+		},
+		{
+			"SELECT 1, 2, 3",
+			[]string{"column", "column_1", "column_2"},
+			[]string{"column_1", "column_2", "column_3"},
+		},
+		{
+			`SELECT 1, 2 AS id, 3 AS id, 4 AS "?column?", 5 AS id`,
+			[]string{"column", "id", "id_1", "column_1", "id_2"},
+			[]string{"column_1", "id", "id_3", "column_4", "id_5"},
+		},
+		{
+			// the new name taken by the column later
+			"SELECT 1 AS a, 2 AS a, 3 AS a_1",
+			[]string{"a", "a_2", "a_1"},
+			[]string{"a", "a_2", "a_1"},
+		},
+		{
+			"SELECT 1 AS column_2, 2, 3",
+			[]string{"column_2", "column", "column_1"},
+			[]string{"column_2", "column_2_1", "column_3"},
+		},
+	}
+	for _, naming := range []ColumnNaming{ColumnNamesSuffix, ColumnNamesPosition} {
+		c := testConn(t, WithColumnNaming(naming))
+		testExec(t, c, "CREATE TEMP TABLE ta (id int)", "CREATE TEMP TABLE tb (id int)")
+		for _, tt := range tests {
+			want := tt.suffix
+			if naming == ColumnNamesPosition {
+				want = tt.position
+			}
+			schema, _ := testQuery(t, c, tt.sql)
+			described, err := c.DescribeQuery(tt.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []*arrow.Schema{schema, described} {
+				var got []string
+				for _, f := range s.Fields() {
+					got = append(got, f.Name)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("naming %d: %s: got %v, want %v", naming, tt.sql, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestColumnNamesDictionary(t *testing.T) {
+	// WithDictionaryColumns refers to the new names
+	c := testConn(t, WithColumnNaming(ColumnNamesPosition), WithDictionaryColumns("s_2"))
+	schema, _ := testQuery(t, c, "SELECT 'x' AS s, 'y' AS s")
+	if got := schema.Field(0).Type.ID(); got != arrow.STRING {
+		t.Errorf("s: got %s, want Utf8", schema.Field(0).Type)
+	}
+	if got := schema.Field(1).Type.ID(); got != arrow.DICTIONARY {
+		t.Errorf("s_2: got %s, want Dictionary", schema.Field(1).Type)
+	}
+}
@@ -0,0 +1,56 @@
+package pg2arrow
+
+import (
+	"io"
+	"sync"
+)
+
+// queryReader is the io.ReadCloser of QueryReader. Close may be called
+// while Read is in progress; the query is canceled first, so Read returns
+// shortly, then the stream is closed under the lock.
+type queryReader struct {
+	mu sync.Mutex
+	q  *canceler
+	s  *stream
+	r  *ipcReader
+}
+
+// QueryReader runs the SQL command, then returns its result as the bytes
+// of an Arrow IPC stream: the schema message, the dictionary and record
+// batches, then the end-of-stream marker. The batches are fetched as the
+// bytes are read, so the result can be piped to a file or a socket by
+// io.Copy without staying in memory. The caller must Close the reader,
+// which stops the query if it is still running, then releases the Conn.
+// After Close, Read returns ErrReaderClosed.
+func (c *Conn) QueryReader(sql string) (io.ReadCloser, error) {
+	q := new(canceler)
+	s, err := c.openStream(sql, nil, q)
+	if err != nil {
+		return nil, err
+	}
+	return &queryReader{q: q, s: s, r: newIPCReader(s)}, nil
+}
+
+func (r *queryReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.s == nil {
+		return 0, ErrReaderClosed
+	}
+	return r.r.Read(p)
+}
+
+// Close is safe to call more than once.
+func (r *queryReader) Close() error {
+	r.q.Cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.s != nil {
+		r.s.close()
+		r.s = nil
+	}
+	return nil
+}
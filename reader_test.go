@@ -0,0 +1,108 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+func TestQueryReader(t *testing.T) {
+	c := testConn(t, WithBatchSize(4))
+	_, want := testStream(t, c, nullsQuery)
+
+	// the bytes are an Arrow IPC stream, however small the reads are
+	r, err := c.QueryReader(nullsQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(iotest.OneByteReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(buf, []byte(ipcEOS)) {
+		t.Errorf("got no end-of-stream marker at the end")
+	}
+	rdr, err := ipc.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("invalid Arrow stream: %v", err)
+	}
+	defer rdr.Release()
+	k := 0
+	for ; rdr.Next(); k++ {
+		if k >= len(want) || !array.RecordEqual(rdr.Record(), want[k]) {
+			t.Errorf("batch %d differs from QueryStream", k)
+		}
+	}
+	if err := rdr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if k != len(want) {
+		t.Errorf("got %d record batches, want %d", k, len(want))
+	}
+
+	// closed more than once, then the Conn is released
+	if err := r.Close(); err != nil {
+		t.Errorf("got %v of the second Close", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != ErrReaderClosed {
+		t.Errorf("got %v, want ErrReaderClosed", err)
+	}
+	testExec(t, c, "SELECT 1")
+}
+
+func TestQueryReaderError(t *testing.T) {
+	c := testConn(t, WithBatchSize(2))
+
+	if _, err := c.QueryReader("SELECT * FROM pg2arrow_test_none"); err == nil {
+		t.Errorf("got no error of the table not existing")
+	}
+
+	// the error of the query stops the reads
+	r, err := c.QueryReader("SELECT 1 / (i - 7) AS r FROM generate_series(1, 10) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var qe *QueryError
+	if _, err := io.ReadAll(r); !errors.As(err, &qe) || qe.SQLState != "22012" {
+		t.Errorf("got %v, want the division by zero", err)
+	}
+}
+
+func TestQueryReaderClose(t *testing.T) {
+	c := testConn(t, WithBatchSize(2))
+
+	// the read waits for the rows after the sleep, then Close cancels it
+	r, err := c.QueryReader("SELECT i FROM generate_series(1, 10) i " +
+		"WHERE i < 5 OR (SELECT true FROM pg_sleep(30))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, r)
+		done <- err
+	}()
+	testSleeping(t, testConn(t), 1)
+	start := time.Now()
+	r.Close()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Close took %v, want the query canceled", d)
+	}
+	// Read in progress returns the cancel, or ErrReaderClosed if it came
+	// after Close
+	var qe *QueryError
+	if err := <-done; err != ErrReaderClosed && !(errors.As(err, &qe) && qe.SQLState == sqlStateQueryCanceled) {
+		t.Errorf("got %v of the read, want the query canceled", err)
+	}
+	testExec(t, c, "SELECT 1")
+}
@@ -0,0 +1,74 @@
+package pg2arrow
+
+import (
+	"io"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// RecordIterator iterates the result of QueryRecords as arrow.Record. The
+// rows are fetched as the iteration goes, and the Conn stays busy until
+// Close.
+type RecordIterator struct {
+	s   *stream
+	r   *ipcReader
+	rdr *ipc.Reader
+}
+
+// QueryRecords runs the SQL command, then returns an iterator over its
+// result as arrow.Record, so callers get typed columns without parsing
+// the Arrow IPC messages by themselves. The buffers of the records are
+// allocated by the allocator given by WithAllocator. The caller must
+// Close the iterator.
+func (c *Conn) QueryRecords(sql string) (*RecordIterator, error) {
+	s, err := c.openStream(sql, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.newRecordIterator(s)
+}
+
+func (c *Conn) newRecordIterator(s *stream) (*RecordIterator, error) {
+	r := newIPCReader(s)
+	rdr, err := ipc.NewReader(r, ipc.WithAllocator(c.cfg.allocator))
+	if err != nil {
+		s.close()
+		return nil, r.wrapErr(err)
+	}
+	return &RecordIterator{s: s, r: r, rdr: rdr}, nil
+}
+
+// Schema returns the schema of the result.
+func (it *RecordIterator) Schema() *arrow.Schema {
+	return it.rdr.Schema()
+}
+
+// Next returns the next record, or io.EOF if no more records. The caller
+// owns the record, and must Release it.
+func (it *RecordIterator) Next() (arrow.Record, error) {
+	if it.s == nil {
+		return nil, ErrReaderClosed
+	}
+	if !it.rdr.Next() {
+		if err := it.rdr.Err(); err != nil && err != io.EOF {
+			return nil, it.r.wrapErr(err)
+		}
+		return nil, io.EOF
+	}
+	rec := it.rdr.Record()
+	rec.Retain()
+	return rec, nil
+}
+
+// Close stops the query if it is still running, then releases the Conn.
+// The records returned by Next remain valid. It is safe to call Close
+// more than once.
+func (it *RecordIterator) Close() error {
+	if it.s != nil {
+		it.rdr.Release()
+		it.s.close()
+		it.s = nil
+	}
+	return nil
+}
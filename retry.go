@@ -0,0 +1,122 @@
+package pg2arrow
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy configures the retries of transient connection failures,
+// like a connection dropped by a pooler during failover. The delay before
+// the n-th retry is BaseDelay * Factor^(n-1), spread randomly by Jitter.
+// SQL errors reported by the server are never retried.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first one; 1 means no retry
+	BaseDelay   time.Duration // delay before the first retry
+	Factor      float64       // growth of the delay per retry; 1 means constant
+	Jitter      float64       // random spread of the delay, from 0 to 1; 0.2 means ±20%
+}
+
+// WithRetryPolicy sets the retry policy. It is applied to Connect, and to
+// QueryRetry which reconnects and reruns the query; other queries are run
+// once, because they may not be idempotent. By default, nothing is
+// retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(cfg *config) error {
+		switch {
+		case p.MaxAttempts < 1:
+			return fmt.Errorf("pg2arrow: retry attempts must be positive, got %d", p.MaxAttempts)
+		case p.BaseDelay < 0:
+			return fmt.Errorf("pg2arrow: retry delay must not be negative, got %v", p.BaseDelay)
+		case p.Factor < 1:
+			return fmt.Errorf("pg2arrow: retry backoff factor must be 1 or more, got %v", p.Factor)
+		case p.Jitter < 0 || p.Jitter > 1:
+			return fmt.Errorf("pg2arrow: retry jitter must be from 0 to 1, got %v", p.Jitter)
+		}
+		cfg.retry = p
+		return nil
+	}
+}
+
+// delay returns the delay before the n-th retry, from 1.
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(p.Factor, float64(n-1))
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// do runs fn until it succeeds, fails with a non-transient error, or the
+// attempts are exhausted. If fn is attempted more than once and never
+// succeeds, it returns a RetryError of all the attempts.
+func (p *RetryPolicy) do(fn func() error) error {
+	var errs []error
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+		if !isTransient(err) || n >= p.MaxAttempts {
+			break
+		}
+		time.Sleep(p.delay(n))
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return &RetryError{Errors: errs}
+}
+
+// RetryError is returned when all the attempts failed. errors.As and
+// errors.Is inspect the errors of all the attempts, in order.
+type RetryError struct {
+	Errors []error // the error of each attempt
+}
+
+func (e *RetryError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("pg2arrow: %d attempts failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *RetryError) Unwrap() []error {
+	return e.Errors
+}
+
+// isTransient reports whether the error is a connection-level failure,
+// which may go away by reconnecting.
+func isTransient(err error) bool {
+	return errors.Is(err, ErrConnectionLost)
+}
+
+// QueryRetry is like QueryParams, but retries the query by the policy of
+// WithRetryPolicy, if it fails with a connection-level error; the broken
+// connection is replaced by a new one. Use it for idempotent queries only,
+// like SELECT, because the server may have run the query once already.
+func (c *Conn) QueryRetry(sql string, args ...interface{}) ([]byte, error) {
+	var buf []byte
+	first := true
+	err := c.cfg.retry.do(func() error {
+		if !first {
+			if err := c.reconnect(); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		var err error
+		buf, err = c.query(sql, args, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
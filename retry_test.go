@@ -0,0 +1,109 @@
+package pg2arrow
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	lost := &QueryError{Code: CodeConnection, Message: "lost"}
+	syntax := &QueryError{Code: CodeQuery, SQLState: "42601", Message: "syntax error"}
+	p := RetryPolicy{MaxAttempts: 3, Factor: 1}
+
+	// the connection-level failures are retried up to the attempts
+	n := 0
+	err := p.do(func() error { n++; return lost })
+	var re *RetryError
+	if !errors.As(err, &re) || len(re.Errors) != 3 || n != 3 {
+		t.Errorf("got %v by %d attempts, want RetryError of 3", err, n)
+	}
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("got %v, want ErrConnectionLost of the attempts", err)
+	}
+
+	// but not the others, which are returned as is
+	n = 0
+	if err := p.do(func() error { n++; return syntax }); err != syntax || n != 1 {
+		t.Errorf("got %v by %d attempts, want the error of the first one", err, n)
+	}
+	n = 0
+	if err := p.do(func() error {
+		if n++; n < 2 {
+			return lost
+		}
+		return nil
+	}); err != nil || n != 2 {
+		t.Errorf("got %v by %d attempts, want the success of the second one", err, n)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, Factor: 2}
+	for n, want := range []time.Duration{100, 200, 400, 800} {
+		if got := p.delay(n + 1); got != want*time.Millisecond {
+			t.Errorf("delay(%d) = %v, want %v", n+1, got, want*time.Millisecond)
+		}
+	}
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := p.delay(2); got < 160*time.Millisecond || got > 240*time.Millisecond {
+			t.Fatalf("delay(2) = %v, want 200ms ±20%%", got)
+		}
+	}
+
+	for _, bad := range []RetryPolicy{
+		{MaxAttempts: 0, Factor: 1},
+		{MaxAttempts: 1, BaseDelay: -1, Factor: 1},
+		{MaxAttempts: 1, Factor: 0.5},
+		{MaxAttempts: 1, Factor: 1, Jitter: 1.5},
+	} {
+		if _, err := newConfig([]Option{WithRetryPolicy(bad)}); err == nil {
+			t.Errorf("%+v: got no error", bad)
+		}
+	}
+}
+
+func TestQueryRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, Factor: 2}
+	c := testConn(t, WithRetryPolicy(policy))
+	pid := func() int32 {
+		return testColumn(t, c, "SELECT pg_backend_pid()").(*array.Int32).Value(0)
+	}
+	kill := func(pid int32) {
+		testExec(t, testConn(t), "SELECT pg_terminate_backend("+strconv.Itoa(int(pid))+", 1000)")
+	}
+
+	// the connection lost is replaced, then the query is run again
+	old := pid()
+	kill(old)
+	buf, err := c.QueryRetry("SELECT pg_backend_pid()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, recs := testFile(t, "QueryRetry", buf)
+	if got := recs[0].Column(0).(*array.Int32).Value(0); got == old {
+		t.Errorf("got the backend lost, want a new one")
+	}
+
+	// but not a SQL error, nor by Query
+	if _, err := c.QueryRetry("SELEC 1"); err == nil || errors.As(err, new(*RetryError)) {
+		t.Errorf("got %v, want the syntax error once", err)
+	}
+	kill(pid())
+	if _, err := c.Query("SELECT 1"); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("got %v, want ErrConnectionLost of Query", err)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	dsn := withParams(t, testDSN(t), "port=1 connect_timeout=1")
+	_, err := Connect(dsn, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Factor: 1}))
+	var re *RetryError
+	if !errors.As(err, &re) || len(re.Errors) != 3 {
+		t.Errorf("got %v, want RetryError of 3 attempts", err)
+	}
+}
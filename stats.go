@@ -0,0 +1,147 @@
+package pg2arrow
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats is the counters and timings of a query.
+type Stats struct {
+	Rows    int64 // rows fetched
+	Bytes   int64 // bytes of the Arrow messages built, including the schema
+	Batches int   // record batches built
+
+	// CommandRows is the number of rows reported by the command tag of the
+	// server, like "SELECT 100", to assert Rows is complete. It is -1 until
+	// the query completes, or if the command reports no number of rows.
+	CommandRows int64
+
+	// FetchTime is the time from sending the query until the last row was
+	// fetched. It includes the transfer of the rows and the build of the
+	// batches, as libpq tells nothing about the execution on the server.
+	FetchTime time.Duration
+	// Elapsed is the wall-clock time from sending the query until it was
+	// closed, or until now if still running.
+	Elapsed time.Duration
+}
+
+// BatchStats is the counters and timing of a record batch.
+type BatchStats struct {
+	Rows  int64 // rows in the batch
+	Bytes int   // bytes of the record batch message, and the delta
+	// dictionary batches preceding it, if any
+
+	// FetchTime is the time to fetch the rows of the batch and build it.
+	FetchTime time.Duration
+}
+
+// WithOnBatch sets the callback fired for each record batch built, like
+// for metrics. It is called on the goroutine fetching the rows, which is
+// not the consumer of QueryStream, so fn must be safe for concurrent use
+// and return quickly; the fetch waits for it.
+func WithOnBatch(fn func(BatchStats)) Option {
+	return func(cfg *config) error {
+		cfg.onBatch = fn
+		return nil
+	}
+}
+
+// statsRecorder accumulates the Stats of a query, which may run by more
+// than one stream as QueryParallel does.
+type statsRecorder struct {
+	onBatch func(BatchStats)
+
+	mu      sync.Mutex
+	stats   Stats
+	start   time.Time
+	end     time.Time // zero while any stream is open
+	streams int       // number of the streams open
+}
+
+func newStatsRecorder(onBatch func(BatchStats)) *statsRecorder {
+	return &statsRecorder{
+		onBatch: onBatch,
+		stats:   Stats{CommandRows: -1},
+		start:   time.Now(),
+	}
+}
+
+// attach counts a stream opened for the query.
+func (r *statsRecorder) attach() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.streams++
+	r.end = time.Time{}
+}
+
+// detach counts a stream closed, with the rows by its command tag.
+func (r *statsRecorder) detach(cmdRows int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cmdRows >= 0 {
+		if r.stats.CommandRows < 0 {
+			r.stats.CommandRows = 0
+		}
+		r.stats.CommandRows += cmdRows
+	}
+	if r.streams--; r.streams == 0 {
+		r.end = time.Now()
+	}
+}
+
+// header counts the messages other than record batches.
+func (r *statsRecorder) header(n int) {
+	r.mu.Lock()
+	r.stats.Bytes += int64(n)
+	r.mu.Unlock()
+}
+
+// batch counts a record batch, then fires the callback.
+func (r *statsRecorder) batch(b BatchStats) {
+	r.mu.Lock()
+	r.stats.Rows += b.Rows
+	r.stats.Bytes += int64(b.Bytes)
+	r.stats.Batches++
+	r.mu.Unlock()
+
+	if r.onBatch != nil {
+		r.onBatch(b)
+	}
+}
+
+// fetched records that a stream fetched all the rows.
+func (r *statsRecorder) fetched() {
+	r.mu.Lock()
+	r.stats.FetchTime = time.Since(r.start)
+	r.mu.Unlock()
+}
+
+func (r *statsRecorder) snapshot() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := r.stats
+	if r.end.IsZero() {
+		st.Elapsed = time.Since(r.start)
+	} else {
+		st.Elapsed = r.end.Sub(r.start)
+	}
+	return st
+}
+
+// Stats returns the counters and timings of the query so far.
+func (r *RecordReader) Stats() Stats {
+	return r.rec.snapshot()
+}
+
+// Stats returns the counters and timings of the last query completed on
+// the Conn, or the zero Stats if none. QueryParallel runs the query on
+// the other connections, so its Stats are those of the RecordReader.
+func (c *Conn) Stats() Stats {
+	if st := c.lastStats.Load(); st != nil {
+		return *st
+	}
+	return Stats{}
+}
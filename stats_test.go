@@ -0,0 +1,135 @@
+package pg2arrow
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	var mu sync.Mutex
+	var batches []BatchStats
+	c := testConn(t, WithBatchSize(4), WithOnBatch(func(b BatchStats) {
+		mu.Lock()
+		batches = append(batches, b)
+		mu.Unlock()
+	}))
+	if st := c.Stats(); st != (Stats{}) {
+		t.Errorf("got %+v before any query, want the zero Stats", st)
+	}
+
+	buf, err := c.Query("SELECT i FROM generate_series(1, 10) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := c.Stats()
+	if st.Rows != 10 || st.CommandRows != 10 || st.Batches != 3 {
+		t.Errorf("got %d rows, %d by the command tag and %d batches, want 10, 10 and 3",
+			st.Rows, st.CommandRows, st.Batches)
+	}
+	// the messages are all of the file but the leading magic
+	if st.Bytes != int64(len(buf)-len(arrowMagic)) {
+		t.Errorf("got %d bytes, want %d of the file", st.Bytes, len(buf)-len(arrowMagic))
+	}
+	if st.FetchTime <= 0 || st.FetchTime > st.Elapsed {
+		t.Errorf("got the fetch time %v and the elapsed %v", st.FetchTime, st.Elapsed)
+	}
+
+	// the callback fires for each batch, which excludes the schema and the
+	// footer from the bytes
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 3 {
+		t.Fatalf("got %d callbacks, want 3", len(batches))
+	}
+	var nbytes int64
+	for i, want := range []int64{4, 4, 2} {
+		if batches[i].Rows != want {
+			t.Errorf("batch %d: got %d rows, want %d", i, batches[i].Rows, want)
+		}
+		if batches[i].Bytes <= 0 {
+			t.Errorf("batch %d: got %d bytes", i, batches[i].Bytes)
+		}
+		nbytes += int64(batches[i].Bytes)
+	}
+	if nbytes >= st.Bytes {
+		t.Errorf("got %d bytes of the batches, want less than %d of the file", nbytes, st.Bytes)
+	}
+}
+
+func TestStatsCommandRows(t *testing.T) {
+	c := testConn(t)
+
+	// the command tag of SET has no number of rows
+	testExec(t, c, "SET application_name = 'pg2arrow_test'")
+	if st := c.Stats(); st.Rows != 0 || st.CommandRows != -1 {
+		t.Errorf("SET: got %d rows and %d by the command tag, want 0 and -1", st.Rows, st.CommandRows)
+	}
+
+	testTable(t, c, "pg2arrow_test_stats", "i int")
+	testExec(t, c, "INSERT INTO pg2arrow_test_stats SELECT generate_series(1, 5) RETURNING i")
+	if st := c.Stats(); st.Rows != 5 || st.CommandRows != 5 {
+		t.Errorf("INSERT RETURNING: got %d rows and %d by the command tag, want 5 and 5", st.Rows, st.CommandRows)
+	}
+}
+
+func TestStatsStream(t *testing.T) {
+	// one batch buffered by default, so the query cannot complete before
+	// the reader
+	c := testConn(t, WithBatchSize(100))
+
+	r, err := c.QueryStream("SELECT i FROM generate_series(1, 1000) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// the schema counts as soon as the query runs
+	if st := r.Stats(); st.Rows != 0 || st.CommandRows != -1 || st.Bytes != int64(len(r.Schema())) {
+		t.Errorf("got %+v before Next, want the bytes of the schema only", st)
+	}
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	// the rows of the batches already fetched, but not the command tag
+	// until the query completes
+	if st := r.Stats(); st.Rows == 0 || st.CommandRows != -1 || st.Bytes == 0 {
+		t.Errorf("got %+v after the first batch", st)
+	}
+
+	nrows, err := testRows(t, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := r.Stats()
+	if st.Rows != 1000 || st.CommandRows != 1000 || st.Batches != 10 {
+		t.Errorf("got %d rows, %d by the command tag and %d batches, want 1000, 1000 and 10",
+			st.Rows, st.CommandRows, st.Batches)
+	}
+	if nrows+100 != st.Rows {
+		t.Errorf("got %d rows read after the first batch, want %d", nrows, st.Rows-100)
+	}
+	// the time stops at Close, and the Conn reports the same
+	if again := r.Stats(); again != st {
+		t.Errorf("got %+v after Close, then %+v", st, again)
+	}
+	if got := c.Stats(); got != st {
+		t.Errorf("got %+v by the Conn, want %+v by the RecordReader", got, st)
+	}
+}
+
+func TestStatsParallel(t *testing.T) {
+	c := testConn(t, WithBatchSize(50))
+
+	// the partitions count as one query
+	r, err := c.QueryParallel("SELECT i FROM generate_series(1, 1000) i", "i", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testRows(t, r); err != nil {
+		t.Fatal(err)
+	}
+	st := r.Stats()
+	if st.Rows != 1000 || st.CommandRows != 1000 || st.Batches < 20 {
+		t.Errorf("got %d rows, %d by the command tag and %d batches, want 1000, 1000 and at least 20",
+			st.Rows, st.CommandRows, st.Batches)
+	}
+}
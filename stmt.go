@@ -0,0 +1,102 @@
+package pg2arrow
+
+// #include <stdlib.h>
+// #include "pg2arrow.h"
+import "C"
+import (
+	"bytes"
+	"errors"
+	"unsafe"
+)
+
+// Stmt is a statement prepared on the server by Prepare, to run the same
+// SQL command with different parameters without planning it each time.
+type Stmt struct {
+	c    *Conn
+	stmt *C.SQLstatement // nil if closed
+}
+
+// Prepare prepares the SQL command as the statement of the name on the
+// server, to be run by Stmt.Query. The name must be unique on the Conn,
+// like any prepared statements of PostgreSQL. The types of the parameters
+// are inferred by the server here, so a []byte argument of Stmt.Query
+// must be for a bytea parameter.
+//
+// A statement belongs to the session, so it is lost if the Conn is
+// reconnected by QueryRetry; prepare it again then.
+func (c *Conn) Prepare(name, sql string) (*Stmt, error) {
+	if name == "" {
+		return nil, errors.New("pg2arrow: prepared statement must have a name")
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cs := C.CString(sql)
+	defer C.free(unsafe.Pointer(cs))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil, ErrConnClosed
+	}
+	opts, free := c.options()
+	defer free()
+	var errinfo C.ErrorInfo
+	stmt := C.pgsql_prepare_statement(c.conn, cname, cs, &opts, &errinfo)
+	if stmt == nil {
+		return nil, newQueryError(&errinfo)
+	}
+	return &Stmt{c: c, stmt: stmt}, nil
+}
+
+// Query runs the statement with the parameters, then returns the whole
+// result in Apache Arrow file format. The parameters are the same as
+// QueryParams.
+func (s *Stmt) Query(args ...interface{}) ([]byte, error) {
+	p, err := newParams(args)
+	if err != nil {
+		return nil, err
+	}
+	defer p.free()
+
+	closed := false
+	st, err := s.c.open(nil, func(opts *C.SQLoptions, errinfo *C.ErrorInfo) *C.SQLtable {
+		// s.stmt is checked under the connection lock, like Close
+		if s.stmt == nil {
+			closed = true
+			return nil
+		}
+		return C.pgsql_open_statement(s.c.conn, s.stmt, &p.c, opts, errinfo)
+	})
+	if closed {
+		return nil, ErrStmtClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer st.close()
+
+	var buf bytes.Buffer
+	if err := st.writeTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Close deallocates the statement on the server. It is safe to call Close
+// more than once, or after the Conn is closed.
+func (s *Stmt) Close() error {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+
+	if s.stmt == nil {
+		return nil
+	}
+	var errinfo C.ErrorInfo
+	rc := C.pgsql_close_statement(s.c.conn, s.stmt, &errinfo)
+	s.stmt = nil
+	if rc != 0 {
+		return newQueryError(&errinfo)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package pg2arrow
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+)
+
+func TestPrepare(t *testing.T) {
+	c := testConn(t)
+	s, err := c.Prepare("pg2arrow_test_stmt", "SELECT i FROM generate_series(1, $1::int) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int64{3, 0, 10} {
+		buf, err := s.Query(n)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		var nrows int64
+		_, recs := testFile(t, "pg2arrow_test_stmt", buf)
+		for _, rec := range recs {
+			nrows += rec.NumRows()
+		}
+		if nrows != n {
+			t.Errorf("got %d rows, want %d", nrows, n)
+		}
+	}
+
+	// the name is taken until Close
+	if _, err := c.Prepare("pg2arrow_test_stmt", "SELECT 1"); err == nil {
+		t.Errorf("got no error of the duplicate name")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Query(int64(1)); !errors.Is(err, ErrStmtClosed) {
+		t.Errorf("got %v, want ErrStmtClosed", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close again: %v", err)
+	}
+	if _, err := c.Prepare("", "SELECT 1"); err == nil {
+		t.Errorf("got no error of the statement without a name")
+	}
+}
+
+func TestPrepareTextColumns(t *testing.T) {
+	l := new(testLogger)
+	c := testConn(t, WithLogger(l))
+	s, err := c.Prepare("pg2arrow_test_stmt", "SELECT int4range(1, $1::int) AS r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the column cast to text by the server is of the source type on each
+	// run, and logged
+	for i, n := range []int64{5, 10} {
+		l.reset()
+		buf, err := s.Query(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, recs := testFile(t, "pg2arrow_test_stmt", buf)
+		f := schema.Field(0)
+		if got := [2]string{fieldMetadata(f, "pg_oid"), fieldMetadata(f, "pg_typname")}; got != [2]string{"3904", "int4range"} {
+			t.Errorf("run %d: got pg_oid and pg_typname %q, want of int4range", i, got)
+		}
+		want := fmt.Sprintf("[1,%d)", n)
+		if got := recs[0].Column(0).(*array.String).Value(0); got != want {
+			t.Errorf("run %d: got %q, want %q", i, got, want)
+		}
+		if logged := len(l.logged("info", "pg2arrow: column fetched as text")); logged != 1 {
+			t.Errorf("run %d: got the column logged %d times, want once", i, logged)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package pg2arrow
+
+/*
+#include "pg2arrow.h"
+
+// cgo omits the flexible array member of SQLtable
+static SQLattribute *
+pg2arrow_get_attr(SQLtable *table, int j)
+{
+	return &table->attrs[j];
+}
+*/
+import "C"
+import (
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// arrowMagic is the leading signature of the Apache Arrow file format. The
+// messages built by the C code are placed as if they follow it.
+const arrowMagic = "ARROW1\x00\x00"
+
+// stream is a query in progress. It holds the connection lock from
+// openStream until close, and must be driven by one goroutine at a time.
+// The stream of a statement of QueryMulti is nested in the MultiReader,
+// which holds the lock instead.
+type stream struct {
+	c      *Conn
+	q      *canceler
+	table  *C.SQLtable
+	rec    *statsRecorder
+	nrows  int64 // rows written out by the C code so far
+	nested bool  // true, if the lock is held by the MultiReader
+}
+
+// openStream runs the SQL command with the parameters, if any, then returns
+// the stream positioned at the header messages.
+func (c *Conn) openStream(sql string, args []interface{}, q *canceler) (*stream, error) {
+	p, err := newParams(args)
+	if err != nil {
+		return nil, err
+	}
+	defer p.free()
+
+	return c.open(q, func(opts *C.SQLoptions, errinfo *C.ErrorInfo) *C.SQLtable {
+		cs := C.CString(sql)
+		defer C.free(unsafe.Pointer(cs))
+
+		return C.pgsql_open_query(c.conn, cs, &p.c, opts, errinfo)
+	})
+}
+
+// openInternal is like openStream, but for the queries of the package
+// itself, like EXPLAIN of EstimateQuery. The options shaping the results
+// of the caller's queries are cleared, so the result is of a fixed shape.
+func (c *Conn) openInternal(sql string) (*stream, error) {
+	return c.open(nil, func(opts *C.SQLoptions, errinfo *C.ErrorInfo) *C.SQLtable {
+		cs := C.CString(sql)
+		defer C.free(unsafe.Pointer(cs))
+
+		clearResultOptions(opts)
+		return C.pgsql_open_query(c.conn, cs, nil, opts, errinfo)
+	})
+}
+
+// openCopy is like openStream, but the rows come by COPY ... TO STDOUT.
+func (c *Conn) openCopy(sql string, q *canceler) (*stream, error) {
+	return c.open(q, func(opts *C.SQLoptions, errinfo *C.ErrorInfo) *C.SQLtable {
+		cs := C.CString(sql)
+		defer C.free(unsafe.Pointer(cs))
+
+		return C.pgsql_open_copy(c.conn, cs, opts, errinfo)
+	})
+}
+
+// open locks the connection, then begins the query by the C function.
+func (c *Conn) open(q *canceler, begin func(*C.SQLoptions, *C.ErrorInfo) *C.SQLtable) (*stream, error) {
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	s, err := c.begin(q, begin)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// begin is like open, but the connection is already locked by the caller.
+// The C function returning no table without error means no more results,
+// then it returns io.EOF.
+func (c *Conn) begin(q *canceler, begin func(*C.SQLoptions, *C.ErrorInfo) *C.SQLtable) (*stream, error) {
+	if !q.start(c.conn, c.cfg.logger) {
+		return nil, errCanceledBeforeStart
+	}
+
+	opts, free := c.options()
+	defer free()
+	rec := newStatsRecorder(c.cfg.onBatch)
+	var errinfo C.ErrorInfo
+	table := begin(&opts, &errinfo)
+	c.logSessionError()
+	if table == nil {
+		q.finish()
+		if errinfo.code == C.PG2ARROW_OK {
+			return nil, io.EOF
+		}
+		err := newQueryError(&errinfo)
+		c.cfg.logger.Error("pg2arrow: query failed", "sqlstate", err.SQLState, "error", err)
+		return nil, err
+	}
+	rec.attach()
+	s := &stream{c: c, q: q, table: table, rec: rec}
+	s.logTextColumns()
+	return s, nil
+}
+
+// logTextColumns logs the columns cast to text by the server, because they
+// have no known binary format.
+func (s *stream) logTextColumns() {
+	for j := 0; j < int(s.table.nfields); j++ {
+		attr := C.pg2arrow_get_attr(s.table, C.int(j))
+		if attr.text_typname == nil {
+			continue
+		}
+		s.c.cfg.logger.Info("pg2arrow: column fetched as text",
+			"column", C.GoString(attr.attname),
+			"pg_type", C.GoString(attr.text_typname),
+			"arrow_type", C.GoString(attr.arrow_typename))
+	}
+}
+
+// output copies the messages built by the last step of the C code. The
+// C buffer is reused by the next step, and released by close, so the
+// messages never alias it.
+func (s *stream) output() []byte {
+	out := &s.table.output
+	return C.GoBytes(unsafe.Pointer(out.ptr), C.int(out.usage))
+}
+
+// view is like output, but the messages alias the C buffer; they are valid
+// only until the next step of the stream.
+func (s *stream) view() []byte {
+	out := &s.table.output
+	return unsafe.Slice((*byte)(unsafe.Pointer(out.ptr)), int(out.usage))
+}
+
+// header returns the schema message followed by the dictionary batches.
+// It must be called prior to next.
+func (s *stream) header() []byte {
+	b := s.output()
+	s.rec.header(len(b))
+	return b
+}
+
+// next returns the next record batch message, or io.EOF if no more rows.
+func (s *stream) next() ([]byte, error) {
+	b, err := s.nextView()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// nextView is like next, but the message is of view.
+func (s *stream) nextView() ([]byte, error) {
+	start := time.Now()
+	var errinfo C.ErrorInfo
+	switch C.pgsql_fetch_next(s.table, &errinfo) {
+	case 1:
+		b := s.view()
+		nrows := int64(s.table.nrows)
+		st := BatchStats{
+			Rows:      nrows - s.nrows,
+			Bytes:     len(b),
+			FetchTime: time.Since(start),
+		}
+		s.rec.batch(st)
+		s.c.cfg.logger.Debug("pg2arrow: record batch flushed",
+			"rows", st.Rows, "bytes", st.Bytes, "fetch_time", st.FetchTime)
+		s.nrows = nrows
+		return b, nil
+	case 0:
+		s.rec.fetched()
+		return nil, io.EOF
+	}
+	return nil, s.queryError(&errinfo)
+}
+
+// queryError converts the error of the query. A query canceled by the
+// server, not by the canceler, is of the statement timeout if it is set.
+func (s *stream) queryError(info *C.ErrorInfo) *QueryError {
+	e := newQueryError(info)
+	e.timeout = e.SQLState == sqlStateQueryCanceled &&
+		s.c.cfg.timeout > 0 && !s.q.wasCanceled()
+	e.rowLimit = bool(s.table.row_limit_exceeded)
+	s.c.cfg.logger.Error("pg2arrow: query failed", "sqlstate", e.SQLState, "error", e)
+	return e
+}
+
+// footer returns the footer of the Apache Arrow file format, including
+// the trailing signature. It must be called after next returned io.EOF.
+func (s *stream) footer() ([]byte, error) {
+	var errinfo C.ErrorInfo
+	if C.pgsql_fetch_footer(s.table, &errinfo) != 0 {
+		return nil, newQueryError(&errinfo)
+	}
+	b := s.output()
+	s.rec.header(len(b))
+	return b, nil
+}
+
+// close terminates the query if still running, then releases the
+// connection. The C buffers of the query are released too.
+func (s *stream) close() {
+	s.rec.detach(int64(s.table.cmd_ntuples))
+	st := s.rec.snapshot()
+	s.c.lastStats.Store(&st)
+	C.pgsql_close_query(s.table)
+	s.table = nil
+	s.c.logSessionError()
+	s.q.finish()
+	if !s.nested {
+		s.c.mu.Unlock()
+	}
+}
+
+// writeTo writes the whole result in Apache Arrow file format.
+func (s *stream) writeTo(w io.Writer) error {
+	if _, err := io.WriteString(w, arrowMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(s.header()); err != nil {
+		return err
+	}
+	for {
+		b, err := s.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	b, err := s.footer()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ipcEOS is the end-of-stream marker of the Arrow IPC stream format, in the
+// legacy framing without continuation, like the messages of the C code.
+const ipcEOS = "\x00\x00\x00\x00"
+
+// ipcReader reads the stream in Arrow IPC stream format, for the readers
+// of the Arrow library. The messages are fetched as they are read, and may
+// be read in any pieces.
+type ipcReader struct {
+	s   *stream
+	buf []byte
+	eof bool
+	err error // error from the stream, if any
+}
+
+func newIPCReader(s *stream) *ipcReader {
+	return &ipcReader{s: s, buf: s.header()}
+}
+
+func (r *ipcReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		b, err := r.s.next()
+		if err == io.EOF {
+			r.eof = true
+			b = []byte(ipcEOS)
+		} else if err != nil {
+			r.err = err
+		}
+		r.buf = b
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// wrapErr returns the error from the stream, rather than err reported by
+// the Arrow library on top of it, so the QueryError is never hidden.
+func (r *ipcReader) wrapErr(err error) error {
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// RecordReader reads the result of QueryStream one record batch at a time.
+// The next batch is fetched in background while the current one is being
+// processed. The Conn stays busy until Close.
+type RecordReader struct {
+	schema []byte
+	cancel func() // cancels the running queries
+	rec    *statsRecorder
+	limit  *rowLimit // rows of the partitions of QueryParallel, or nil
+	ch     chan batch
+	budget *budget
+	done   chan struct{}
+	exited chan struct{}
+	err    error
+	once   sync.Once
+}
+
+type batch struct {
+	buf []byte
+	err error
+}
+
+// budget is the bytes of the batches fetched but not consumed yet. The
+// producers wait for the consumer once it exceeds max.
+type budget struct {
+	max    int64 // 0 means no limit
+	mu     sync.Mutex
+	cond   *sync.Cond
+	usage  int64
+	closed bool
+}
+
+func newBudget(max int64) *budget {
+	b := &budget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes fit in the budget, or nothing is buffered.
+// It returns false if the budget is closed.
+func (b *budget) acquire(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for !b.closed && b.max > 0 && b.usage > 0 && b.usage+int64(n) > b.max {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.usage += int64(n)
+	return true
+}
+
+func (b *budget) release(n int) {
+	b.mu.Lock()
+	b.usage -= int64(n)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *budget) bytes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.usage
+}
+
+// close wakes up the producers waiting for the budget.
+func (b *budget) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// QueryStream runs the SQL command, then returns a RecordReader over its
+// result. Unlike Query, the memory consumption is proportional to the
+// batch size, not to the result size; see WithMaxBufferedBatches and
+// WithMaxBufferedBytes to limit the batches fetched ahead. The caller must
+// Close the reader.
+func (c *Conn) QueryStream(sql string) (*RecordReader, error) {
+	q := new(canceler)
+	s, err := c.openStream(sql, nil, q)
+	if err != nil {
+		return nil, err
+	}
+	return newRecordReader(s, q), nil
+}
+
+// CopyOut is like QueryStream, but runs the SQL command by
+// COPY (sql) TO STDOUT (FORMAT binary), which streams the rows faster for
+// full-table dumps. The sql must be a query allowed as the source of COPY,
+// like SELECT or VALUES; otherwise, it returns a QueryError.
+func (c *Conn) CopyOut(sql string) (*RecordReader, error) {
+	q := new(canceler)
+	s, err := c.openCopy(sql, q)
+	if err != nil {
+		return nil, err
+	}
+	return newRecordReader(s, q), nil
+}
+
+func newRecordReader(s *stream, q *canceler) *RecordReader {
+	n := s.c.cfg.maxBatches
+	if n == 0 {
+		n = 1
+	}
+	r := &RecordReader{
+		schema: s.header(),
+		cancel: q.Cancel,
+		rec:    s.rec,
+		ch:     make(chan batch, n),
+		budget: newBudget(s.c.cfg.maxBytes),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go r.produce(s)
+	return r
+}
+
+func (r *RecordReader) produce(s *stream) {
+	defer close(r.exited)
+	defer s.close()
+
+	for {
+		b, err := s.next()
+		if !r.send(batch{b, err}) || err != nil {
+			return
+		}
+	}
+}
+
+// send queues the batch for Next, waiting for the budget and the room of
+// the queue. It returns false if the reader is closed.
+func (r *RecordReader) send(b batch) bool {
+	if !r.budget.acquire(len(b.buf)) {
+		return false
+	}
+	select {
+	case r.ch <- b:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// Schema returns the schema message of the result, followed by the
+// dictionary batches if any. Schema and all the record batches returned by
+// Next form an Arrow IPC stream.
+func (r *RecordReader) Schema() []byte {
+	return r.schema
+}
+
+// Next returns the next record batch message, preceded by the delta
+// dictionary batches of the values first appearing in it, if any. It
+// returns io.EOF when no more batches, or the error that stopped the query;
+// errors.Is(err, ErrConnectionLost) tells the connection was lost.
+func (r *RecordReader) Next() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	select {
+	case b := <-r.ch:
+		r.budget.release(len(b.buf))
+		if b.err != nil {
+			r.err = b.err
+			return nil, b.err
+		}
+		return b.buf, nil
+	case <-r.done:
+		r.err = ErrReaderClosed
+		return nil, r.err
+	}
+}
+
+// Buffered returns the number and the total size of the record batches
+// fetched ahead, but not returned by Next yet.
+func (r *RecordReader) Buffered() (batches int, bytes int64) {
+	return len(r.ch), r.budget.bytes()
+}
+
+// Close stops the query if it is still running, then releases the Conn.
+// It is safe to call Close more than once.
+func (r *RecordReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+		r.budget.close()
+		r.cancel()
+		<-r.exited
+	})
+	return nil
+}
@@ -0,0 +1,417 @@
+package pg2arrow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+)
+
+// nullsQuery has the NULLs of every third row in three types, so they fall
+// on both sides of the batch boundaries of WithBatchSize(4).
+const nullsQuery = `SELECT i,
+       CASE WHEN i % 3 <> 0 THEN i END AS n,
+       CASE WHEN i % 3 <> 1 THEN 'v' || i END AS s,
+       CASE WHEN i % 3 <> 2 THEN i % 2 = 0 END AS b
+  FROM generate_series(0, 10) i`
+
+func TestNullsAcrossBatches(t *testing.T) {
+	c := testConn(t, WithBatchSize(4))
+
+	for _, run := range []struct {
+		name string
+		fn   func(*testing.T, *Conn, string) (*arrow.Schema, []arrow.Record)
+	}{
+		{"Query", testQuery},
+		{"QueryStream", testStream},
+	} {
+		name := run.name
+		schema, recs := run.fn(t, c, nullsQuery)
+		for _, f := range schema.Fields() {
+			if !f.Nullable {
+				t.Errorf("%s: field %q is not nullable", name, f.Name)
+			}
+		}
+		if len(recs) != 3 {
+			t.Fatalf("%s: got %d record batches, want 3", name, len(recs))
+		}
+		i := 0
+		for k, rec := range recs {
+			ids := rec.Column(0).(*array.Int32)
+			n := rec.Column(1).(*array.Int32)
+			s := rec.Column(2).(*array.String)
+			b := rec.Column(3).(*array.Boolean)
+			nulls := 0
+			for row := 0; row < int(rec.NumRows()); row, i = row+1, i+1 {
+				if got := int(ids.Value(row)); got != i {
+					t.Fatalf("%s: batch %d row %d: got i = %d, want %d", name, k, row, got, i)
+				}
+				if n.IsNull(row) != (i%3 == 0) || (!n.IsNull(row) && int(n.Value(row)) != i) {
+					t.Errorf("%s: i = %d: got n = %s", name, i, n.ValueStr(row))
+				}
+				if s.IsNull(row) != (i%3 == 1) || (!s.IsNull(row) && s.Value(row) != fmt.Sprintf("v%d", i)) {
+					t.Errorf("%s: i = %d: got s = %s", name, i, s.ValueStr(row))
+				}
+				if b.IsNull(row) != (i%3 == 2) || (!b.IsNull(row) && b.Value(row) != (i%2 == 0)) {
+					t.Errorf("%s: i = %d: got b = %s", name, i, b.ValueStr(row))
+				}
+				if i%3 == 0 {
+					nulls++
+				}
+			}
+			if got := n.NullN(); got != nulls {
+				t.Errorf("%s: batch %d: got null count %d, want %d", name, k, got, nulls)
+			}
+		}
+		if i != 11 {
+			t.Errorf("%s: got %d rows, want 11", name, i)
+		}
+	}
+}
+
+func TestNullableNotNull(t *testing.T) {
+	c := testConn(t)
+	testExec(t, c, "CREATE TEMP TABLE nn (a int NOT NULL, b text NOT NULL)",
+		"INSERT INTO nn VALUES (1, 'x')")
+
+	// a NOT NULL column may still be NULL by the outer join, so it is
+	// nullable without WithNotNullHints
+	schema, recs := testQuery(t, c, "SELECT nn.a, nn.b FROM (VALUES (1), (2)) v(k) LEFT JOIN nn ON nn.a = v.k ORDER BY v.k")
+	for _, f := range schema.Fields() {
+		if !f.Nullable {
+			t.Errorf("field %q is not nullable", f.Name)
+		}
+	}
+	if got := recs[0].Column(0).NullN(); got != 1 {
+		t.Errorf("got %d nulls, want 1", got)
+	}
+}
+
+func TestNotNullHints(t *testing.T) {
+	c := testConn(t, WithNotNullHints())
+	testExec(t, c, "CREATE TEMP TABLE nn (a int NOT NULL, b text NOT NULL, c int, d int4range NOT NULL)")
+
+	// only the columns simply referencing the NOT NULL ones, even if cast
+	// to text by the server
+	want := map[string]bool{"a": false, "b": false, "c": true, "d": false, "e": true}
+	const sql = "SELECT a, b, c, d, a + 1 AS e FROM nn"
+	schema, _ := testQuery(t, c, sql)
+	for _, f := range schema.Fields() {
+		if f.Nullable != want[f.Name] {
+			t.Errorf("Query: field %q: got nullable %v, want %v", f.Name, f.Nullable, want[f.Name])
+		}
+	}
+	s, err := c.Prepare("pg2arrow_test_nn", sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		buf, err := s.Query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, _ := testFile(t, sql, buf)
+		for _, f := range schema.Fields() {
+			if f.Nullable != want[f.Name] {
+				t.Errorf("Stmt: field %q: got nullable %v, want %v", f.Name, f.Nullable, want[f.Name])
+			}
+		}
+	}
+}
+
+func TestBufferOwnership(t *testing.T) {
+	c := testConn(t, WithBatchSize(100))
+	const sql = "SELECT i, repeat('x', i % 50) AS s FROM generate_series(1, 1000) i"
+
+	buf, err := c.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := bytes.Clone(buf)
+
+	r, err := c.QueryStream(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := [][]byte{r.Schema()}
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, b)
+	}
+	savedMsgs := make([][]byte, len(msgs))
+	for i, b := range msgs {
+		savedMsgs[i] = bytes.Clone(b)
+	}
+	r.Close()
+
+	// neither the next queries nor Close touch the buffers returned
+	testQuery(t, c, sql)
+	c.Close()
+	runtime.GC()
+	if !bytes.Equal(buf, saved) {
+		t.Errorf("the result of Query changed after the Conn is closed")
+	}
+	for i := range msgs {
+		if !bytes.Equal(msgs[i], savedMsgs[i]) {
+			t.Errorf("message %d of QueryStream changed after the reader is closed", i)
+		}
+	}
+	if len(msgs) != 11 {
+		t.Errorf("got %d messages, want the schema and 10 record batches", len(msgs))
+	}
+}
+
+func TestBufferReclaimed(t *testing.T) {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skip("no /proc/self/statm to tell the resident memory")
+	}
+	rss := func() int64 {
+		statm, _ = os.ReadFile("/proc/self/statm")
+		var size, resident int64
+		fmt.Sscan(string(statm), &size, &resident)
+		return resident * int64(os.Getpagesize())
+	}
+	c := testConn(t)
+	const sql = "SELECT i, repeat('x', 1000) AS s FROM generate_series(1, 1000) i"
+
+	// about 1MB each; 200MB if the C buffers leaked
+	testQuery(t, c, sql)
+	runtime.GC()
+	before := rss()
+	for i := 0; i < 200; i++ {
+		if _, err := c.Query(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.GC()
+	if grown := rss() - before; grown > 64<<20 {
+		t.Errorf("resident memory grew by %d bytes over 200 queries", grown)
+	}
+}
+
+// dictionaryStrings decodes the Dictionary<Int32, Utf8> column by its
+// values, or "null".
+func dictionaryStrings(t *testing.T, col arrow.Array) []string {
+	t.Helper()
+	d, ok := col.(*array.Dictionary)
+	if !ok {
+		t.Fatalf("got %s, want Dictionary", col.DataType())
+	}
+	dict := d.Dictionary().(*array.String)
+	values := make([]string, d.Len())
+	for i := range values {
+		if d.IsNull(i) {
+			values[i] = "null"
+		} else {
+			values[i] = dict.Value(d.GetValueIndex(i))
+		}
+	}
+	return values
+}
+
+func TestDictionaryDelta(t *testing.T) {
+	c := testConn(t, WithBatchSize(3), WithDictionaryColumns("s"))
+	// each batch brings the new values, and repeats the old ones
+	want := []string{"a", "b", "a", "c", "null", "b", "d", "a", "e", "c"}
+	const sql = `SELECT s FROM unnest('{a,b,a,c,NULL,b,d,a,e,c}'::text[]) WITH ORDINALITY t(s, i) ORDER BY i`
+
+	for _, run := range []struct {
+		name  string
+		fn    func(*testing.T, *Conn, string) (*arrow.Schema, []arrow.Record)
+		delta bool // the dictionary of each batch is of the values so far
+	}{
+		{"Query", testQuery, false},
+		{"QueryStream", testStream, true},
+	} {
+		_, recs := run.fn(t, c, sql)
+		if len(recs) != 4 {
+			t.Fatalf("%s: got %d record batches, want 4", run.name, len(recs))
+		}
+		var got []string
+		dictLen := 0
+		for k, rec := range recs {
+			got = append(got, dictionaryStrings(t, rec.Column(0))...)
+			n := rec.Column(0).(*array.Dictionary).Dictionary().Len()
+			if n < dictLen {
+				t.Errorf("%s: batch %d: the dictionary shrank from %d to %d", run.name, k, dictLen, n)
+			}
+			if want := []int{2, 3, 5, 5}[k]; run.delta && n != want {
+				t.Errorf("%s: batch %d: got %d values of the dictionary, want %d", run.name, k, n, want)
+			}
+			dictLen = n
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", run.name, got, want)
+		}
+		if dictLen != 5 {
+			t.Errorf("%s: got %d values of the dictionary, want 5", run.name, dictLen)
+		}
+	}
+
+	if _, err := c.Query("SELECT 1 AS s"); err == nil {
+		t.Errorf("got no error of the dictionary column of int4")
+	}
+}
+
+func TestFieldMetadata(t *testing.T) {
+	c := testConn(t)
+	testExec(t, c, "CREATE TYPE pg_temp.pair AS (a int8, b varchar(5))")
+
+	schema, recs := testQuery(t, c, `SELECT 'x'::varchar(32) AS v, 1 AS i, 1.5::numeric(10,2) AS n,
+       '{1}'::int2[] AS l, ROW(1, 'y')::pg_temp.pair AS p, '[1,2)'::int4range AS r`)
+
+	// write it out and read back by the Arrow library
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(schema))
+	for _, rec := range recs {
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := ipc.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Release()
+
+	type meta struct{ oid, typname, typmod string }
+	want := []struct {
+		path string
+		meta
+	}{
+		{"v", meta{"1043", "varchar", "36"}},
+		{"i", meta{"23", "int4", "-1"}},
+		{"n", meta{"1700", "numeric", fmt.Sprint((10<<16 | 2) + 4)}},
+		{"l", meta{"1005", "_int2", "-1"}},
+		{"l.", meta{"21", "int2", "-1"}},
+		{"p", meta{"", "pair", "-1"}},
+		{"p.a", meta{"20", "int8", "-1"}},
+		{"p.b", meta{"1043", "varchar", "9"}},
+		// cast to text by the server, but of the source type
+		{"r", meta{"3904", "int4range", "-1"}},
+	}
+	for _, s := range []*arrow.Schema{schema, rdr.Schema()} {
+		for _, w := range want {
+			f := lookupField(t, s, w.path)
+			got := meta{fieldMetadata(f, "pg_oid"), fieldMetadata(f, "pg_typname"), fieldMetadata(f, "pg_typmod")}
+			if w.oid == "" {
+				w.oid = got.oid // of the temporary type
+			}
+			if got != w.meta {
+				t.Errorf("%s: got %+v, want %+v", w.path, got, w.meta)
+			}
+		}
+	}
+}
+
+// lookupField returns the field of the path, like "p.a" for the field a
+// of the Struct p, or "l." for the element of the List l.
+func lookupField(t *testing.T, s *arrow.Schema, path string) arrow.Field {
+	t.Helper()
+	name, rest, nested := strings.Cut(path, ".")
+	fields := s.FieldIndices(name)
+	if len(fields) != 1 {
+		t.Fatalf("no field %q", name)
+	}
+	f := s.Field(fields[0])
+	if !nested {
+		return f
+	}
+	switch typ := f.Type.(type) {
+	case *arrow.ListType:
+		return typ.ElemField()
+	case *arrow.StructType:
+		if sub, ok := typ.FieldByName(rest); ok {
+			return sub
+		}
+	}
+	t.Fatalf("no field %q", path)
+	return arrow.Field{}
+}
+
+func TestConnectionLost(t *testing.T) {
+	c := testConn(t, WithBatchSize(10), WithMaxBufferedBatches(1))
+	_, recs := testQuery(t, c, "SELECT pg_backend_pid()")
+	pid := recs[0].Column(0).(*array.Int32).Value(0)
+
+	// slow enough to be in the middle, when terminated
+	r, err := c.QueryStream("SELECT i, pg_sleep(0.001) FROM generate_series(1, 100000) i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	first, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := bytes.Clone(first)
+	testQuery(t, testConn(t), fmt.Sprintf("SELECT pg_terminate_backend(%d)", pid))
+
+	n := 0
+	for {
+		_, err = r.Next()
+		if err != nil {
+			break
+		}
+		if n++; n > 10000 {
+			t.Fatal("got no error after the backend is terminated")
+		}
+	}
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("got %v, want ErrConnectionLost", err)
+	}
+	var qerr *QueryError
+	if !errors.As(err, &qerr) {
+		t.Errorf("got %#v, want a QueryError", err)
+	}
+	// the error stays, and the batch delivered remains valid
+	if _, again := r.Next(); again != err {
+		t.Errorf("got %v by the next Next, want %v", again, err)
+	}
+	if !bytes.Equal(first, saved) {
+		t.Errorf("the batch delivered changed after the connection is lost")
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	c := testConn(t, WithMaxRows(100), WithBatchSize(30))
+
+	// the streams deliver exactly the rows of the limit, then the error
+	for _, open := range []func(string) (*RecordReader, error){c.QueryStream, c.CopyOut} {
+		r, err := open("SELECT i FROM generate_series(1, 1000) i")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nrows, err := testRows(t, r)
+		if !errors.Is(err, ErrRowLimitExceeded) {
+			t.Errorf("got %v, want ErrRowLimitExceeded", err)
+		}
+		if nrows != 100 {
+			t.Errorf("got %d rows, want 100", nrows)
+		}
+	}
+	if _, err := c.Query("SELECT i FROM generate_series(1, 101) i"); !errors.Is(err, ErrRowLimitExceeded) {
+		t.Errorf("Query: got %v, want ErrRowLimitExceeded", err)
+	}
+	if _, recs := testQuery(t, c, "SELECT i FROM generate_series(1, 100) i"); len(recs) != 4 {
+		t.Errorf("got %d record batches of the limit exactly, want 4", len(recs))
+	}
+}
@@ -0,0 +1,1033 @@
+/*
+ * text_recv.c
+ *
+ * text forms of the built-in PostgreSQL types --> their binary formats
+ *
+ * The simple query protocol sends the results in text only. Rather than
+ * another set of the put_value handlers, the text form of each value is
+ * converted to the binary format of the type, like its receive function
+ * would send, then it goes through the same handlers as the results in
+ * binary; so the options like WithUUIDAsString apply as well.
+ *
+ * The catalog entries of the built-in types are fixed, so they are known
+ * without the catalog lookups, which cannot run while the connection is
+ * busy with the rest of the statements.
+ */
+#include "pg2arrow.h"
+#include "catalog/pg_type_d.h"
+
+#define NUMERIC_POS			0x0000
+#define NUMERIC_NEG			0x4000
+#define NUMERIC_NAN			0xC000
+#define NUMERIC_PINF		0xD000
+#define NUMERIC_NINF		0xF000
+#define DEC_DIGITS			4	/* decimal digits per NBASE digit */
+
+#define PGSQL_AF_INET		(AF_INET + 0)
+#define PGSQL_AF_INET6		(AF_INET + 1)
+
+static inline void
+__append_int16(SQLbuffer *out, int16 value)
+{
+	uint16		temp = htons((uint16) value);
+
+	sql_buffer_append(out, &temp, sizeof(temp));
+}
+
+static inline void
+__append_int32(SQLbuffer *out, int32 value)
+{
+	uint32		temp = htonl((uint32) value);
+
+	sql_buffer_append(out, &temp, sizeof(temp));
+}
+
+static inline void
+__append_int64(SQLbuffer *out, int64 value)
+{
+	__append_int32(out, (int32)((uint64) value >> 32));
+	__append_int32(out, (int32)((uint64) value & 0xffffffffU));
+}
+
+static void
+__text_invalid(SQLattribute *attr, const char *text)
+{
+	Elog("unexpected text form of %s in column \"%s\": \"%s\"",
+		 attr->typname, attr->attname, text);
+}
+
+/*
+ * __parse_int64
+ *
+ * It parses the decimal integer at *p_pos, then moves *p_pos beyond it.
+ */
+static bool
+__parse_int64(const char **p_pos, int64 *p_value)
+{
+	char	   *end;
+	long long	value;
+
+	if (!isdigit((unsigned char)**p_pos) &&
+		!((**p_pos == '-' || **p_pos == '+') &&
+		  isdigit((unsigned char)(*p_pos)[1])))
+		return false;
+	errno = 0;
+	value = strtoll(*p_pos, &end, 10);
+	if (errno != 0)
+		return false;
+	*p_pos = end;
+	*p_value = value;
+	return true;
+}
+
+/*
+ * __parse_fixed
+ *
+ * It parses exactly ndigits decimal digits at *p_pos.
+ */
+static bool
+__parse_fixed(const char **p_pos, int ndigits, int *p_value)
+{
+	int			i, value = 0;
+
+	for (i=0; i < ndigits; i++)
+	{
+		if (!isdigit((unsigned char)(*p_pos)[i]))
+			return false;
+		value = 10 * value + ((*p_pos)[i] - '0');
+	}
+	*p_pos += ndigits;
+	*p_value = value;
+	return true;
+}
+
+/*
+ * __parse_usecs
+ *
+ * It parses the fraction of seconds, like ".123", as microseconds, if any.
+ */
+static bool
+__parse_usecs(const char **p_pos, int64 *p_usecs)
+{
+	const char *pos = *p_pos;
+	int64		usecs = 0;
+	int			i;
+
+	if (*pos == '.')
+	{
+		pos++;
+		if (!isdigit((unsigned char)*pos))
+			return false;
+		for (i=0; isdigit((unsigned char)*pos); i++, pos++)
+		{
+			/* the output has 6 digits at most */
+			if (i >= 6)
+				return false;
+			usecs = 10 * usecs + (*pos - '0');
+		}
+		for (; i < 6; i++)
+			usecs *= 10;
+	}
+	*p_pos = pos;
+	*p_usecs = usecs;
+	return true;
+}
+
+static void
+recv_bool(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	char		value;
+
+	if (strcmp(text, "t") == 0)
+		value = 1;
+	else if (strcmp(text, "f") == 0)
+		value = 0;
+	else
+		__text_invalid(attr, text);
+	sql_buffer_append(out, &value, sizeof(value));
+}
+
+static void
+recv_int(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	int64		value;
+
+	if (!__parse_int64(&pos, &value) || *pos != '\0')
+		__text_invalid(attr, text);
+	switch (attr->attlen)
+	{
+		case sizeof(int16):
+			if (value < PG_INT16_MIN || value > PG_INT16_MAX)
+				__text_invalid(attr, text);
+			__append_int16(out, value);
+			break;
+		case sizeof(int32):
+			/* oid is unsigned */
+			if (value < (attr->atttypid == OIDOID ? 0 : PG_INT32_MIN) ||
+				value > (attr->atttypid == OIDOID ? PG_UINT32_MAX : PG_INT32_MAX))
+				__text_invalid(attr, text);
+			__append_int32(out, (int32)(uint32) value);
+			break;
+		default:
+			__append_int64(out, value);
+			break;
+	}
+}
+
+/*
+ * recv_float
+ *
+ * The text form is exact as long as extra_float_digits is 1, the default,
+ * or more; strtod() also takes NaN, Infinity and -Infinity of it.
+ */
+static void
+recv_float(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	char	   *end;
+
+	errno = 0;
+	if (attr->attlen == sizeof(float))
+	{
+		union { float f; int32 i; } v;
+
+		v.f = strtof(text, &end);
+		if (end == text || *end != '\0' || (errno != 0 && v.f != 0.0))
+			__text_invalid(attr, text);
+		__append_int32(out, v.i);
+	}
+	else
+	{
+		union { double f; int64 i; } v;
+
+		v.f = strtod(text, &end);
+		if (end == text || *end != '\0' || (errno != 0 && v.f != 0.0))
+			__text_invalid(attr, text);
+		__append_int64(out, v.i);
+	}
+}
+
+/*
+ * recv_numeric
+ *
+ * The decimal digits are grouped into the NBASE digits by the decimal
+ * point, then the leading and trailing zero digits are dropped, like
+ * numeric_send() does. The display scale is the number of the fraction
+ * digits.
+ */
+static void
+recv_numeric(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	const char *int_start, *frac_start;
+	int			int_len, frac_len;
+	int			ngroups, first, last, weight;
+	int			sign = NUMERIC_POS;
+	int16	   *groups;
+	int			i, k;
+
+	if (strcmp(text, "NaN") == 0 ||
+		strcmp(text, "Infinity") == 0 ||
+		strcmp(text, "-Infinity") == 0)
+	{
+		__append_int16(out, 0);		/* ndigits */
+		__append_int16(out, 0);		/* weight */
+		__append_int16(out, (text[0] == 'N' ? NUMERIC_NAN :
+							 text[0] == 'I' ? NUMERIC_PINF : NUMERIC_NINF));
+		__append_int16(out, 0);		/* dscale */
+		return;
+	}
+	if (*pos == '-')
+	{
+		sign = NUMERIC_NEG;
+		pos++;
+	}
+	int_start = pos;
+	while (isdigit((unsigned char)*pos))
+		pos++;
+	int_len = pos - int_start;
+	frac_start = pos;
+	frac_len = 0;
+	if (*pos == '.')
+	{
+		frac_start = ++pos;
+		while (isdigit((unsigned char)*pos))
+			pos++;
+		frac_len = pos - frac_start;
+	}
+	if (*pos != '\0' || int_len + frac_len == 0)
+		__text_invalid(attr, text);
+
+	/* NBASE digits of the integer part, then of the fraction part */
+	weight = (int_len + DEC_DIGITS - 1) / DEC_DIGITS;
+	ngroups = weight + (frac_len + DEC_DIGITS - 1) / DEC_DIGITS;
+	groups = alloca(sizeof(int16) * Max(ngroups, 1));
+	memset(groups, 0, sizeof(int16) * Max(ngroups, 1));
+	for (i=0; i < int_len; i++)
+	{
+		k = weight - 1 - (int_len - 1 - i) / DEC_DIGITS;
+		groups[k] = 10 * groups[k] + (int_start[i] - '0');
+	}
+	for (i=0; i < frac_len; i++)
+	{
+		k = weight + i / DEC_DIGITS;
+		groups[k] = 10 * groups[k] + (frac_start[i] - '0');
+	}
+	for (i=frac_len; i % DEC_DIGITS != 0; i++)
+	{
+		k = weight + i / DEC_DIGITS;
+		groups[k] *= 10;
+	}
+	for (first=0; first < ngroups && groups[first] == 0; first++);
+	for (last=ngroups; last > first && groups[last-1] == 0; last--);
+	if (first == last)
+	{
+		/* zero has no digits, and is never negative */
+		first = last = 0;
+		weight = 0;
+		sign = NUMERIC_POS;
+	}
+	else
+		weight = weight - 1 - first;
+
+	__append_int16(out, last - first);
+	__append_int16(out, weight);
+	__append_int16(out, sign);
+	__append_int16(out, frac_len);
+	for (i=first; i < last; i++)
+		__append_int16(out, groups[i]);
+}
+
+/*
+ * recv_money
+ *
+ * The text form depends on lc_monetary, like "$1,234.56" or "-$0.05", but
+ * its digits are always those of the int64 of the smallest currency unit,
+ * with the separators and the currency symbol in between. A negative value
+ * is either of the minus sign or the parentheses.
+ */
+static void
+recv_money(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos;
+	bool		negative = false;
+	bool		has_digits = false;
+	uint64		value = 0;
+
+	for (pos = text; *pos != '\0'; pos++)
+	{
+		if (isdigit((unsigned char)*pos))
+		{
+			if (value > (PG_UINT64_MAX - 9) / 10)
+				__text_invalid(attr, text);
+			value = 10 * value + (*pos - '0');
+			has_digits = true;
+		}
+		else if (*pos == '-' || *pos == '(')
+			negative = true;
+	}
+	if (!has_digits ||
+		value > (negative ? (uint64) PG_INT64_MAX + 1 : (uint64) PG_INT64_MAX))
+		__text_invalid(attr, text);
+	__append_int64(out, negative ? (int64)(0 - value) : (int64) value);
+}
+
+/*
+ * __date2j
+ *
+ * Julian day of the date, like date2j() of PostgreSQL.
+ */
+static int
+__date2j(int year, int month, int day)
+{
+	int			julian;
+	int			century;
+
+	if (month > 2)
+	{
+		month += 1;
+		year += 4800;
+	}
+	else
+	{
+		month += 13;
+		year += 4799;
+	}
+	century = year / 100;
+	julian = year * 365 - 32167;
+	julian += year / 4 - century + century / 4;
+	julian += 7834 * month / 256 + day;
+
+	return julian;
+}
+
+/*
+ * __parse_date
+ *
+ * It parses the date of DateStyle=ISO, like "2024-01-31", then returns
+ * the days since the PostgreSQL epoch. The suffix " BC" comes at the end
+ * of the whole text, so the caller looks for it.
+ */
+static bool
+__parse_date(const char **p_pos, bool bc, int *p_days)
+{
+	const char *pos = *p_pos;
+	const char *start = pos;
+	int64		year;
+	int			month, day;
+
+	while (isdigit((unsigned char)*pos))
+		pos++;
+	if (pos - start < 4)
+		return false;
+	pos = start;
+	if (!__parse_int64(&pos, &year) || year <= 0 || year > PG_INT32_MAX / 2 ||
+		*pos++ != '-' || !__parse_fixed(&pos, 2, &month) ||
+		*pos++ != '-' || !__parse_fixed(&pos, 2, &day) ||
+		month < 1 || month > 12 || day < 1 || day > 31)
+		return false;
+	if (bc)
+		year = 1 - year;
+	*p_days = __date2j(year, month, day) - POSTGRES_EPOCH_JDATE;
+	*p_pos = pos;
+	return true;
+}
+
+/*
+ * __parse_time
+ *
+ * It parses the time like "12:34:56.789", then returns the microseconds.
+ * The hours may be beyond 24 for the interval.
+ */
+static bool
+__parse_time(const char **p_pos, int64 *p_usecs)
+{
+	const char *pos = *p_pos;
+	int64		hours, usecs;
+	int			minutes, seconds;
+
+	if (!isdigit((unsigned char)*pos) ||
+		!__parse_int64(&pos, &hours) || hours > PG_INT64_MAX / USECS_PER_HOUR ||
+		*pos++ != ':' || !__parse_fixed(&pos, 2, &minutes) ||
+		*pos++ != ':' || !__parse_fixed(&pos, 2, &seconds) ||
+		minutes > 59 || seconds > 60 ||
+		!__parse_usecs(&pos, &usecs))
+		return false;
+	*p_usecs = (hours * USECS_PER_HOUR + minutes * USECS_PER_MINUTE +
+				seconds * USECS_PER_SEC + usecs);
+	*p_pos = pos;
+	return true;
+}
+
+/*
+ * __trim_bc
+ *
+ * It returns the length of the text without the suffix " BC", if any.
+ */
+static size_t
+__trim_bc(const char *text, bool *p_bc)
+{
+	size_t		len = strlen(text);
+
+	*p_bc = (len > 3 && strcmp(text + len - 3, " BC") == 0);
+	return (*p_bc ? len - 3 : len);
+}
+
+static void
+recv_date(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	bool		bc;
+	size_t		len = __trim_bc(text, &bc);
+	int			days;
+
+	if (strcmp(text, "infinity") == 0)
+		days = DATEVAL_NOEND;
+	else if (strcmp(text, "-infinity") == 0)
+		days = DATEVAL_NOBEGIN;
+	else if (!__parse_date(&pos, bc, &days) || pos != text + len)
+		__text_invalid(attr, text);
+	__append_int32(out, days);
+}
+
+static void
+recv_time(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	int64		usecs;
+
+	if (!__parse_time(&pos, &usecs) || *pos != '\0' || usecs > USECS_PER_DAY)
+		__text_invalid(attr, text);
+	__append_int64(out, usecs);
+}
+
+/*
+ * recv_timestamp
+ *
+ * timestamptz is of the session TimeZone, with the UTC offset like "+09",
+ * "-03:30" or "+00:53:28" next to the time, followed by " BC" if any.
+ */
+static void
+recv_timestamp(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	bool		bc;
+	size_t		len = __trim_bc(text, &bc);
+	int			days;
+	int64		usecs;
+
+	if (strcmp(text, "infinity") == 0)
+	{
+		__append_int64(out, DT_NOEND);
+		return;
+	}
+	if (strcmp(text, "-infinity") == 0)
+	{
+		__append_int64(out, DT_NOBEGIN);
+		return;
+	}
+	if (!__parse_date(&pos, bc, &days) || *pos++ != ' ' ||
+		!__parse_time(&pos, &usecs))
+		__text_invalid(attr, text);
+	usecs += (int64) days * USECS_PER_DAY;
+	if (attr->atttypid == TIMESTAMPTZOID)
+	{
+		int			sign, hours, minutes = 0, seconds = 0;
+
+		if (*pos != '+' && *pos != '-')
+			__text_invalid(attr, text);
+		sign = (*pos++ == '+' ? 1 : -1);
+		if (!__parse_fixed(&pos, 2, &hours) ||
+			(*pos == ':' && (pos++, !__parse_fixed(&pos, 2, &minutes))) ||
+			(*pos == ':' && (pos++, !__parse_fixed(&pos, 2, &seconds))))
+			__text_invalid(attr, text);
+		usecs -= sign * (hours * USECS_PER_HOUR +
+						 minutes * USECS_PER_MINUTE +
+						 seconds * USECS_PER_SEC);
+	}
+	if (pos != text + len)
+		__text_invalid(attr, text);
+	__append_int64(out, usecs);
+}
+
+/*
+ * recv_interval
+ *
+ * It parses the interval of IntervalStyle=postgres, like
+ * "1 year 2 mons -3 days +04:05:06.5", where each part has its own sign.
+ * The time part is the last one, if any.
+ */
+static void
+recv_interval(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	int64		months = 0, days = 0, usecs = 0;
+
+	if (strcmp(text, "infinity") == 0 || strcmp(text, "-infinity") == 0)
+	{
+		bool	pinf = (text[0] == 'i');
+
+		__append_int64(out, pinf ? PG_INT64_MAX : PG_INT64_MIN);
+		__append_int32(out, pinf ? PG_INT32_MAX : PG_INT32_MIN);
+		__append_int32(out, pinf ? PG_INT32_MAX : PG_INT32_MIN);
+		return;
+	}
+	while (*pos != '\0')
+	{
+		const char *start;
+		size_t		len;
+		int64		value;
+
+		if (pos != text && *pos++ != ' ')
+			__text_invalid(attr, text);
+		start = pos;
+		len = strcspn(pos, " ");
+		if (memchr(pos, ':', len) != NULL)
+		{
+			/* [+-]hh:mm:ss[.ffffff] */
+			int		sign = 1;
+
+			if (*pos == '-' || *pos == '+')
+				sign = (*pos++ == '-' ? -1 : 1);
+			if (!__parse_time(&pos, &usecs) || *pos != '\0')
+				__text_invalid(attr, text);
+			usecs *= sign;
+			break;
+		}
+		if (!__parse_int64(&pos, &value) || *pos++ != ' ')
+			__text_invalid(attr, text);
+		if (strncmp(pos, "years", 5) == 0 || strncmp(pos, "year", 4) == 0)
+			months += 12 * value;
+		else if (strncmp(pos, "mons", 4) == 0 || strncmp(pos, "mon", 3) == 0)
+			months += value;
+		else if (strncmp(pos, "days", 4) == 0 || strncmp(pos, "day", 3) == 0)
+			days += value;
+		else
+			__text_invalid(attr, text);
+		while (isalpha((unsigned char)*pos))
+			pos++;
+		if (pos == start)
+			__text_invalid(attr, text);
+	}
+	if (months < PG_INT32_MIN || months > PG_INT32_MAX ||
+		days < PG_INT32_MIN || days > PG_INT32_MAX)
+		__text_invalid(attr, text);
+	__append_int64(out, usecs);
+	__append_int32(out, days);
+	__append_int32(out, months);
+}
+
+static inline int
+__hex_value(char c)
+{
+	if (c >= '0' && c <= '9')
+		return c - '0';
+	if (c >= 'a' && c <= 'f')
+		return c - 'a' + 10;
+	if (c >= 'A' && c <= 'F')
+		return c - 'A' + 10;
+	return -1;
+}
+
+/*
+ * recv_bytea
+ *
+ * Either the hex format like "\x0102", or the escape format like
+ * "a\000\\", by bytea_output.
+ */
+static void
+recv_bytea(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+
+	if (pos[0] == '\\' && pos[1] == 'x')
+	{
+		for (pos += 2; *pos != '\0'; pos += 2)
+		{
+			int		h = __hex_value(pos[0]);
+			int		l = (h < 0 ? -1 : __hex_value(pos[1]));
+			char	c;
+
+			if (l < 0)
+				__text_invalid(attr, text);
+			c = (h << 4) | l;
+			sql_buffer_append(out, &c, 1);
+		}
+		return;
+	}
+	while (*pos != '\0')
+	{
+		char	c = *pos++;
+
+		if (c == '\\')
+		{
+			if (*pos == '\\')
+				pos++;
+			else if (pos[0] >= '0' && pos[0] <= '3' &&
+					 pos[1] >= '0' && pos[1] <= '7' &&
+					 pos[2] >= '0' && pos[2] <= '7')
+			{
+				c = ((pos[0] - '0') << 6) | ((pos[1] - '0') << 3) | (pos[2] - '0');
+				pos += 3;
+			}
+			else
+				__text_invalid(attr, text);
+		}
+		sql_buffer_append(out, &c, 1);
+	}
+}
+
+/*
+ * recv_char
+ *
+ * The text form of "char" is empty for NUL, and an octal escape like
+ * "\377" for a byte beyond ASCII; see put_char_value.
+ */
+static void
+recv_char(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	char		c;
+
+	if (text[0] == '\0')
+		c = '\0';
+	else if (text[1] == '\0')
+		c = text[0];
+	else if (text[0] == '\\' && strlen(text) == 4 &&
+			 text[1] >= '0' && text[1] <= '3' &&
+			 text[2] >= '0' && text[2] <= '7' &&
+			 text[3] >= '0' && text[3] <= '7')
+		c = ((text[1] - '0') << 6) | ((text[2] - '0') << 3) | (text[3] - '0');
+	else
+		__text_invalid(attr, text);
+	sql_buffer_append(out, &c, 1);
+}
+
+/*
+ * recv_hex_bytes
+ *
+ * uuid and macaddr are the hex digits of their bytes, separated by '-'
+ * or ':' in between; the number of the bytes is attlen.
+ */
+static void
+recv_hex_bytes(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	const char *pos = text;
+	char		temp[16];
+	int			i;
+
+	assert(attr->attlen > 0 && attr->attlen <= sizeof(temp));
+	for (i=0; i < attr->attlen; i++)
+	{
+		int		h, l;
+
+		if (i > 0 && (*pos == '-' || *pos == ':'))
+			pos++;
+		h = __hex_value(pos[0]);
+		l = (h < 0 ? -1 : __hex_value(pos[1]));
+		if (l < 0)
+			__text_invalid(attr, text);
+		temp[i] = (h << 4) | l;
+		pos += 2;
+	}
+	if (*pos != '\0')
+		__text_invalid(attr, text);
+	sql_buffer_append(out, temp, attr->attlen);
+}
+
+/*
+ * recv_inet
+ *
+ * inet and cidr are the address, followed by the prefix length if not of
+ * the host address; see inet_send() for the binary format.
+ */
+static void
+recv_inet(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	char		temp[INET6_ADDRSTRLEN + 8];
+	char	   *slash;
+	uint8		head[4];
+	uint8		ipaddr[16];
+	int			bits = -1;
+
+	if (strlen(text) >= sizeof(temp))
+		__text_invalid(attr, text);
+	strcpy(temp, text);
+	slash = strchr(temp, '/');
+	if (slash)
+	{
+		const char *pos = slash + 1;
+		int64		value;
+
+		if (!__parse_int64(&pos, &value) || *pos != '\0' ||
+			value < 0 || value > 128)
+			__text_invalid(attr, text);
+		bits = value;
+		*slash = '\0';
+	}
+	if (inet_pton(AF_INET, temp, ipaddr) == 1)
+	{
+		head[0] = PGSQL_AF_INET;
+		head[3] = 4;
+	}
+	else if (inet_pton(AF_INET6, temp, ipaddr) == 1)
+	{
+		head[0] = PGSQL_AF_INET6;
+		head[3] = 16;
+	}
+	else
+		__text_invalid(attr, text);
+	if (bits < 0)
+		bits = 8 * head[3];
+	else if (bits > 8 * head[3])
+		__text_invalid(attr, text);
+	head[1] = bits;
+	head[2] = (attr->atttypid == CIDROID);
+	sql_buffer_append(out, head, sizeof(head));
+	sql_buffer_append(out, ipaddr, head[3]);
+}
+
+/*
+ * recv_jsonb
+ *
+ * The binary format of jsonb is the version number, then the text.
+ */
+static void
+recv_jsonb(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	char		version = 1;
+
+	sql_buffer_append(out, &version, 1);
+	sql_buffer_append(out, text, strlen(text));
+}
+
+/*
+ * recv_array
+ *
+ * It parses the text form of the array, like "{1,NULL,"a b"}", or with
+ * the dimensions like "[0:1]={1,2}" if the lower bound is not 1, then
+ * builds the binary format of array_send(); the elements are converted by
+ * the handler of the element type. The nested braces of the multi-
+ * dimensional arrays are accepted, so put_array_value reports them.
+ */
+#define ARRAY_MAX_DIMS		6
+
+typedef struct
+{
+	int			ndim;
+	int			dims[ARRAY_MAX_DIMS];
+	int			lbounds[ARRAY_MAX_DIMS];
+	int			nitems;
+	char	  **items;			/* unescaped, or NULL for NULL */
+	bool		hasnull;
+} arrayText;
+
+static char *
+__parse_array_item(SQLattribute *attr, const char *text,
+				   char **p_pos, char **p_dest)
+{
+	char	   *pos = *p_pos;
+	char	   *dest = *p_dest;
+	char	   *item = dest;
+	bool		quoted = false;
+
+	if (*pos == '"')
+	{
+		quoted = true;
+		for (pos++; *pos != '"'; pos++)
+		{
+			if (*pos == '\\')
+				pos++;
+			if (*pos == '\0')
+				__text_invalid(attr, text);
+			*dest++ = *pos;
+		}
+		pos++;
+	}
+	else
+	{
+		while (*pos != ',' && *pos != '}')
+		{
+			if (*pos == '\0' || *pos == '{' || *pos == '"')
+				__text_invalid(attr, text);
+			*dest++ = *pos++;
+		}
+	}
+	*dest++ = '\0';
+	*p_pos = pos;
+	*p_dest = dest;
+	if (!quoted && strcasecmp(item, "NULL") == 0)
+		return NULL;
+	return item;
+}
+
+static void
+__parse_array_level(SQLattribute *attr, const char *text, arrayText *at,
+					int depth, char **p_pos, char **p_dest)
+{
+	char	   *pos = *p_pos;
+	int			count = 0;
+
+	if (*pos++ != '{' || depth >= ARRAY_MAX_DIMS)
+		__text_invalid(attr, text);
+	if (*pos != '}')
+	{
+		for (;;)
+		{
+			if (*pos == '{')
+				__parse_array_level(attr, text, at, depth + 1, &pos, p_dest);
+			else
+			{
+				/* the scalars are all at the same depth */
+				if (at->ndim == 0)
+					at->ndim = depth + 1;
+				else if (at->ndim != depth + 1)
+					__text_invalid(attr, text);
+				at->items[at->nitems] = __parse_array_item(attr, text,
+														   &pos, p_dest);
+				if (!at->items[at->nitems])
+					at->hasnull = true;
+				at->nitems++;
+			}
+			count++;
+			if (*pos == '}')
+				break;
+			if (*pos++ != ',')
+				__text_invalid(attr, text);
+		}
+	}
+	pos++;
+	/* the sub-arrays have the same lengths */
+	if (at->dims[depth] == 0)
+		at->dims[depth] = count;
+	else if (at->dims[depth] != count)
+		__text_invalid(attr, text);
+	*p_pos = pos;
+}
+
+static void
+recv_array(SQLattribute *attr, const char *text, SQLbuffer *out)
+{
+	SQLattribute *element = attr->element;
+	arrayText	at;
+	char	   *buf = pstrdup(text);
+	char	   *items = palloc(strlen(text) + 1);
+	char	   *dest = items;
+	char	   *pos = buf;
+	int			i, ndecl = 0;
+
+	memset(&at, 0, sizeof(arrayText));
+	at.items = palloc(sizeof(char *) * (strlen(text) + 1));
+	/* dimension decoration, like "[0:1][1:2]=" */
+	while (*pos == '[')
+	{
+		const char *p = pos + 1;
+		int64		lb, ub;
+
+		if (ndecl >= ARRAY_MAX_DIMS ||
+			!__parse_int64(&p, &lb) || *p++ != ':' ||
+			!__parse_int64(&p, &ub) || *p++ != ']')
+			__text_invalid(attr, text);
+		at.lbounds[ndecl++] = lb;
+		pos = (char *) p;
+	}
+	if (ndecl > 0 && *pos++ != '=')
+		__text_invalid(attr, text);
+	for (i=ndecl; i < ARRAY_MAX_DIMS; i++)
+		at.lbounds[i] = 1;
+	__parse_array_level(attr, text, &at, 0, &pos, &dest);
+	if (*pos != '\0' || (ndecl > 0 && ndecl != at.ndim))
+		__text_invalid(attr, text);
+
+	/* see array_send() */
+	__append_int32(out, at.ndim);
+	__append_int32(out, at.hasnull);
+	__append_int32(out, element->atttypid);
+	for (i=0; i < at.ndim; i++)
+	{
+		__append_int32(out, at.dims[i]);
+		__append_int32(out, at.lbounds[i]);
+	}
+	for (i=0; i < at.nitems; i++)
+	{
+		size_t		head = out->usage;
+		int32		len;
+
+		if (!at.items[i])
+		{
+			__append_int32(out, -1);
+			continue;
+		}
+		__append_int32(out, 0);		/* set later */
+		if (element->text_recv)
+			element->text_recv(element, at.items[i], out);
+		else
+			sql_buffer_append(out, at.items[i], strlen(at.items[i]));
+		len = htonl(out->usage - head - sizeof(int32));
+		memcpy(out->ptr + head, &len, sizeof(int32));
+	}
+	pfree(at.items);
+	pfree(items);
+	pfree(buf);
+}
+
+/*
+ * builtin_types
+ *
+ * The built-in types fetched in text by their text_recv. NULL text_recv
+ * means their text form is the binary format as is, like text or json.
+ */
+static const SQLbuiltinType builtin_types[] =
+{
+	/* typid, typname, typlen, typbyval, typalign, typtype, typelem, text_recv */
+	{ BOOLOID,			"bool",			1,	true,	'c', 'b', 0,	recv_bool },
+	{ BYTEAOID,			"bytea",		-1,	false,	'i', 'b', 0,	recv_bytea },
+	{ CHAROID,			"char",			1,	true,	'c', 'b', 0,	recv_char },
+	{ NAMEOID,			"name",			64,	false,	'c', 'b', CHAROID, NULL },
+	{ INT8OID,			"int8",			8,	true,	'd', 'b', 0,	recv_int },
+	{ INT2OID,			"int2",			2,	true,	's', 'b', 0,	recv_int },
+	{ INT4OID,			"int4",			4,	true,	'i', 'b', 0,	recv_int },
+	{ TEXTOID,			"text",			-1,	false,	'i', 'b', 0,	NULL },
+	{ OIDOID,			"oid",			4,	true,	'i', 'b', 0,	recv_int },
+	{ JSONOID,			"json",			-1,	false,	'i', 'b', 0,	NULL },
+	{ FLOAT4OID,		"float4",		4,	true,	'i', 'b', 0,	recv_float },
+	{ FLOAT8OID,		"float8",		8,	true,	'd', 'b', 0,	recv_float },
+	{ UNKNOWNOID,		"unknown",		-2,	false,	'c', 'p', 0,	NULL },
+	{ MONEYOID,			"money",		8,	true,	'd', 'b', 0,	recv_money },
+	{ MACADDROID,		"macaddr",		6,	false,	'i', 'b', 0,	recv_hex_bytes },
+	{ INETOID,			"inet",			-1,	false,	'i', 'b', 0,	recv_inet },
+	{ CIDROID,			"cidr",			-1,	false,	'i', 'b', 0,	recv_inet },
+	{ MACADDR8OID,		"macaddr8",		8,	false,	'i', 'b', 0,	recv_hex_bytes },
+	{ BPCHAROID,		"bpchar",		-1,	false,	'i', 'b', 0,	NULL },
+	{ VARCHAROID,		"varchar",		-1,	false,	'i', 'b', 0,	NULL },
+	{ DATEOID,			"date",			4,	true,	'i', 'b', 0,	recv_date },
+	{ TIMEOID,			"time",			8,	true,	'd', 'b', 0,	recv_time },
+	{ TIMESTAMPOID,		"timestamp",	8,	true,	'd', 'b', 0,	recv_timestamp },
+	{ TIMESTAMPTZOID,	"timestamptz",	8,	true,	'd', 'b', 0,	recv_timestamp },
+	{ INTERVALOID,		"interval",		16,	false,	'd', 'b', 0,	recv_interval },
+	{ NUMERICOID,		"numeric",		-1,	false,	'i', 'b', 0,	recv_numeric },
+	{ VOIDOID,			"void",			4,	true,	'i', 'p', 0,	NULL },
+	{ UUIDOID,			"uuid",			16,	false,	'c', 'b', 0,	recv_hex_bytes },
+	{ JSONBOID,			"jsonb",		-1,	false,	'i', 'b', 0,	recv_jsonb },
+	/* arrays of the above */
+	{ BOOLARRAYOID,		"_bool",		-1,	false,	'i', 'b', BOOLOID,	recv_array },
+	{ BYTEAARRAYOID,	"_bytea",		-1,	false,	'i', 'b', BYTEAOID,	recv_array },
+	{ CHARARRAYOID,		"_char",		-1,	false,	'i', 'b', CHAROID,	recv_array },
+	{ NAMEARRAYOID,		"_name",		-1,	false,	'i', 'b', NAMEOID,	recv_array },
+	{ INT8ARRAYOID,		"_int8",		-1,	false,	'd', 'b', INT8OID,	recv_array },
+	{ INT2ARRAYOID,		"_int2",		-1,	false,	'i', 'b', INT2OID,	recv_array },
+	{ INT4ARRAYOID,		"_int4",		-1,	false,	'i', 'b', INT4OID,	recv_array },
+	{ TEXTARRAYOID,		"_text",		-1,	false,	'i', 'b', TEXTOID,	recv_array },
+	{ OIDARRAYOID,		"_oid",			-1,	false,	'i', 'b', OIDOID,	recv_array },
+	{ JSONARRAYOID,		"_json",		-1,	false,	'i', 'b', JSONOID,	recv_array },
+	{ FLOAT4ARRAYOID,	"_float4",		-1,	false,	'i', 'b', FLOAT4OID,	recv_array },
+	{ FLOAT8ARRAYOID,	"_float8",		-1,	false,	'd', 'b', FLOAT8OID,	recv_array },
+	{ MONEYARRAYOID,	"_money",		-1,	false,	'd', 'b', MONEYOID,	recv_array },
+	{ MACADDRARRAYOID,	"_macaddr",		-1,	false,	'i', 'b', MACADDROID, recv_array },
+	{ INETARRAYOID,		"_inet",		-1,	false,	'i', 'b', INETOID,	recv_array },
+	{ CIDRARRAYOID,		"_cidr",		-1,	false,	'i', 'b', CIDROID,	recv_array },
+	{ MACADDR8ARRAYOID,	"_macaddr8",	-1,	false,	'i', 'b', MACADDR8OID, recv_array },
+	{ BPCHARARRAYOID,	"_bpchar",		-1,	false,	'i', 'b', BPCHAROID,	recv_array },
+	{ VARCHARARRAYOID,	"_varchar",		-1,	false,	'i', 'b', VARCHAROID, recv_array },
+	{ DATEARRAYOID,		"_date",		-1,	false,	'i', 'b', DATEOID,	recv_array },
+	{ TIMEARRAYOID,		"_time",		-1,	false,	'd', 'b', TIMEOID,	recv_array },
+	{ TIMESTAMPARRAYOID, "_timestamp",	-1,	false,	'd', 'b', TIMESTAMPOID, recv_array },
+	{ TIMESTAMPTZARRAYOID, "_timestamptz", -1, false, 'd', 'b', TIMESTAMPTZOID, recv_array },
+	{ INTERVALARRAYOID,	"_interval",	-1,	false,	'd', 'b', INTERVALOID, recv_array },
+	{ NUMERICARRAYOID,	"_numeric",		-1,	false,	'i', 'b', NUMERICOID, recv_array },
+	{ UUIDARRAYOID,		"_uuid",		-1,	false,	'i', 'b', UUIDOID,	recv_array },
+	{ JSONBARRAYOID,	"_jsonb",		-1,	false,	'i', 'b', JSONBOID,	recv_array },
+	{ InvalidOid,		NULL,			0,	false,	0,	0,	0,	NULL },
+};
+
+/*
+ * pgsql_lookup_builtin_type
+ *
+ * It returns the built-in type of typid, or NULL if the type is not built
+ * in, or has no known text form. The date and time types are of
+ * DateStyle=ISO, and interval of IntervalStyle=postgres, which are the
+ * defaults; the connection reports the settings as they change.
+ */
+const SQLbuiltinType *
+pgsql_lookup_builtin_type(PGconn *conn, Oid typid)
+{
+	const SQLbuiltinType *bt;
+	const char *datestyle = PQparameterStatus(conn, "DateStyle");
+	const char *intervalstyle = PQparameterStatus(conn, "IntervalStyle");
+
+	for (bt = builtin_types; bt->typid != InvalidOid; bt++)
+	{
+		if (bt->typid != typid)
+			continue;
+		if (bt->typelem != InvalidOid && bt->text_recv == recv_array)
+			typid = bt->typelem;	/* the element decides below */
+		if ((typid == DATEOID || typid == TIMESTAMPOID ||
+			 typid == TIMESTAMPTZOID) &&
+			(!datestyle || strncmp(datestyle, "ISO", 3) != 0))
+			return NULL;
+		if (typid == INTERVALOID &&
+			(!intervalstyle || strcmp(intervalstyle, "postgres") != 0))
+			return NULL;
+		return bt;
+	}
+	return NULL;
+}